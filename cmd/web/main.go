@@ -1,26 +1,47 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/TranQuocToan1996/bookings/internal/config"
 	"github.com/TranQuocToan1996/bookings/internal/driver"
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
 	"github.com/TranQuocToan1996/bookings/internal/handlers"
 	"github.com/TranQuocToan1996/bookings/internal/helpers"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/privacy"
 	"github.com/TranQuocToan1996/bookings/internal/render"
+	"github.com/TranQuocToan1996/bookings/internal/repository/dbrepo"
+	"github.com/TranQuocToan1996/bookings/internal/supervisor"
+	"github.com/TranQuocToan1996/bookings/internal/trash"
 	"github.com/alexedwards/scs/v2"
 )
 
-const portNumber = ":8080"
+// retentionInterval is how often reservations past the retention period are anonymized
+const retentionInterval = 24 * time.Hour
+
+// mailQueueSize is how many emails can wait to be sent before the handlers queuing one wait too
+const mailQueueSize = 100
+
+// trashInterval is how often the trash is emptied of the reservations deleted long enough ago
+const trashInterval = time.Hour
+
+// errCommandDone is returned by run after a command that exits without starting the server, such
+// as a migration, ran successfully
+var errCommandDone = errors.New("command done")
 
 var app config.AppConfig
+var settings config.Settings
 var session *scs.SessionManager
 var infoLog *log.Logger
 var errorLog *log.Logger
@@ -29,32 +50,104 @@ var errorLog *log.Logger
 func main() {
 
 	db, err := run()
+	if errors.Is(err, errCommandDone) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.SQL.Close()
-	defer close(app.MailChan)
+
+	// Background workers, stopped after the last request on shutdown
+	workers := supervisor.New(infoLog, errorLog)
 
 	// Listen continuous for an email
 	infoLog.Println("Starting mail listener!")
-	listenForMail()
+	workers.Go("mail", listenForMail)
+
+	if app.RetentionYears > 0 {
+		infoLog.Printf("Anonymizing reservations older than %d years", app.RetentionYears)
+		workers.Go("retention", func(ctx context.Context) {
+			privacy.Retain(ctx, handlers.Repo.DB, app.RetentionYears, retentionInterval, infoLog, errorLog)
+		})
+	}
+
+	if app.TrashDays > 0 {
+		infoLog.Printf("Purging reservations deleted more than %d days ago", app.TrashDays)
+		workers.Go("trash", func(ctx context.Context) {
+			trash.Purge(ctx, handlers.Repo.DB, app.TrashDays, trashInterval, infoLog, errorLog)
+		})
+	}
 
-	fmt.Println("Starting application on port:", portNumber)
+	// Stop on Ctrl-C or when the service manager asks to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("Starting application on:", settings.Addr)
 	// Start the server
 	srv := &http.Server{
-		Addr:    portNumber,
+		Addr:    settings.Addr,
 		Handler: routes(&app),
 	}
 	// Start server. After server close or shutdown, return err
-	err = srv.ListenAndServe()
-	log.Fatal(err)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
+		errorLog.Println("Server stopped:", err)
+	case <-ctx.Done():
+		infoLog.Println("Shutting down")
+	}
+	// A second signal kills the application right away
+	stop()
+
+	if !shutdown(srv, workers, db) || err != nil {
+		os.Exit(1)
+	}
+}
+
+// shutdown stops taking requests and waits for the ones in flight, then stops the workers once they
+// flushed their queues, and closes the database. Both steps share the shutdown timeout, so the whole
+// shutdown fits in the time the service manager waits before killing. It reports whether everything
+// stopped in time.
+func shutdown(srv *http.Server, workers *supervisor.Supervisor, db *driver.DB) bool {
+	clean := true
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		errorLog.Println("Requests still in flight:", err)
+		clean = false
+	}
+
+	// The workers get what the requests left of the timeout
+	err = workers.Stop(ctx)
+	if err != nil {
+		errorLog.Println("Workers not stopped:", err)
+		clean = false
+	}
+
+	// Without a database there is nothing to close
+	if db != nil {
+		err = db.SQL.Close()
+		if err != nil {
+			errorLog.Println("Can't close the database:", err)
+			clean = false
+		}
+	}
+
+	infoLog.Println("Stopped")
+	return clean
 }
 
 /*  Old code: Alternative in routes.go
 	// Send a request -> process request -> send back a response
    	http.HandleFunc("/", handlers.Repo.Home)
    	http.HandleFunc("/about", handlers.Repo.About)
-	http.ListenAndServe(portNumber, nil)
+	http.ListenAndServe(":8080", nil)
 */
 
 func run() (*driver.DB, error) {
@@ -67,29 +160,72 @@ func run() (*driver.DB, error) {
 	gob.Register(models.Restriction{})
 	gob.Register(map[string]int{})
 
-	// read flags from terminal
-	inProduction := flag.Bool("production", true, "Application is in production")
-	useCache := flag.Bool("cache", true, "Save loading template in cache for reduce loading times")
-	dbName := flag.String("dbname", "", "Database name")
-	dbHost := flag.String("dbhost", "localhost", "Database host")
-	dbUser := flag.String("dbuser", "", "Database user")
-	dbPass := flag.String("dbpass", "", "Database password")
-	dbPort := flag.String("dbport", "5432", "Database port")
-	dbSSL := flag.String("dbssl", "disable", "Database SSL setting (disable, prefer, require)")
-
-	// Parse the flags
+	// Every setting has a flag, overriding its environment variable and the settings file
+	config.DeclareFlags(flag.CommandLine)
+	configFile := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"),
+		"YAML settings file, see bookings.example.yml ("+config.EnvPrefix+"CONFIG)")
+	reencrypt := flag.Bool("reencrypt", false, "Re-encrypt the personal data of guests with the active key, then exit")
+	autoMigrate := flag.Bool("migrate", false, "Apply the pending database migrations before starting")
+
+	// Parse the flags, "bookings [flags] migrate up|down|status|redo [flags]" runs a migration command
+	// and "bookings [flags] config print [flags]" shows the settings
 	flag.Parse()
-	if *dbName == "" || *dbUser == "" {
-		log.Println("Missing require flags")
-		os.Exit(1)
+	command, subcommand := "", ""
+	if flag.NArg() > 0 {
+		if flag.NArg() > 1 {
+			command, subcommand = flag.Arg(0), flag.Arg(1)
+			flag.CommandLine.Parse(flag.Args()[2:])
+		}
+		valid := (command == "migrate" && migrateCommands[subcommand]) || (command == "config" && subcommand == "print")
+		if !valid || flag.NArg() > 0 {
+			return nil, errors.New("usage: bookings [flags] migrate up|down|status|redo [flags], or bookings [flags] config print [flags]")
+		}
+	}
+	migrateCommand := ""
+	if command == "migrate" {
+		migrateCommand = subcommand
+	}
+
+	var err error
+	settings, err = config.LoadSettings(*configFile, os.LookupEnv, flag.CommandLine)
+	if err != nil {
+		return nil, fmt.Errorf("can't load the settings: %w", err)
+	}
+	if command == "config" {
+		settings.Print(os.Stdout)
+	}
+	if err = settings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings:\n%w", err)
+	}
+	if command == "config" {
+		return nil, errCommandDone
+	}
+
+	dbDriver := settings.DB.Driver
+	inMemory := dbDriver == "memory"
+	if inMemory && (migrateCommand != "" || *autoMigrate || *reencrypt) {
+		return nil, errors.New("migrations and re-encryption need -dbdriver=postgres or -dbdriver=sqlite")
 	}
 
 	// Production
-	app.InProduction = *inProduction
-	app.UseCache = *useCache
+	app.InProduction = settings.InProduction
+	app.UseCache = settings.UseCache
+	app.RetentionYears = settings.RetentionYears
+	app.TrashDays = settings.TrashDays
+	app.QueryTimeout = settings.DB.Timeout
+
+	// Without keys emails and phones are kept in plain text
+	if settings.EncryptionKeys != "" || settings.BlindIndexKey != "" {
+		keys, err := fieldcrypt.New(settings.EncryptionKeys, settings.BlindIndexKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the encryption keys: %w", err)
+		}
+		app.FieldKeys = keys
+	}
 
 	// Create mail channel
-	mailChan := make(chan models.MailData) // We not going to close channel here it will close after run() finish
+	// Handlers queue emails without waiting for them to be sent, the mail listener flushes the queue on shutdown
+	mailChan := make(chan models.MailData, mailQueueSize)
 	app.MailChan = mailChan
 
 	// Declare logs for appconfig
@@ -99,33 +235,93 @@ func run() (*driver.DB, error) {
 	app.ErrorLog = errorLog
 
 	session = scs.New()
-	session.Lifetime = 24 * time.Hour
+	session.Lifetime = settings.Session.Lifetime
 	// Keep session even after close window/browser
-	session.Cookie.Persist = true
+	session.Cookie.Persist = settings.Session.Persist
 	// allows you to declare if your cookie should be restricted to a first-party or same-site context
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	// HTTPS
 	session.Cookie.Secure = app.InProduction
 	app.Session = session
 
-	// Connect to database
-	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
-	db, err := driver.ConnectSQL(connectionString)
-	if err != nil {
-		log.Fatal("Can't connect to database! Exiting...")
+	// Connect to database, unless the data is kept in memory
+	var db *driver.DB
+	if !inMemory {
+		if dbDriver == "sqlite" {
+			db, err = driver.ConnectSQLite(settings.DB.File)
+		} else {
+			d := settings.DB
+			connectionString := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s", d.Host, d.Port, d.Name, d.User, d.Password, d.SSL)
+			db, err = driver.ConnectSQL(connectionString)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't connect to database: %w", err)
+		}
+		log.Println("Connected to database")
+
+		if migrateCommand != "" {
+			err = runMigrate(context.Background(), db.SQL, dbDriver, migrateCommand, os.Stdout)
+			db.SQL.Close()
+			if err != nil {
+				return nil, fmt.Errorf("migration failed: %w", err)
+			}
+			return nil, errCommandDone
+		}
+
+		if *autoMigrate {
+			err = runMigrate(context.Background(), db.SQL, dbDriver, "up", os.Stdout)
+			if err != nil {
+				db.SQL.Close()
+				return nil, fmt.Errorf("migration failed: %w", err)
+			}
+		}
+
+		// Rows written before the keys were set have their blind indexes in plain text, lookups by email
+		// or phone miss them until they are re-encrypted, so that is done before taking requests
+		if app.FieldKeys != nil && !*reencrypt {
+			n, err := dbrepo.Unindexed(context.Background(), db.SQL)
+			if err == nil && n > 0 {
+				log.Printf("Re-encrypting %d rows written without the keys", n)
+				_, err = dbrepo.Reencrypt(context.Background(), db.SQL, app.FieldKeys)
+			}
+			if err != nil {
+				db.SQL.Close()
+				return nil, fmt.Errorf("can't index the rows written without the keys: %w", err)
+			}
+		}
+
+		if *reencrypt {
+			n, err := dbrepo.Reencrypt(context.Background(), db.SQL, app.FieldKeys)
+			db.SQL.Close()
+			if err != nil {
+				return nil, fmt.Errorf("re-encryption stopped: %w", err)
+			}
+			log.Printf("Re-encrypted %d rows with key %q", n, app.FieldKeys.ActiveKey())
+			return nil, errCommandDone
+		}
 	}
-	log.Println("Connected to database")
 
 	// Create template cache (map data structure of Golang)
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
 		// If we can't get template cache, we can't show any pages
-		log.Fatal("Can't create template cache: ", err)
-		return nil, err
+		if db != nil {
+			db.SQL.Close()
+		}
+		return nil, fmt.Errorf("can't create template cache: %w", err)
 	}
 	app.TemplateCache = tc
 
-	repo := handlers.NewRepo(&app, db)
+	var repo *handlers.Repository
+	switch dbDriver {
+	case "memory":
+		infoLog.Println("Keeping data in memory, every change is lost on exit")
+		repo = handlers.NewMemoryRepo(&app)
+	case "sqlite":
+		repo = handlers.NewSQLiteRepo(&app, db)
+	default:
+		repo = handlers.NewRepo(&app, db)
+	}
 	// Pass new repo to handler
 	handlers.NewHandlers(repo)
 	render.NewRenderer(&app)
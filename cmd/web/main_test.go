@@ -1,10 +1,58 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/config"
+	"github.com/TranQuocToan1996/bookings/internal/supervisor"
+)
 
 func TestRun(t *testing.T) {
+	t.Setenv(config.EnvPrefix+"DB_DRIVER", "memory")
 	_, err := run()
 	if err != nil {
-		t.Error("failed run")
+		t.Error("failed run:", err)
+	}
+}
+
+// A request and a worker both outliving the timeout still stop the shutdown after one timeout
+func TestShutdownSharesTimeout(t *testing.T) {
+	infoLog = log.New(io.Discard, "", 0)
+	errorLog = log.New(io.Discard, "", 0)
+	settings.ShutdownTimeout = 200 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go srv.Serve(listener)
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+
+	workers := supervisor.New(infoLog, errorLog)
+	workers.Go("stuck", func(ctx context.Context) {
+		<-release
+	})
+
+	begin := time.Now()
+	if shutdown(srv, workers, nil) {
+		t.Error("shutdown reported a clean stop with a request and a worker still running")
+	}
+	if took := time.Since(begin); took > settings.ShutdownTimeout*3/2 {
+		t.Errorf("shutdown took %v, longer than the timeout of %v", took, settings.ShutdownTimeout)
 	}
 }
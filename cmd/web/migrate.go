@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/TranQuocToan1996/bookings/internal/migrate"
+	"github.com/TranQuocToan1996/bookings/migrations"
+	"github.com/TranQuocToan1996/bookings/migrations/sqlite"
+)
+
+// migrateCommands are the subcommands of "bookings migrate"
+var migrateCommands = map[string]bool{"up": true, "down": true, "status": true, "redo": true}
+
+// runMigrate runs a migrate subcommand on db, a database of dbDriver, and writes what it did to w
+func runMigrate(ctx context.Context, db *sql.DB, dbDriver, command string, w io.Writer) error {
+	var m *migrate.Migrator
+	var err error
+	if dbDriver == "sqlite" {
+		m, err = migrate.NewSQLite(db, sqlite.FS)
+	} else {
+		m, err = migrate.New(db, migrations.FS)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, migration := range applied {
+			fmt.Fprintln(w, "Applied", migration)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "Nothing to apply, the database is up to date")
+		}
+		return err
+
+	case "down":
+		migration, err := m.Down(ctx)
+		if errors.Is(err, migrate.ErrNothingToRollBack) {
+			fmt.Fprintln(w, "Nothing to roll back")
+			return nil
+		}
+		if err == nil {
+			fmt.Fprintln(w, "Rolled back", migration)
+		}
+		return err
+
+	case "redo":
+		migration, err := m.Redo(ctx)
+		if err == nil {
+			fmt.Fprintln(w, "Redone", migration)
+		}
+		return err
+
+	case "status":
+		list, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range list {
+			status, appliedAt := "pending", ""
+			if s.Applied() {
+				status, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Modified {
+				status = "modified"
+			}
+			if s.Missing {
+				status = "missing"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, status, appliedAt)
+		}
+		return tw.Flush()
+	}
+
+	return fmt.Errorf("unknown migrate command %q, use up, down, status or redo", command)
+}
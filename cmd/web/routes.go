@@ -35,6 +35,7 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/generals-quarters", handlers.Repo.Generals)
 	mux.Get("/majors-suite", handlers.Repo.Majors)
 	mux.Get("/search-availability", handlers.Repo.Availability)
+	mux.Get("/availability-grid", handlers.Repo.AvailabilityGridJSON)
 	mux.Get("/contact", handlers.Repo.Contact)
 	mux.Get("/make-reservation", handlers.Repo.Reservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
@@ -42,12 +43,20 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/book-room", handlers.Repo.BookRoom)
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
+	mux.Get("/account/register", handlers.Repo.ShowRegister)
+	mux.Get("/account/verify", handlers.Repo.VerifyAccount)
+	mux.Get("/account/login", handlers.Repo.ShowGuestLogin)
+	mux.Get("/account/logout", handlers.Repo.GuestLogout)
+	mux.With(GuestAuth).Get("/account", handlers.Repo.Account)
 
 	// Handlers POST request
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
 	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
+	mux.Post("/account/register", handlers.Repo.PostRegister)
+	mux.Post("/account/login", handlers.Repo.PostGuestLogin)
+	mux.With(GuestAuth).Post("/account/rebook", handlers.Repo.AccountRebook)
 
 	// Routes handler
 	mux.Route("/admin", func(mux chi.Router) {
@@ -56,16 +65,44 @@ func routes(app *config.AppConfig) http.Handler {
 
 		// Handle GET request /admin/someOther
 		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+		mux.Get("/search", handlers.Repo.AdminSearch)
 		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
 		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
 		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
 		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservations)
 		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
 		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.Get("/room-assignment", handlers.Repo.AdminRoomAssignment)
+		mux.Get("/stay-rules", handlers.Repo.AdminStayRules)
+		mux.Get("/delete-stay-rule/{id}/do", handlers.Repo.AdminDeleteStayRule)
+		mux.Get("/blocks", handlers.Repo.AdminBlocks)
+		mux.Get("/blocks/{id}", handlers.Repo.AdminShowBlock)
+		mux.Get("/delete-block/{id}/do", handlers.Repo.AdminDeleteBlock)
+		mux.Get("/delete-block-series/{id}/do", handlers.Repo.AdminDeleteBlockSeries)
+		mux.Get("/api/calendar", handlers.Repo.AdminCalendarJSON)
+		mux.Get("/api/dashboard", handlers.Repo.AdminDashboardJSON)
+		mux.Get("/reports", handlers.Repo.AdminReports)
+		mux.Get("/reports/export", handlers.Repo.AdminExportReport)
+		mux.Get("/guests", handlers.Repo.AdminGuests)
+		mux.Get("/guests/{id}", handlers.Repo.AdminShowGuest)
+		mux.Post("/guests/{id}", handlers.Repo.AdminPostShowGuest)
+		mux.Post("/guests/{id}/merge", handlers.Repo.AdminMergeGuest)
+		mux.Get("/privacy", handlers.Repo.AdminPrivacy)
+		mux.Get("/privacy/export", handlers.Repo.AdminExportPersonalData)
+		mux.Post("/privacy/erase", handlers.Repo.AdminErasePersonalData)
+		mux.Get("/audit", handlers.Repo.AdminAudit)
+		mux.Get("/trash", handlers.Repo.AdminTrash)
 
 		// Handle POST request /admin/someOther
 		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservations)
 		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.Post("/room-assignment", handlers.Repo.AdminPostRoomAssignment)
+		mux.Post("/stay-rules", handlers.Repo.AdminPostStayRules)
+		mux.Post("/blocks", handlers.Repo.AdminPostBlocks)
+		mux.Post("/blocks/{id}", handlers.Repo.AdminPostShowBlock)
+		mux.Post("/api/reservations/{id}/move", handlers.Repo.AdminMoveReservationJSON)
+		mux.Post("/api/blocks/{id}/resize", handlers.Repo.AdminResizeBlockJSON)
+		mux.Post("/trash/{id}/restore", handlers.Repo.AdminRestoreReservation)
 
 	})
 
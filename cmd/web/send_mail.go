@@ -1,41 +1,56 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"strings"
-	"time"
 
 	"github.com/TranQuocToan1996/bookings/internal/models"
 	mail "github.com/xhit/go-simple-mail/v2"
 )
 
-// listenForMail creates go routine to make this function running in backgound asynchronous with other function in bookings app
-func listenForMail() {
-	go func() {
-		// For loop for continuous listen for mails
-		for {
-			message := <-app.MailChan
+// listenForMail sends the emails queued by the handlers until ctx is done, then the ones still queued.
+// The supervisor runs it in the background once the server stopped taking requests.
+func listenForMail(ctx context.Context) {
+	// For loop for continuous listen for mails
+	for {
+		select {
+		case message := <-app.MailChan:
 			sendMessage(message)
-
+		case <-ctx.Done():
+			if n := len(app.MailChan); n > 0 {
+				infoLog.Printf("Sending the %d queued emails", n)
+			}
+			for {
+				select {
+				case message := <-app.MailChan:
+					sendMessage(message)
+				default:
+					return
+				}
+			}
 		}
-	}()
+	}
 }
 
 func sendMessage(mailData models.MailData) {
-	// Create dummy sending mail server, and receiver is mailHog
+	// The default settings send to MailHog
 	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
+	server.Host = settings.Mail.Host
+	server.Port = settings.Mail.Port
+	server.Username = settings.Mail.Username
+	server.Password = settings.Mail.Password
 	server.KeepAlive = false // Active only when needed to send an email
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
+	server.ConnectTimeout = settings.Mail.Timeout
+	server.SendTimeout = settings.Mail.Timeout
 	// server.Encryption = mail.EncryptionSSLTLS
 
 	// Client connect to server
 	client, err := server.Connect()
 	if err != nil {
 		errorLog.Println(err)
+		return
 	}
 
 	// Set information for email
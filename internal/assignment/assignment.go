@@ -0,0 +1,335 @@
+package assignment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// reservationRestriction is the restriction id of a guest reservation, other ids are owner blocks
+const reservationRestriction = 1
+
+// Move is a reservation that should change room
+type Move struct {
+	Reservation models.Reservation
+	FromRoom    models.Room
+	ToRoom      models.Room
+}
+
+// Plan is the result of the optimiser for a date window
+type Plan struct {
+	Moves      []Move
+	GapsBefore int // orphan nights with the current assignment
+	GapsAfter  int // orphan nights once every move is applied
+}
+
+// Fingerprint identifies the moves of the plan. The preview posts it back with the moves, so that a
+// plan which changed in between, because bookings did, is not applied.
+func (p Plan) Fingerprint() string {
+	h := sha256.New()
+	for _, m := range p.Moves {
+		fmt.Fprintf(h, "%d:%d:%d:%s:%s\n", m.Reservation.ID, m.FromRoom.ID, m.ToRoom.ID,
+			m.Reservation.StartDate.Format("2006-01-02"), m.Reservation.EndDate.Format("2006-01-02"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Ordered returns the moves in an order they can be applied one at a time: a move into a room comes
+// after the moves out of it that overlap its stay. Moves swapping rooms in a cycle can't be applied
+// that way, they come last in the plan order. Optimise never plans such a cycle.
+func (p Plan) Ordered() []Move {
+	ordered, cycles := order(p.Moves)
+	return append(ordered, cycles...)
+}
+
+// order returns the moves that can be applied one at a time, in the order to apply them, and the
+// moves left waiting on each other in cycles
+func order(moves []Move) (ordered, cycles []Move) {
+	pending := moves
+	for len(pending) > 0 {
+		var waiting []Move
+		for _, m := range pending {
+			if waits(m, pending) {
+				waiting = append(waiting, m)
+				continue
+			}
+			ordered = append(ordered, m)
+		}
+		if len(waiting) == len(pending) {
+			return ordered, waiting
+		}
+		pending = waiting
+	}
+	return ordered, nil
+}
+
+// waits reports whether a move must wait for another one to free its new room
+func waits(m Move, pending []Move) bool {
+	for _, n := range pending {
+		if n.Reservation.ID != m.Reservation.ID && n.FromRoom.ID == m.ToRoom.ID &&
+			n.Reservation.StartDate.Before(m.Reservation.EndDate) && n.Reservation.EndDate.After(m.Reservation.StartDate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Optimise places the movable reservations of the window [start, end) into rooms of the same
+// type so that the number of orphan nights (empty gaps of at most orphanNights between two stays)
+// is as small as possible. Owner blocks, guest-locked reservations and reservations that are not
+// fully inside the window never move. The moves can always be applied one at a time, in the order
+// of Ordered. Nothing is written, the returned plan is a dry run.
+func Optimise(rooms []models.Room, restrictions []models.RoomRestriction, start, end time.Time, orphanNights int) Plan {
+	var plan Plan
+
+	// Group interchangeable rooms by type, rooms without a type can't trade guests
+	groups := make(map[string][]models.Room)
+	roomByID := make(map[int]models.Room)
+	for _, room := range rooms {
+		roomByID[room.ID] = room
+		if room.RoomType != "" {
+			groups[room.RoomType] = append(groups[room.RoomType], room)
+		}
+	}
+
+	// Keep the output stable between the preview and the apply request
+	var types []string
+	for roomType := range groups {
+		types = append(types, roomType)
+	}
+	sort.Strings(types)
+
+	for _, roomType := range types {
+		group := groups[roomType]
+		inGroup := make(map[int]bool)
+		for _, room := range group {
+			inGroup[room.ID] = true
+		}
+
+		current := make(map[int][]models.RoomRestriction)
+		for _, r := range restrictions {
+			if inGroup[r.RoomID] {
+				current[r.RoomID] = append(current[r.RoomID], r)
+			}
+		}
+
+		before := 0
+		for _, room := range group {
+			before += orphans(current[room.ID], orphanNights)
+		}
+		plan.GapsBefore += before
+
+		// Reservations swapping rooms in a cycle keep theirs, and the others are planned again around them
+		pinned := make(map[int]bool)
+		for {
+			moves, after, placedAll := planGroup(group, current, pinned, start, end, orphanNights, roomByID)
+			if !placedAll || after >= before {
+				plan.GapsAfter += before
+				break
+			}
+
+			_, cycles := order(moves)
+			if len(cycles) == 0 {
+				plan.GapsAfter += after
+				plan.Moves = append(plan.Moves, moves...)
+				break
+			}
+			for _, m := range cycles {
+				pinned[m.Reservation.ID] = true
+			}
+		}
+	}
+
+	return plan
+}
+
+// planGroup packs the movable reservations of a group of rooms, except the pinned ones, greedily.
+// It returns the moves, the orphan nights once they are applied, and false when a reservation
+// didn't fit anywhere.
+func planGroup(group []models.Room, current map[int][]models.RoomRestriction, pinned map[int]bool,
+	start, end time.Time, orphanNights int, roomByID map[int]models.Room) ([]Move, int, bool) {
+	planned := make(map[int][]models.RoomRestriction)
+	var movable []models.RoomRestriction
+	for _, room := range group {
+		for _, r := range current[room.ID] {
+			if isMovable(r, start, end) && !pinned[r.ReservationID] {
+				movable = append(movable, r)
+				continue
+			}
+			planned[r.RoomID] = append(planned[r.RoomID], r)
+		}
+	}
+
+	// Longer stays first on the same arrival day, they are the hardest to fit
+	sort.SliceStable(movable, func(i, j int) bool {
+		if !movable[i].StartDate.Equal(movable[j].StartDate) {
+			return movable[i].StartDate.Before(movable[j].StartDate)
+		}
+		return movable[i].EndDate.After(movable[j].EndDate)
+	})
+
+	// assigned is the room of each movable reservation in the plan
+	assigned := make([]int, len(movable))
+	for i, r := range movable {
+		best, bestCost, bestTight := 0, 0, 0
+		for _, room := range group {
+			if overlaps(planned[room.ID], r) {
+				continue
+			}
+			cost := orphans(append(clone(planned[room.ID]), r), orphanNights) -
+				orphans(planned[room.ID], orphanNights)
+			tight := gapBefore(planned[room.ID], r)
+			if best == 0 || better(cost, tight, room.ID == r.RoomID, bestCost, bestTight, best == r.RoomID) {
+				best, bestCost, bestTight = room.ID, cost, tight
+			}
+		}
+		if best == 0 {
+			// Greedy packing ran into a dead end, keep this group as it is
+			return nil, 0, false
+		}
+		planned[best] = append(planned[best], r)
+		assigned[i] = best
+	}
+
+	keepTwinsInPlace(movable, assigned)
+
+	var moves []Move
+	for i, r := range movable {
+		if assigned[i] != r.RoomID {
+			moves = append(moves, Move{
+				Reservation: r.Reservation,
+				FromRoom:    roomByID[r.RoomID],
+				ToRoom:      roomByID[assigned[i]],
+			})
+		}
+	}
+
+	after := 0
+	for _, room := range group {
+		after += orphans(planned[room.ID], orphanNights)
+	}
+	return moves, after, true
+}
+
+// keepTwinsInPlace trades the planned rooms of reservations with the same dates so that as many of
+// them as possible keep their room. The gaps are the same whichever of them takes which room, and a
+// trade between two of them is a swap that can't be applied one move at a time.
+func keepTwinsInPlace(movable []models.RoomRestriction, assigned []int) {
+	twins := make(map[[2]int64][]int)
+	for i, r := range movable {
+		key := [2]int64{r.StartDate.Unix(), r.EndDate.Unix()}
+		twins[key] = append(twins[key], i)
+	}
+
+	for _, group := range twins {
+		if len(group) < 2 {
+			continue
+		}
+
+		free := make(map[int]bool)
+		var rooms []int
+		for _, i := range group {
+			free[assigned[i]] = true
+			rooms = append(rooms, assigned[i])
+		}
+
+		var others []int
+		for _, i := range group {
+			if free[movable[i].RoomID] {
+				free[movable[i].RoomID] = false
+				assigned[i] = movable[i].RoomID
+				continue
+			}
+			others = append(others, i)
+		}
+
+		// The others take the rooms left, in plan order
+		for _, roomID := range rooms {
+			if !free[roomID] {
+				continue
+			}
+			free[roomID] = false
+			assigned[others[0]] = roomID
+			others = others[1:]
+		}
+	}
+}
+
+// isMovable reports whether the optimiser may change the room of a restriction
+func isMovable(r models.RoomRestriction, start, end time.Time) bool {
+	if r.RestrictionID != reservationRestriction || r.ReservationID == 0 {
+		return false
+	}
+	if r.Reservation.RoomLocked {
+		return false
+	}
+	return !r.StartDate.Before(start) && !r.EndDate.After(end)
+}
+
+// better compares a candidate room with the best one so far: fewer orphan nights win,
+// then staying in the current room, then the tightest fit after the previous stay
+func better(cost, tight int, isCurrent bool, bestCost, bestTight int, bestIsCurrent bool) bool {
+	if cost != bestCost {
+		return cost < bestCost
+	}
+	if isCurrent != bestIsCurrent {
+		return isCurrent
+	}
+	return tight < bestTight
+}
+
+// overlaps checks a restriction against every stay of a room
+func overlaps(stays []models.RoomRestriction, r models.RoomRestriction) bool {
+	for _, s := range stays {
+		if r.StartDate.Before(s.EndDate) && r.EndDate.After(s.StartDate) {
+			return true
+		}
+	}
+	return false
+}
+
+// gapBefore returns the number of empty nights between the previous stay and r, large when there is none
+func gapBefore(stays []models.RoomRestriction, r models.RoomRestriction) int {
+	gap := 1 << 30
+	for _, s := range stays {
+		if !s.EndDate.After(r.StartDate) {
+			if n := nights(s.EndDate, r.StartDate); n < gap {
+				gap = n
+			}
+		}
+	}
+	return gap
+}
+
+// orphans counts the empty nights in gaps of at most orphanNights between consecutive stays
+func orphans(stays []models.RoomRestriction, orphanNights int) int {
+	sorted := clone(stays)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StartDate.Before(sorted[j].StartDate)
+	})
+
+	total := 0
+	for i := 1; i < len(sorted); i++ {
+		gap := nights(sorted[i-1].EndDate, sorted[i].StartDate)
+		if gap > 0 && gap <= orphanNights {
+			total += gap
+		}
+	}
+	return total
+}
+
+func clone(stays []models.RoomRestriction) []models.RoomRestriction {
+	out := make([]models.RoomRestriction, len(stays))
+	copy(out, stays)
+	return out
+}
+
+// nights returns the number of nights between two dates
+func nights(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
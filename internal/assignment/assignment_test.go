@@ -0,0 +1,282 @@
+package assignment
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+func day(d int) time.Time {
+	return time.Date(2050, time.January, d, 0, 0, 0, 0, time.UTC)
+}
+
+func reservation(id, roomID, start, end int, locked bool) models.RoomRestriction {
+	return models.RoomRestriction{
+		ID:            id,
+		RoomID:        roomID,
+		ReservationID: id,
+		RestrictionID: 1,
+		StartDate:     day(start),
+		EndDate:       day(end),
+		Reservation: models.Reservation{
+			ID:         id,
+			RoomID:     roomID,
+			StartDate:  day(start),
+			EndDate:    day(end),
+			RoomLocked: locked,
+		},
+	}
+}
+
+func block(id, roomID, start, end int) models.RoomRestriction {
+	return models.RoomRestriction{
+		ID:            id,
+		RoomID:        roomID,
+		RestrictionID: 2,
+		StartDate:     day(start),
+		EndDate:       day(end),
+	}
+}
+
+var suites = []models.Room{
+	{ID: 1, RoomName: "Suite 1", RoomType: "suite"},
+	{ID: 2, RoomName: "Suite 2", RoomType: "suite"},
+}
+
+var optimiseTests = []struct {
+	name         string
+	rooms        []models.Room
+	restrictions []models.RoomRestriction
+	gapsBefore   int
+	gapsAfter    int
+	moves        int
+}{
+	{
+		name:  "fills-single-night-hole",
+		rooms: suites,
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 1, 3, false),
+			reservation(2, 1, 4, 6, false),
+			reservation(3, 2, 3, 4, false),
+		},
+		gapsBefore: 1,
+		gapsAfter:  0,
+		moves:      1,
+	},
+	{
+		name:  "locked-guests-stay",
+		rooms: suites,
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 1, 3, true),
+			reservation(2, 1, 4, 6, true),
+			reservation(3, 2, 3, 4, true),
+		},
+		gapsBefore: 1,
+		gapsAfter:  1,
+		moves:      0,
+	},
+	{
+		name:  "owner-block-stays",
+		rooms: suites,
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 1, 3, true),
+			reservation(2, 1, 4, 6, false),
+			block(3, 2, 3, 4),
+		},
+		gapsBefore: 1,
+		gapsAfter:  0,
+		moves:      1,
+	},
+	{
+		name: "different-room-types",
+		rooms: []models.Room{
+			{ID: 1, RoomName: "Suite", RoomType: "suite"},
+			{ID: 2, RoomName: "Quarters", RoomType: "quarters"},
+		},
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 1, 3, false),
+			reservation(2, 1, 4, 6, false),
+			reservation(3, 2, 3, 4, false),
+		},
+		gapsBefore: 1,
+		gapsAfter:  1,
+		moves:      0,
+	},
+	{
+		// Swapping 2 and 3 fills the hole too, but can't be applied one move at a time
+		name:  "no-swap",
+		rooms: suites,
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 2, 3, false),
+			reservation(2, 2, 6, 7, false),
+			reservation(3, 1, 4, 7, false),
+		},
+		gapsBefore: 1,
+		gapsAfter:  0,
+		moves:      1,
+	},
+	{
+		name:  "nothing-to-improve",
+		rooms: suites,
+		restrictions: []models.RoomRestriction{
+			reservation(1, 1, 1, 3, false),
+			reservation(2, 1, 3, 6, false),
+		},
+		gapsBefore: 0,
+		gapsAfter:  0,
+		moves:      0,
+	},
+}
+
+func TestOptimise(t *testing.T) {
+	for _, e := range optimiseTests {
+		plan := Optimise(e.rooms, e.restrictions, day(1), day(31), 1)
+
+		if plan.GapsBefore != e.gapsBefore {
+			t.Errorf("%s: expected %d gaps before, got %d", e.name, e.gapsBefore, plan.GapsBefore)
+		}
+		if plan.GapsAfter != e.gapsAfter {
+			t.Errorf("%s: expected %d gaps after, got %d", e.name, e.gapsAfter, plan.GapsAfter)
+		}
+		if len(plan.Moves) != e.moves {
+			t.Errorf("%s: expected %d moves, got %d", e.name, e.moves, len(plan.Moves))
+		}
+
+		for _, move := range plan.Moves {
+			if move.Reservation.ID == 0 {
+				t.Errorf("%s: an owner block was moved", e.name)
+			}
+			if move.Reservation.RoomLocked {
+				t.Errorf("%s: a locked reservation was moved", e.name)
+			}
+			if move.FromRoom.RoomType != move.ToRoom.RoomType {
+				t.Errorf("%s: reservation moved to a room of another type", e.name)
+			}
+		}
+	}
+}
+
+func TestOptimiseKeepsTwinsInPlace(t *testing.T) {
+	rooms := append(suites, models.Room{ID: 3, RoomName: "Suite 3", RoomType: "suite"})
+	restrictions := []models.RoomRestriction{
+		reservation(1, 2, 6, 7, false),
+		reservation(2, 1, 6, 7, false),
+		reservation(3, 1, 2, 5, false),
+	}
+
+	// 1 and 2 have the same dates, 2 leaves room 1 and 1 keeps its room
+	plan := Optimise(rooms, restrictions, day(1), day(31), 1)
+	if len(plan.Moves) != 1 || plan.Moves[0].Reservation.ID != 2 {
+		t.Errorf("expected reservation 2 to move alone, got %+v", plan.Moves)
+	}
+}
+
+// Random months of bookings: every plan can be applied one move at a time and leaves the gaps it says
+func TestOptimiseAppliesOneMoveAtATime(t *testing.T) {
+	rooms := append(suites, models.Room{ID: 3, RoomName: "Suite 3", RoomType: "suite"})
+	rng := rand.New(rand.NewSource(1))
+
+	for n := 0; n < 1000; n++ {
+		var restrictions []models.RoomRestriction
+		id := 0
+		for _, room := range rooms {
+			for d := 1 + rng.Intn(3); ; {
+				length := 1 + rng.Intn(4)
+				if d+length > 30 {
+					break
+				}
+				id++
+				restrictions = append(restrictions, reservation(id, room.ID, d, d+length, rng.Intn(6) == 0))
+				d += length + rng.Intn(3)
+			}
+		}
+
+		plan := Optimise(rooms, restrictions, day(1), day(31), 2)
+
+		state := make(map[int][]models.RoomRestriction)
+		for _, r := range restrictions {
+			state[r.RoomID] = append(state[r.RoomID], r)
+		}
+		for _, move := range plan.Ordered() {
+			var r models.RoomRestriction
+			var stays []models.RoomRestriction
+			for _, s := range state[move.FromRoom.ID] {
+				if s.ReservationID == move.Reservation.ID {
+					r = s
+					continue
+				}
+				stays = append(stays, s)
+			}
+			if overlaps(state[move.ToRoom.ID], r) {
+				t.Fatalf("plan %d: reservation %d can't move to room %d, it is taken", n, move.Reservation.ID, move.ToRoom.ID)
+			}
+			state[move.FromRoom.ID] = stays
+			state[move.ToRoom.ID] = append(state[move.ToRoom.ID], r)
+		}
+
+		after := 0
+		for _, stays := range state {
+			after += orphans(stays, 2)
+		}
+		if after != plan.GapsAfter {
+			t.Fatalf("plan %d: expected %d gaps after, got %d once applied", n, plan.GapsAfter, after)
+		}
+	}
+}
+
+func TestOptimiseOutsideWindow(t *testing.T) {
+	restrictions := []models.RoomRestriction{
+		reservation(1, 1, 1, 3, false),
+		reservation(2, 1, 4, 6, false),
+		reservation(3, 2, 3, 4, false),
+	}
+
+	// Every reservation starts before the window, none of them may move
+	plan := Optimise(suites, restrictions, day(10), day(20), 1)
+	if len(plan.Moves) != 0 {
+		t.Errorf("expected no moves outside the window, got %d", len(plan.Moves))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	suite := func(id int) models.Room { return models.Room{ID: id, RoomType: "suite"} }
+	plan := Plan{Moves: []Move{{Reservation: reservation(1, 1, 1, 3, false).Reservation, FromRoom: suite(1), ToRoom: suite(2)}}}
+
+	if plan.Fingerprint() != plan.Fingerprint() {
+		t.Error("expected the same plan to have the same fingerprint")
+	}
+	if plan.Fingerprint() == (Plan{}).Fingerprint() {
+		t.Error("expected a plan without moves to have another fingerprint")
+	}
+
+	// The same move of a booking whose dates changed is another plan
+	changed := Plan{Moves: []Move{{Reservation: reservation(1, 1, 1, 4, false).Reservation, FromRoom: suite(1), ToRoom: suite(2)}}}
+	if plan.Fingerprint() == changed.Fingerprint() {
+		t.Error("expected the dates of the moves in the fingerprint")
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	suite := func(id int) models.Room { return models.Room{ID: id, RoomType: "suite"} }
+	move := func(id, from, to, start, end int) Move {
+		return Move{Reservation: reservation(id, from, start, end, false).Reservation, FromRoom: suite(from), ToRoom: suite(to)}
+	}
+
+	// 1 goes where 2 is, which leaves for room 3, and 3 takes the room of 1: 2, then 1, then 3
+	plan := Plan{Moves: []Move{move(1, 1, 2, 1, 3), move(2, 2, 3, 2, 4), move(3, 4, 1, 1, 3)}}
+	var ids []int
+	for _, m := range plan.Ordered() {
+		ids = append(ids, m.Reservation.ID)
+	}
+	if len(ids) != 3 || ids[0] != 2 || ids[1] != 1 || ids[2] != 3 {
+		t.Errorf("expected the moves in the order 2, 1, 3, got %v", ids)
+	}
+
+	// A swap can't be ordered, both moves are kept
+	swap := Plan{Moves: []Move{move(1, 1, 2, 1, 3), move(2, 2, 1, 1, 3)}}
+	if n := len(swap.Ordered()); n != 2 {
+		t.Errorf("expected the 2 moves of a swap, got %d", n)
+	}
+}
@@ -0,0 +1,148 @@
+// Package audit describes the changes recorded in the audit log: what was done to which entity, and
+// the fields it changed
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionProcess = "process"
+	ActionMove    = "move"
+	ActionMerge   = "merge"
+	ActionRestore = "restore"
+)
+
+// Actions lists every action, in the order they are shown
+var Actions = []string{ActionCreate, ActionUpdate, ActionDelete, ActionRestore, ActionProcess, ActionMove, ActionMerge}
+
+// Entities changed by the admin pages
+const (
+	EntityReservation = "reservation"
+	EntityBlock       = "block"
+	EntityBlockSeries = "block_series"
+	EntityStayRule    = "stay_rule"
+	EntityGuest       = "guest"
+)
+
+// Entities lists every entity, in the order they are shown
+var Entities = []string{EntityReservation, EntityBlock, EntityBlockSeries, EntityStayRule, EntityGuest}
+
+// Redacted is recorded in place of the values of personal fields. The log is append-only, so it tells
+// they changed but never holds the values, which an erasure could not reach.
+const Redacted = "[redacted]"
+
+// ignored fields change with every write or follow another field
+var ignored = map[string]bool{
+	"id":          true,
+	"created_at":  true,
+	"updated_at":  true,
+	"email_index": true,
+	"phone_index": true,
+}
+
+// personal fields are recorded as Redacted, they are the fields of reservations and guests about a person
+var personal = map[string]bool{
+	"first_name": true,
+	"last_name":  true,
+	"email":      true,
+	"phone":      true,
+	"notes":      true,
+	"tags":       true,
+}
+
+// Change is the value of a field before and after a change, nil when the entity didn't exist
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Diff returns the fields that differ between two states of an entity, a nil state being an entity
+// created or deleted by the change
+func Diff(before, after map[string]interface{}) map[string]Change {
+	changes := make(map[string]Change)
+
+	add := func(field string) {
+		if ignored[field] {
+			return
+		}
+		if _, done := changes[field]; done {
+			return
+		}
+		from, to := before[field], after[field]
+		if fmt.Sprint(from) == fmt.Sprint(to) {
+			return
+		}
+		if personal[field] {
+			from, to = redact(from), redact(to)
+		}
+		changes[field] = Change{From: from, To: to}
+	}
+
+	for field := range before {
+		add(field)
+	}
+	for field := range after {
+		add(field)
+	}
+
+	return changes
+}
+
+func redact(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return Redacted
+}
+
+// FieldChange is a change of a field, formatted to be shown
+type FieldChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+// Fields decodes the changes of an entry of the log, sorted by field
+func Fields(changes string) ([]FieldChange, error) {
+	var fields []FieldChange
+	if changes == "" {
+		return fields, nil
+	}
+
+	var decoded map[string]Change
+	err := json.Unmarshal([]byte(changes), &decoded)
+	if err != nil {
+		return fields, err
+	}
+
+	for field, c := range decoded {
+		fields = append(fields, FieldChange{Field: field, From: format(c.From), To: format(c.To)})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+
+	return fields, nil
+}
+
+// format writes a decoded JSON value, numbers without exponent
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var before = map[string]interface{}{
+	"id":          float64(7),
+	"first_name":  "John",
+	"email":       "john@smith.com",
+	"phone":       "0989123456",
+	"email_index": "john@smith.com",
+	"room_id":     float64(1),
+	"total_price": float64(1250000),
+	"updated_at":  "2050-05-01T10:00:00",
+}
+
+func TestDiff(t *testing.T) {
+	after := map[string]interface{}{
+		"id":          float64(7),
+		"first_name":  "John",
+		"email":       "johnny@smith.com",
+		"phone":       "0989123456",
+		"email_index": "johnny@smith.com",
+		"room_id":     float64(2),
+		"total_price": float64(1250000),
+		"updated_at":  "2050-05-02T10:00:00",
+	}
+
+	changes := Diff(before, after)
+	if len(changes) != 2 {
+		t.Fatalf("expected the email and the room to change, got %v", changes)
+	}
+	if changes["room_id"].From != float64(1) || changes["room_id"].To != float64(2) {
+		t.Errorf("wrong room change %v", changes["room_id"])
+	}
+	if changes["email"].From != Redacted || changes["email"].To != Redacted {
+		t.Errorf("email not redacted: %v", changes["email"])
+	}
+
+	if len(Diff(before, before)) != 0 {
+		t.Error("an unchanged entity has changes")
+	}
+}
+
+func TestDiffDeleted(t *testing.T) {
+	changes := Diff(before, nil)
+	if _, ok := changes["first_name"]; !ok {
+		t.Fatalf("deleted fields missing from %v", changes)
+	}
+	if changes["first_name"].To != nil {
+		t.Errorf("deleted field has a new value %v", changes["first_name"].To)
+	}
+	if changes["phone"].From != Redacted {
+		t.Errorf("phone not redacted: %v", changes["phone"])
+	}
+	if _, ok := changes["id"]; ok {
+		t.Error("id recorded as a change")
+	}
+}
+
+func TestDiffPersonal(t *testing.T) {
+	guest := map[string]interface{}{
+		"first_name": "John",
+		"last_name":  "Smith",
+		"notes":      "Allergic to nuts",
+		"tags":       "vip",
+	}
+	changes := Diff(guest, map[string]interface{}{
+		"first_name": "Johnny",
+		"last_name":  "Smith",
+		"notes":      "",
+		"tags":       "vip,late",
+	})
+	if len(changes) != 3 {
+		t.Fatalf("expected the first name, the notes and the tags to change, got %v", changes)
+	}
+	for field, c := range changes {
+		if c.From != Redacted || (c.To != Redacted && c.To != "") {
+			t.Errorf("%s not redacted: %v", field, c)
+		}
+	}
+	if changes["notes"].To != "" {
+		t.Errorf("expected emptied notes to show, got %v", changes["notes"])
+	}
+}
+
+func TestFields(t *testing.T) {
+	encoded, err := json.Marshal(Diff(before, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := Fields(string(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FieldChange{
+		{Field: "email", From: Redacted},
+		{Field: "first_name", From: Redacted},
+		{Field: "phone", From: Redacted},
+		{Field: "room_id", From: "1"},
+		{Field: "total_price", From: "1250000"},
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+	for i := range fields {
+		if fields[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], fields[i])
+		}
+	}
+
+	if _, err := Fields("not json"); err == nil {
+		t.Error("no error for broken changes")
+	}
+}
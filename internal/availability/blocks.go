@@ -0,0 +1,86 @@
+package availability
+
+import (
+	"sort"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// Frequencies of a recurring owner block
+const (
+	FrequencyWeekly = "weekly"
+	FrequencyYearly = "yearly"
+)
+
+// ownerBlock is the restriction id of a block made by the owner
+const ownerBlock = 2
+
+// maxOccurrences caps the blocks created by one series, ten years of weekly blocks
+const maxOccurrences = 520
+
+// Occurrences expands a recurring block into one owner block per occurrence. Every block keeps
+// the length of the first one and the series stops at the last occurrence starting on or before
+// UntilDate. An unknown frequency gives the first block only.
+func Occurrences(s models.BlockSeries) []models.RoomRestriction {
+	var blocks []models.RoomRestriction
+
+	for i := 0; i < maxOccurrences; i++ {
+		var start, end time.Time
+		switch s.Frequency {
+		case FrequencyWeekly:
+			start, end = s.StartDate.AddDate(0, 0, 7*i), s.EndDate.AddDate(0, 0, 7*i)
+		case FrequencyYearly:
+			start, end = s.StartDate.AddDate(i, 0, 0), s.EndDate.AddDate(i, 0, 0)
+		default:
+			if i > 0 {
+				return blocks
+			}
+			start, end = s.StartDate, s.EndDate
+		}
+
+		if start.After(s.UntilDate) {
+			break
+		}
+
+		blocks = append(blocks, models.RoomRestriction{
+			RoomID:        s.RoomID,
+			RestrictionID: ownerBlock,
+			StartDate:     start,
+			EndDate:       end,
+			Note:          s.Note,
+			SeriesID:      s.ID,
+		})
+	}
+
+	return blocks
+}
+
+// BlocksFromNights merges the nights ticked for a room into as few owner blocks as possible,
+// consecutive nights become one block ending the morning after the last night
+func BlocksFromNights(roomID int, nights []time.Time) []models.RoomRestriction {
+	sorted := make([]time.Time, len(nights))
+	copy(sorted, nights)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+
+	var blocks []models.RoomRestriction
+	for _, night := range sorted {
+		last := len(blocks) - 1
+		if last >= 0 && !night.After(blocks[last].EndDate) {
+			if night.Equal(blocks[last].EndDate) {
+				blocks[last].EndDate = night.AddDate(0, 0, 1)
+			}
+			continue
+		}
+		blocks = append(blocks, models.RoomRestriction{
+			RoomID:        roomID,
+			RestrictionID: ownerBlock,
+			StartDate:     night,
+			EndDate:       night.AddDate(0, 0, 1),
+		})
+	}
+
+	return blocks
+}
@@ -0,0 +1,120 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+var occurrencesTests = []struct {
+	name      string
+	series    models.BlockSeries
+	count     int
+	lastStart string
+	lastEnd   string
+}{
+	{
+		// 2050-07-04 is a Monday
+		name: "every-monday",
+		series: models.BlockSeries{
+			StartDate: date("2050-07-04"),
+			EndDate:   date("2050-07-05"),
+			Frequency: FrequencyWeekly,
+			UntilDate: date("2050-07-31"),
+		},
+		count:     4,
+		lastStart: "2050-07-25",
+		lastEnd:   "2050-07-26",
+	},
+	{
+		name: "yearly-closure",
+		series: models.BlockSeries{
+			StartDate: date("2050-12-20"),
+			EndDate:   date("2051-01-05"),
+			Frequency: FrequencyYearly,
+			UntilDate: date("2052-12-20"),
+		},
+		count:     3,
+		lastStart: "2052-12-20",
+		lastEnd:   "2053-01-05",
+	},
+	{
+		name: "unknown-frequency",
+		series: models.BlockSeries{
+			StartDate: date("2050-07-04"),
+			EndDate:   date("2050-07-10"),
+			UntilDate: date("2051-07-04"),
+		},
+		count:     1,
+		lastStart: "2050-07-04",
+		lastEnd:   "2050-07-10",
+	},
+	{
+		name: "until-before-start",
+		series: models.BlockSeries{
+			StartDate: date("2050-07-04"),
+			EndDate:   date("2050-07-05"),
+			Frequency: FrequencyWeekly,
+			UntilDate: date("2050-07-01"),
+		},
+		count: 0,
+	},
+}
+
+func TestOccurrences(t *testing.T) {
+	for _, e := range occurrencesTests {
+		e.series.ID = 7
+		e.series.RoomID = 1
+		e.series.Note = "maintenance"
+
+		blocks := Occurrences(e.series)
+		if len(blocks) != e.count {
+			t.Errorf("%s: expected %d blocks, got %d", e.name, e.count, len(blocks))
+			continue
+		}
+		if e.count == 0 {
+			continue
+		}
+
+		last := blocks[len(blocks)-1]
+		if !last.StartDate.Equal(date(e.lastStart)) || !last.EndDate.Equal(date(e.lastEnd)) {
+			t.Errorf("%s: expected last block %s to %s, got %s to %s", e.name, e.lastStart, e.lastEnd,
+				last.StartDate.Format("2006-01-02"), last.EndDate.Format("2006-01-02"))
+		}
+		for _, b := range blocks {
+			if b.RoomID != 1 || b.SeriesID != 7 || b.Note != "maintenance" || b.RestrictionID != ownerBlock {
+				t.Errorf("%s: block does not carry the series details: %+v", e.name, b)
+			}
+		}
+	}
+}
+
+func TestBlocksFromNights(t *testing.T) {
+	nights := []time.Time{
+		date("2050-07-06"),
+		date("2050-07-01"),
+		date("2050-07-02"),
+		date("2050-07-03"),
+		date("2050-07-02"),
+	}
+
+	blocks := BlocksFromNights(1, nights)
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(blocks))
+	}
+
+	expected := []struct{ start, end string }{
+		{"2050-07-01", "2050-07-04"},
+		{"2050-07-06", "2050-07-07"},
+	}
+	for i, e := range expected {
+		if !blocks[i].StartDate.Equal(date(e.start)) || !blocks[i].EndDate.Equal(date(e.end)) {
+			t.Errorf("block %d: expected %s to %s, got %s to %s", i, e.start, e.end,
+				blocks[i].StartDate.Format("2006-01-02"), blocks[i].EndDate.Format("2006-01-02"))
+		}
+		if blocks[i].RoomID != 1 {
+			t.Errorf("block %d: expected room 1, got %d", i, blocks[i].RoomID)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package availability
+
+import (
+	"sort"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// Window is a free stay of a room close to the dates a guest asked for
+type Window struct {
+	Room      models.Room
+	StartDate time.Time
+	EndDate   time.Time
+	Shift     int // days from the start date asked for, negative is earlier
+}
+
+// NearestWindows looks for stays of the same length as [start, end) starting at most flexDays earlier or
+// later in every room, restrictions and rules being the ones of those rooms around the dates. It returns up
+// to perRoom free windows of every room, closest first and earlier first on a tie. The exact dates count as
+// a window when they are free. Windows starting in the past or blocked by a stay rule are left out.
+func NearestWindows(rooms []models.Room, restrictions []models.RoomRestriction, rules []models.StayRule,
+	start, end time.Time, flexDays, perRoom int, today time.Time) []Window {
+	var windows []Window
+
+	taken := make(map[int][]models.RoomRestriction)
+	for _, r := range restrictions {
+		taken[r.RoomID] = append(taken[r.RoomID], r)
+	}
+
+	for _, room := range rooms {
+		found := 0
+		for _, shift := range shifts(flexDays) {
+			if found == perRoom {
+				break
+			}
+
+			s, e := start.AddDate(0, 0, shift), end.AddDate(0, 0, shift)
+			if isTaken(taken[room.ID], s, e) {
+				continue
+			}
+			if len(CheckStay(RulesForRoom(rules, room.ID, s), s, e, today)) > 0 {
+				continue
+			}
+
+			windows = append(windows, Window{Room: room, StartDate: s, EndDate: e, Shift: shift})
+			found++
+		}
+	}
+
+	sort.SliceStable(windows, func(i, j int) bool {
+		if abs(windows[i].Shift) != abs(windows[j].Shift) {
+			return abs(windows[i].Shift) < abs(windows[j].Shift)
+		}
+		return windows[i].Shift < windows[j].Shift
+	})
+
+	return windows
+}
+
+// shifts lists the day offsets to try, closest first: 0, -1, 1, -2, 2 ...
+func shifts(flexDays int) []int {
+	out := []int{0}
+	for d := 1; d <= flexDays; d++ {
+		out = append(out, -d, d)
+	}
+	return out
+}
+
+// isTaken reports whether a restriction of the room overlaps [start, end)
+func isTaken(restrictions []models.RoomRestriction, start, end time.Time) bool {
+	for _, r := range restrictions {
+		if start.Before(r.EndDate) && end.After(r.StartDate) {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package availability
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+var flexRooms = []models.Room{
+	{ID: 1, RoomName: "General's Quarters"},
+	{ID: 2, RoomName: "Major's Suite"},
+}
+
+// Room 1 is booked from the 10th to the 13th, room 2 from the 8th to the 15th
+var flexRestrictions = []models.RoomRestriction{
+	{RoomID: 1, StartDate: date("2050-07-10"), EndDate: date("2050-07-13")},
+	{RoomID: 2, StartDate: date("2050-07-08"), EndDate: date("2050-07-15")},
+}
+
+var nearestWindowsTests = []struct {
+	name     string
+	start    string
+	end      string
+	flexDays int
+	perRoom  int
+	rules    []models.StayRule
+	expected []string // room id and start date of every window, in order
+}{
+	{
+		name:     "exact-dates-free",
+		start:    "2050-07-01",
+		end:      "2050-07-03",
+		flexDays: 0,
+		perRoom:  1,
+		expected: []string{"1 2050-07-01", "2 2050-07-01"},
+	},
+	{
+		name:     "closest-windows",
+		start:    "2050-07-11",
+		end:      "2050-07-13",
+		flexDays: 4,
+		perRoom:  2,
+		// room 1: 8th to 10th (-3) and 13th to 15th (+2), room 2: 15th to 17th (+4)
+		expected: []string{"1 2050-07-13", "1 2050-07-08", "2 2050-07-15"},
+	},
+	{
+		name:     "nothing-close-enough",
+		start:    "2050-07-11",
+		end:      "2050-07-13",
+		flexDays: 1,
+		perRoom:  2,
+		expected: nil,
+	},
+	{
+		name:     "in-the-past",
+		start:    "2050-06-02",
+		end:      "2050-06-04",
+		flexDays: 3,
+		perRoom:  1,
+		// today is 2050-06-01, earlier arrivals are in the past
+		expected: []string{"1 2050-06-02", "2 2050-06-02"},
+	},
+	{
+		name:     "stay-rule",
+		start:    "2050-07-01",
+		end:      "2050-07-03",
+		flexDays: 2,
+		perRoom:  1,
+		rules: []models.StayRule{
+			{RoomID: 1, StartDate: date("2050-06-01"), EndDate: date("2050-07-01"), ClosedToArrival: 127},
+		},
+		// room 1 can't take arrivals up to the 1st
+		expected: []string{"2 2050-07-01", "1 2050-07-02"},
+	},
+}
+
+func TestNearestWindows(t *testing.T) {
+	for _, e := range nearestWindowsTests {
+		windows := NearestWindows(flexRooms, flexRestrictions, e.rules, date(e.start), date(e.end),
+			e.flexDays, e.perRoom, date("2050-06-01"))
+
+		var got []string
+		for _, w := range windows {
+			got = append(got, fmt.Sprintf("%d %s", w.Room.ID, w.StartDate.Format("2006-01-02")))
+
+			if w.EndDate.Sub(w.StartDate) != date(e.end).Sub(date(e.start)) {
+				t.Errorf("%s: window %s has another length", e.name, got[len(got)-1])
+			}
+		}
+
+		if len(got) != len(e.expected) {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != e.expected[i] {
+				t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package availability
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
+)
+
+// Status of a day in the availability grid of a room
+const (
+	StatusAvailable     = "available"
+	StatusBooked        = "booked"
+	StatusBlocked       = "blocked"
+	StatusArrivalClosed = "arrival-closed" // the night is free but a stay can't start on it
+)
+
+// Day is the status and the nightly price of a room for the night starting on Date
+type Day struct {
+	Date   time.Time
+	Status string
+	Price  int // In cents, for the party of the grid
+}
+
+// MonthGrid lays out the nights of a room from start to end (excluded). Restrictions are the
+// reservations and blocks of the room overlapping the range, rules its stay rules.
+func MonthGrid(room models.Room, restrictions []models.RoomRestriction, rules []models.StayRule,
+	start, end time.Time, adults, children int) []Day {
+	var days []Day
+
+	price := pricing.NightlyPrice(room, adults, children)
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		day := Day{Date: d, Status: StatusAvailable, Price: price}
+
+		for _, r := range restrictions {
+			if r.RoomID != room.ID || d.Before(r.StartDate) || !d.Before(r.EndDate) {
+				continue
+			}
+			if r.ReservationID > 0 {
+				day.Status = StatusBooked
+			} else {
+				day.Status = StatusBlocked
+			}
+			break
+		}
+
+		if day.Status == StatusAvailable {
+			for _, rule := range RulesForRoom(rules, room.ID, d) {
+				if ClosedOn(rule.ClosedToArrival, d.Weekday()) {
+					day.Status = StatusArrivalClosed
+					break
+				}
+			}
+		}
+
+		days = append(days, day)
+	}
+
+	return days
+}
+
+// GridCache keeps up to size computed grids for ttl, or until Invalidate is called after a change
+// to reservations, blocks or stay rules
+type GridCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	size       int
+	entries    map[string]gridEntry
+	generation uint64
+}
+
+type gridEntry struct {
+	days    []Day
+	expires time.Time
+}
+
+// NewGridCache creates an empty cache of at most size grids, each living for ttl
+func NewGridCache(ttl time.Duration, size int) *GridCache {
+	return &GridCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]gridEntry),
+	}
+}
+
+// GridKey identifies the grid of a room for a range and a party
+func GridKey(roomID int, start, end time.Time, adults, children int) string {
+	return fmt.Sprintf("%d:%s:%s:%d:%d", roomID, start.Format("2006-01-02"), end.Format("2006-01-02"), adults, children)
+}
+
+// Get returns the cached grid for key, if it is still fresh
+func (c *GridCache) Get(key string) ([]Day, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.days, true
+}
+
+// Generation changes on every Invalidate, read it before reading what a grid is computed from
+func (c *GridCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// Set stores a grid for key, computed from what was read at generation. A grid computed before the
+// last Invalidate may be stale, it is not stored. A full cache drops its expired grids first, then
+// the ones expiring soonest.
+func (c *GridCache) Set(key string, days []Day, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for len(c.entries) >= c.size {
+			var oldest string
+			for k, entry := range c.entries {
+				if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[key] = gridEntry{days: days, expires: time.Now().Add(c.ttl)}
+}
+
+// Invalidate drops every cached grid, and the grids being computed meanwhile
+func (c *GridCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]gridEntry)
+	c.generation++
+}
@@ -0,0 +1,100 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+func TestMonthGrid(t *testing.T) {
+	room := models.Room{ID: 1, BaseOccupancy: 2, PricePerNight: 10000, ExtraGuestFee: 2500}
+	restrictions := []models.RoomRestriction{
+		{RoomID: 1, ReservationID: 7, StartDate: date("2050-07-02"), EndDate: date("2050-07-04")},
+		{RoomID: 1, StartDate: date("2050-07-05"), EndDate: date("2050-07-06")},
+		// another room, ignored
+		{RoomID: 2, ReservationID: 8, StartDate: date("2050-07-01"), EndDate: date("2050-07-10")},
+	}
+	rules := []models.StayRule{
+		// 2050-07-09 is a Saturday
+		{RoomID: 1, StartDate: date("2050-07-01"), EndDate: date("2050-07-31"), ClosedToArrival: WeekdayMask(time.Saturday)},
+	}
+
+	days := MonthGrid(room, restrictions, rules, date("2050-07-01"), date("2050-07-10"), 3, 0)
+
+	expected := []string{
+		StatusAvailable,     // 1st
+		StatusBooked,        // 2nd
+		StatusBooked,        // 3rd
+		StatusAvailable,     // 4th, the guest leaves in the morning
+		StatusBlocked,       // 5th
+		StatusAvailable,     // 6th
+		StatusAvailable,     // 7th
+		StatusAvailable,     // 8th
+		StatusArrivalClosed, // 9th
+	}
+	if len(days) != len(expected) {
+		t.Fatalf("expected %d days, got %d", len(expected), len(days))
+	}
+	for i, status := range expected {
+		if days[i].Status != status {
+			t.Errorf("%s: expected %s, got %s", days[i].Date.Format("2006-01-02"), status, days[i].Status)
+		}
+		if days[i].Price != 12500 {
+			t.Errorf("%s: expected a price of 12500, got %d", days[i].Date.Format("2006-01-02"), days[i].Price)
+		}
+	}
+}
+
+func TestGridCache(t *testing.T) {
+	cache := NewGridCache(time.Minute, 10)
+	key := GridKey(1, date("2050-07-01"), date("2050-08-01"), 2, 0)
+
+	if _, ok := cache.Get(key); ok {
+		t.Error("empty cache returned a grid")
+	}
+
+	cache.Set(key, []Day{{Date: date("2050-07-01"), Status: StatusAvailable}}, cache.Generation())
+	if days, ok := cache.Get(key); !ok || len(days) != 1 {
+		t.Error("cache lost a fresh grid")
+	}
+
+	cache.Invalidate()
+	if _, ok := cache.Get(key); ok {
+		t.Error("cache kept a grid after Invalidate")
+	}
+
+	expired := NewGridCache(-time.Second, 10)
+	expired.Set(key, []Day{{Date: date("2050-07-01"), Status: StatusAvailable}}, expired.Generation())
+	if _, ok := expired.Get(key); ok {
+		t.Error("cache returned an expired grid")
+	}
+}
+
+func TestGridCacheStale(t *testing.T) {
+	cache := NewGridCache(time.Minute, 10)
+	key := GridKey(1, date("2050-07-01"), date("2050-08-01"), 2, 0)
+
+	// A change between reading the data and storing the grid
+	generation := cache.Generation()
+	cache.Invalidate()
+	cache.Set(key, []Day{{Date: date("2050-07-01"), Status: StatusAvailable}}, generation)
+	if _, ok := cache.Get(key); ok {
+		t.Error("cache stored a grid computed before Invalidate")
+	}
+}
+
+func TestGridCacheSize(t *testing.T) {
+	cache := NewGridCache(time.Minute, 3)
+	for roomID := 1; roomID <= 5; roomID++ {
+		key := GridKey(roomID, date("2050-07-01"), date("2050-08-01"), 2, 0)
+		cache.Set(key, []Day{{Date: date("2050-07-01"), Status: StatusAvailable}}, cache.Generation())
+	}
+
+	if n := len(cache.entries); n != 3 {
+		t.Errorf("expected 3 grids in the cache, got %d", n)
+	}
+	if _, ok := cache.Get(GridKey(5, date("2050-07-01"), date("2050-08-01"), 2, 0)); !ok {
+		t.Error("cache dropped the latest grid")
+	}
+}
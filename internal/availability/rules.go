@@ -0,0 +1,112 @@
+package availability
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
+)
+
+// WeekdayMask packs weekdays into the bitmask stored in the closed to arrival/departure columns
+func WeekdayMask(days ...time.Weekday) int {
+	mask := 0
+	for _, d := range days {
+		mask |= 1 << uint(d)
+	}
+	return mask
+}
+
+// ClosedOn reports whether the weekday is set in the bitmask
+func ClosedOn(mask int, d time.Weekday) bool {
+	return mask&(1<<uint(d)) != 0
+}
+
+// Weekdays returns the names of the weekdays set in the bitmask, ie "Saturday, Sunday"
+func Weekdays(mask int) string {
+	var names []string
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if ClosedOn(mask, d) {
+			names = append(names, d.String())
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// RulesForRoom keeps the stay rules of one room that apply to an arrival date
+func RulesForRoom(rules []models.StayRule, roomID int, arrival time.Time) []models.StayRule {
+	var out []models.StayRule
+	for _, rule := range rules {
+		if rule.RoomID != roomID {
+			continue
+		}
+		if arrival.Before(rule.StartDate) || arrival.After(rule.EndDate) {
+			continue
+		}
+		out = append(out, rule)
+	}
+	return out
+}
+
+// Explain joins the messages of CheckStay into one line for the guest
+func Explain(problems []string) string {
+	return strings.Join(problems, "; ")
+}
+
+// CheckStay evaluates the stay rules of a room for a stay from start to end booked on today,
+// every broken rule is explained in a message that can be shown to the guest
+func CheckStay(rules []models.StayRule, start, end, today time.Time) []string {
+	leadDays := pricing.Nights(today, start)
+	return checkStay(rules, start, end, &leadDays, true)
+}
+
+// CheckMove evaluates the stay rules of a room for a stay staff move to start and end. How long
+// before arrival it happens doesn't matter, staff extend stays that started, and a stay keeping
+// its arrival day isn't checked against the days closed to arrival.
+func CheckMove(rules []models.StayRule, start, end time.Time, keepsArrival bool) []string {
+	return checkStay(rules, start, end, nil, !keepsArrival)
+}
+
+// checkStay evaluates the stay rules, the ones on the lead time only with leadDays and the ones on
+// the arrival day only with arrival
+func checkStay(rules []models.StayRule, start, end time.Time, leadDays *int, arrival bool) []string {
+	var problems []string
+
+	nights := pricing.Nights(start, end)
+	if nights <= 0 {
+		return append(problems, "End date must be after start date")
+	}
+
+	if leadDays != nil && *leadDays < 0 {
+		return append(problems, "Start date is in the past")
+	}
+
+	for _, rule := range rules {
+		if rule.MinNights > 0 && nights < rule.MinNights {
+			problems = append(problems, fmt.Sprintf("Stays arriving from %s to %s need at least %d nights",
+				rule.StartDate.Format("2006-01-02"), rule.EndDate.Format("2006-01-02"), rule.MinNights))
+		}
+		if rule.MaxNights > 0 && nights > rule.MaxNights {
+			problems = append(problems, fmt.Sprintf("Stays arriving from %s to %s can't be longer than %d nights",
+				rule.StartDate.Format("2006-01-02"), rule.EndDate.Format("2006-01-02"), rule.MaxNights))
+		}
+		if arrival && ClosedOn(rule.ClosedToArrival, start.Weekday()) {
+			problems = append(problems, fmt.Sprintf("No arrivals on %s", Weekdays(rule.ClosedToArrival)))
+		}
+		if ClosedOn(rule.ClosedToDeparture, end.Weekday()) {
+			problems = append(problems, fmt.Sprintf("No departures on %s", Weekdays(rule.ClosedToDeparture)))
+		}
+		if leadDays == nil {
+			continue
+		}
+		if rule.MinAdvanceDays > 0 && *leadDays < rule.MinAdvanceDays {
+			problems = append(problems, fmt.Sprintf("Book at least %d days before arrival", rule.MinAdvanceDays))
+		}
+		if rule.MaxAdvanceDays > 0 && *leadDays > rule.MaxAdvanceDays {
+			problems = append(problems, fmt.Sprintf("Bookings open %d days before arrival", rule.MaxAdvanceDays))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,104 @@
+package availability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+// summer rule applies to room 1 for arrivals in July 2050
+var summer = models.StayRule{
+	RoomID:            1,
+	StartDate:         date("2050-07-01"),
+	EndDate:           date("2050-07-31"),
+	MinNights:         2,
+	MaxNights:         7,
+	ClosedToArrival:   WeekdayMask(time.Sunday),
+	ClosedToDeparture: WeekdayMask(time.Saturday),
+	MinAdvanceDays:    3,
+	MaxAdvanceDays:    365,
+}
+
+var checkStayTests = []struct {
+	name     string
+	start    string
+	end      string
+	today    string
+	problems int
+}{
+	// 2050-07-04 is a Monday
+	{"valid-stay", "2050-07-04", "2050-07-06", "2050-06-01", 0},
+	{"end-before-start", "2050-07-06", "2050-07-04", "2050-06-01", 1},
+	{"same-day", "2050-07-04", "2050-07-04", "2050-06-01", 1},
+	{"in-the-past", "2050-07-04", "2050-07-06", "2050-08-01", 1},
+	{"too-short", "2050-07-04", "2050-07-05", "2050-06-01", 1},
+	{"too-long", "2050-07-04", "2050-07-14", "2050-06-01", 1},
+	{"closed-to-arrival", "2050-07-03", "2050-07-05", "2050-06-01", 1},
+	{"closed-to-departure", "2050-07-04", "2050-07-09", "2050-06-01", 1},
+	{"too-late", "2050-07-04", "2050-07-06", "2050-07-03", 1},
+	{"too-early", "2050-07-04", "2050-07-06", "2049-01-01", 1},
+}
+
+func TestCheckStay(t *testing.T) {
+	for _, e := range checkStayTests {
+		rules := RulesForRoom([]models.StayRule{summer}, 1, date(e.start))
+		problems := CheckStay(rules, date(e.start), date(e.end), date(e.today))
+		if len(problems) != e.problems {
+			t.Errorf("%s: expected %d problems, got %d: %v", e.name, e.problems, len(problems), problems)
+		}
+	}
+}
+
+var checkMoveTests = []struct {
+	name         string
+	start        string
+	end          string
+	keepsArrival bool
+	problems     int
+}{
+	// Staff may move a stay at any time before arrival, or after it
+	{"valid-move", "2050-07-04", "2050-07-06", false, 0},
+	{"end-before-start", "2050-07-06", "2050-07-04", false, 1},
+	{"too-short", "2050-07-04", "2050-07-05", false, 1},
+	{"closed-to-arrival", "2050-07-03", "2050-07-05", false, 1},
+	{"keeps-closed-arrival", "2050-07-03", "2050-07-05", true, 0},
+	{"closed-to-departure", "2050-07-04", "2050-07-09", true, 1},
+}
+
+func TestCheckMove(t *testing.T) {
+	for _, e := range checkMoveTests {
+		rules := RulesForRoom([]models.StayRule{summer}, 1, date(e.start))
+		problems := CheckMove(rules, date(e.start), date(e.end), e.keepsArrival)
+		if len(problems) != e.problems {
+			t.Errorf("%s: expected %d problems, got %d: %v", e.name, e.problems, len(problems), problems)
+		}
+	}
+}
+
+func TestRulesForRoom(t *testing.T) {
+	if len(RulesForRoom([]models.StayRule{summer}, 2, date("2050-07-04"))) != 0 {
+		t.Error("rule of room 1 applied to room 2")
+	}
+	if len(RulesForRoom([]models.StayRule{summer}, 1, date("2050-08-01"))) != 0 {
+		t.Error("rule applied outside of its date range")
+	}
+	if len(RulesForRoom([]models.StayRule{summer}, 1, date("2050-07-31"))) != 1 {
+		t.Error("rule not applied on the last day of its date range")
+	}
+}
+
+func TestWeekdays(t *testing.T) {
+	mask := WeekdayMask(time.Saturday, time.Sunday)
+	if Weekdays(mask) != "Sunday, Saturday" {
+		t.Errorf("unexpected weekdays %s", Weekdays(mask))
+	}
+	if ClosedOn(mask, time.Monday) {
+		t.Error("monday should not be closed")
+	}
+}
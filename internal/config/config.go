@@ -3,7 +3,9 @@ package config
 import (
 	"html/template"
 	"log"
+	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
 	"github.com/TranQuocToan1996/bookings/internal/models"
 	"github.com/alexedwards/scs/v2"
 )
@@ -17,4 +19,12 @@ type AppConfig struct {
 	InfoLog       *log.Logger
 	ErrorLog      *log.Logger
 	MailChan      chan models.MailData
+	// RetentionYears is how long reservations keep their personal data after the stay, 0 keeps it forever
+	RetentionYears int
+	// TrashDays is how long deleted reservations stay in the trash before they are purged, 0 keeps them forever
+	TrashDays int
+	// QueryTimeout bounds every database query but the reports, 0 uses the default of the repository
+	QueryTimeout time.Duration
+	// FieldKeys encrypts guest emails, phones and sent emails in the database, nil keeps them in plain text
+	FieldKeys *fieldcrypt.Keyring
 }
@@ -0,0 +1,434 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are what the application starts with. Each one is taken, in order of precedence, from its
+// command line flag, its environment variable, the settings file, or else its default.
+type Settings struct {
+	// Addr is the host:port the server listens on
+	Addr string
+	// ShutdownTimeout bounds the whole shutdown: draining the requests, then stopping the workers
+	ShutdownTimeout time.Duration
+	InProduction    bool
+	UseCache        bool
+	DB              DBSettings
+	Session         SessionSettings
+	Mail            MailSettings
+	// RetentionYears is how long reservations keep their personal data after the stay, 0 keeps it forever
+	RetentionYears int
+	// TrashDays is how long deleted reservations stay in the trash before they are purged, 0 keeps them forever
+	TrashDays int
+	// EncryptionKeys and BlindIndexKey encrypt guest emails, phones and the emails sent to them, see fieldcrypt.New
+	EncryptionKeys string
+	BlindIndexKey  string
+}
+
+// DBSettings are the settings of the database
+type DBSettings struct {
+	// Driver is postgres, sqlite, or memory to run without a database
+	Driver   string
+	Host     string
+	Port     int
+	Name     string
+	User     string
+	Password string
+	SSL      string
+	// File is the SQLite database file
+	File string
+	// Timeout bounds every query but the reports, 0 uses the default of the repository
+	Timeout time.Duration
+}
+
+// SessionSettings are the settings of the session cookie
+type SessionSettings struct {
+	Lifetime time.Duration
+	// Persist keeps the session after the browser is closed
+	Persist bool
+}
+
+// MailSettings are the settings of the SMTP server sending the emails
+type MailSettings struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// DefaultSettings are the settings of a development machine running Postgres and MailHog
+func DefaultSettings() Settings {
+	return Settings{
+		Addr:            ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		InProduction:    true,
+		UseCache:        true,
+		DB: DBSettings{
+			Driver: "postgres",
+			Host:   "localhost",
+			Port:   5432,
+			SSL:    "disable",
+			File:   "bookings.db",
+		},
+		Session: SessionSettings{
+			Lifetime: 24 * time.Hour,
+			Persist:  true,
+		},
+		Mail: MailSettings{
+			Host:    "localhost",
+			Port:    1025,
+			Timeout: 10 * time.Second,
+		},
+		TrashDays: 30,
+	}
+}
+
+// EnvPrefix starts the environment variables of the settings. The one of a setting is its key in
+// upper case, dots turned to underscores: BOOKINGS_DB_PASSWORD for db.password.
+const EnvPrefix = "BOOKINGS_"
+
+// setting is a setting of Settings: its key in the file, sections separated by a dot, its flag,
+// and the field holding it
+type setting struct {
+	key    string
+	flag   string
+	usage  string
+	secret bool
+	field  func(s *Settings) interface{}
+}
+
+// env is the environment variable of the setting
+func (st setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(st.key, ".", "_"))
+}
+
+// settings lists every setting, the flags keep the names they had before there was a settings file
+var settings = []setting{
+	{"addr", "addr", "Address the server listens on, host:port", false,
+		func(s *Settings) interface{} { return &s.Addr }},
+	{"shutdown_timeout", "shutdown-timeout", "Longest draining the requests, then stopping the background workers, may take on shutdown", false,
+		func(s *Settings) interface{} { return &s.ShutdownTimeout }},
+	{"production", "production", "Application is in production", false,
+		func(s *Settings) interface{} { return &s.InProduction }},
+	{"cache", "cache", "Save loading template in cache for reduce loading times", false,
+		func(s *Settings) interface{} { return &s.UseCache }},
+	{"db.driver", "dbdriver", "Database driver: postgres, sqlite, or memory to run without a database, losing every change on exit", false,
+		func(s *Settings) interface{} { return &s.DB.Driver }},
+	{"db.host", "dbhost", "Database host", false,
+		func(s *Settings) interface{} { return &s.DB.Host }},
+	{"db.port", "dbport", "Database port", false,
+		func(s *Settings) interface{} { return &s.DB.Port }},
+	{"db.name", "dbname", "Database name", false,
+		func(s *Settings) interface{} { return &s.DB.Name }},
+	{"db.user", "dbuser", "Database user", false,
+		func(s *Settings) interface{} { return &s.DB.User }},
+	{"db.password", "dbpass", "Database password, better given in the environment or the settings file", true,
+		func(s *Settings) interface{} { return &s.DB.Password }},
+	{"db.ssl", "dbssl", "Database SSL setting (disable, prefer, require)", false,
+		func(s *Settings) interface{} { return &s.DB.SSL }},
+	{"db.file", "dbfile", "SQLite database file, created when missing", false,
+		func(s *Settings) interface{} { return &s.DB.File }},
+	{"db.timeout", "db-timeout", "Longest a database query may run, reports excepted, 0 for the default", false,
+		func(s *Settings) interface{} { return &s.DB.Timeout }},
+	{"session.lifetime", "session-lifetime", "How long a session lasts", false,
+		func(s *Settings) interface{} { return &s.Session.Lifetime }},
+	{"session.persist", "session-persist", "Keep the session after the browser is closed", false,
+		func(s *Settings) interface{} { return &s.Session.Persist }},
+	{"mail.host", "mail-host", "SMTP server host", false,
+		func(s *Settings) interface{} { return &s.Mail.Host }},
+	{"mail.port", "mail-port", "SMTP server port", false,
+		func(s *Settings) interface{} { return &s.Mail.Port }},
+	{"mail.username", "mail-username", "SMTP user, none logs in", false,
+		func(s *Settings) interface{} { return &s.Mail.Username }},
+	{"mail.password", "mail-password", "SMTP password, better given in the environment or the settings file", true,
+		func(s *Settings) interface{} { return &s.Mail.Password }},
+	{"mail.timeout", "mail-timeout", "Longest connecting to the SMTP server or sending an email may take", false,
+		func(s *Settings) interface{} { return &s.Mail.Timeout }},
+	{"retention_years", "retention-years", "Anonymize reservations this many years after the stay, 0 never does", false,
+		func(s *Settings) interface{} { return &s.RetentionYears }},
+	{"trash_days", "trash-days", "Purge deleted reservations this many days after they were deleted, 0 never does", false,
+		func(s *Settings) interface{} { return &s.TrashDays }},
+	{"encryption_keys", "encryption-keys", "Keys encrypting guest emails, phones and sent emails, id:base64 separated by commas, the active key first", true,
+		func(s *Settings) interface{} { return &s.EncryptionKeys }},
+	{"blind_index_key", "blind-index-key", "Base64 key of the blind indexes looking up encrypted emails and phones", true,
+		func(s *Settings) interface{} { return &s.BlindIndexKey }},
+}
+
+// DeclareFlags declares on fs the flag of every setting, with its default
+func DeclareFlags(fs *flag.FlagSet) {
+	defaults := DefaultSettings()
+	for _, st := range settings {
+		usage := fmt.Sprintf("%s (%s)", st.usage, st.env())
+		switch v := st.field(&defaults).(type) {
+		case *string:
+			fs.StringVar(v, st.flag, *v, usage)
+		case *int:
+			fs.IntVar(v, st.flag, *v, usage)
+		case *bool:
+			fs.BoolVar(v, st.flag, *v, usage)
+		case *time.Duration:
+			fs.DurationVar(v, st.flag, *v, usage)
+		}
+	}
+}
+
+// LoadSettings returns the defaults overridden by the settings file path when it isn't empty, by the
+// environment variables found by lookupEnv, then by the flags set on fs, which DeclareFlags declared.
+// It doesn't validate them.
+func LoadSettings(path string, lookupEnv func(string) (string, bool), fs *flag.FlagSet) (Settings, error) {
+	s := DefaultSettings()
+
+	if path != "" {
+		err := s.loadFile(path)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	for _, st := range settings {
+		value, ok := lookupEnv(st.env())
+		if !ok {
+			continue
+		}
+		err := set(st.field(&s), value)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", st.env(), err)
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, st := range settings {
+			if st.flag == f.Name && err == nil {
+				err = set(st.field(&s), f.Value.String())
+				if err != nil {
+					err = fmt.Errorf("-%s: %w", f.Name, err)
+				}
+			}
+		}
+	})
+
+	return s, err
+}
+
+// loadFile sets the settings found in the YAML file path, sections being nested mappings
+func (s *Settings) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var tree map[string]interface{}
+	err = yaml.Unmarshal(data, &tree)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]interface{})
+	flatten("", tree, values)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		st, ok := settingByKey(key)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+
+		var text string
+		switch v := values[key].(type) {
+		case nil:
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("%s: %s must be a single value", path, key)
+		default:
+			text = fmt.Sprint(v)
+		}
+
+		err = set(st.field(s), text)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// flatten adds the values of tree to values under their dotted keys, prefixed by prefix
+func flatten(prefix string, tree map[string]interface{}, values map[string]interface{}) {
+	for key, value := range tree {
+		if section, ok := value.(map[string]interface{}); ok {
+			flatten(prefix+key+".", section, values)
+			continue
+		}
+		values[prefix+key] = value
+	}
+}
+
+// settingByKey returns the setting of a key of the file
+func settingByKey(key string) (setting, bool) {
+	for _, st := range settings {
+		if st.key == key {
+			return st, true
+		}
+	}
+	return setting{}, false
+}
+
+// set parses value into the field
+func set(field interface{}, value string) error {
+	var err error
+	switch v := field.(type) {
+	case *string:
+		*v = value
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *bool:
+		*v, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*v, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
+
+// Validate returns an error listing every setting that can't be used, nil when they all can
+func (s Settings) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	_, port, err := net.SplitHostPort(s.Addr)
+	if err != nil || !validPort(port) {
+		add("addr must be host:port, the host may be empty, got %q", s.Addr)
+	}
+	if s.ShutdownTimeout <= 0 {
+		add("shutdown_timeout must be positive")
+	}
+
+	switch s.DB.Driver {
+	case "postgres":
+		if s.DB.Name == "" {
+			add("db.name is required with the postgres driver")
+		}
+		if s.DB.User == "" {
+			add("db.user is required with the postgres driver")
+		}
+		if s.DB.Host == "" {
+			add("db.host is required with the postgres driver")
+		}
+		if s.DB.Port < 1 || s.DB.Port > 65535 {
+			add("db.port must be from 1 to 65535, got %d", s.DB.Port)
+		}
+		switch s.DB.SSL {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			add("db.ssl must be disable, allow, prefer, require, verify-ca or verify-full, got %q", s.DB.SSL)
+		}
+	case "sqlite":
+		if s.DB.File == "" {
+			add("db.file is required with the sqlite driver")
+		}
+	case "memory":
+	default:
+		add("db.driver must be postgres, sqlite or memory, got %q", s.DB.Driver)
+	}
+	if s.DB.Timeout < 0 {
+		add("db.timeout can't be negative")
+	}
+
+	if s.Session.Lifetime <= 0 {
+		add("session.lifetime must be positive")
+	}
+
+	if s.Mail.Host == "" {
+		add("mail.host is required")
+	}
+	if s.Mail.Port < 1 || s.Mail.Port > 65535 {
+		add("mail.port must be from 1 to 65535, got %d", s.Mail.Port)
+	}
+	if s.Mail.Password != "" && s.Mail.Username == "" {
+		add("mail.password is set without mail.username")
+	}
+	if s.Mail.Timeout <= 0 {
+		add("mail.timeout must be positive")
+	}
+
+	if s.RetentionYears < 0 {
+		add("retention_years can't be negative")
+	}
+	if s.TrashDays < 0 {
+		add("trash_days can't be negative")
+	}
+	// Without keys emails and phones are kept in plain text
+	if s.EncryptionKeys != "" || s.BlindIndexKey != "" {
+		_, err = fieldcrypt.New(s.EncryptionKeys, s.BlindIndexKey)
+		if err != nil {
+			add("encryption_keys and blind_index_key: %v", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// validPort reports whether port is a TCP port number
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
+
+// redacted stands for a secret that is set
+const redacted = "[redacted]"
+
+// Print writes every setting to w with its value, secrets being redacted, and the environment variable
+// and the flag setting it
+func (s Settings) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tENVIRONMENT\tFLAG")
+	for _, st := range settings {
+		value := get(st.field(&s))
+		if st.secret && value != `""` {
+			value = redacted
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t-%s\n", st.key, value, st.env(), st.flag)
+	}
+	return tw.Flush()
+}
+
+// get formats the value of the field, strings quoted so that an empty one shows
+func get(field interface{}) string {
+	switch v := field.(type) {
+	case *string:
+		return strconv.Quote(*v)
+	case *int:
+		return strconv.Itoa(*v)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *time.Duration:
+		return v.String()
+	}
+	return ""
+}
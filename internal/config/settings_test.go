@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a settings file in a temporary directory and returns its path
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bookings.yml")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// env is an environment holding the variables given
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// flags returns the flags of the settings parsed from args
+func flags(t *testing.T, args ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("bookings", flag.ContinueOnError)
+	DeclareFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLoadSettingsLayers(t *testing.T) {
+	path := writeFile(t, `
+addr: ":9000"
+cache: false
+db:
+  name: from_file
+  user: from_file
+  port: 6543
+  timeout: 5s
+mail:
+  host: smtp.example.com
+trash_days: 7
+`)
+
+	s, err := LoadSettings(path, env(map[string]string{
+		"BOOKINGS_DB_USER":     "from_env",
+		"BOOKINGS_DB_PASSWORD": "secret",
+		"BOOKINGS_TRASH_DAYS":  "14",
+	}), flags(t, "-dbuser=from_flag", "-production=false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"default", s.DB.Host, "localhost"},
+		{"default", s.Session.Lifetime, 24 * time.Hour},
+		{"file", s.Addr, ":9000"},
+		{"file", s.UseCache, false},
+		{"file", s.DB.Name, "from_file"},
+		{"file", s.DB.Port, 6543},
+		{"file", s.DB.Timeout, 5 * time.Second},
+		{"file", s.Mail.Host, "smtp.example.com"},
+		{"environment over file", s.TrashDays, 14},
+		{"environment", s.DB.Password, "secret"},
+		{"flag over environment", s.DB.User, "from_flag"},
+		{"flag", s.InProduction, false},
+	}
+	for _, e := range tests {
+		if e.got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, e.got)
+		}
+	}
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		expected string
+	}{
+		{"unknown key", "db:\n  nmae: bookings\n", nil, nil, "unknown setting db.nmae"},
+		{"file value", "db:\n  port: many\n", nil, nil, `db.port: invalid value "many"`},
+		{"list", "addr: [1, 2]\n", nil, nil, "addr must be a single value"},
+		{"environment value", "", map[string]string{"BOOKINGS_SESSION_LIFETIME": "a day"}, nil,
+			`BOOKINGS_SESSION_LIFETIME: invalid value "a day"`},
+	}
+	for _, e := range tests {
+		path := ""
+		if e.file != "" {
+			path = writeFile(t, e.file)
+		}
+		_, err := LoadSettings(path, env(e.env), flags(t, e.args...))
+		if err == nil || !strings.Contains(err.Error(), e.expected) {
+			t.Errorf("%s: expected an error with %q, got %v", e.name, e.expected, err)
+		}
+	}
+
+	_, err := LoadSettings(filepath.Join(t.TempDir(), "missing.yml"), env(nil), flags(t))
+	if err == nil {
+		t.Error("expected an error for a missing settings file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := DefaultSettings()
+	s.DB.Name, s.DB.User = "bookings", "postgres"
+	if err := s.Validate(); err != nil {
+		t.Fatalf("expected the defaults with a database to be valid, got %v", err)
+	}
+
+	s = DefaultSettings()
+	err := s.Validate()
+	if err == nil || !strings.Contains(err.Error(), "db.name is required") ||
+		!strings.Contains(err.Error(), "db.user is required") {
+		t.Errorf("expected the database name and user to be required, got %v", err)
+	}
+
+	s.DB.Driver = "memory"
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected no database setting required in memory, got %v", err)
+	}
+
+	s.Addr = "8080"
+	s.DB.Driver = "mysql"
+	s.Mail.Port = 0
+	s.Mail.Password = "secret"
+	s.TrashDays = -1
+	s.EncryptionKeys = "1:short"
+	err = s.Validate()
+	if err == nil {
+		t.Fatal("expected invalid settings")
+	}
+	for _, expected := range []string{"addr", "db.driver", "mail.port", "mail.password", "trash_days", "encryption_keys"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected a problem with %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	s := DefaultSettings()
+	s.DB.Name = "bookings"
+	s.DB.Password = "hunter2"
+	s.BlindIndexKey = "c2VjcmV0"
+
+	var out bytes.Buffer
+	err := s.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := out.String()
+	if strings.Contains(text, "hunter2") || strings.Contains(text, "c2VjcmV0") {
+		t.Errorf("secrets are printed:\n%s", text)
+	}
+	for _, expected := range []string{`"bookings"`, "BOOKINGS_DB_NAME", "-dbname", "db.password", redacted, "24h0m0s"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %s in:\n%s", expected, text)
+		}
+	}
+	// An empty secret shows it isn't set
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "mail.password") && !strings.Contains(line, `""`) {
+			t.Errorf("expected an empty mail password, got %s", line)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteTimeFormat is how times are written to SQLite, which has no type for them: the wall clock as
+// Postgres keeps it in a timestamp column, with a fixed width so that comparing the text compares the times.
+// Dates are written as YYYY-MM-DD.
+const SQLiteTimeFormat = "2006-01-02 15:04:05.000000"
+
+// sqlitePragmas turn on the foreign keys, wait for the lock rather than fail when another connection
+// writes, and let reads go on during a write. Transactions take the write lock as they begin, so that
+// one reading then writing can't be overtaken.
+const sqlitePragmas = "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+// sqliteDriver is the driver registered by modernc.org/sqlite, the functions registered for the
+// repository come with its connections
+var sqliteDriver = func() driver.Driver {
+	db, _ := sql.Open("sqlite", "")
+	defer db.Close()
+	return db.Driver()
+}()
+
+// NewSQLite opens the SQLite database of the file path, which is created when missing
+func NewSQLite(path string) (*sql.DB, error) {
+	db := sql.OpenDB(sqliteConnector{dsn: path + sqlitePragmas})
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ConnectSQLite creates database pool for SQLite
+func ConnectSQLite(path string) (*DB, error) {
+	d, err := NewSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writers wait for each other, readers don't
+	d.SetMaxOpenConns(maxOpenDbConn)
+	d.SetMaxIdleConns(maxIdleDbConn)
+
+	dbConn.SQL = d
+
+	return dbConn, nil
+}
+
+// sqliteConnector opens connections to a SQLite database writing times as SQLiteTimeFormat
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := sqliteDriver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn}, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return sqliteDriver
+}
+
+// sqliteConn is a connection of modernc.org/sqlite, it would write times in their String format
+type sqliteConn struct {
+	driver.Conn
+}
+
+// sqliteConnContext is what the connections of modernc.org/sqlite implement besides driver.Conn
+type sqliteConnContext interface {
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+// CheckNamedValue writes times as SQLiteTimeFormat and lets database/sql convert the other values
+func (c *sqliteConn) CheckNamedValue(v *driver.NamedValue) error {
+	if t, ok := v.Value.(time.Time); ok {
+		v.Value = t.Format(SQLiteTimeFormat)
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(sqliteConnContext).BeginTx(ctx, opts)
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(sqliteConnContext).PrepareContext(ctx, query)
+}
+
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(sqliteConnContext).ExecContext(ctx, query, args)
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(sqliteConnContext).QueryContext(ctx, query, args)
+}
+
+func (c *sqliteConn) Ping(ctx context.Context) error {
+	return c.Conn.(sqliteConnContext).Ping(ctx)
+}
@@ -0,0 +1,229 @@
+// Package fieldcrypt encrypts single database values with envelope encryption. Every value gets its own
+// random data key, which is stored with the value wrapped by a master key of the keyring, so rotating the
+// master key only re-wraps data keys. Blind indexes, keyed hashes of the plain values, let encrypted
+// values be looked up by equality.
+//
+// A nil *Keyring leaves values in plain text and indexes them as they are, and plain text values are
+// read back as they are, so a database can be encrypted row by row while in use.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix starts encrypted values, it never starts a plain email or phone
+const encryptedPrefix = "enc1:"
+
+// IndexPrefix starts the blind indexes made with a keyring, it never starts a plain email or phone
+const IndexPrefix = "idx1:"
+
+// KeySize is the size of master, data and index keys, AES-256
+const KeySize = 32
+
+// ErrNoKey is returned when a value is encrypted with a key that isn't in the keyring
+var ErrNoKey = errors.New("fieldcrypt: the value is encrypted with an unknown key")
+
+// Keyring holds the master keys, new values are encrypted with the active one and the others are kept to
+// read values not rotated yet
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+	index  []byte
+}
+
+// New parses a keyring from keys, "id:base64,id:base64" with the active key first, and indexKey, the
+// base64 key of the blind indexes. Every key is KeySize bytes.
+func New(keys, indexKey string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, entry := range strings.Split(keys, ",") {
+		entry = strings.TrimSpace(entry)
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("fieldcrypt: key %q is not id:base64", entry)
+		}
+		id := parts[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("fieldcrypt: key %s is given twice", id)
+		}
+
+		aead, err := newAEAD(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("fieldcrypt: key %s: %w", id, err)
+		}
+		k.keys[id] = aead
+		if k.active == "" {
+			k.active = id
+		}
+	}
+
+	var err error
+	k.index, err = decodeKey(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: index key: %w", err)
+	}
+
+	return k, nil
+}
+
+// NewKey returns a random key, base64 encoded as New takes it
+func NewKey() string {
+	return base64.StdEncoding.EncodeToString(random(KeySize))
+}
+
+// ActiveKey is the id of the key new values are encrypted with
+func (k *Keyring) ActiveKey() string {
+	if k == nil {
+		return ""
+	}
+	return k.active
+}
+
+// Encrypt encrypts plain with a new data key wrapped by the active key. Empty values stay empty.
+func (k *Keyring) Encrypt(plain string) (string, error) {
+	if k == nil || plain == "" {
+		return plain, nil
+	}
+
+	dataKey := random(KeySize)
+	aead, err := aeadFor(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped := seal(k.keys[k.active], dataKey)
+	sealed := seal(aead, []byte(plain))
+
+	return encryptedPrefix + k.active + ":" + encode(wrapped) + ":" + encode(sealed), nil
+}
+
+// Decrypt returns the plain text of an encrypted value, other values are returned as they are
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("fieldcrypt: malformed encrypted value")
+	}
+	if k == nil {
+		return "", ErrNoKey
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return "", ErrNoKey
+	}
+
+	wrapped, err := decode(parts[1])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := open(master, wrapped)
+	if err != nil {
+		return "", err
+	}
+	aead, err := aeadFor(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := decode(parts[2])
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// Index returns the blind index of a normalized value, the same value always gets the same index.
+// Without a keyring the value is its own index. Empty values have an empty index.
+func (k *Keyring) Index(normalized string) string {
+	if k == nil || normalized == "" {
+		return normalized
+	}
+
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(normalized))
+	return IndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Stale reports whether a value isn't encrypted with the active key, it is plain text or uses an old key
+func (k *Keyring) Stale(value string) bool {
+	if k == nil || value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+k.active+":")
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	b, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return aeadFor(b)
+}
+
+func decodeKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != KeySize {
+		return nil, fmt.Errorf("the key is %d bytes, not %d", len(b), KeySize)
+	}
+	return b, nil
+}
+
+func aeadFor(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with a random nonce put in front of the cipher text
+func seal(aead cipher.AEAD, plain []byte) []byte {
+	nonce := random(aead.NonceSize())
+	return aead.Seal(nonce, nonce, plain, nil)
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("fieldcrypt: encrypted value too short")
+	}
+	nonce, text := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, text, nil)
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on the supported platforms
+		panic(err)
+	}
+	return b
+}
+
+func encode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
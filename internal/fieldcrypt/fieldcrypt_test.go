@@ -0,0 +1,115 @@
+package fieldcrypt
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey   = NewKey()
+	newKey   = NewKey()
+	indexKey = NewKey()
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := New("2:"+newKey+",1:"+oldKey, indexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ActiveKey() != "2" {
+		t.Errorf("expected key 2 to be active, got %s", k.ActiveKey())
+	}
+
+	encrypted, err := k.Encrypt("john@smith.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "john") || !strings.HasPrefix(encrypted, "enc1:2:") {
+		t.Errorf("value isn't encrypted with key 2: %s", encrypted)
+	}
+
+	again, _ := k.Encrypt("john@smith.com")
+	if again == encrypted {
+		t.Error("the same value was encrypted twice the same way")
+	}
+
+	plain, err := k.Decrypt(encrypted)
+	if err != nil || plain != "john@smith.com" {
+		t.Errorf("expected john@smith.com, got %q, %v", plain, err)
+	}
+
+	if empty, _ := k.Encrypt(""); empty != "" {
+		t.Errorf("an empty value was encrypted: %s", empty)
+	}
+	if plain, err := k.Decrypt("0989123456"); err != nil || plain != "0989123456" {
+		t.Errorf("a plain text value wasn't read as it is: %q, %v", plain, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := New("1:"+oldKey, indexKey)
+	encrypted, _ := old.Encrypt("0989123456")
+
+	rotated, _ := New("2:"+newKey+",1:"+oldKey, indexKey)
+	if !rotated.Stale(encrypted) || rotated.Stale("") {
+		t.Error("a value of the old key isn't stale")
+	}
+	plain, err := rotated.Decrypt(encrypted)
+	if err != nil || plain != "0989123456" {
+		t.Fatalf("the new keyring can't read the old key: %q, %v", plain, err)
+	}
+
+	reencrypted, _ := rotated.Encrypt(plain)
+	if rotated.Stale(reencrypted) {
+		t.Error("a value of the active key is stale")
+	}
+
+	dropped, _ := New("2:"+newKey, indexKey)
+	if _, err := dropped.Decrypt(encrypted); err != ErrNoKey {
+		t.Errorf("expected ErrNoKey once the old key is dropped, got %v", err)
+	}
+
+	var none *Keyring
+	if _, err := none.Decrypt(encrypted); err != ErrNoKey {
+		t.Errorf("expected ErrNoKey without a keyring, got %v", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	k, _ := New("1:"+oldKey, indexKey)
+	other, _ := New("2:"+newKey, indexKey)
+
+	if k.Index("john@smith.com") != other.Index("john@smith.com") {
+		t.Error("the index depends on the master key")
+	}
+	if k.Index("john@smith.com") == k.Index("johnny@smith.com") {
+		t.Error("two values have the same index")
+	}
+	if strings.Contains(k.Index("john@smith.com"), "john") || k.Index("") != "" {
+		t.Errorf("unexpected index %s", k.Index("john@smith.com"))
+	}
+
+	var none *Keyring
+	if none.Index("john@smith.com") != "john@smith.com" {
+		t.Error("without a keyring a value should be its own index")
+	}
+}
+
+var newTests = []struct {
+	name     string
+	keys     string
+	indexKey string
+}{
+	{"missing-id", newKey, indexKey},
+	{"short-key", "1:c2hvcnQ=", indexKey},
+	{"same-id-twice", "1:" + newKey + ",1:" + oldKey, indexKey},
+	{"missing-index-key", "1:" + newKey, ""},
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, e := range newTests {
+		if _, err := New(e.keys, e.indexKey); err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
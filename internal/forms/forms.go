@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -54,6 +55,31 @@ func (f *Form) MinLength(field string, length int) bool {
 	return true
 }
 
+// IsNumber checks that field is a whole number from min to max, and returns it
+func (f *Form) IsNumber(field string, min, max int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(f.Get(field)))
+	if err != nil || n < min || n > max {
+		f.Errors.Add(field, fmt.Sprintf("Must be a whole number from %d to %d", min, max))
+		return 0
+	}
+	return n
+}
+
+// AreNumbers checks that every value of field, as posted by checkboxes, is a whole number from min to max,
+// and returns them
+func (f *Form) AreNumbers(field string, min, max int) []int {
+	var numbers []int
+	for _, value := range f.Values[field] {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < min || n > max {
+			f.Errors.Add(field, fmt.Sprintf("Must be whole numbers from %d to %d", min, max))
+			return nil
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
 // Check for valid email address
 func (f *Form) IsEmail(field string) {
 	if !govalidator.IsEmail(f.Get(field)) {
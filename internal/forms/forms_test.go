@@ -179,3 +179,39 @@ func TestForm_IsPhoneNumber(t *testing.T) {
 	}
 
 }
+
+func TestForm_IsNumber(t *testing.T) {
+	form := New(url.Values{"a": {"3"}, "b": {"9"}, "c": {"x"}})
+
+	if n := form.IsNumber("a", 0, 6); n != 3 || !form.Valid() {
+		t.Errorf("expected 3 and a valid form, got %d and %v", n, form.Errors)
+	}
+	form.IsNumber("b", 0, 6)
+	if form.Errors.Get("b") == "" {
+		t.Error("a number out of range is considered as valid")
+	}
+	form.IsNumber("c", 0, 6)
+	if form.Errors.Get("c") == "" {
+		t.Error("a word is considered as a number")
+	}
+	form.IsNumber("whateverfield", 0, 6)
+	if form.Errors.Get("whateverfield") == "" {
+		t.Error("a missing number is considered as valid")
+	}
+}
+
+func TestForm_AreNumbers(t *testing.T) {
+	form := New(url.Values{"days": {"0", "6"}, "bad": {"1", "9"}})
+
+	days := form.AreNumbers("days", 0, 6)
+	if len(days) != 2 || days[0] != 0 || days[1] != 6 || !form.Valid() {
+		t.Errorf("expected 0 and 6, got %v and %v", days, form.Errors)
+	}
+	if days := form.AreNumbers("whateverfield", 0, 6); len(days) != 0 || !form.Valid() {
+		t.Error("expected no number for a missing field")
+	}
+	form.AreNumbers("bad", 0, 6)
+	if form.Errors.Get("bad") == "" {
+		t.Error("a number out of range is considered as valid")
+	}
+}
@@ -0,0 +1,88 @@
+// Package guests matches reservations to the guests who made them
+package guests
+
+import (
+	"strings"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// Tags a guest can be given
+const (
+	TagVIP       = "vip"
+	TagBlacklist = "blacklist"
+)
+
+// Tags lists every tag, in the order they are shown
+var Tags = []string{TagVIP, TagBlacklist}
+
+// NormalizeEmail is the form emails are compared in
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone keeps the digits of a phone number only, and drops the 00 international prefix,
+// so "+84 989-123" and "0084989123" match
+func NormalizePhone(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+
+	return strings.TrimPrefix(digits, "00")
+}
+
+// HasTag reports whether g was given tag
+func HasTag(g models.Guest, tag string) bool {
+	for _, t := range g.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanTags keeps the known tags of tags, once each and in the order of Tags
+func CleanTags(tags []string) []string {
+	var clean []string
+	for _, known := range Tags {
+		for _, tag := range tags {
+			if tag == known {
+				clean = append(clean, known)
+				break
+			}
+		}
+	}
+	return clean
+}
+
+// Merge folds duplicate into keep: empty contact details are filled in, notes are put after each other
+// and tags are joined. Reservations are moved by the repository.
+func Merge(keep, duplicate models.Guest) models.Guest {
+	if keep.FirstName == "" {
+		keep.FirstName = duplicate.FirstName
+	}
+	if keep.LastName == "" {
+		keep.LastName = duplicate.LastName
+	}
+	if keep.Email == "" {
+		keep.Email = duplicate.Email
+	}
+	if keep.Phone == "" {
+		keep.Phone = duplicate.Phone
+	}
+
+	switch {
+	case duplicate.Notes == "" || duplicate.Notes == keep.Notes:
+	case keep.Notes == "":
+		keep.Notes = duplicate.Notes
+	default:
+		keep.Notes = keep.Notes + "\n" + duplicate.Notes
+	}
+
+	keep.Tags = CleanTags(append(append([]string{}, keep.Tags...), duplicate.Tags...))
+
+	return keep
+}
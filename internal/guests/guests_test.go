@@ -0,0 +1,62 @@
+package guests
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+func TestNormalize(t *testing.T) {
+	emails := map[string]string{
+		" John.Smith@Example.COM ": "john.smith@example.com",
+		"":                         "",
+	}
+	for email, expected := range emails {
+		if got := NormalizeEmail(email); got != expected {
+			t.Errorf("email %q: expected %q, got %q", email, expected, got)
+		}
+	}
+
+	phones := map[string]string{
+		"+84 989-123-456":  "84989123456",
+		"0084989123456":    "84989123456",
+		"(+84)989.123.456": "84989123456",
+		"0989 123 456":     "0989123456",
+		"n/a":              "",
+	}
+	for phone, expected := range phones {
+		if got := NormalizePhone(phone); got != expected {
+			t.Errorf("phone %q: expected %q, got %q", phone, expected, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	keep := models.Guest{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com", Notes: "Likes tea",
+		Tags: []string{TagBlacklist}}
+	duplicate := models.Guest{ID: 2, FirstName: "Johnny", Phone: "0989123456", Notes: "Late arrival",
+		Tags: []string{TagVIP, TagBlacklist, "unknown"}}
+
+	merged := Merge(keep, duplicate)
+
+	if merged.ID != 1 || merged.FirstName != "John" || merged.Email != "john@smith.com" {
+		t.Errorf("merge changed the details of the guest kept: %+v", merged)
+	}
+	if merged.Phone != "0989123456" {
+		t.Errorf("expected the missing phone from the duplicate, got %q", merged.Phone)
+	}
+	if merged.Notes != "Likes tea\nLate arrival" {
+		t.Errorf("unexpected notes %q", merged.Notes)
+	}
+	if !reflect.DeepEqual(merged.Tags, []string{TagVIP, TagBlacklist}) {
+		t.Errorf("unexpected tags %v", merged.Tags)
+	}
+	if !HasTag(merged, TagVIP) || HasTag(keep, TagVIP) {
+		t.Error("HasTag is wrong")
+	}
+
+	if again := Merge(merged, models.Guest{Notes: "Likes tea\nLate arrival"}); again.Notes != merged.Notes {
+		t.Errorf("same notes were repeated: %q", again.Notes)
+	}
+}
@@ -1,42 +1,88 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/assignment"
+	"github.com/TranQuocToan1996/bookings/internal/audit"
+	"github.com/TranQuocToan1996/bookings/internal/availability"
 	"github.com/TranQuocToan1996/bookings/internal/config"
 	"github.com/TranQuocToan1996/bookings/internal/driver"
 	"github.com/TranQuocToan1996/bookings/internal/forms"
+	"github.com/TranQuocToan1996/bookings/internal/guests"
 	"github.com/TranQuocToan1996/bookings/internal/helpers"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
+	"github.com/TranQuocToan1996/bookings/internal/privacy"
 	"github.com/TranQuocToan1996/bookings/internal/render"
+	"github.com/TranQuocToan1996/bookings/internal/reports"
 	"github.com/TranQuocToan1996/bookings/internal/repository"
 	"github.com/TranQuocToan1996/bookings/internal/repository/dbrepo"
 	"github.com/go-chi/chi"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Const variable layout for format time.Time
 const layout string = "2006-01-02"
 
+// orphanNights is the longest empty gap between two stays that the room assignment tries to close
+const orphanNights = 1
+
 // Repo the respository used by the handler
 var Repo *Repository
 
+// gridCacheTTL bounds how long an availability grid is served from the cache, changes made
+// through the application drop the cache at once
+const gridCacheTTL = 5 * time.Minute
+
+// gridCacheSize bounds how many availability grids are cached, the grid is served to anyone
+const gridCacheSize = 1000
+
 // Repository is the repository type
 type Repository struct {
-	App *config.AppConfig
-	DB  repository.DatabaseRepo
+	App  *config.AppConfig
+	DB   repository.DatabaseRepo
+	Grid *availability.GridCache
 }
 
 // NewRepo creates a new Repository
 func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	return newRepository(a, dbrepo.NewPostgresRepo(db.SQL, a))
+}
+
+// NewSQLiteRepo creates a new Repository on a SQLite database
+func NewSQLiteRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	return newRepository(a, dbrepo.NewSQLiteRepo(db.SQL, a))
+}
+
+// NewMemoryRepo creates a new Repository keeping its data in memory, for running the site without Postgres
+func NewMemoryRepo(a *config.AppConfig) *Repository {
+	return newRepository(a, dbrepo.NewMemoryRepo(a))
+}
+
+// newRepository creates a Repository on db, dropping the cached availability grids on every change
+func newRepository(a *config.AppConfig, db repository.DatabaseRepo) *Repository {
+	grid := availability.NewGridCache(gridCacheTTL, gridCacheSize)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
+		App:  a,
+		DB:   dbrepo.NewInvalidatingRepo(db, grid.Invalidate),
+		Grid: grid,
 	}
 }
 
@@ -78,13 +124,34 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get room struct by ID and saving into
-	room, err := m.DB.GetRoomByID(reservation.RoomID)
+	room, err := m.DB.GetRoomByID(r.Context(), reservation.RoomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't find rooms!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	reservation.Room.RoomName = room.RoomName
+	if !pricing.Fits(room, reservation.Adults, reservation.Children) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s sleeps at most %d guests!", room.RoomName, room.MaxOccupancy))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	reservation.Room = room
+	reservation.TotalPrice = pricing.Quote(room, reservation.StartDate, reservation.EndDate, reservation.Adults, reservation.Children)
+
+	// A guest logged in to its account books with the details of its profile
+	if id := m.App.Session.GetInt(r.Context(), "guest_account_id"); id > 0 && reservation.Email == "" {
+		account, err := m.DB.GetGuestAccountByID(r.Context(), id)
+		if err == nil {
+			reservation.GuestID = account.GuestID
+			reservation.FirstName = account.Guest.FirstName
+			reservation.LastName = account.Guest.LastName
+			reservation.Email = account.Guest.Email
+			reservation.Phone = account.Guest.Phone
+			if reservation.Email == "" {
+				reservation.Email = account.Email
+			}
+		}
+	}
 
 	// Update reservation into session (startDate, endDate, roomName, roomID) and this data will take in PostReservation
 	m.App.Session.Put(r.Context(), "reservation", reservation)
@@ -127,6 +194,12 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation.Phone = r.Form.Get("phone")
 	reservation.Email = r.Form.Get("email")
 
+	// The profile of the account logged in gets the booking only when it is made under one of its emails,
+	// other bookings go to the guest their details match
+	if reservation.GuestID > 0 && !m.accountBooking(r, reservation) {
+		reservation.GuestID = 0
+	}
+
 	form := forms.New(r.PostForm)
 
 	// Check input from post request
@@ -156,25 +229,54 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// after form validation, push data into database and get returned id
-	newReservationID, err := m.DB.InsertReservation(&reservation)
+	// Rules may have changed since the search, check them again before booking
+	problems, err := m.stayProblems(r.Context(), reservation.RoomID, reservation.StartDate, reservation.EndDate)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into the database!")
+		m.App.Session.Put(r.Context(), "error", "can't get stay rules from the database!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-
-	restriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1, // This id is for reservation
+	if len(problems) > 0 {
+		m.App.Session.Put(r.Context(), "error", availability.Explain(problems))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
 	}
 
-	err = m.DB.InsertRoomRestriction(&restriction)
+	// after form validation, push data into database, the reservation is kept only with its room restriction
+	reservation.ConfirmationCode = helpers.ConfirmationCode()
+	failure := ""
+	err = m.DB.Transaction(r.Context(), func(repo repository.DatabaseRepo) error {
+		newReservationID, err := repo.InsertReservation(r.Context(), &reservation)
+		if err != nil {
+			failure = "can't insert reservation into the database!"
+			return err
+		}
+
+		restriction := models.RoomRestriction{
+			StartDate:     reservation.StartDate,
+			EndDate:       reservation.EndDate,
+			RoomID:        reservation.RoomID,
+			ReservationID: newReservationID,
+			RestrictionID: 1, // This id is for reservation
+		}
+
+		err = repo.InsertRoomRestriction(r.Context(), &restriction)
+		if err != nil {
+			failure = "can't insert room restriction!"
+		}
+		return err
+	})
+	if errors.Is(err, repository.ErrOverlap) {
+		// Booked by someone else since the search
+		m.App.Session.Put(r.Context(), "error", "The room is no longer free on these dates, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction!")
+		if failure == "" {
+			failure = "can't save the reservation!"
+		}
+		m.App.Session.Put(r.Context(), "error", failure)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -183,10 +285,22 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	htmlMessageGuest := fmt.Sprintf(`
 		<strong>Reservation confirmation</strong><br>
 		Dear %s:, <br>
-		This is confirmed your reservation from %s to %s.
+		This is confirmed your reservation from %s to %s.<br>
+		Your confirmation code is <strong>%s</strong>.
 	`, reservation.FirstName,
 		reservation.StartDate.Format(layout),
-		reservation.EndDate.Format(layout))
+		reservation.EndDate.Format(layout),
+		reservation.ConfirmationCode)
+
+	// Offer an account to see the reservation online, the link claims the guest profile of the reservation
+	if !m.App.Session.Exists(r.Context(), "guest_account_id") {
+		claim := url.Values{}
+		claim.Set("email", reservation.Email)
+		claim.Set("code", reservation.ConfirmationCode)
+		htmlMessageGuest += fmt.Sprintf(`<br>
+		<a href="%s/account/register?%s">Create an account</a> to see your reservations and book again.
+	`, m.siteURL(r), template.HTMLEscapeString(claim.Encode()))
+	}
 
 	msg := models.MailData{
 		To:       reservation.Email,
@@ -195,7 +309,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		Content:  htmlMessageGuest,
 		Template: "basic.html",
 	}
-	m.App.MailChan <- msg
+	m.sendMail(r.Context(), msg)
 
 	// Send notifications - first to Owner rooms
 	htmlMessageOwner := fmt.Sprintf(`
@@ -213,7 +327,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		Content:  htmlMessageOwner,
 		Template: "basic.html",
 	}
-	m.App.MailChan <- msg
+	m.sendMail(r.Context(), msg)
 
 	// Update reservation into session
 	// Write Reservation info into session, we will add logic to added this info into reservation-summary.page.html
@@ -282,38 +396,213 @@ func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.html", &models.TemplateData{})
-}
+	start, end, err := dateRange(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		start, end = currentMonth()
+	}
 
-// AdminNewReservations shows all new reservations in admin dashboard
-func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+	arrivals, err := m.DB.ArrivalsOn(r.Context(), today())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	departures, err := m.DB.DeparturesOn(r.Context(), today())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	feed, err := m.dashboardFeed(r.Context(), start, end)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["arrivals"] = arrivals
+	data["departures"] = departures
+	data["stats"] = feed
 
-	render.Template(w, r, "admin-new-reservations.page.html", &models.TemplateData{
-		Data: data,
+	stringMap := make(map[string]string)
+	stringMap["start"] = start.Format(layout)
+	stringMap["end"] = end.Format(layout)
+
+	render.Template(w, r, "admin-dashboard.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
 	})
 }
 
-// AdminAllReservations shows all reservations in admin dashboard
+// AdminNewReservations shows the new reservations in admin dashboard, a page at a time
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	m.reservationList(w, r, "new", "admin-new-reservations.page.html")
+}
+
+// AdminAllReservations shows all reservations in admin dashboard, a page at a time
 func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	m.reservationList(w, r, "all", "admin-all-reservations.page.html")
+}
+
+// Page sizes of the admin reservation lists
+const (
+	reservationsPerPage    = 20
+	maxReservationsPerPage = 100
+)
+
+// reservationPage is a page of an admin reservation list with the links to move around it
+type reservationPage struct {
+	Src          string // "new" or "all", for the links to the reservations
+	Filter       models.ReservationFilter
+	Reservations []models.Reservation
+	Total        int
+	From         int // Position of the first reservation of the page, 0 when it is empty
+	To           int
+	Pages        []pageLink
+	PrevURL      string
+	NextURL      string
+	SortURLs     map[string]string // Column to the URL sorting on it, the current column flips direction
+}
+
+// pageLink is a link to a page of a list
+type pageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// reservationFilter reads the filters, sort and page of a reservation list from the query string,
+// values that can't be read are left out
+func reservationFilter(r *http.Request) models.ReservationFilter {
+	q := r.URL.Query()
+	f := models.ReservationFilter{
+		Query:   strings.TrimSpace(q.Get("q")),
+		Sort:    "start_date",
+		Desc:    q.Get("dir") == "desc",
+		Page:    1,
+		PerPage: reservationsPerPage,
+	}
+
+	f.RoomID, _ = strconv.Atoi(q.Get("room"))
+	f.Start, _ = time.Parse(layout, q.Get("start"))
+	f.End, _ = time.Parse(layout, q.Get("end"))
+
+	if status := q.Get("status"); status == "new" || status == "processed" {
+		f.Status = status
+	}
+	for _, column := range repository.ReservationSorts {
+		if q.Get("sort") == column {
+			f.Sort = column
+		}
+	}
+	if page, err := strconv.Atoi(q.Get("page")); err == nil && page > 0 {
+		f.Page = page
+	}
+	if perPage, err := strconv.Atoi(q.Get("per_page")); err == nil && perPage > 0 && perPage <= maxReservationsPerPage {
+		f.PerPage = perPage
+	}
+
+	return f
+}
+
+// listURL is the current list URL with some query values changed, other filters are kept
+func listURL(r *http.Request, changes map[string]string) string {
+	q := r.URL.Query()
+	for key, value := range changes {
+		if value == "" {
+			q.Del(key)
+		} else {
+			q.Set(key, value)
+		}
+	}
+	if len(q) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// pageLinks returns the links to the pages of a list around the current one, and to the previous and next pages
+func pageLinks(r *http.Request, page, perPage, total int) ([]pageLink, string, string) {
+	var links []pageLink
+	var prev, next string
+
+	pages := (total + perPage - 1) / perPage
+	for n := page - 2; n <= page+2; n++ {
+		if n >= 1 && n <= pages {
+			links = append(links, pageLink{
+				Number:  n,
+				URL:     listURL(r, map[string]string{"page": strconv.Itoa(n)}),
+				Current: n == page,
+			})
+		}
+	}
+	if page > 1 && page <= pages {
+		prev = listURL(r, map[string]string{"page": strconv.Itoa(page - 1)})
+	}
+	if page < pages {
+		next = listURL(r, map[string]string{"page": strconv.Itoa(page + 1)})
+	}
+
+	return links, prev, next
+}
+
+// reservationList renders a page of reservations, src "new" only lists the reservations not processed yet
+func (m *Repository) reservationList(w http.ResponseWriter, r *http.Request, src, page string) {
+	f := reservationFilter(r)
+	if src == "new" {
+		f.Status = "new"
+	}
+
+	reservations, total, err := m.DB.FindReservations(r.Context(), f)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
+	list := reservationPage{
+		Src:          src,
+		Filter:       f,
+		Reservations: reservations,
+		Total:        total,
+		SortURLs:     make(map[string]string),
+	}
+	if len(reservations) > 0 {
+		list.From = (f.Page-1)*f.PerPage + 1
+		list.To = list.From + len(reservations) - 1
+	}
+
+	// A new sort or filter starts again from the first page
+	list.Pages, list.PrevURL, list.NextURL = pageLinks(r, f.Page, f.PerPage, total)
+	for _, column := range repository.ReservationSorts {
+		dir := "asc"
+		if column == f.Sort && !f.Desc {
+			dir = "desc"
+		}
+		list.SortURLs[column] = listURL(r, map[string]string{"sort": column, "dir": dir, "page": ""})
+	}
+
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["list"] = list
+	data["rooms"] = rooms
 
-	render.Template(w, r, "admin-all-reservations.page.html", &models.TemplateData{
-		Data: data,
+	stringMap := make(map[string]string)
+	if !f.Start.IsZero() {
+		stringMap["start"] = f.Start.Format(layout)
+	}
+	if !f.End.IsZero() {
+		stringMap["end"] = f.End.Format(layout)
+	}
+
+	render.Template(w, r, page, &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
 	})
 }
 
@@ -330,9 +619,9 @@ func (m *Repository) AdminShowReservations(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Get the reservation from the database
-	res, err := m.DB.GetReservationByID(id)
+	res, err := m.DB.GetReservationByID(r.Context(), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		lookupError(w, err)
 		return
 	}
 
@@ -346,6 +635,31 @@ func (m *Repository) AdminShowReservations(w http.ResponseWriter, r *http.Reques
 	data := make(map[string]interface{})
 	data["reservation"] = res
 
+	if res.GuestID > 0 {
+		guest, err := m.DB.GetGuestByID(r.Context(), res.GuestID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["guest"] = guest
+	}
+
+	entries, _, err := m.DB.AuditLog(r.Context(), models.AuditFilter{
+		Entity:   audit.EntityReservation,
+		EntityID: id,
+		Page:     1,
+		PerPage:  maxAuditPerPage,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data["history"], err = auditRows(entries)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	render.Template(w, r, "admin-reservations-show.page.html", &models.TemplateData{
 		StringMap: stringMap,
 		Data:      data,
@@ -388,7 +702,7 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
 	if err != nil {
 		log.Println(err)
 
@@ -430,17 +744,99 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	adults, children, err := parseParty(r.Form.Get("adults"), r.Form.Get("children"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	flexDays, err := parseFlex(r.Form.Get("flex"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	// Dates that can never be booked, whatever the room
+	if problems := availability.CheckStay(nil, startDate, endDate, today()); len(problems) > 0 {
+		m.App.Session.Put(r.Context(), "error", availability.Explain(problems))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	freeRooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate, adults+children)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	// If no room available, redirect and popup notie "no available room"
-	if len(rooms) == 0 {
-		m.App.Session.Put(r.Context(), "error", "No availability room!")
-		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+	rules, err := m.DB.GetStayRulesByDate(r.Context(), startDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get stay rules for rooms")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// Drop the free rooms whose stay rules block these dates, and remember why, one sentence a room
+	var rooms []models.Room
+	var problems []string
+	for _, room := range freeRooms {
+		roomProblems := availability.CheckStay(availability.RulesForRoom(rules, room.ID, startDate), startDate, endDate, today())
+		if len(roomProblems) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", room.RoomName, availability.Explain(roomProblems)))
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+
+	// A flexible search, or no room on the exact dates: look for the closest free dates
+	if flexDays > 0 || len(rooms) == 0 {
+		lookAround := flexDays
+		if lookAround == 0 {
+			lookAround = suggestDays
+		}
+
+		windows, err := m.nearestWindows(r.Context(), startDate, endDate, adults, children, lookAround)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// If no room available, redirect and popup notie "no available room"
+		if len(windows) == 0 {
+			if len(problems) > 0 {
+				m.App.Session.Put(r.Context(), "error", strings.Join(problems, ". "))
+			} else {
+				m.App.Session.Put(r.Context(), "error", "No availability room!")
+			}
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+
+		stringMap := make(map[string]string)
+		stringMap["start"] = startDate.Format(layout)
+		stringMap["end"] = endDate.Format(layout)
+		stringMap["adults"] = strconv.Itoa(adults)
+		stringMap["children"] = strconv.Itoa(children)
+		stringMap["flex"] = strconv.Itoa(flexDays)
+		if len(rooms) == 0 {
+			message := "No room is free on those dates, these are the closest free dates."
+			if len(problems) > 0 {
+				message = strings.Join(problems, ". ") + ". " + message
+			}
+			stringMap["message"] = message
+		}
+
+		data := make(map[string]interface{})
+		data["windows"] = windows
+
+		render.Template(w, r, "search-availability.page.html", &models.TemplateData{
+			StringMap: stringMap,
+			Data:      data,
+		})
 		return
 	}
 
@@ -448,15 +844,24 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]interface{})
 	data["rooms"] = rooms
 
+	// Nightly price of every room for this party
+	prices := make(map[string]string)
+	for _, room := range rooms {
+		prices[strconv.Itoa(room.ID)] = pricing.Format(pricing.NightlyPrice(room, adults, children))
+	}
+
 	// Store date into session
 	res := models.Reservation{
 		StartDate: startDate,
 		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
 	}
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	render.Template(w, r, "choose-room.page.html", &models.TemplateData{
-		Data: data,
+		Data:      data,
+		StringMap: prices,
 	})
 
 	/* 	Old code
@@ -464,12 +869,127 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 	//w.Write([]byte(fmt.Sprintf("Start date is %s and End date is %s", startDate, endDate))) */
 }
 
+// accountBooking reports whether a reservation is booked by the guest account logged in for its own
+// profile, under the email of the account or of the profile
+func (m *Repository) accountBooking(r *http.Request, reservation models.Reservation) bool {
+	account, err := m.DB.GetGuestAccountByID(r.Context(), m.App.Session.GetInt(r.Context(), "guest_account_id"))
+	if err != nil || account.GuestID != reservation.GuestID {
+		return false
+	}
+
+	email := guests.NormalizeEmail(reservation.Email)
+	return email == guests.NormalizeEmail(account.Email) || email == guests.NormalizeEmail(account.Guest.Email)
+}
+
+// today returns the current date at midnight UTC, the way dates are parsed from forms
+func today() time.Time {
+	year, month, day := time.Now().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// stayProblems explains which stay rules of the room block a stay from start to end
+func (m *Repository) stayProblems(ctx context.Context, roomID int, start, end time.Time) ([]string, error) {
+	rules, err := m.DB.GetStayRulesByDate(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+
+	return availability.CheckStay(availability.RulesForRoom(rules, roomID, start), start, end, today()), nil
+}
+
+// moveProblems explains which stay rules of the room block staff moving a stay to start and end,
+// arrival is the day the guest arrives now
+func (m *Repository) moveProblems(ctx context.Context, roomID int, start, end, arrival time.Time) ([]string, error) {
+	rules, err := m.DB.GetStayRulesByDate(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+
+	return availability.CheckMove(availability.RulesForRoom(rules, roomID, start), start, end, start.Equal(arrival)), nil
+}
+
+// Flexible searches look at most maxFlexDays around the dates, a search on exact dates that finds
+// nothing suggests the free dates up to suggestDays around them, windowsPerRoom per room
+const (
+	maxFlexDays    = 14
+	suggestDays    = 7
+	windowsPerRoom = 3
+)
+
+// parseFlex reads the number of days a search may move the dates, an empty value means exact dates
+func parseFlex(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	flexDays, err := strconv.Atoi(value)
+	if err != nil || flexDays < 0 || flexDays > maxFlexDays {
+		return 0, fmt.Errorf("flexibility must be between 0 and %d days", maxFlexDays)
+	}
+	return flexDays, nil
+}
+
+// nearestWindows finds the free stays closest to the dates in the rooms the party fits in
+func (m *Repository) nearestWindows(ctx context.Context, start, end time.Time, adults, children, flexDays int) ([]availability.Window, error) {
+	allRooms, err := m.DB.AllRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []models.Room
+	for _, room := range allRooms {
+		if pricing.Fits(room, adults, children) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	restrictions, err := m.DB.GetRestrictionsByDate(ctx, start.AddDate(0, 0, -flexDays), end.AddDate(0, 0, flexDays))
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := m.DB.AllStayRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return availability.NearestWindows(rooms, restrictions, rules, start, end, flexDays, windowsPerRoom, today()), nil
+}
+
+// parseParty reads the number of adults and children of a search, an empty value means 1 adult and no child
+func parseParty(adultsValue, childrenValue string) (int, int, error) {
+	adults, children := 1, 0
+	var err error
+
+	if adultsValue != "" {
+		adults, err = strconv.Atoi(adultsValue)
+		if err != nil || adults < 1 {
+			return 0, 0, errors.New("at least one adult is required")
+		}
+	}
+	if childrenValue != "" {
+		children, err = strconv.Atoi(childrenValue)
+		if err != nil || children < 0 {
+			return 0, 0, errors.New("invalid number of children")
+		}
+	}
+
+	return adults, children, nil
+}
+
 type jsonResponse struct {
 	// The member name must be captalize because JSON (un)marshaller uses reflection, it cannot read or write unexported fields
 	// `` what the field will be recognized in json/xml
-	OK        bool   `json:"ok"`
-	Message   string `json:"message"`
-	RoomID    string `json:"room_id"`
+	OK           bool         `json:"ok"`
+	Message      string       `json:"message"`
+	RoomID       string       `json:"room_id"`
+	StartDate    string       `json:"start_date"`
+	EndDate      string       `json:"end_date"`
+	Alternatives []jsonWindow `json:"alternatives,omitempty"` // Closest free dates when the room isn't available
+}
+
+// jsonWindow is a free stay suggested instead of the dates asked for
+type jsonWindow struct {
 	StartDate string `json:"start_date"`
 	EndDate   string `json:"end_date"`
 }
@@ -524,7 +1044,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		w.Write(out)
 		return
 	}
-	available, err := m.DB.SearchAvailabilityByRoomID(startDate, endDate, roomID)
+	available, err := m.DB.SearchAvailabilityByRoomID(r.Context(), startDate, endDate, roomID)
 	if err != nil {
 		resp := jsonResponse{
 			OK:      false,
@@ -536,14 +1056,57 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := ""
+	if available {
+		problems, err := m.stayProblems(r.Context(), roomID, startDate, endDate)
+		if err != nil {
+			resp := jsonResponse{
+				OK:      false,
+				Message: "Connecting to database error!",
+			}
+			out, _ := json.MarshalIndent(resp, "", "    ")
+			w.Header().Set("Content-type", "application/json")
+			w.Write(out)
+			return
+		}
+		if len(problems) > 0 {
+			available = false
+			message = availability.Explain(problems)
+		}
+	}
+
 	// Create response json to client
 	resp := jsonResponse{
 		OK:        available,
-		Message:   "",
+		Message:   message,
 		StartDate: r.Form.Get("start"),
 		EndDate:   r.Form.Get("end"),
 		RoomID:    strconv.Itoa(roomID),
 	}
+
+	// Suggest the closest free dates of this room, "flex" days around the dates asked for
+	if !available {
+		flexDays, err := parseFlex(r.Form.Get("flex"))
+		if err != nil || flexDays == 0 {
+			flexDays = suggestDays
+		}
+		adults, children, err := parseParty(r.Form.Get("adults"), r.Form.Get("children"))
+		if err != nil {
+			adults, children = 1, 0
+		}
+
+		windows, err := m.nearestWindows(r.Context(), startDate, endDate, adults, children, flexDays)
+		if err == nil {
+			for _, window := range windows {
+				if window.Room.ID == roomID && window.Shift != 0 {
+					resp.Alternatives = append(resp.Alternatives, jsonWindow{
+						StartDate: window.StartDate.Format(layout),
+						EndDate:   window.EndDate.Format(layout),
+					})
+				}
+			}
+		}
+	}
 	json, _ := json.MarshalIndent(resp, "", "    ") // No error here because the resp json is constructed manually
 
 	// Send json back to client browser (general.page.html check fetch function)
@@ -611,17 +1174,37 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	room, err := m.DB.GetRoomByID(roomID)
+	adults, children, err := parseParty(r.URL.Query().Get("a"), r.URL.Query().Get("c"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Error when querying room id from database!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	problems, err := m.stayProblems(r.Context(), roomID, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Error when querying stay rules from database!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if len(problems) > 0 {
+		m.App.Session.Put(r.Context(), "error", availability.Explain(problems))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
 	var res models.Reservation
 	res.RoomID = roomID
 	res.StartDate = startDate
 	res.EndDate = endDate
+	res.Adults = adults
+	res.Children = children
 	res.Room.RoomName = room.RoomName
 
 	// Put res into session
@@ -654,9 +1237,16 @@ func (m *Repository) AdminPostShowReservations(w http.ResponseWriter, r *http.Re
 	stringMap["src"] = src
 
 	// Get the reservation from the database
-	res, err := m.DB.GetReservationByID(id)
+	res, err := m.DB.GetReservationByID(r.Context(), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		lookupError(w, err)
+		return
+	}
+
+	// A reservation in the trash is shown as it was deleted, it can only be restored
+	if !res.DeletedAt.IsZero() {
+		m.App.Session.Put(r.Context(), "error", "This reservation is in the trash, restore it before changing it")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
 		return
 	}
 
@@ -665,9 +1255,11 @@ func (m *Repository) AdminPostShowReservations(w http.ResponseWriter, r *http.Re
 	res.LastName = r.Form.Get("last_name")
 	res.Email = r.Form.Get("email")
 	res.Phone = r.Form.Get("phone")
-	err = m.DB.UpdateReservation(res)
+	res.RoomLocked = r.Form.Get("room_locked") == "1"
+	res.Notes = strings.TrimSpace(r.Form.Get("notes"))
+	err = m.DB.UpdateReservation(r.Context(), m.actor(r), res)
 	if err != nil {
-		helpers.ServerError(w, err)
+		lookupError(w, err)
 		return
 	}
 
@@ -691,9 +1283,9 @@ func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Requ
 
 	src := chi.URLParam(r, "src")
 
-	err := m.DB.UpdateProcessedForReservation(id, 1) // 1 is already processed status for a reservation
+	err := m.DB.UpdateProcessedForReservation(r.Context(), m.actor(r), id, 1) // 1 is already processed status for a reservation
 	if err != nil {
-		helpers.ServerError(w, err)
+		lookupError(w, err)
 		return
 	}
 
@@ -717,17 +1309,17 @@ func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Reque
 
 	src := chi.URLParam(r, "src")
 
-	err := m.DB.DeleteReservation(id)
+	err := m.DB.DeleteReservation(r.Context(), m.actor(r), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		lookupError(w, err)
 		return
 	}
 
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
 
-	// Inform "Reservation marked as processed" to user and redirect to source page
-	m.App.Session.Put(r.Context(), "flash", "Reservation delete")
+	// Inform the reservation is in the trash and redirect to source page
+	m.App.Session.Put(r.Context(), "flash", "Reservation moved to the trash")
 
 	if year == "" {
 		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
@@ -736,66 +1328,183 @@ func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-// AdminPostReservationsCalendar handles post of reservation calendar
+// AdminTrash shows the deleted reservations that can still be restored
+func (m *Repository) AdminTrash(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.TrashedReservations(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	intMap := make(map[string]int)
+	intMap["trash_days"] = m.App.TrashDays
+
+	render.Template(w, r, "admin-trash.page.html", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminRestoreReservation takes a reservation out of the trash, unless its room was booked or
+// blocked on its dates in the meantime
+func (m *Repository) AdminRestoreReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.RestoreReservation(r.Context(), m.actor(r), id)
+	if errors.Is(err, repository.ErrOverlap) {
+		m.App.Session.Put(r.Context(), "error", "The room is no longer free on these dates, the reservation stays in the trash")
+		http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "This reservation is not in the trash")
+		http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d/show", id), http.StatusSeeOther)
+}
+
+// calendarConflict is shown when the calendar changed between the page load and the save
+const calendarConflict = "The calendar was changed by someone else since you opened it, nothing was saved. Please check the calendar and try again."
+
+// AdminPostReservationsCalendar applies the block changes posted by the reservation calendar.
+// The form lists the blocks to remove by id (remove_block) and the nights to block as "roomID_date"
+// (add_block), together with the version of the month it was rendered from. Nothing is saved when
+// the month changed in the meantime or when an operation doesn't match the current restrictions.
 func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
-	form := forms.New(r.PostForm)
 
 	// Get hidden filed y and m in calendar page
-	year, _ := strconv.Atoi(r.Form.Get("y"))
-	month, _ := strconv.Atoi(r.Form.Get("m"))
+	year, errYear := strconv.Atoi(r.Form.Get("y"))
+	month, errMonth := strconv.Atoi(r.Form.Get("m"))
+	if errYear != nil || errMonth != nil || month < 1 || month > 12 {
+		m.App.Session.Put(r.Context(), "error", "Invalid calendar month, nothing was saved")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+	calendarURL := fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%02d", year, month)
 
-	rooms, err := m.DB.AllRooms()
+	firstOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	firstOfNextMonth := firstOfMonth.AddDate(0, 1, 0)
+
+	current, err := m.DB.GetRestrictionsByDate(r.Context(), firstOfMonth, firstOfNextMonth)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	// Process unblocking in calendar page
-	for _, room := range rooms {
-		// Get the blockMap from the session (From AdminReservationsCalendar handler)
-		/* Loop through the blockMap, if we have an entry in the map that does not exist in our posted data, and if the restriction id > 0, then it is a block we need to remove */
-		currentMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", room.ID)).(map[string]int)
-		for name := range currentMap {
-			// check whether name in th blockMap
-			if val, ok := currentMap[name]; ok {
-				// Pay attention only to value > 0 and not in the form post (Uncheck)
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", room.ID, name)) {
-						// delete restriction by id
-						err := m.DB.DeleteBlockByID(val)
-						if err != nil {
-							log.Println(err)
-						}
-						log.Println("delete block successful the:", name)
-					}
-				}
+	if r.Form.Get("version") != calendarVersion(current) {
+		m.App.Session.Put(r.Context(), "error", calendarConflict)
+		http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+		return
+	}
+
+	// The blocks that can be removed and the nights already taken in every room
+	blocks := make(map[int]bool)
+	taken := make(map[int]map[string]bool)
+	for _, restriction := range current {
+		if restriction.ReservationID == 0 {
+			blocks[restriction.ID] = true
+		}
+		if taken[restriction.RoomID] == nil {
+			taken[restriction.RoomID] = make(map[string]bool)
+		}
+		for d := restriction.StartDate; d.Before(restriction.EndDate); d = d.AddDate(0, 0, 1) {
+			taken[restriction.RoomID][d.Format(layout)] = true
+		}
+	}
+
+	var removals []int
+	for _, value := range r.Form["remove_block"] {
+		id, err := strconv.Atoi(value)
+		if err != nil || !blocks[id] {
+			m.App.Session.Put(r.Context(), "error", calendarConflict)
+			http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+			return
+		}
+		removals = append(removals, id)
+		delete(blocks, id)
+	}
+
+	nights := make(map[int][]time.Time)
+	for _, value := range r.Form["add_block"] {
+		exploded := strings.SplitN(value, "_", 2)
+		if len(exploded) != 2 {
+			m.App.Session.Put(r.Context(), "error", calendarConflict)
+			http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+			return
+		}
+		roomID, err := strconv.Atoi(exploded[0])
+		night, errNight := time.Parse(layout, exploded[1])
+		if err != nil || errNight != nil || night.Before(firstOfMonth) || !night.Before(firstOfNextMonth) ||
+			taken[roomID][night.Format(layout)] {
+			m.App.Session.Put(r.Context(), "error", calendarConflict)
+			http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+			return
+		}
+		nights[roomID] = append(nights[roomID], night)
+	}
+
+	// The changes are saved all together or not at all
+	err = m.DB.Transaction(r.Context(), func(repo repository.DatabaseRepo) error {
+		for _, id := range removals {
+			err := repo.DeleteBlockByID(r.Context(), m.actor(r), id)
+			if err != nil {
+				return err
 			}
 		}
 
-		// Process new blocking
-		for name := range r.PostForm {
-			if strings.HasPrefix(name, "add_block") {
-				exploded := strings.Split(name, "_")
-				roomID, _ := strconv.Atoi(exploded[2])
-				startDate, _ := time.Parse("2006-01-2", exploded[3])
-				// Inserts a new block
-				err := m.DB.InsertBlockForRoom(roomID, startDate)
+		// The nights ticked for a room become as few blocks as possible
+		for roomID, days := range nights {
+			for _, block := range availability.BlocksFromNights(roomID, days) {
+				err := repo.InsertBlockForRoom(r.Context(), m.actor(r), block)
 				if err != nil {
-					log.Println(err)
+					return err
 				}
-				log.Println("insert block complete the startdate:", startDate)
-
 			}
 		}
+		return nil
+	})
+	if errors.Is(err, repository.ErrOverlap) {
+		// Booked by someone else between the version check and the save
+		m.App.Session.Put(r.Context(), "error", calendarConflict)
+		http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
 
 	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+}
+
+// calendarVersion fingerprints the restrictions of a calendar month, any added, removed, moved
+// or resized reservation or block gives another version
+func calendarVersion(restrictions []models.RoomRestriction) string {
+	lines := make([]string, 0, len(restrictions))
+	for _, r := range restrictions {
+		lines = append(lines, fmt.Sprintf("%d:%d:%d:%d:%s:%s", r.ID, r.RoomID, r.ReservationID, r.RestrictionID,
+			r.StartDate.Format(layout), r.EndDate.Format(layout)))
+	}
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
 }
 
 // AdminReservationsCalendar displays the reservation calendar
@@ -842,14 +1551,13 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 
 	// Get the first and last day of the month and passing into templates
 	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, time.UTC)
 	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
 	intMap := make(map[string]int)
 	intMap["days_in_month"] = lastOfMonth.Day()
 
 	// Get rooms from database
-	rooms, err := m.DB.AllRooms()
+	rooms, err := m.DB.AllRooms(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -859,36 +1567,36 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 	for _, room := range rooms {
 		// create maps
 		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
-
-		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
 
 		// get all the restrictions for the current room
-		restrictions, err := m.DB.GetRestrictionsForRoomByDate(room.ID, firstOfMonth, lastOfMonth)
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), room.ID, firstOfMonth, lastOfMonth.AddDate(0, 0, 1))
 		if err != nil {
 			helpers.ServerError(w, err)
 			return
 		}
 
+		var blocks []models.RoomRestriction
 		for _, restriction := range restrictions {
 			if restriction.ReservationID > 0 {
 				// it's a reservation
 				for d := restriction.StartDate; !d.After(restriction.EndDate); d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = restriction.ReservationID
+					reservationMap[d.Format(layout)] = restriction.ReservationID
 				}
 			} else {
 				// it's a block
-				blockMap[restriction.StartDate.Format("2006-01-2")] = restriction.ID
+				blocks = append(blocks, restriction)
 			}
 		}
-		data[fmt.Sprintf("reservation_map_%d", room.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", room.ID)] = blockMap
+		data[fmt.Sprintf("days_%d", room.ID)] = calendarDays(firstOfMonth, lastOfMonth, reservationMap, blocks)
+	}
 
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", room.ID), blockMap)
+	// The save is refused when the month changed after this version was rendered
+	current, err := m.DB.GetRestrictionsByDate(r.Context(), firstOfMonth, lastOfMonth.AddDate(0, 0, 1))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
+	stringMap["version"] = calendarVersion(current)
 
 	render.Template(w, r, "admin-reservations-calendar.page.html", &models.TemplateData{
 		StringMap: stringMap,
@@ -896,3 +1604,2008 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 		IntMap:    intMap,
 	})
 }
+
+// calendarDay is a cell of a room row in the reservation calendar, a block covers Span days
+type calendarDay struct {
+	Date          string // yyyy-mm-dd
+	Span          int
+	ReservationID int
+	BlockID       int
+	Note          string
+	SeriesID      int
+}
+
+// calendarDays lays out the row of a room for the month, every block is one cell spanning its nights
+func calendarDays(firstOfMonth, lastOfMonth time.Time, reservationMap map[string]int, blocks []models.RoomRestriction) []calendarDay {
+	blockAt := make(map[string]models.RoomRestriction)
+	for _, b := range blocks {
+		first := b.StartDate
+		if first.Before(firstOfMonth) {
+			first = firstOfMonth
+		}
+		blockAt[first.Format(layout)] = b
+	}
+
+	var days []calendarDay
+	for d := firstOfMonth; !d.After(lastOfMonth); {
+		date := d.Format(layout)
+		day := calendarDay{Date: date, Span: 1, ReservationID: reservationMap[date]}
+
+		if b, ok := blockAt[date]; ok && day.ReservationID == 0 {
+			// the last night of a block is the day before its end date
+			last := b.EndDate.AddDate(0, 0, -1)
+			if last.After(lastOfMonth) {
+				last = lastOfMonth
+			}
+			for n := d.AddDate(0, 0, 1); !n.After(last) && reservationMap[n.Format(layout)] == 0; n = n.AddDate(0, 0, 1) {
+				day.Span++
+			}
+			day.BlockID = b.ID
+			day.Note = b.Note
+			day.SeriesID = b.SeriesID
+		}
+
+		days = append(days, day)
+		d = d.AddDate(0, 0, day.Span)
+	}
+
+	return days
+}
+
+// assignmentPlan computes the room assignment dry run for the month in the URL query (y, m)
+func (m *Repository) assignmentPlan(r *http.Request) (assignment.Plan, time.Time, error) {
+	now := today()
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	if r.Form.Get("y") != "" && r.Form.Get("m") != "" {
+		year, err := strconv.Atoi(r.Form.Get("y"))
+		if err != nil {
+			return assignment.Plan{}, firstOfMonth, err
+		}
+		month, err := strconv.Atoi(r.Form.Get("m"))
+		if err != nil {
+			return assignment.Plan{}, firstOfMonth, err
+		}
+		firstOfMonth = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	// Guests already in house or in the past are never moved
+	start := firstOfMonth
+	if now.After(start) {
+		start = now
+	}
+	end := firstOfMonth.AddDate(0, 1, 0)
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		return assignment.Plan{}, firstOfMonth, err
+	}
+
+	restrictions, err := m.DB.GetRestrictionsByDate(r.Context(), firstOfMonth, end)
+	if err != nil {
+		return assignment.Plan{}, firstOfMonth, err
+	}
+
+	return assignment.Optimise(rooms, restrictions, start, end, orphanNights), firstOfMonth, nil
+}
+
+// AdminRoomAssignment shows the moves the room assignment optimiser would make, nothing is saved
+func (m *Repository) AdminRoomAssignment(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	plan, firstOfMonth, err := m.assignmentPlan(r)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["plan"] = plan
+	data["now"] = firstOfMonth
+
+	stringMap := make(map[string]string)
+	stringMap["this_month"] = firstOfMonth.Format("01")
+	stringMap["this_month_year"] = firstOfMonth.Format("2006")
+
+	render.Template(w, r, "admin-room-assignment.page.html", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminPostRoomAssignment applies the moves of the previewed room assignment plan. The plan is computed
+// again and must have the fingerprint of the preview, bookings may have changed meanwhile.
+func (m *Repository) AdminPostRoomAssignment(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	plan, firstOfMonth, err := m.assignmentPlan(r)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	preview := fmt.Sprintf("/admin/room-assignment?y=%s&m=%s", firstOfMonth.Format("2006"), firstOfMonth.Format("01"))
+	if r.Form.Get("fingerprint") != plan.Fingerprint() || !samePlanMoves(r.Form["move"], plan.Moves) {
+		m.App.Session.Put(r.Context(), "error", "Bookings changed since the preview, check the new plan before applying it")
+		http.Redirect(w, r, preview, http.StatusSeeOther)
+		return
+	}
+
+	// A plan applied halfway could leave rooms it meant to free taken
+	err = m.DB.Transaction(r.Context(), func(repo repository.DatabaseRepo) error {
+		for _, move := range plan.Ordered() {
+			err := repo.UpdateRoomForReservation(r.Context(), m.actor(r), move.Reservation.ID, move.ToRoom.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, repository.ErrOverlap) {
+		m.App.Session.Put(r.Context(), "error", "A room of the plan is no longer free, nothing was moved")
+		http.Redirect(w, r, preview, http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "A reservation of the plan was deleted, nothing was moved")
+		http.Redirect(w, r, preview, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d reservation(s) moved", len(plan.Moves)))
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s",
+		firstOfMonth.Format("2006"), firstOfMonth.Format("01")), http.StatusSeeOther)
+}
+
+// samePlanMoves reports whether the moves posted by the preview, as reservation:room, are the moves of the plan
+func samePlanMoves(posted []string, moves []assignment.Move) bool {
+	if len(posted) != len(moves) {
+		return false
+	}
+	for i, move := range moves {
+		if posted[i] != fmt.Sprintf("%d:%d", move.Reservation.ID, move.ToRoom.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// AdminStayRules shows the stay rules of every room and the form to add a new one
+func (m *Repository) AdminStayRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := m.DB.AllStayRules(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rules"] = rules
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-stay-rules.page.html", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// maxRuleDays is the largest number of nights or days a stay rule takes, ten years
+const maxRuleDays = 3650
+
+// hasRoom reports whether id is one of rooms
+func hasRoom(rooms []models.Room, id int) bool {
+	for _, room := range rooms {
+		if room.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminPostStayRules adds a stay rule from the POST form
+func (m *Repository) AdminPostStayRules(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id", "start_date", "end_date")
+
+	var rule models.StayRule
+	if form.Has("room_id") {
+		rule.RoomID, err = strconv.Atoi(r.Form.Get("room_id"))
+		if err != nil || !hasRoom(rooms, rule.RoomID) {
+			form.Errors.Add("room_id", "Choose one of the rooms")
+		}
+	}
+
+	rule.StartDate, err = time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid date, use yyyy-mm-dd")
+	}
+	rule.EndDate, err = time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid date, use yyyy-mm-dd")
+	} else if rule.EndDate.Before(rule.StartDate) {
+		form.Errors.Add("end_date", "End date must not be before start date")
+	}
+
+	// Empty number fields mean no limit
+	numbers := map[string]*int{
+		"min_nights":       &rule.MinNights,
+		"max_nights":       &rule.MaxNights,
+		"min_advance_days": &rule.MinAdvanceDays,
+		"max_advance_days": &rule.MaxAdvanceDays,
+	}
+	for field, value := range numbers {
+		if form.Has(field) {
+			*value = form.IsNumber(field, 0, maxRuleDays)
+		}
+	}
+
+	// Weekday checkboxes post their time.Weekday number
+	for _, d := range form.AreNumbers("closed_to_arrival", int(time.Sunday), int(time.Saturday)) {
+		rule.ClosedToArrival |= availability.WeekdayMask(time.Weekday(d))
+	}
+	for _, d := range form.AreNumbers("closed_to_departure", int(time.Sunday), int(time.Saturday)) {
+		rule.ClosedToDeparture |= availability.WeekdayMask(time.Weekday(d))
+	}
+
+	if !form.Valid() {
+		rules, err := m.DB.AllStayRules(r.Context())
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		data := make(map[string]interface{})
+		data["rules"] = rules
+		data["rooms"] = rooms
+
+		render.Template(w, r, "admin-stay-rules.page.html", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	err = m.DB.InsertStayRule(r.Context(), m.actor(r), rule)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Stay rule added")
+	http.Redirect(w, r, "/admin/stay-rules", http.StatusSeeOther)
+}
+
+// AdminDeleteStayRule deletes a stay rule
+func (m *Repository) AdminDeleteStayRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteStayRule(r.Context(), m.actor(r), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Stay rule deleted")
+	http.Redirect(w, r, "/admin/stay-rules", http.StatusSeeOther)
+}
+
+// AdminBlocks shows the recurring owner blocks and the form to block a room for a date range
+func (m *Repository) AdminBlocks(w http.ResponseWriter, r *http.Request) {
+	data, err := m.blocksPageData(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	render.Template(w, r, "admin-blocks.page.html", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// blocksPageData loads the rooms and the recurring blocks shown on the blocks page
+func (m *Repository) blocksPageData(ctx context.Context) (map[string]interface{}, error) {
+	series, err := m.DB.AllBlockSeries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms, err := m.DB.AllRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+	data["series"] = series
+	data["rooms"] = rooms
+	return data, nil
+}
+
+// blockDates reads and validates the start_date and end_date of a block form
+func blockDates(r *http.Request, form *forms.Form) (time.Time, time.Time) {
+	start, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid date, use yyyy-mm-dd")
+	}
+	end, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid date, use yyyy-mm-dd")
+	} else if !end.After(start) {
+		form.Errors.Add("end_date", "End date must be after start date")
+	}
+	return start, end
+}
+
+// AdminPostBlocks blocks a room for a date range, once or repeated every week or year
+func (m *Repository) AdminPostBlocks(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id", "start_date", "end_date")
+
+	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
+	start, end := blockDates(r, form)
+	note := r.Form.Get("note")
+	frequency := r.Form.Get("frequency")
+
+	var until time.Time
+	switch frequency {
+	case "":
+	case availability.FrequencyWeekly, availability.FrequencyYearly:
+		form.Required("until_date")
+		until, err = time.Parse(layout, r.Form.Get("until_date"))
+		if err != nil {
+			form.Errors.Add("until_date", "Invalid date, use yyyy-mm-dd")
+		} else if until.Before(start) {
+			form.Errors.Add("until_date", "Repeat until must not be before start date")
+		}
+
+		// An occurrence must end before the next one starts
+		if frequency == availability.FrequencyWeekly && end.After(start.AddDate(0, 0, 7)) {
+			form.Errors.Add("end_date", "A weekly block can't be longer than 7 nights")
+		}
+		if frequency == availability.FrequencyYearly && end.After(start.AddDate(1, 0, 0)) {
+			form.Errors.Add("end_date", "A yearly block can't be longer than a year")
+		}
+	default:
+		form.Errors.Add("frequency", "Unknown repeat")
+	}
+
+	if !form.Valid() {
+		data, err := m.blocksPageData(r.Context())
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		render.Template(w, r, "admin-blocks.page.html", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	if frequency == "" {
+		err = m.DB.InsertBlockForRoom(r.Context(), m.actor(r), models.RoomRestriction{
+			RoomID:    roomID,
+			StartDate: start,
+			EndDate:   end,
+			Note:      note,
+		})
+	} else {
+		series := models.BlockSeries{
+			RoomID:    roomID,
+			StartDate: start,
+			EndDate:   end,
+			Frequency: frequency,
+			UntilDate: until,
+			Note:      note,
+		}
+		err = m.DB.InsertBlockSeries(r.Context(), m.actor(r), series, availability.Occurrences(series))
+	}
+	if errors.Is(err, repository.ErrOverlap) {
+		form.Errors.Add("end_date", "These dates overlap a reservation or block of the room")
+
+		data, err := m.blocksPageData(r.Context())
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		render.Template(w, r, "admin-blocks.page.html", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room blocked")
+	http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+}
+
+// lookupError answers the lookup of a row that doesn't exist with a 404, any other error is a server error
+func lookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	helpers.ServerError(w, err)
+}
+
+// AdminShowBlock shows the form to change the dates and the note of an owner block
+func (m *Repository) AdminShowBlock(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	block, err := m.DB.GetBlockByID(r.Context(), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["year"] = r.URL.Query().Get("y")
+	stringMap["month"] = r.URL.Query().Get("m")
+	data := make(map[string]interface{})
+	data["block"] = block
+
+	render.Template(w, r, "admin-block-show.page.html", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminPostShowBlock updates the dates and the note of an owner block, a block of a recurring
+// series is changed on its own
+func (m *Repository) AdminPostShowBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	block, err := m.DB.GetBlockByID(r.Context(), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("start_date", "end_date")
+	start, end := blockDates(r, form)
+
+	year := r.Form.Get("year")
+	month := r.Form.Get("month")
+
+	if !form.Valid() {
+		stringMap := make(map[string]string)
+		stringMap["year"] = year
+		stringMap["month"] = month
+		data := make(map[string]interface{})
+		data["block"] = block
+
+		render.Template(w, r, "admin-block-show.page.html", &models.TemplateData{
+			StringMap: stringMap,
+			Data:      data,
+			Form:      form,
+		})
+		return
+	}
+
+	block.StartDate = start
+	block.EndDate = end
+	block.Note = r.Form.Get("note")
+	err = m.DB.UpdateBlock(r.Context(), m.actor(r), block)
+	if errors.Is(err, repository.ErrOverlap) {
+		form.Errors.Add("end_date", "These dates overlap another reservation or block")
+
+		stringMap := make(map[string]string)
+		stringMap["year"] = year
+		stringMap["month"] = month
+		data := make(map[string]interface{})
+		data["block"] = block
+
+		render.Template(w, r, "admin-block-show.page.html", &models.TemplateData{
+			StringMap: stringMap,
+			Data:      data,
+			Form:      form,
+		})
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	if year == "" {
+		http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminDeleteBlock deletes an owner block
+func (m *Repository) AdminDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteBlockByID(r.Context(), m.actor(r), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", "Block deleted")
+	if year == "" {
+		http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminDeleteBlockSeries deletes a recurring owner block with all of its blocks
+func (m *Repository) AdminDeleteBlockSeries(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteBlockSeries(r.Context(), m.actor(r), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Recurring block deleted")
+	http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+}
+
+// maxCalendarDays is the longest window served by the JSON calendar feed
+const maxCalendarDays = 366
+
+// calendarRoom is a room of the JSON calendar feed
+type calendarRoom struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// calendarEvent is a reservation or an owner block of the JSON calendar feed, EndDate is the check-out day
+type calendarEvent struct {
+	ID            int    `json:"id"`
+	Type          string `json:"type"` // "reservation" or "block"
+	RoomID        int    `json:"room_id"`
+	ReservationID int    `json:"reservation_id,omitempty"`
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+	Title         string `json:"title"`
+	Note          string `json:"note,omitempty"`
+	SeriesID      int    `json:"series_id,omitempty"`
+	Locked        bool   `json:"locked,omitempty"`
+}
+
+// calendarFeed is the response of the JSON calendar feed
+type calendarFeed struct {
+	OK        bool            `json:"ok"`
+	Message   string          `json:"message,omitempty"`
+	StartDate string          `json:"start_date"`
+	EndDate   string          `json:"end_date"`
+	Rooms     []calendarRoom  `json:"rooms"`
+	Events    []calendarEvent `json:"events"`
+}
+
+// writeJSON sends v to the client as indented JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, _ := json.MarshalIndent(v, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// AdminCalendarJSON returns the reservations and blocks of a date window as JSON.
+// Query: start and end (yyyy-mm-dd, end excluded) and optionally rooms, a comma separated list of room ids
+func (m *Repository) AdminCalendarJSON(w http.ResponseWriter, r *http.Request) {
+	start, err := time.Parse(layout, r.URL.Query().Get("start"))
+	if err != nil {
+		writeJSON(w, calendarFeed{Message: "Invalid start date, use yyyy-mm-dd"})
+		return
+	}
+	end, err := time.Parse(layout, r.URL.Query().Get("end"))
+	if err != nil {
+		writeJSON(w, calendarFeed{Message: "Invalid end date, use yyyy-mm-dd"})
+		return
+	}
+	if !end.After(start) {
+		writeJSON(w, calendarFeed{Message: "End date must be after start date"})
+		return
+	}
+	if end.After(start.AddDate(0, 0, maxCalendarDays)) {
+		writeJSON(w, calendarFeed{Message: fmt.Sprintf("The window can't be longer than %d days", maxCalendarDays)})
+		return
+	}
+
+	// An empty rooms parameter means every room
+	wanted := make(map[int]bool)
+	if value := r.URL.Query().Get("rooms"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				writeJSON(w, calendarFeed{Message: "Invalid room id " + field})
+				return
+			}
+			wanted[id] = true
+		}
+	}
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		writeJSON(w, calendarFeed{Message: "Connecting to database error!"})
+		return
+	}
+
+	restrictions, err := m.DB.GetRestrictionsByDate(r.Context(), start, end)
+	if err != nil {
+		writeJSON(w, calendarFeed{Message: "Connecting to database error!"})
+		return
+	}
+
+	feed := calendarFeed{
+		OK:        true,
+		StartDate: start.Format(layout),
+		EndDate:   end.Format(layout),
+		Rooms:     []calendarRoom{},
+		Events:    []calendarEvent{},
+	}
+	for _, room := range rooms {
+		if len(wanted) == 0 || wanted[room.ID] {
+			feed.Rooms = append(feed.Rooms, calendarRoom{ID: room.ID, Name: room.RoomName})
+		}
+	}
+	for _, restriction := range restrictions {
+		if len(wanted) > 0 && !wanted[restriction.RoomID] {
+			continue
+		}
+
+		event := calendarEvent{
+			ID:        restriction.ID,
+			Type:      "block",
+			RoomID:    restriction.RoomID,
+			StartDate: restriction.StartDate.Format(layout),
+			EndDate:   restriction.EndDate.Format(layout),
+			Title:     restriction.Note,
+			Note:      restriction.Note,
+			SeriesID:  restriction.SeriesID,
+		}
+		if restriction.ReservationID > 0 {
+			event.Type = "reservation"
+			event.ReservationID = restriction.ReservationID
+			event.Title = strings.TrimSpace(restriction.Reservation.FirstName + " " + restriction.Reservation.LastName)
+			event.Locked = restriction.Reservation.RoomLocked
+		} else if event.Title == "" {
+			event.Title = "Blocked"
+		}
+		feed.Events = append(feed.Events, event)
+	}
+
+	writeJSON(w, feed)
+}
+
+// AdminMoveReservationJSON moves a reservation to another room and/or dates, priced again, and answers with
+// a jsonResponse. Form: room_id, start_date and end_date, a missing field keeps the current value
+func (m *Repository) AdminMoveReservationJSON(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Internal server error!"})
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Can't find the reservation"})
+		return
+	}
+	if !res.DeletedAt.IsZero() {
+		writeJSON(w, jsonResponse{Message: "The reservation is in the trash"})
+		return
+	}
+
+	roomID, start, end := res.RoomID, res.StartDate, res.EndDate
+	if value := r.Form.Get("room_id"); value != "" {
+		roomID, err = strconv.Atoi(value)
+		if err != nil {
+			writeJSON(w, jsonResponse{Message: "Invalid room id"})
+			return
+		}
+	}
+	if value := r.Form.Get("start_date"); value != "" {
+		start, err = time.Parse(layout, value)
+		if err != nil {
+			writeJSON(w, jsonResponse{Message: "Invalid start date, use yyyy-mm-dd"})
+			return
+		}
+	}
+	if value := r.Form.Get("end_date"); value != "" {
+		end, err = time.Parse(layout, value)
+		if err != nil {
+			writeJSON(w, jsonResponse{Message: "Invalid end date, use yyyy-mm-dd"})
+			return
+		}
+	}
+	if !end.After(start) {
+		writeJSON(w, jsonResponse{Message: "End date must be after start date"})
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Can't find the room"})
+		return
+	}
+	if !pricing.Fits(room, res.Adults, res.Children) {
+		writeJSON(w, jsonResponse{Message: "The party doesn't fit in this room"})
+		return
+	}
+
+	// The stay rules of the new room and dates apply, but for the ones on when guests may book
+	problems, err := m.moveProblems(r.Context(), roomID, start, end, res.StartDate)
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Connecting to database error!"})
+		return
+	}
+	if len(problems) > 0 {
+		writeJSON(w, jsonResponse{Message: availability.Explain(problems)})
+		return
+	}
+
+	totalPrice := pricing.Quote(room, start, end, res.Adults, res.Children)
+	err = m.DB.MoveReservation(r.Context(), m.actor(r), id, roomID, start, end, totalPrice)
+	if errors.Is(err, repository.ErrOverlap) {
+		writeJSON(w, jsonResponse{Message: "These dates overlap another reservation or block"})
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, jsonResponse{Message: "The reservation is in the trash"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Connecting to database error!"})
+		return
+	}
+
+	writeJSON(w, jsonResponse{
+		OK:        true,
+		RoomID:    strconv.Itoa(roomID),
+		StartDate: start.Format(layout),
+		EndDate:   end.Format(layout),
+	})
+}
+
+// AdminResizeBlockJSON changes the dates of an owner block and answers with a jsonResponse.
+// Form: start_date and end_date, a missing field keeps the current value
+func (m *Repository) AdminResizeBlockJSON(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Internal server error!"})
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	block, err := m.DB.GetBlockByID(r.Context(), id)
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Can't find the block"})
+		return
+	}
+
+	if value := r.Form.Get("start_date"); value != "" {
+		block.StartDate, err = time.Parse(layout, value)
+		if err != nil {
+			writeJSON(w, jsonResponse{Message: "Invalid start date, use yyyy-mm-dd"})
+			return
+		}
+	}
+	if value := r.Form.Get("end_date"); value != "" {
+		block.EndDate, err = time.Parse(layout, value)
+		if err != nil {
+			writeJSON(w, jsonResponse{Message: "Invalid end date, use yyyy-mm-dd"})
+			return
+		}
+	}
+	if !block.EndDate.After(block.StartDate) {
+		writeJSON(w, jsonResponse{Message: "End date must be after start date"})
+		return
+	}
+
+	err = m.DB.UpdateBlock(r.Context(), m.actor(r), block)
+	if errors.Is(err, repository.ErrOverlap) {
+		writeJSON(w, jsonResponse{Message: "These dates overlap another reservation or block"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, jsonResponse{Message: "Connecting to database error!"})
+		return
+	}
+
+	writeJSON(w, jsonResponse{
+		OK:        true,
+		RoomID:    strconv.Itoa(block.RoomID),
+		StartDate: block.StartDate.Format(layout),
+		EndDate:   block.EndDate.Format(layout),
+	})
+}
+
+// maxGridMonths is the longest range served by the availability grid, maxGridAheadMonths how far
+// ahead of this month it may start
+const (
+	maxGridMonths      = 12
+	maxGridAheadMonths = 24
+)
+
+// gridDay is a night of the availability grid sent to the booking widget
+type gridDay struct {
+	Date   string `json:"date"`
+	Status string `json:"status"`
+	Price  string `json:"price"`
+}
+
+// gridResponse is the availability grid of a room
+type gridResponse struct {
+	OK        bool      `json:"ok"`
+	Message   string    `json:"message,omitempty"`
+	RoomID    int       `json:"room_id"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	Days      []gridDay `json:"days"`
+}
+
+// AvailabilityGridJSON returns the status and nightly price of every night of a room for whole months,
+// so the datepicker can grey out the nights that can't be booked.
+// Query: room_id, month (yyyy-mm, default this month), months (default 3), a and c the party (default 1 adult)
+func (m *Repository) AvailabilityGridJSON(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.URL.Query().Get("room_id"))
+	if err != nil {
+		writeJSON(w, gridResponse{Message: "Invalid room id"})
+		return
+	}
+
+	thisMonth := today()
+	thisMonth = thisMonth.AddDate(0, 0, 1-thisMonth.Day())
+	start := thisMonth
+	if value := r.URL.Query().Get("month"); value != "" {
+		start, err = time.Parse("2006-01", value)
+		if err != nil {
+			writeJSON(w, gridResponse{Message: "Invalid month, use yyyy-mm"})
+			return
+		}
+	}
+	if start.Before(thisMonth) || start.After(thisMonth.AddDate(0, maxGridAheadMonths, 0)) {
+		writeJSON(w, gridResponse{Message: fmt.Sprintf("Month must be within %d months from now", maxGridAheadMonths)})
+		return
+	}
+
+	months := 3
+	if value := r.URL.Query().Get("months"); value != "" {
+		months, err = strconv.Atoi(value)
+		if err != nil || months < 1 || months > maxGridMonths {
+			writeJSON(w, gridResponse{Message: fmt.Sprintf("Months must be between 1 and %d", maxGridMonths)})
+			return
+		}
+	}
+	end := start.AddDate(0, months, 0)
+
+	adults, children, err := parseParty(r.URL.Query().Get("a"), r.URL.Query().Get("c"))
+	if err != nil {
+		writeJSON(w, gridResponse{Message: err.Error()})
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		writeJSON(w, gridResponse{Message: "Can't find the room"})
+		return
+	}
+	// A room is never available for a party it can't hold, and there is a grid per party it can
+	if !pricing.Fits(room, adults, children) {
+		writeJSON(w, gridResponse{Message: fmt.Sprintf("%s sleeps at most %d guests", room.RoomName, room.MaxOccupancy)})
+		return
+	}
+
+	key := availability.GridKey(roomID, start, end, adults, children)
+	days, ok := m.Grid.Get(key)
+	if !ok {
+		// A change made while the grid is computed keeps it out of the cache
+		generation := m.Grid.Generation()
+
+		// One query for every reservation and block of the range
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), roomID, start, end)
+		if err != nil {
+			writeJSON(w, gridResponse{Message: "Connecting to database error!"})
+			return
+		}
+
+		rules, err := m.DB.AllStayRules(r.Context())
+		if err != nil {
+			writeJSON(w, gridResponse{Message: "Connecting to database error!"})
+			return
+		}
+
+		days = availability.MonthGrid(room, restrictions, rules, start, end, adults, children)
+		m.Grid.Set(key, days, generation)
+	}
+
+	resp := gridResponse{
+		OK:        true,
+		RoomID:    roomID,
+		StartDate: start.Format(layout),
+		EndDate:   end.Format(layout),
+		Days:      make([]gridDay, 0, len(days)),
+	}
+	for _, day := range days {
+		resp.Days = append(resp.Days, gridDay{
+			Date:   day.Date.Format(layout),
+			Status: day.Status,
+			Price:  pricing.Format(day.Price),
+		})
+	}
+
+	writeJSON(w, resp)
+}
+
+// dashboardFeed holds the dashboard figures of the reservations arriving in a date range
+type dashboardFeed struct {
+	OK              bool                 `json:"ok"`
+	Message         string               `json:"message,omitempty"`
+	StartDate       string               `json:"start_date"`
+	EndDate         string               `json:"end_date"`
+	Arrivals        int                  `json:"arrivals_today"`
+	Departures      int                  `json:"departures_today"`
+	Reservations    int                  `json:"reservations"`
+	New             int                  `json:"new"`
+	Processed       int                  `json:"processed"`
+	AverageStay     float64              `json:"average_stay"`
+	AverageLeadTime float64              `json:"average_lead_time"`
+	Revenue         string               `json:"revenue,omitempty"` // Empty when no reservation of the range has a price
+	Occupancy       []dashboardOccupancy `json:"occupancy"`
+}
+
+// dashboardOccupancy is the occupancy of a room in a month
+type dashboardOccupancy struct {
+	RoomID       int     `json:"room_id"`
+	RoomName     string  `json:"room_name"`
+	Month        string  `json:"month"`
+	Nights       int     `json:"nights"`
+	BookedNights int     `json:"booked_nights"`
+	Rate         float64 `json:"rate"` // Percent of the nights booked
+}
+
+// currentMonth returns the first day of this month and of the next one
+func currentMonth() (time.Time, time.Time) {
+	start := today()
+	start = start.AddDate(0, 0, 1-start.Day())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// dateRange reads the start and end (excluded) query parameters of the dashboard and the reports,
+// the current month by default
+func dateRange(r *http.Request) (time.Time, time.Time, error) {
+	if r.URL.Query().Get("start") == "" && r.URL.Query().Get("end") == "" {
+		start, end := currentMonth()
+		return start, end, nil
+	}
+
+	start, err := time.Parse(layout, r.URL.Query().Get("start"))
+	if err != nil {
+		return start, start, errors.New("invalid start date, use yyyy-mm-dd")
+	}
+	end, err := time.Parse(layout, r.URL.Query().Get("end"))
+	if err != nil {
+		return start, end, errors.New("invalid end date, use yyyy-mm-dd")
+	}
+	if !end.After(start) {
+		return start, end, errors.New("end date must be after start date")
+	}
+	if end.After(start.AddDate(0, 0, maxCalendarDays)) {
+		return start, end, fmt.Errorf("the range can't be longer than %d days", maxCalendarDays)
+	}
+
+	return start, end, nil
+}
+
+// dashboardFeed sums up the reservations and the occupancy of the rooms from start to end
+func (m *Repository) dashboardFeed(ctx context.Context, start, end time.Time) (dashboardFeed, error) {
+	feed := dashboardFeed{
+		StartDate: start.Format(layout),
+		EndDate:   end.Format(layout),
+		Occupancy: []dashboardOccupancy{},
+	}
+
+	stats, err := m.DB.DashboardStats(ctx, start, end)
+	if err != nil {
+		return feed, err
+	}
+
+	occupancy, err := m.DB.OccupancyByMonth(ctx, start, end)
+	if err != nil {
+		return feed, err
+	}
+
+	feed.OK = true
+	feed.Reservations = stats.Reservations
+	feed.New = stats.New
+	feed.Processed = stats.Processed
+	feed.AverageStay = stats.AverageStay
+	feed.AverageLeadTime = stats.AverageLeadTime
+	if stats.PricedReservations > 0 {
+		feed.Revenue = pricing.Format(stats.Revenue)
+	}
+
+	for _, o := range occupancy {
+		item := dashboardOccupancy{
+			RoomID:       o.RoomID,
+			RoomName:     o.RoomName,
+			Month:        o.Month.Format("2006-01"),
+			Nights:       o.Nights,
+			BookedNights: o.BookedNights,
+		}
+		if o.Nights > 0 {
+			item.Rate = float64(o.BookedNights) * 100 / float64(o.Nights)
+		}
+		feed.Occupancy = append(feed.Occupancy, item)
+	}
+
+	return feed, nil
+}
+
+// AdminDashboardJSON returns the dashboard figures for the charts.
+// Query: start and end (yyyy-mm-dd, end excluded), the current month by default
+func (m *Repository) AdminDashboardJSON(w http.ResponseWriter, r *http.Request) {
+	start, end, err := dateRange(r)
+	if err != nil {
+		writeJSON(w, dashboardFeed{Message: err.Error()})
+		return
+	}
+
+	feed, err := m.dashboardFeed(r.Context(), start, end)
+	if err != nil {
+		writeJSON(w, dashboardFeed{Message: "Connecting to database error!"})
+		return
+	}
+
+	arrivals, err := m.DB.ArrivalsOn(r.Context(), today())
+	if err != nil {
+		writeJSON(w, dashboardFeed{Message: "Connecting to database error!"})
+		return
+	}
+
+	departures, err := m.DB.DeparturesOn(r.Context(), today())
+	if err != nil {
+		writeJSON(w, dashboardFeed{Message: "Connecting to database error!"})
+		return
+	}
+
+	feed.Arrivals = len(arrivals)
+	feed.Departures = len(departures)
+
+	writeJSON(w, feed)
+}
+
+// AdminReports shows the reports the admin can export, for last month by default
+func (m *Repository) AdminReports(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	end, _ := currentMonth()
+	start := end.AddDate(0, -1, 0)
+
+	data := make(map[string]interface{})
+	data["reports"] = reports.All
+	data["rooms"] = rooms
+
+	stringMap := make(map[string]string)
+	stringMap["start"] = start.Format(layout)
+	stringMap["end"] = end.Format(layout)
+
+	render.Template(w, r, "admin-reports.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminExportReport streams a report as a CSV or XLSX download, rows are written as they are read.
+// Query: report, start and end (yyyy-mm-dd, end excluded), rooms (repeated, none means every room) and format (csv or xlsx)
+func (m *Repository) AdminExportReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := reports.Find(r.URL.Query().Get("report"))
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Unknown report")
+		http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+		return
+	}
+
+	start, end, err := dateRange(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+		return
+	}
+
+	filter := models.ReportFilter{Start: start, End: end}
+	for _, value := range r.URL.Query()["rooms"] {
+		roomID, err := strconv.Atoi(value)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid room id "+value)
+			http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+			return
+		}
+		filter.RoomIDs = append(filter.RoomIDs, roomID)
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "csv" && format != "xlsx" {
+		m.App.Session.Put(r.Context(), "error", "Choose CSV or XLSX")
+		http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+		return
+	}
+
+	fileName := fmt.Sprintf("%s_%s_%s.%s", report.Name, start.Format(layout), end.AddDate(0, 0, -1).Format(layout), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+
+	var writer reports.RowWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer = reports.NewCSV(w)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		writer, err = reports.NewXLSX(w, report.Title, report.Numeric)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	// The status is sent with the first row, a failure after it can only be logged
+	err = report.Run(r.Context(), m.DB, filter, writer)
+	if err != nil {
+		m.App.ErrorLog.Println("report", report.Name, "stopped:", err)
+	}
+}
+
+// Admin search limits
+const (
+	minSearchLength  = 2
+	searchResultsPer = 20 // Results of each kind
+)
+
+// searchKinds are the kinds of search results, in the order they are shown
+var searchKinds = []struct {
+	Kind  string
+	Title string
+}{
+	{"code", "Confirmation codes"},
+	{"guest", "Guests"},
+	{"notes", "Notes"},
+	{"room", "Rooms"},
+}
+
+// searchGroup holds the search results of one kind
+type searchGroup struct {
+	Title   string
+	Results []models.SearchResult
+}
+
+// parseSearch takes a month name out of a search, so "smith may" looks for smith arriving in May
+func parseSearch(q string) (string, time.Month) {
+	var words []string
+	var month time.Month
+
+	for _, word := range strings.Fields(q) {
+		found := false
+		for m := time.January; m <= time.December && month == 0; m++ {
+			name := strings.ToLower(m.String())
+			if lower := strings.ToLower(word); lower == name || lower == name[:3] {
+				month, found = m, true
+			}
+		}
+		if !found {
+			words = append(words, word)
+		}
+	}
+
+	return strings.Join(words, " "), month
+}
+
+// AdminSearch looks for reservations by guest, confirmation code, notes or room, q being the search
+func (m *Repository) AdminSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	text, month := parseSearch(q)
+
+	stringMap := make(map[string]string)
+	stringMap["q"] = q
+	if month != 0 {
+		stringMap["month"] = month.String()
+	}
+
+	var groups []searchGroup
+	if len([]rune(text)) < minSearchLength {
+		if q != "" {
+			stringMap["message"] = fmt.Sprintf("Type at least %d characters", minSearchLength)
+		}
+	} else {
+		results, err := m.DB.SearchReservations(r.Context(), text, month, searchResultsPer)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		for _, k := range searchKinds {
+			group := searchGroup{Title: k.Title}
+			for _, result := range results {
+				if result.Kind == k.Kind {
+					group.Results = append(group.Results, result)
+				}
+			}
+			if len(group.Results) > 0 {
+				groups = append(groups, group)
+			}
+		}
+		if len(groups) == 0 {
+			stringMap["message"] = "Nothing found"
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["groups"] = groups
+
+	render.Template(w, r, "admin-search.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// maxGuestsListed is the longest guest list shown, a search narrows it down
+const maxGuestsListed = 100
+
+// AdminGuests lists the guests, q filters them on name, email or phone
+func (m *Repository) AdminGuests(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	list, err := m.DB.AllGuests(r.Context(), q, maxGuestsListed)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["guests"] = list
+
+	stringMap := make(map[string]string)
+	stringMap["q"] = q
+
+	render.Template(w, r, "admin-guests.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminShowGuest shows a guest with its stays and the guests that may be the same person
+func (m *Repository) AdminShowGuest(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	guest, err := m.DB.GetGuestByID(r.Context(), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	m.renderGuest(w, r, guest, forms.New(nil))
+}
+
+// renderGuest shows the guest page with form
+func (m *Repository) renderGuest(w http.ResponseWriter, r *http.Request, guest models.Guest, form *forms.Form) {
+	reservations, err := m.DB.GuestReservations(r.Context(), guest.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	duplicates, err := m.DB.GuestDuplicates(r.Context(), guest.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// Checked tags
+	tags := make(map[string]bool)
+	for _, tag := range guest.Tags {
+		tags[tag] = true
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["reservations"] = reservations
+	data["duplicates"] = duplicates
+	data["tags"] = guests.Tags
+	data["checked"] = tags
+
+	render.Template(w, r, "admin-guest-show.page.html", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminPostShowGuest saves the details, notes and tags of a guest
+func (m *Repository) AdminPostShowGuest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	guest, err := m.DB.GetGuestByID(r.Context(), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	guest.FirstName = strings.TrimSpace(r.Form.Get("first_name"))
+	guest.LastName = strings.TrimSpace(r.Form.Get("last_name"))
+	guest.Email = strings.TrimSpace(r.Form.Get("email"))
+	guest.Phone = strings.TrimSpace(r.Form.Get("phone"))
+	guest.Notes = strings.TrimSpace(r.Form.Get("notes"))
+	guest.Tags = guests.CleanTags(r.Form["tags"])
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name")
+	if guest.Email != "" {
+		form.IsEmail("email")
+	}
+	if !form.Valid() {
+		m.renderGuest(w, r, guest, form)
+		return
+	}
+
+	err = m.DB.UpdateGuest(r.Context(), m.actor(r), guest)
+	if errors.Is(err, repository.ErrGuestEmailTaken) {
+		form.Errors.Add("email", "Another guest has this email, merge the two guests instead")
+		m.renderGuest(w, r, guest, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/guests/%d", id), http.StatusSeeOther)
+}
+
+// AdminMergeGuest merges the guest duplicate_id into the guest of the page, which keeps its details
+// and gets the reservations, notes and tags of the duplicate
+func (m *Repository) AdminMergeGuest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	location := fmt.Sprintf("/admin/guests/%d", id)
+
+	duplicateID, err := strconv.Atoi(r.Form.Get("duplicate_id"))
+	if err != nil || duplicateID == id {
+		m.App.Session.Put(r.Context(), "error", "Choose another guest to merge")
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+
+	keep, err := m.DB.GetGuestByID(r.Context(), id)
+	if err != nil {
+		lookupError(w, err)
+		return
+	}
+
+	duplicate, err := m.DB.GetGuestByID(r.Context(), duplicateID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the guest to merge")
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.MergeGuests(r.Context(), m.actor(r), guests.Merge(keep, duplicate), duplicate.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s merged", duplicate.FirstName, duplicate.LastName))
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
+
+// sendMail queues an email and keeps a copy of it for the exports of personal data, a copy that
+// can't be kept doesn't stop the email. Secrets, such as the token of a link, are left out of the copy.
+func (m *Repository) sendMail(ctx context.Context, msg models.MailData, secrets ...string) {
+	kept := msg
+	for _, secret := range secrets {
+		kept.Content = strings.ReplaceAll(kept.Content, secret, redactedSecret)
+	}
+
+	err := m.DB.InsertSentEmail(ctx, kept)
+	if err != nil {
+		m.App.ErrorLog.Println("can't keep a copy of the email:", err)
+	}
+
+	m.App.MailChan <- msg
+}
+
+// redactedSecret replaces the secrets of an email in the copy that is kept
+const redactedSecret = "[removed]"
+
+// verifyTokenTTL is how long the link of a verification email can be used
+const verifyTokenTTL = 48 * time.Hour
+
+// minPasswordLength is the shortest password of a guest account
+const minPasswordLength = 8
+
+// siteURL returns the scheme and host the request came to, for links sent by email
+func (m *Repository) siteURL(r *http.Request) string {
+	if m.App.InProduction {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// sendVerification emails a new verification link to the guest, token is the plain token
+func (m *Repository) sendVerification(r *http.Request, email, firstName, token string) {
+	link := fmt.Sprintf("%s/account/verify?token=%s", m.siteURL(r), token)
+	htmlMessage := fmt.Sprintf(`
+		<strong>Verify your email</strong><br>
+		Dear %s, <br>
+		Open <a href="%s">this link</a> within %d hours to verify your email and log in to your account.
+	`, template.HTMLEscapeString(firstName), link, int(verifyTokenTTL.Hours()))
+
+	m.sendMail(r.Context(), models.MailData{
+		To:       email,
+		From:     "me@here.com",
+		Subject:  "Verify your email",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}, token)
+}
+
+// ShowRegister shows the form to create a guest account. The link of the confirmation email fills
+// in the email and the confirmation code to claim the account of a past reservation.
+func (m *Repository) ShowRegister(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "account-register.page.html", &models.TemplateData{
+		Form: forms.New(r.URL.Query()),
+	})
+}
+
+// PostRegister creates an unverified guest account and emails the verification link. With a confirmation
+// code made with the same email the account gets the guest profile of that reservation, otherwise the
+// profile with the same email, or a new one.
+func (m *Repository) PostRegister(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form!")
+		http.Redirect(w, r, "/account/register", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password")
+	form.IsEmail("email")
+	form.MinLength("password", minPasswordLength)
+	if form.Get("password") != form.Get("password_confirm") {
+		form.Errors.Add("password_confirm", "The passwords don't match")
+	}
+
+	account := models.GuestAccount{
+		Email: guests.NormalizeEmail(form.Get("email")),
+		Guest: models.Guest{
+			FirstName: strings.TrimSpace(form.Get("first_name")),
+			LastName:  strings.TrimSpace(form.Get("last_name")),
+			Phone:     strings.TrimSpace(form.Get("phone")),
+		},
+	}
+
+	if code := strings.TrimSpace(form.Get("code")); code != "" {
+		res, err := m.DB.GetReservationByCode(r.Context(), code)
+		if err != nil || guests.NormalizeEmail(res.Email) != account.Email {
+			form.Errors.Add("code", "No reservation with this code was made with this email")
+		}
+		account.GuestID = res.GuestID
+	}
+
+	if !form.Valid() {
+		render.Template(w, r, "account-register.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(form.Get("password")), 12)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	account.Password = string(hash)
+
+	token := helpers.Token()
+	account.VerifyToken = helpers.HashToken(token)
+	account.VerifyExpires = time.Now().Add(verifyTokenTTL)
+
+	_, err = m.DB.InsertGuestAccount(r.Context(), account)
+	if errors.Is(err, repository.ErrEmailTaken) {
+		form.Errors.Add("email", "An account already exists for this email, log in instead")
+		render.Template(w, r, "account-register.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.sendVerification(r, account.Email, account.Guest.FirstName, token)
+
+	m.App.Session.Put(r.Context(), "flash", "Check your email to verify your account")
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// VerifyAccount verifies the email of a guest account from the emailed link and logs the guest in
+func (m *Repository) VerifyAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := m.DB.VerifyGuestAccount(r.Context(), helpers.HashToken(r.URL.Query().Get("token")))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired, log in to get a new one")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// Prevent session fixation, the privilege changes
+	err = m.App.Session.RenewToken(r.Context())
+	if err != nil {
+		log.Println(err)
+	}
+	m.App.Session.Put(r.Context(), "guest_account_id", id)
+
+	m.App.Session.Put(r.Context(), "flash", "Your email is verified")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ShowGuestLogin shows the login screen of the guests
+func (m *Repository) ShowGuestLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "account-login.page.html", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestLogin logs a guest in to a verified account. An unverified account gets a new verification email.
+func (m *Repository) PostGuestLogin(w http.ResponseWriter, r *http.Request) {
+	// Call RenewToken method whenever we have operation that change privilege (IE login, logout)
+	err := m.App.Session.RenewToken(r.Context())
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "account-login.page.html", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	account, err := m.DB.AuthenticateGuest(r.Context(), form.Get("email"), form.Get("password"))
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	if !account.Verified {
+		token := helpers.Token()
+		err = m.DB.SetGuestAccountToken(r.Context(), account.ID, helpers.HashToken(token), time.Now().Add(verifyTokenTTL))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.sendVerification(r, account.Email, account.Guest.FirstName, token)
+
+		m.App.Session.Put(r.Context(), "warning", "Verify your email first, we sent you a new link")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "guest_account_id", account.ID)
+
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully!")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// GuestLogout logs the guest out, the rest of the session is kept
+func (m *Repository) GuestLogout(w http.ResponseWriter, r *http.Request) {
+	err := m.App.Session.RenewToken(r.Context())
+	if err != nil {
+		log.Println(err)
+	}
+	m.App.Session.Remove(r.Context(), "guest_account_id")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Account shows the upcoming and past reservations of the guest logged in
+func (m *Repository) Account(w http.ResponseWriter, r *http.Request) {
+	account, err := m.DB.GetGuestAccountByID(r.Context(), m.App.Session.GetInt(r.Context(), "guest_account_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	reservations, err := m.DB.GuestReservations(r.Context(), account.GuestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// Reservations come latest stay first, upcoming ones are shown soonest first
+	var upcoming, past []models.Reservation
+	for _, res := range reservations {
+		if res.EndDate.After(today()) {
+			upcoming = append([]models.Reservation{res}, upcoming...)
+		} else {
+			past = append(past, res)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["account"] = account
+	data["upcoming"] = upcoming
+	data["past"] = past
+
+	render.Template(w, r, "account.page.html", &models.TemplateData{
+		Data:      data,
+		StringMap: map[string]string{"today": today().Format(layout)},
+	})
+}
+
+// AccountRebook books the room of one of the guest's reservations again for new dates, it checks the room
+// is free and hands over to BookRoom
+func (m *Repository) AccountRebook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form!")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	account, err := m.DB.GetGuestAccountByID(r.Context(), m.App.Session.GetInt(r.Context(), "guest_account_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	reservations, err := m.DB.GuestReservations(r.Context(), account.GuestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.Form.Get("reservation_id"))
+	var previous models.Reservation
+	for _, res := range reservations {
+		if res.ID == id {
+			previous = res
+		}
+	}
+	if previous.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't find this reservation in your account")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	startDate, err := time.Parse(layout, r.Form.Get("start"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse start date!")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end"))
+	if err != nil || !endDate.After(startDate) {
+		m.App.Session.Put(r.Context(), "error", "The departure must be after the arrival")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	available, err := m.DB.SearchAvailabilityByRoomID(r.Context(), startDate, endDate, previous.RoomID)
+	if err != nil || !available {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s is not available for these dates", previous.Room.RoomName))
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	q := url.Values{}
+	q.Set("id", strconv.Itoa(previous.RoomID))
+	q.Set("s", startDate.Format(layout))
+	q.Set("e", endDate.Format(layout))
+	q.Set("a", r.Form.Get("adults"))
+	q.Set("c", r.Form.Get("children"))
+	http.Redirect(w, r, "/book-room?"+q.Encode(), http.StatusSeeOther)
+}
+
+// AdminPrivacy shows what is held about a guest email, to export or erase it
+func (m *Repository) AdminPrivacy(w http.ResponseWriter, r *http.Request) {
+	email := guests.NormalizeEmail(r.URL.Query().Get("email"))
+
+	data := make(map[string]interface{})
+	if email != "" {
+		personal, err := m.DB.PersonalData(r.Context(), email)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["personal"] = personal
+	}
+
+	render.Template(w, r, "admin-privacy.page.html", &models.TemplateData{
+		StringMap: map[string]string{"email": email},
+		Data:      data,
+	})
+}
+
+// AdminExportPersonalData downloads everything held about a guest email as JSON, or as a ZIP bundle
+// that also has the emails sent
+func (m *Repository) AdminExportPersonalData(w http.ResponseWriter, r *http.Request) {
+	email := guests.NormalizeEmail(r.URL.Query().Get("email"))
+	back := "/admin/privacy?" + url.Values{"email": {email}}.Encode()
+	if email == "" {
+		m.App.Session.Put(r.Context(), "error", "Type the email of the guest")
+		http.Redirect(w, r, "/admin/privacy", http.StatusSeeOther)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != privacy.FormatJSON && format != privacy.FormatZIP {
+		m.App.Session.Put(r.Context(), "error", "Choose JSON or ZIP")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	personal, err := m.DB.PersonalData(r.Context(), email)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// The bundle is small, build it first so a failure can still be reported
+	var buf bytes.Buffer
+	if format == privacy.FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		err = privacy.WriteJSON(&buf, personal)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		err = privacy.WriteZIP(&buf, personal)
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fileName := fmt.Sprintf("personal-data_%s.%s", today().Format(layout), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		m.App.ErrorLog.Println("personal data export stopped:", err)
+	}
+}
+
+// AdminErasePersonalData anonymizes the reservations of a guest email and deletes the rest of its data,
+// the email has to be typed twice
+func (m *Repository) AdminErasePersonalData(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	email := guests.NormalizeEmail(r.Form.Get("email"))
+	if email == "" || guests.NormalizeEmail(r.Form.Get("confirm")) != email {
+		m.App.Session.Put(r.Context(), "error", "Type the email again to confirm the erasure")
+		http.Redirect(w, r, "/admin/privacy?"+url.Values{"email": {email}}.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	n, err := m.DB.ErasePersonalData(r.Context(), email)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Personal data of %s erased, %d reservation(s) anonymized", email, n))
+	http.Redirect(w, r, "/admin/privacy", http.StatusSeeOther)
+}
+
+// actor is the staff user making a change with r, for the audit log
+func (m *Repository) actor(r *http.Request) models.Actor {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return models.Actor{
+		UserID: m.App.Session.GetInt(r.Context(), "user_id"),
+		IP:     ip,
+	}
+}
+
+// Page sizes of the audit log viewer
+const (
+	auditPerPage    = 50
+	maxAuditPerPage = 200
+)
+
+// auditRow is an entry of the audit log with its changes decoded
+type auditRow struct {
+	Entry  models.AuditEntry
+	Fields []audit.FieldChange
+}
+
+// auditRows decodes the changes of audit log entries
+func auditRows(entries []models.AuditEntry) ([]auditRow, error) {
+	var rows []auditRow
+	for _, e := range entries {
+		fields, err := audit.Fields(e.Changes)
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, auditRow{Entry: e, Fields: fields})
+	}
+	return rows, nil
+}
+
+// auditPage is a page of the audit log viewer
+type auditPage struct {
+	Filter  models.AuditFilter
+	Rows    []auditRow
+	Total   int
+	From    int // Position of the first entry of the page, 0 when it is empty
+	To      int
+	Pages   []pageLink
+	PrevURL string
+	NextURL string
+}
+
+// auditFilter reads the filters and page of the audit log viewer from the query string, values that
+// can't be read are left out
+func auditFilter(r *http.Request) models.AuditFilter {
+	q := r.URL.Query()
+	f := models.AuditFilter{
+		Page:    1,
+		PerPage: auditPerPage,
+	}
+
+	f.UserID, _ = strconv.Atoi(q.Get("user"))
+	f.EntityID, _ = strconv.Atoi(q.Get("entity_id"))
+	f.Start, _ = time.Parse(layout, q.Get("start"))
+	if end, err := time.Parse(layout, q.Get("end")); err == nil {
+		// The end day is included
+		f.End = end.AddDate(0, 0, 1)
+	}
+
+	for _, action := range audit.Actions {
+		if q.Get("action") == action {
+			f.Action = action
+		}
+	}
+	for _, entity := range audit.Entities {
+		if q.Get("entity") == entity {
+			f.Entity = entity
+		}
+	}
+	if page, err := strconv.Atoi(q.Get("page")); err == nil && page > 0 {
+		f.Page = page
+	}
+	if perPage, err := strconv.Atoi(q.Get("per_page")); err == nil && perPage > 0 && perPage <= maxAuditPerPage {
+		f.PerPage = perPage
+	}
+
+	return f
+}
+
+// AdminAudit shows the audit log of the admin changes, a page at a time
+func (m *Repository) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	f := auditFilter(r)
+
+	entries, total, err := m.DB.AuditLog(r.Context(), f)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rows, err := auditRows(entries)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	list := auditPage{
+		Filter: f,
+		Rows:   rows,
+		Total:  total,
+	}
+	if len(rows) > 0 {
+		list.From = (f.Page-1)*f.PerPage + 1
+		list.To = list.From + len(rows) - 1
+	}
+	list.Pages, list.PrevURL, list.NextURL = pageLinks(r, f.Page, f.PerPage, total)
+
+	stringMap := make(map[string]string)
+	if !f.Start.IsZero() {
+		stringMap["start"] = f.Start.Format(layout)
+	}
+	if !f.End.IsZero() {
+		stringMap["end"] = f.End.AddDate(0, 0, -1).Format(layout)
+	}
+
+	render.Template(w, r, "admin-audit.page.html", &models.TemplateData{
+		StringMap: stringMap,
+		Data: map[string]interface{}{
+			"list":     list,
+			"actions":  audit.Actions,
+			"entities": audit.Entities,
+		},
+	})
+}
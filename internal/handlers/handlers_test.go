@@ -1,8 +1,16 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,13 +19,19 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/assignment"
+	"github.com/TranQuocToan1996/bookings/internal/availability"
 	"github.com/TranQuocToan1996/bookings/internal/driver"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
+	"github.com/TranQuocToan1996/bookings/internal/repository/dbrepo"
 )
 
 // Reservation data for some tests require reservation in session
 var reservation = models.Reservation{
-	RoomID: 1,
+	RoomID:    1,
+	StartDate: time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC),
+	EndDate:   time.Date(2050, time.January, 2, 0, 0, 0, 0, time.UTC),
 	Room: models.Room{
 		ID:       1,
 		RoomName: "General's Quarters",
@@ -41,11 +55,32 @@ var theTestsGET = []struct {
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/logout", "GET", http.StatusOK},
 	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
+	{"dashboard with range", "/admin/dashboard?start=2050-01-01&end=2050-03-01", "GET", http.StatusOK},
+	{"dashboard with invalid range", "/admin/dashboard?start=2050-03-01&end=2050-01-01", "GET", http.StatusOK},
+	{"reports", "/admin/reports", "GET", http.StatusOK},
+	{"guests", "/admin/guests", "GET", http.StatusOK},
+	{"guests search", "/admin/guests?q=johnny", "GET", http.StatusOK},
+	{"show guest", "/admin/guests/1", "GET", http.StatusOK},
+	{"show unknown guest", "/admin/guests/9", "GET", http.StatusNotFound},
+	{"personal data", "/admin/privacy", "GET", http.StatusOK},
+	{"personal data of a guest", "/admin/privacy?email=John@Smith.com", "GET", http.StatusOK},
+	{"audit log", "/admin/audit", "GET", http.StatusOK},
+	{"trash", "/admin/trash", "GET", http.StatusOK},
 	{"new res", "/admin/reservations-new", "GET", http.StatusOK},
 	{"all res", "/admin/reservations-all", "GET", http.StatusOK},
 	{"show res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
 	{"show res cal", "/admin/reservations-calendar", "GET", http.StatusOK},
 	{"show res cal with params", "/admin/reservations-calendar?y=2020&m=1", "GET", http.StatusOK},
+	{"room assignment", "/admin/room-assignment", "GET", http.StatusOK},
+	{"room assignment with params", "/admin/room-assignment?y=2050&m=1", "GET", http.StatusOK},
+	{"stay rules", "/admin/stay-rules", "GET", http.StatusOK},
+	{"blocks", "/admin/blocks", "GET", http.StatusOK},
+	{"show block", "/admin/blocks/1?y=2050&m=1", "GET", http.StatusOK},
+	{"show unknown block", "/admin/blocks/2?y=2050&m=1", "GET", http.StatusNotFound},
+	{"delete block", "/admin/delete-block/1/do", "GET", http.StatusOK},
+	{"delete block series", "/admin/delete-block-series/1/do", "GET", http.StatusOK},
+	{"delete unknown block", "/admin/delete-block/99/do", "GET", http.StatusNotFound},
+	{"delete unknown block series", "/admin/delete-block-series/99/do", "GET", http.StatusNotFound},
 }
 
 func TestHanlers(t *testing.T) {
@@ -208,7 +243,9 @@ func TestRepository_PostReservation(t *testing.T) {
 	/* Case 5: InsertReservation error*/
 	// set up
 	var reservation = models.Reservation{
-		RoomID: 2,
+		RoomID:    2,
+		StartDate: time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, time.January, 2, 0, 0, 0, 0, time.UTC),
 	}
 
 	postedData = url.Values{}
@@ -231,6 +268,31 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("Reservation handler returned wrong code: Got %d, wanted %d", responseRecorder.Code, http.StatusSeeOther)
 	}
 
+	/* Case 6: the room was booked for these nights since the search*/
+	reservation = models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, time.February, 2, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, time.February, 3, 0, 0, 0, 0, time.UTC),
+	}
+
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	responseRecorder = httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+	handler = http.HandlerFunc(Repo.PostReservation)
+	handler.ServeHTTP(responseRecorder, req)
+	if responseRecorder.Code != http.StatusSeeOther {
+		t.Errorf("Reservation handler returned wrong code: Got %d, wanted %d", responseRecorder.Code, http.StatusSeeOther)
+	}
+	if location := responseRecorder.Header().Get("Location"); location != "/search-availability" {
+		t.Errorf("Reservation handler redirected to %q when the room was taken, wanted /search-availability", location)
+	}
+	if message := session.GetString(ctx, "error"); !strings.Contains(message, "no longer free") {
+		t.Errorf("Reservation handler flashed %q when the room was taken", message)
+	}
+
 }
 
 var testData_AvailabilityJSON = []struct {
@@ -241,7 +303,8 @@ var testData_AvailabilityJSON = []struct {
 }{
 	// 2050-01-01 is already booked, 2060-01-01 is available
 	{"roomNotAvailable", "2050-01-01", "2060-01-01", "1"},
-	{"roomAvailable", "2060-01-01", "2060-01-01", "1"},
+	{"roomAvailable", "2060-01-01", "2060-01-02", "1"},
+	{"stayRuleBlocks", "2070-01-01", "2070-01-02", "1"},
 	{"noRequestBody", "2060-01-01", "2060-01-01", "1"},
 	{"databaseErrors", "2050-01-01", "2050-01-01", "1"},
 	{"failConvertStartDate", "Invalid", "2060-01-02", "1"},
@@ -296,6 +359,14 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 			if !j.OK {
 				t.Error("Got no availability when some was expected in AvailabilityJSON")
 			}
+		case "stayRuleBlocks":
+			if j.OK || j.Message == "" {
+				t.Error("Got availability when a stay rule blocks the dates in AvailabilityJSON")
+			}
+			// Arrivals in December 2069 are not covered by the rule
+			if len(j.Alternatives) == 0 || j.Alternatives[0].StartDate != "2069-12-31" {
+				t.Errorf("Expected the closest free dates in AvailabilityJSON, got %v", j.Alternatives)
+			}
 		case "noRequestBody":
 			if j.OK || j.Message != "Internal server error!" {
 				t.Error("Got availability when request body of POST method was empty")
@@ -555,7 +626,7 @@ func TestRepository_PostAvailability(t *testing.T) {
 	// 2050-01-01 is not room available
 	postedData = url.Values{}
 	postedData.Add("start", "2060-01-01")
-	postedData.Add("end", "2060-01-01")
+	postedData.Add("end", "2060-01-02")
 
 	// create our request
 	req, _ = http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
@@ -857,75 +928,125 @@ func TestAdminDeleteReservation(t *testing.T) {
 	}
 }
 
+// currentVersion in the posted data is replaced by the version of the January 2050 calendar,
+// the test repository is only set up once the tests run
+const currentVersion = "current"
+
+// januaryVersion is the version of the January 2050 calendar in the test repository
+func januaryVersion() string {
+	first := time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC)
+	restrictions, _ := Repo.DB.GetRestrictionsByDate(context.Background(), first, first.AddDate(0, 1, 0))
+	return calendarVersion(restrictions)
+}
+
 var adminPostReservationCalendarTests = []struct {
-	name                 string
-	postedData           url.Values
-	expectedResponseCode int
-	expectedLocation     string
-	expectedHTML         string
-	blocks               int
-	reservations         int
+	name             string
+	postedData       url.Values
+	expectedLocation string
+	expectedError    bool
 }{
 	{
-		name: "cal",
+		name: "add-nights",
 		postedData: url.Values{
-			"year":  {time.Now().Format("2006")},
-			"month": {time.Now().Format("01")},
-			fmt.Sprintf("add_block_1_%s", time.Now().AddDate(0, 0, 2).Format("2006-01-2")): {"1"},
+			"y":         {"2050"},
+			"m":         {"1"},
+			"version":   {currentVersion},
+			"add_block": {"1_2050-01-10", "1_2050-01-11", "2_2050-01-10"},
 		},
-		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
 	},
 	{
-		name:                 "cal-blocks",
-		postedData:           url.Values{},
-		expectedResponseCode: http.StatusSeeOther,
-		blocks:               1,
+		name: "remove-block",
+		postedData: url.Values{
+			"y":            {"2050"},
+			"m":            {"01"},
+			"version":      {currentVersion},
+			"remove_block": {"1"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
 	},
 	{
-		name:                 "cal-res",
-		postedData:           url.Values{},
-		expectedResponseCode: http.StatusSeeOther,
-		reservations:         1,
+		name: "stale-version",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"1"},
+			"version":   {calendarVersion(nil)},
+			"add_block": {"1_2050-01-10"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name: "missing-version",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"1"},
+			"add_block": {"1_2050-01-10"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name: "remove-unknown-block",
+		postedData: url.Values{
+			"y":            {"2050"},
+			"m":            {"1"},
+			"version":      {currentVersion},
+			"remove_block": {"99"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name: "add-blocked-night",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"1"},
+			"version":   {currentVersion},
+			"add_block": {"1_2050-01-02"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name: "add-night-of-another-month",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"1"},
+			"version":   {currentVersion},
+			"add_block": {"1_2050-02-01"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name: "malformed-add",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"1"},
+			"version":   {currentVersion},
+			"add_block": {"2050-01-10"},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+		expectedError:    true,
+	},
+	{
+		name:             "missing-month",
+		postedData:       url.Values{},
+		expectedLocation: "/admin/reservations-calendar",
+		expectedError:    true,
 	},
 }
 
 func TestAdminPostReservationCalendar(t *testing.T) {
 	for _, e := range adminPostReservationCalendarTests {
-		var req *http.Request
-		if e.postedData != nil {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.postedData.Encode()))
-		} else {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", nil)
+		if e.postedData.Get("version") == currentVersion {
+			e.postedData.Set("version", januaryVersion())
 		}
+		req, _ := http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.postedData.Encode()))
 		ctx := getCtx(req)
 		req = req.WithContext(ctx)
 
-		now := time.Now()
-		bm := make(map[string]int)
-		rm := make(map[string]int)
-
-		currentYear, currentMonth, _ := now.Date()
-		currentLocation := now.Location()
-
-		firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-		lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
-
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			rm[d.Format("2006-01-2")] = 0
-			bm[d.Format("2006-01-2")] = 0
-		}
-
-		if e.blocks > 0 {
-			bm[firstOfMonth.Format("2006-01-2")] = e.blocks
-		}
-
-		if e.reservations > 0 {
-			rm[lastOfMonth.Format("2006-01-2")] = e.reservations
-		}
-
-		session.Put(ctx, "block_map_1", bm)
-		session.Put(ctx, "reservation_map_1", rm)
-
 		// set the header
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		rr := httptest.NewRecorder()
@@ -934,10 +1055,19 @@ func TestAdminPostReservationCalendar(t *testing.T) {
 		handler := http.HandlerFunc(Repo.AdminPostReservationsCalendar)
 		handler.ServeHTTP(rr, req)
 
-		if rr.Code != e.expectedResponseCode {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
 		}
 
+		hasError := session.GetString(ctx, "error") != ""
+		if hasError != e.expectedError {
+			t.Errorf("failed %s: expected error %v, but got %v", e.name, e.expectedError, hasError)
+		}
 	}
 }
 
@@ -990,6 +1120,28 @@ var adminPostShowReservationTests = []struct {
 		expectedLocation:     "/admin/reservations-calendar?y=2022&m=01",
 		expectedHTML:         "",
 	},
+	{
+		name: "in-the-trash",
+		url:  "/admin/reservations/all/7/show",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "/admin/reservations/all/7/show",
+		expectedHTML:         "",
+	},
+	{
+		name: "unknown-reservation",
+		url:  "/admin/reservations/all/99/show",
+		postedData: url.Values{
+			"first_name": {"John"},
+		},
+		expectedResponseCode: http.StatusNotFound,
+		expectedLocation:     "",
+		expectedHTML:         "",
+	},
 }
 
 // TestAdminPostShowReservations tests the AdminPostReservation handler
@@ -1035,3 +1187,2033 @@ func TestAdminPostShowReservations(t *testing.T) {
 		}
 	}
 }
+
+var adminPostRoomAssignmentTests = []struct {
+	name             string
+	postedData       url.Values
+	expectedLocation string
+}{
+	{
+		name: "apply-current-month",
+		postedData: url.Values{
+			"fingerprint": {assignment.Plan{}.Fingerprint()},
+		},
+		expectedLocation: fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", time.Now().Format("2006"), time.Now().Format("01")),
+	},
+	{
+		name: "apply-given-month",
+		postedData: url.Values{
+			"y":           {"2050"},
+			"m":           {"1"},
+			"fingerprint": {assignment.Plan{}.Fingerprint()},
+		},
+		expectedLocation: "/admin/reservations-calendar?y=2050&m=01",
+	},
+	{
+		name: "plan-changed",
+		postedData: url.Values{
+			"y":           {"2050"},
+			"m":           {"1"},
+			"fingerprint": {assignment.Plan{}.Fingerprint()},
+			"move":        {"1:2"},
+		},
+		expectedLocation: "/admin/room-assignment?y=2050&m=01",
+	},
+	{
+		name: "no-fingerprint",
+		postedData: url.Values{
+			"y": {"2050"},
+			"m": {"1"},
+		},
+		expectedLocation: "/admin/room-assignment?y=2050&m=01",
+	},
+}
+
+// TestAdminPostRoomAssignment tests the AdminPostRoomAssignment handler
+func TestAdminPostRoomAssignment(t *testing.T) {
+	for _, e := range adminPostRoomAssignmentTests {
+		req, _ := http.NewRequest("POST", "/admin/room-assignment", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostRoomAssignment)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+	}
+}
+
+// typedRooms gives every room the same type, so that the room assignment may trade guests between them
+type typedRooms struct {
+	repository.DatabaseRepo
+}
+
+func (t typedRooms) AllRooms(ctx context.Context) ([]models.Room, error) {
+	rooms, err := t.DatabaseRepo.AllRooms(ctx)
+	for i := range rooms {
+		rooms[i].RoomType = "suite"
+	}
+	return rooms, err
+}
+
+// TestAdminPostRoomAssignmentApplies applies a plan to rooms that check every move. Swapping reservations
+// 2 and 3 would fill the hole of room 1 too, but no swap can be applied one move at a time.
+func TestAdminPostRoomAssignmentApplies(t *testing.T) {
+	repo := &Repository{App: &app, DB: typedRooms{dbrepo.NewMemoryRepo(&app)}}
+	ctx := context.Background()
+
+	stays := []struct{ room, start, end int }{{1, 2, 3}, {2, 6, 7}, {1, 4, 7}}
+	for i, s := range stays {
+		res := models.Reservation{
+			FirstName:        "John",
+			LastName:         "Smith",
+			Email:            "john@example.com",
+			Phone:            "555 0100",
+			RoomID:           s.room,
+			StartDate:        time.Date(2060, time.May, s.start, 0, 0, 0, 0, time.UTC),
+			EndDate:          time.Date(2060, time.May, s.end, 0, 0, 0, 0, time.UTC),
+			Adults:           1,
+			ConfirmationCode: fmt.Sprintf("PLAN%04d", i),
+		}
+		id, err := repo.DB.InsertReservation(ctx, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.DB.InsertRoomRestriction(ctx, &models.RoomRestriction{
+			StartDate: res.StartDate, EndDate: res.EndDate, RoomID: res.RoomID, ReservationID: id, RestrictionID: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/room-assignment?y=2060&m=05", nil)
+	req = req.WithContext(getCtx(req))
+	req.ParseForm()
+	plan, _, err := repo.assignmentPlan(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Moves) == 0 {
+		t.Fatal("expected a plan filling the hole of room 1")
+	}
+
+	postedData := url.Values{
+		"y":           {"2060"},
+		"m":           {"05"},
+		"fingerprint": {plan.Fingerprint()},
+	}
+	for _, move := range plan.Moves {
+		postedData.Add("move", fmt.Sprintf("%d:%d", move.Reservation.ID, move.ToRoom.ID))
+	}
+	req, _ = http.NewRequest("POST", "/admin/room-assignment", strings.NewReader(postedData.Encode()))
+	req = req.WithContext(getCtx(req))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(repo.AdminPostRoomAssignment).ServeHTTP(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/admin/reservations-calendar?y=2060&m=05" {
+		t.Errorf("expected the plan applied, got redirected to %s with %q", location, session.GetString(req.Context(), "error"))
+	}
+	for _, move := range plan.Moves {
+		res, err := repo.DB.GetReservationByID(ctx, move.Reservation.ID)
+		if err != nil || res.RoomID != move.ToRoom.ID {
+			t.Errorf("expected reservation %d in room %d, got %+v, %v", move.Reservation.ID, move.ToRoom.ID, res, err)
+		}
+	}
+}
+
+var postAvailabilityOccupancyTests = []struct {
+	name               string
+	adults             string
+	children           string
+	expectedStatusCode int
+}{
+	{"party-fits", "2", "2", http.StatusOK},
+	{"default-party", "", "", http.StatusOK},
+	{"party-too-large", "4", "1", http.StatusSeeOther},
+	{"no-adult", "0", "2", http.StatusSeeOther},
+	{"invalid-children", "2", "invalid", http.StatusSeeOther},
+}
+
+// TestPostAvailabilityOccupancy tests that the search only offers rooms that fit the party
+func TestPostAvailabilityOccupancy(t *testing.T) {
+	for _, e := range postAvailabilityOccupancyTests {
+		postedData := url.Values{}
+		postedData.Add("start", "2060-01-01")
+		postedData.Add("end", "2060-01-02")
+		postedData.Add("adults", e.adults)
+		postedData.Add("children", e.children)
+
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAvailability)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+// TestReservationOccupancy tests that a party larger than the room is sent back to the search
+func TestReservationOccupancy(t *testing.T) {
+	var tooLarge = models.Reservation{
+		RoomID:   1,
+		Adults:   4,
+		Children: 2,
+	}
+
+	req, _ := http.NewRequest("GET", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", tooLarge)
+
+	handler := http.HandlerFunc(Repo.Reservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Reservation handler returned wrong code for a party too large: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/search-availability" {
+		t.Errorf("expected location /search-availability, but got %s", actualLoc.String())
+	}
+}
+
+var stayRuleSearchTests = []struct {
+	name             string
+	start            string
+	end              string
+	expectedLocation string
+}{
+	{"end-before-start", "2060-01-02", "2060-01-01", "/search-availability"},
+	{"start-in-the-past", "2000-01-01", "2000-01-03", "/search-availability"},
+}
+
+// TestPostAvailabilityStayRules tests that the search explains the stay rules blocking the dates
+func TestPostAvailabilityStayRules(t *testing.T) {
+	for _, e := range stayRuleSearchTests {
+		postedData := url.Values{}
+		postedData.Add("start", e.start)
+		postedData.Add("end", e.end)
+
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAvailability)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+
+		if session.GetString(ctx, "error") == "" {
+			t.Errorf("failed %s: no explanation for the guest", e.name)
+		}
+	}
+
+	// Room 1 needs 3 nights, the guest gets the reason and the closest free dates instead
+	postedData := url.Values{}
+	postedData.Add("start", "2070-01-01")
+	postedData.Add("end", "2070-01-02")
+
+	req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostAvailability)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("failed minimum-stay: expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "at least 3 nights") || !strings.Contains(rr.Body.String(), "Next available dates") {
+		t.Error("failed minimum-stay: the page doesn't explain the rule and suggest other dates")
+	}
+
+	// A stay long enough for the rule goes through
+	postedData = url.Values{}
+	postedData.Add("start", "2070-01-01")
+	postedData.Add("end", "2070-01-04")
+
+	req, _ = http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(Repo.PostAvailability)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("failed long-enough-stay: expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+// TestBookRoomStayRules tests that BookRoom refuses a stay blocked by a stay rule
+func TestBookRoomStayRules(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/book-room?s=2070-01-01&e=2070-01-02&id=1", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.BookRoom)
+	handler.ServeHTTP(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/search-availability" {
+		t.Errorf("BookRoom did not refuse a stay blocked by a stay rule: got %d to %s", rr.Code, actualLoc.String())
+	}
+}
+
+var adminPostStayRulesTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+}{
+	{
+		name: "valid-rule",
+		postedData: url.Values{
+			"room_id":           {"1"},
+			"start_date":        {"2050-07-01"},
+			"end_date":          {"2050-08-31"},
+			"min_nights":        {"2"},
+			"closed_to_arrival": {"0", "6"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "missing-dates",
+		postedData: url.Values{
+			"room_id": {"1"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "end-before-start",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-08-31"},
+			"end_date":   {"2050-07-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "negative-nights",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-01"},
+			"end_date":   {"2050-08-31"},
+			"max_nights": {"-1"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "unknown-weekday",
+		postedData: url.Values{
+			"room_id":             {"1"},
+			"start_date":          {"2050-07-01"},
+			"end_date":            {"2050-08-31"},
+			"closed_to_departure": {"9"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "invalid-room",
+		postedData: url.Values{
+			"room_id":    {"one"},
+			"start_date": {"2050-07-01"},
+			"end_date":   {"2050-08-31"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "unknown-room",
+		postedData: url.Values{
+			"room_id":    {"3"},
+			"start_date": {"2050-07-01"},
+			"end_date":   {"2050-08-31"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+// TestAdminPostStayRules tests the AdminPostStayRules handler
+func TestAdminPostStayRules(t *testing.T) {
+	for _, e := range adminPostStayRulesTests {
+		req, _ := http.NewRequest("POST", "/admin/stay-rules", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostStayRules)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminPostBlocksTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+}{
+	{
+		name: "one-off-block",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-01"},
+			"end_date":   {"2050-07-05"},
+			"note":       {"painting"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "weekly-block",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-04"},
+			"end_date":   {"2050-07-05"},
+			"frequency":  {"weekly"},
+			"until_date": {"2050-12-31"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "end-not-after-start",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-05"},
+			"end_date":   {"2050-07-05"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "repeat-without-until",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-04"},
+			"end_date":   {"2050-07-05"},
+			"frequency":  {"yearly"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "weekly-longer-than-a-week",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-04"},
+			"end_date":   {"2050-07-14"},
+			"frequency":  {"weekly"},
+			"until_date": {"2050-12-31"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "unknown-repeat",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-07-04"},
+			"end_date":   {"2050-07-05"},
+			"frequency":  {"daily"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "overlaps-a-stay",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-01-30"},
+			"end_date":   {"2050-02-02"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "series-overlaps-a-stay",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-01-18"},
+			"end_date":   {"2050-01-19"},
+			"frequency":  {"weekly"},
+			"until_date": {"2050-03-31"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+// TestAdminPostBlocks tests the AdminPostBlocks handler
+func TestAdminPostBlocks(t *testing.T) {
+	for _, e := range adminPostBlocksTests {
+		req, _ := http.NewRequest("POST", "/admin/blocks", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostBlocks)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminPostShowBlockTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "from-calendar",
+		url:  "/admin/blocks/1",
+		postedData: url.Values{
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-04"},
+			"year":       {"2050"},
+			"month":      {"01"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar?y=2050&m=01",
+	},
+	{
+		name: "from-blocks",
+		url:  "/admin/blocks/1",
+		postedData: url.Values{
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-04"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/blocks",
+	},
+	{
+		name: "overlapping-dates",
+		url:  "/admin/blocks/1",
+		postedData: url.Values{
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-02-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "invalid-dates",
+		url:  "/admin/blocks/1",
+		postedData: url.Values{
+			"start_date": {"2050-01-04"},
+			"end_date":   {"2050-01-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+// TestAdminPostShowBlock tests the AdminPostShowBlock handler through the router, it reads the {id} URL param
+func TestAdminPostShowBlock(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminPostShowBlockTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+// TestCalendarDays tests that a multi-day block is laid out as one calendar cell
+func TestCalendarDays(t *testing.T) {
+	first := time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(2050, time.January, 31, 0, 0, 0, 0, time.UTC)
+
+	reservations := map[string]int{"2050-01-10": 5, "2050-01-11": 5}
+	blocks := []models.RoomRestriction{
+		// started last month, blocks the nights of the 1st and 2nd
+		{ID: 1, StartDate: first.AddDate(0, 0, -3), EndDate: first.AddDate(0, 0, 2), Note: "closure"},
+		// the nights of the 20th to the 22nd
+		{ID: 2, StartDate: first.AddDate(0, 0, 19), EndDate: first.AddDate(0, 0, 22), SeriesID: 3},
+		// runs into next month
+		{ID: 4, StartDate: first.AddDate(0, 0, 29), EndDate: first.AddDate(0, 1, 5)},
+	}
+
+	days := calendarDays(first, last, reservations, blocks)
+
+	total := 0
+	spans := make(map[int]int)
+	for _, d := range days {
+		total += d.Span
+		if d.BlockID > 0 {
+			spans[d.BlockID] = d.Span
+		}
+	}
+
+	if total != 31 {
+		t.Errorf("expected the cells to cover 31 days, got %d", total)
+	}
+	if len(days) != 31-1-2-1 {
+		t.Errorf("expected %d cells, got %d", 31-1-2-1, len(days))
+	}
+	if spans[1] != 2 || spans[2] != 3 || spans[4] != 2 {
+		t.Errorf("unexpected block spans %v", spans)
+	}
+	if days[0].Note != "closure" || days[0].Date != "2050-01-01" {
+		t.Errorf("first cell should be the closure block, got %+v", days[0])
+	}
+}
+
+var adminCalendarJSONTests = []struct {
+	name   string
+	url    string
+	ok     bool
+	rooms  int
+	events int
+}{
+	{"january", "/admin/api/calendar?start=2050-01-01&end=2050-02-01", true, 2, 1},
+	{"room-filter", "/admin/api/calendar?start=2050-01-01&end=2050-02-01&rooms=2", true, 1, 0},
+	{"several-rooms", "/admin/api/calendar?start=2049-12-01&end=2050-03-01&rooms=1,2", true, 2, 1},
+	{"empty-window", "/admin/api/calendar?start=2050-06-01&end=2050-07-01", true, 2, 0},
+	{"missing-start", "/admin/api/calendar?end=2050-02-01", false, 0, 0},
+	{"end-before-start", "/admin/api/calendar?start=2050-02-01&end=2050-01-01", false, 0, 0},
+	{"window-too-long", "/admin/api/calendar?start=2050-01-01&end=2052-01-01", false, 0, 0},
+	{"invalid-room", "/admin/api/calendar?start=2050-01-01&end=2050-02-01&rooms=one", false, 0, 0},
+}
+
+// TestAdminCalendarJSON tests the JSON calendar feed
+func TestAdminCalendarJSON(t *testing.T) {
+	for _, e := range adminCalendarJSONTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminCalendarJSON)
+		handler.ServeHTTP(rr, req)
+
+		var feed calendarFeed
+		err := json.Unmarshal(rr.Body.Bytes(), &feed)
+		if err != nil {
+			t.Errorf("failed %s: can't parse json: %s", e.name, err)
+			continue
+		}
+
+		if feed.OK != e.ok {
+			t.Errorf("failed %s: expected ok %v, but got %v (%s)", e.name, e.ok, feed.OK, feed.Message)
+		}
+		if len(feed.Rooms) != e.rooms {
+			t.Errorf("failed %s: expected %d rooms, but got %d", e.name, e.rooms, len(feed.Rooms))
+		}
+		if len(feed.Events) != e.events {
+			t.Errorf("failed %s: expected %d events, but got %d", e.name, e.events, len(feed.Events))
+		}
+		for _, event := range feed.Events {
+			if event.Type != "block" || event.Title != "Blocked" || event.StartDate != "2050-01-01" {
+				t.Errorf("failed %s: unexpected event %+v", e.name, event)
+			}
+		}
+	}
+}
+
+var adminCalendarChangeJSONTests = []struct {
+	name       string
+	url        string
+	postedData url.Values
+	ok         bool
+}{
+	{
+		name:       "move-reservation",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"room_id": {"2"}, "start_date": {"2050-03-01"}, "end_date": {"2050-03-04"}},
+		ok:         true,
+	},
+	{
+		name:       "move-onto-taken-nights",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"2050-01-30"}, "end_date": {"2050-02-02"}},
+	},
+	{
+		name:       "move-shorter-than-minimum-stay",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"2070-03-01"}, "end_date": {"2070-03-03"}},
+	},
+	{
+		name:       "move-to-missing-room",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"room_id": {"3"}, "start_date": {"2050-03-01"}, "end_date": {"2050-03-04"}},
+	},
+	{
+		name:       "move-with-bad-dates",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"start_date": {"2050-03-04"}, "end_date": {"2050-03-01"}},
+	},
+	{
+		name:       "move-with-invalid-date",
+		url:        "/admin/api/reservations/1/move",
+		postedData: url.Values{"start_date": {"tomorrow"}, "end_date": {"2050-03-01"}},
+	},
+	{
+		// Reservation 6 is in house, staff keep its arrival day in the past
+		name:       "extend-stay-in-house",
+		url:        "/admin/api/reservations/6/move",
+		postedData: url.Values{"end_date": {time.Now().AddDate(0, 0, 3).Format("2006-01-02")}},
+		ok:         true,
+	},
+	{
+		name:       "move-reservation-in-the-trash",
+		url:        "/admin/api/reservations/7/move",
+		postedData: url.Values{"room_id": {"2"}, "start_date": {"2050-04-01"}, "end_date": {"2050-04-04"}},
+	},
+	{
+		name:       "resize-block",
+		url:        "/admin/api/blocks/1/resize",
+		postedData: url.Values{"end_date": {"2050-01-05"}},
+		ok:         true,
+	},
+	{
+		name:       "resize-onto-taken-nights",
+		url:        "/admin/api/blocks/1/resize",
+		postedData: url.Values{"end_date": {"2050-02-03"}},
+	},
+	{
+		name:       "resize-to-nothing",
+		url:        "/admin/api/blocks/1/resize",
+		postedData: url.Values{"end_date": {"2050-01-01"}},
+	},
+	{
+		name:       "resize-missing-block",
+		url:        "/admin/api/blocks/2/resize",
+		postedData: url.Values{"end_date": {"2050-01-05"}},
+	},
+}
+
+// TestAdminCalendarChangeJSON tests the endpoints moving reservations and resizing blocks
+func TestAdminCalendarChangeJSON(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminCalendarChangeJSONTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		var j jsonResponse
+		err := json.Unmarshal(rr.Body.Bytes(), &j)
+		if err != nil {
+			t.Errorf("failed %s: can't parse json: %s", e.name, err)
+			continue
+		}
+
+		if j.OK != e.ok {
+			t.Errorf("failed %s: expected ok %v, but got %v (%s)", e.name, e.ok, j.OK, j.Message)
+		}
+		if !j.OK && j.Message == "" {
+			t.Errorf("failed %s: no message explaining the refusal", e.name)
+		}
+	}
+}
+
+var flexibleSearchTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{
+		name:               "flexible-dates",
+		postedData:         url.Values{"start": {"2060-01-10"}, "end": {"2060-01-12"}, "flex": {"2"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Next available dates",
+	},
+	{
+		name:               "exact-dates",
+		postedData:         url.Values{"start": {"2060-01-10"}, "end": {"2060-01-12"}, "flex": {"0"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose a room",
+	},
+	{
+		name:               "flexibility-too-wide",
+		postedData:         url.Values{"start": {"2060-01-10"}, "end": {"2060-01-12"}, "flex": {"30"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name:               "flexible-party-too-big",
+		postedData:         url.Values{"start": {"2060-01-10"}, "end": {"2060-01-12"}, "flex": {"3"}, "adults": {"5"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+}
+
+// TestPostAvailabilityFlexible tests the search with flexible dates
+func TestPostAvailabilityFlexible(t *testing.T) {
+	for _, e := range flexibleSearchTests {
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAvailability)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %q in the page", e.name, e.expectedHTML)
+		}
+	}
+}
+
+// gridMonth returns the month n months from now, as the availability grid takes it, and its number of days
+func gridMonth(n int) (string, int) {
+	year, month, _ := time.Now().Date()
+	first := time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	return first.Format("2006-01"), first.AddDate(0, 1, -1).Day()
+}
+
+// inHouseNights returns the nights of this month the in-house reservation 6 of room 1 takes
+func inHouseNights() []string {
+	year, month, day := time.Now().Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+
+	var nights []string
+	for d := today.AddDate(0, 0, -2); !d.After(today); d = d.AddDate(0, 0, 1) {
+		if d.Month() == month {
+			nights = append(nights, d.Format("2006-01-02"))
+		}
+	}
+	return nights
+}
+
+var (
+	thisMonth, thisMonthDays = gridMonth(0)
+	nextMonth, nextMonthDays = gridMonth(1)
+	lastMonth, _             = gridMonth(-1)
+	farMonth, _              = gridMonth(maxGridAheadMonths + 1)
+)
+
+var availabilityGridTests = []struct {
+	name   string
+	url    string
+	ok     bool
+	days   int
+	booked []string
+}{
+	{
+		name:   "one-month",
+		url:    "/availability-grid?room_id=1&month=" + thisMonth + "&months=1&a=2",
+		ok:     true,
+		days:   thisMonthDays,
+		booked: inHouseNights(),
+	},
+	{
+		name: "two-months-other-room",
+		url:  "/availability-grid?room_id=2&month=" + thisMonth + "&months=2",
+		ok:   true,
+		days: thisMonthDays + nextMonthDays,
+	},
+	{
+		name: "missing-room",
+		url:  "/availability-grid?room_id=3&month=" + thisMonth,
+	},
+	{
+		name: "invalid-room-id",
+		url:  "/availability-grid?room_id=x",
+	},
+	{
+		name: "invalid-month",
+		url:  "/availability-grid?room_id=1&month=2050-13",
+	},
+	{
+		name: "past-month",
+		url:  "/availability-grid?room_id=1&month=" + lastMonth,
+	},
+	{
+		name: "month-too-far",
+		url:  "/availability-grid?room_id=1&month=" + farMonth,
+	},
+	{
+		name: "too-many-months",
+		url:  "/availability-grid?room_id=1&month=" + thisMonth + "&months=13",
+	},
+	{
+		name: "no-adult",
+		url:  "/availability-grid?room_id=1&month=" + thisMonth + "&a=0",
+	},
+	{
+		// The rooms of the test repository sleep 4
+		name: "party-too-large",
+		url:  "/availability-grid?room_id=1&month=" + thisMonth + "&a=3&c=2",
+	},
+}
+
+func TestAvailabilityGridJSON(t *testing.T) {
+	for _, e := range availabilityGridTests {
+		grid := getAvailabilityGrid(t, e.url)
+
+		if grid.OK != e.ok {
+			t.Errorf("failed %s: expected ok %v, but got %v (%s)", e.name, e.ok, grid.OK, grid.Message)
+		}
+		if len(grid.Days) != e.days {
+			t.Errorf("failed %s: expected %d days, but got %d", e.name, e.days, len(grid.Days))
+		}
+
+		var booked []string
+		for _, day := range grid.Days {
+			if day.Status == availability.StatusBooked {
+				booked = append(booked, day.Date)
+			}
+		}
+		if fmt.Sprint(booked) != fmt.Sprint(e.booked) {
+			t.Errorf("failed %s: expected booked nights %v, but got %v", e.name, e.booked, booked)
+		}
+	}
+}
+
+func TestAvailabilityGridCache(t *testing.T) {
+	start, _ := time.Parse("2006-01", nextMonth)
+	key := availability.GridKey(1, start, start.AddDate(0, 1, 0), 1, 0)
+	Repo.Grid.Set(key, []availability.Day{{Date: start, Status: availability.StatusBlocked}}, Repo.Grid.Generation())
+
+	grid := getAvailabilityGrid(t, "/availability-grid?room_id=1&month="+nextMonth+"&months=1")
+	if len(grid.Days) != 1 || grid.Days[0].Status != availability.StatusBlocked {
+		t.Errorf("expected the cached grid, but got %d days", len(grid.Days))
+	}
+
+	// Any change of the availability drops the cached grids
+	err := Repo.DB.DeleteBlockByID(context.Background(), models.Actor{UserID: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grid = getAvailabilityGrid(t, "/availability-grid?room_id=1&month="+nextMonth+"&months=1")
+	if len(grid.Days) != nextMonthDays {
+		t.Errorf("expected a fresh grid of %d days after a change, but got %d days", nextMonthDays, len(grid.Days))
+	}
+}
+
+func TestAvailabilityGridCacheTransaction(t *testing.T) {
+	start := time.Date(2050, time.August, 1, 0, 0, 0, 0, time.UTC)
+	key := availability.GridKey(1, start, start.AddDate(0, 1, 0), 1, 0)
+	cached := []availability.Day{{Date: start, Status: availability.StatusBlocked}}
+	Repo.Grid.Set(key, cached, Repo.Grid.Generation())
+
+	// A rolled back change leaves the cached grids alone
+	rollback := errors.New("roll back")
+	err := Repo.DB.Transaction(context.Background(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteBlockByID(context.Background(), models.Actor{UserID: 1}, 1)
+		if err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("expected the error of the transaction, but got %v", err)
+	}
+	if _, ok := Repo.Grid.Get(key); !ok {
+		t.Error("the cached grid was dropped by a rolled back change")
+	}
+
+	// A committed one drops them, once committed
+	err = Repo.DB.Transaction(context.Background(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteBlockByID(context.Background(), models.Actor{UserID: 1}, 1)
+		if _, ok := Repo.Grid.Get(key); !ok {
+			t.Error("the cached grid was dropped before the commit")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Repo.Grid.Get(key); ok {
+		t.Error("the cached grid outlived a committed change")
+	}
+}
+
+func getAvailabilityGrid(t *testing.T, target string) gridResponse {
+	req, _ := http.NewRequest("GET", target, nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AvailabilityGridJSON)
+	handler.ServeHTTP(rr, req)
+
+	var grid gridResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &grid)
+	if err != nil {
+		t.Fatalf("%s: can't parse json: %s", target, err)
+	}
+	return grid
+}
+
+var adminDashboardJSONTests = []struct {
+	name      string
+	url       string
+	ok        bool
+	occupancy []float64 // Rate of every room and month, room 1 first
+}{
+	{"default-range", "/admin/api/dashboard", true, nil},
+	{"two-months", "/admin/api/dashboard?start=2050-01-01&end=2050-03-01", true, []float64{1000.0 / 31, 1000.0 / 28, 0, 0}},
+	{"half-month", "/admin/api/dashboard?start=2050-04-01&end=2050-04-21", true, []float64{50, 0}},
+	{"missing-end", "/admin/api/dashboard?start=2050-01-01", false, nil},
+	{"end-before-start", "/admin/api/dashboard?start=2050-03-01&end=2050-01-01", false, nil},
+	{"range-too-long", "/admin/api/dashboard?start=2050-01-01&end=2052-01-01", false, nil},
+}
+
+func TestAdminDashboardJSON(t *testing.T) {
+	for _, e := range adminDashboardJSONTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminDashboardJSON)
+		handler.ServeHTTP(rr, req)
+
+		var feed dashboardFeed
+		err := json.Unmarshal(rr.Body.Bytes(), &feed)
+		if err != nil {
+			t.Errorf("failed %s: can't parse json: %s", e.name, err)
+			continue
+		}
+
+		if feed.OK != e.ok {
+			t.Errorf("failed %s: expected ok %v, but got %v (%s)", e.name, e.ok, feed.OK, feed.Message)
+		}
+		if !e.ok {
+			continue
+		}
+
+		if feed.Arrivals != 1 || feed.Departures != 0 {
+			t.Errorf("failed %s: expected 1 arrival and no departure today, but got %d and %d", e.name, feed.Arrivals, feed.Departures)
+		}
+		if feed.New != 1 || feed.Processed != 3 || feed.AverageStay != 2.5 || feed.Revenue != "450.00" {
+			t.Errorf("failed %s: unexpected figures %+v", e.name, feed)
+		}
+		if e.occupancy == nil {
+			continue
+		}
+		if len(feed.Occupancy) != len(e.occupancy) {
+			t.Errorf("failed %s: expected %d occupancy rows, but got %d", e.name, len(e.occupancy), len(feed.Occupancy))
+			continue
+		}
+		for i, rate := range e.occupancy {
+			if math.Abs(feed.Occupancy[i].Rate-rate) > 0.001 {
+				t.Errorf("failed %s: expected a rate of %.2f for %s in %s, but got %.2f", e.name, rate,
+					feed.Occupancy[i].RoomName, feed.Occupancy[i].Month, feed.Occupancy[i].Rate)
+			}
+		}
+	}
+}
+
+var adminExportReportTests = []struct {
+	name             string
+	url              string
+	expectedStatus   int
+	expectedLocation string
+	expectedRows     int // Rows after the header
+}{
+	{
+		name:           "reservations-csv",
+		url:            "/admin/reports/export?report=reservations-by-stay&start=2050-01-01&end=2050-02-01&format=csv",
+		expectedStatus: http.StatusOK,
+		expectedRows:   2,
+	},
+	{
+		name:           "room-filter",
+		url:            "/admin/reports/export?report=guests&start=2050-01-01&end=2050-02-01&rooms=2&format=csv",
+		expectedStatus: http.StatusOK,
+		expectedRows:   1,
+	},
+	{
+		name:           "cancellations-other-room",
+		url:            "/admin/reports/export?report=cancellations&start=2050-01-01&end=2050-02-01&rooms=2&format=csv",
+		expectedStatus: http.StatusOK,
+		expectedRows:   0,
+	},
+	{
+		name:           "blocks-xlsx",
+		url:            "/admin/reports/export?report=blocks&start=2050-01-01&end=2050-02-01&format=xlsx",
+		expectedStatus: http.StatusOK,
+		expectedRows:   1,
+	},
+	{
+		name:             "unknown-report",
+		url:              "/admin/reports/export?report=payroll&start=2050-01-01&end=2050-02-01&format=csv",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/reports",
+	},
+	{
+		name:             "invalid-range",
+		url:              "/admin/reports/export?report=guests&start=2050-02-01&end=2050-01-01&format=csv",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/reports",
+	},
+	{
+		name:             "invalid-room",
+		url:              "/admin/reports/export?report=guests&start=2050-01-01&end=2050-02-01&rooms=one&format=csv",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/reports",
+	},
+	{
+		name:             "invalid-format",
+		url:              "/admin/reports/export?report=guests&start=2050-01-01&end=2050-02-01&format=pdf",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/reports",
+	},
+}
+
+func TestAdminExportReport(t *testing.T) {
+	for _, e := range adminExportReportTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminExportReport)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedLocation != "" {
+			location, _ := rr.Result().Location()
+			if location.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, location.String())
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment; filename=") {
+			t.Errorf("failed %s: not a download", e.name)
+		}
+
+		rows := 0
+		if strings.HasSuffix(e.url, "format=xlsx") {
+			z, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+			if err != nil {
+				t.Errorf("failed %s: not a workbook: %s", e.name, err)
+				continue
+			}
+			for _, f := range z.File {
+				if f.Name == "xl/worksheets/sheet1.xml" {
+					rc, _ := f.Open()
+					sheet, _ := io.ReadAll(rc)
+					rc.Close()
+					rows = strings.Count(string(sheet), "<row ") - 1
+				}
+			}
+		} else {
+			records, err := csv.NewReader(rr.Body).ReadAll()
+			if err != nil {
+				t.Errorf("failed %s: invalid csv: %s", e.name, err)
+				continue
+			}
+			rows = len(records) - 1
+		}
+
+		if rows != e.expectedRows {
+			t.Errorf("failed %s: expected %d rows, but got %d", e.name, e.expectedRows, rows)
+		}
+	}
+}
+
+var reservationListTests = []struct {
+	name     string
+	url      string
+	expected []string // Parts of the page, markup is matched as is and text escaped
+	missing  []string // Parts that must not be on the page
+}{
+	{
+		name:     "first-page",
+		url:      "/admin/reservations-all",
+		expected: []string{"Showing 1 to 20 of 45 reservations", `href="/admin/reservations-all?page=2">Next`},
+		missing:  []string{">Previous<"},
+	},
+	{
+		name: "last-page",
+		url:  "/admin/reservations-all?page=3",
+		expected: []string{"Showing 41 to 45 of 45 reservations", `href="/admin/reservations-all?page=2">Previous`,
+			"/admin/reservations/all/45/show"},
+		missing: []string{">Next<"},
+	},
+	{
+		name: "filters-kept-in-links",
+		url:  "/admin/reservations-all?q=smith&room=1&per_page=5&page=2",
+		expected: []string{"Showing 6 to 10 of 23 reservations",
+			`href="/admin/reservations-all?page=3&amp;per_page=5&amp;q=smith&amp;room=1">Next`,
+			`href="/admin/reservations-all?dir=asc&amp;per_page=5&amp;q=smith&amp;room=1&amp;sort=last_name"`},
+	},
+	{
+		name:     "sort-flips-direction",
+		url:      "/admin/reservations-all?sort=id&dir=asc",
+		expected: []string{`href="/admin/reservations-all?dir=desc&amp;sort=id"`},
+	},
+	{
+		name:     "processed-only",
+		url:      "/admin/reservations-all?status=processed",
+		expected: []string{"Showing 1 to 15 of 15 reservations"},
+	},
+	{
+		name:     "stay-dates",
+		url:      "/admin/reservations-all?start=2050-01-10&end=2050-01-12",
+		expected: []string{"Showing 1 to 3 of 3 reservations"},
+	},
+	{
+		name:     "new-list-ignores-status",
+		url:      "/admin/reservations-new?status=processed",
+		expected: []string{"Showing 1 to 20 of 30 reservations", "/admin/reservations/new/1/show"},
+	},
+	{
+		name:     "past-the-last-page",
+		url:      "/admin/reservations-all?page=9",
+		expected: []string{"No reservation found"},
+	},
+	{
+		name:     "invalid-values-ignored",
+		url:      "/admin/reservations-all?page=x&per_page=1000&room=one&sort=password",
+		expected: []string{"Showing 1 to 20 of 45 reservations"},
+	},
+}
+
+func TestReservationLists(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range reservationListTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+			continue
+		}
+		for _, part := range e.expected {
+			if !strings.Contains(rr.Body.String(), part) {
+				t.Errorf("failed %s: page is missing %s", e.name, part)
+			}
+		}
+		for _, part := range e.missing {
+			if strings.Contains(rr.Body.String(), part) {
+				t.Errorf("failed %s: page shouldn't have %s", e.name, part)
+			}
+		}
+	}
+}
+
+var parseSearchTests = []struct {
+	q     string
+	text  string
+	month time.Month
+}{
+	{"smith", "smith", 0},
+	{"the Smith booking in May", "the Smith booking in", time.May},
+	{"smith sep", "smith", time.September},
+	{"march april", "april", time.March},
+	{"mayfair", "mayfair", 0},
+}
+
+func TestParseSearch(t *testing.T) {
+	for _, e := range parseSearchTests {
+		text, month := parseSearch(e.q)
+		if text != e.text || month != e.month {
+			t.Errorf("%q: expected %q and %v, but got %q and %v", e.q, e.text, e.month, text, month)
+		}
+	}
+}
+
+var adminSearchTests = []struct {
+	name     string
+	url      string
+	expected []string // Parts of the page
+	missing  []string
+}{
+	{
+		name:     "guest-in-month",
+		url:      "/admin/search?q=smith+may",
+		expected: []string{"Arriving in May", "Guests</h4>", "Notes", "/admin/reservations/all/1/show", "[Smith] asked for a late check-out"},
+		missing:  []string{"Confirmation codes", "Rooms"},
+	},
+	{
+		name:     "guest-other-month",
+		url:      "/admin/search?q=smith+june",
+		expected: []string{"Nothing found"},
+	},
+	{
+		name:     "code",
+		url:      "/admin/search?q=ABCD",
+		expected: []string{"Confirmation codes", "ABCD2345"},
+		missing:  []string{"Guests</h4>"},
+	},
+	{
+		name:     "room",
+		url:      "/admin/search?q=general",
+		expected: []string{"Rooms", "/admin/reservations/all/2/show"},
+	},
+	{
+		name:     "too-short",
+		url:      "/admin/search?q=s+may",
+		expected: []string{"Type at least 2 characters"},
+	},
+	{
+		name:    "empty",
+		url:     "/admin/search",
+		missing: []string{"Type at least", "Nothing found"},
+	},
+}
+
+func TestAdminSearch(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminSearchTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+			continue
+		}
+		for _, part := range e.expected {
+			if !pageHas(rr.Body.String(), part) {
+				t.Errorf("failed %s: page is missing %s", e.name, part)
+			}
+		}
+		for _, part := range e.missing {
+			if pageHas(rr.Body.String(), part) {
+				t.Errorf("failed %s: page shouldn't have %s", e.name, part)
+			}
+		}
+	}
+}
+
+// pageHas reports whether part is in the page, as markup or as escaped text
+func pageHas(page, part string) bool {
+	return strings.Contains(page, part) || strings.Contains(page, template.HTMLEscapeString(part))
+}
+
+var adminPostShowGuestTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "valid",
+		url:  "/admin/guests/1",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"tags":       {"vip", "unknown"},
+			"notes":      {"Allergic to feathers"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/guests/1",
+	},
+	{
+		name: "missing-last-name",
+		url:  "/admin/guests/1",
+		postedData: url.Values{
+			"first_name": {"John"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "invalid-email",
+		url:  "/admin/guests/1",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "email-of-another-guest",
+		url:  "/admin/guests/1",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"johnny@work.com"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "unknown-guest",
+		url:  "/admin/guests/9",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+		},
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name: "merge",
+		url:  "/admin/guests/1/merge",
+		postedData: url.Values{
+			"duplicate_id": {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/guests/1",
+	},
+	{
+		name: "merge-same-guest",
+		url:  "/admin/guests/1/merge",
+		postedData: url.Values{
+			"duplicate_id": {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/guests/1",
+	},
+	{
+		name: "merge-unknown-guest",
+		url:  "/admin/guests/1/merge",
+		postedData: url.Values{
+			"duplicate_id": {"3"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/guests/1",
+	},
+}
+
+// TestAdminPostShowGuest tests the guest form and the merge of duplicates through the router
+func TestAdminPostShowGuest(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminPostShowGuestTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+var guestAccountTests = []struct {
+	name             string
+	method           string
+	url              string
+	postedData       url.Values
+	accountID        int // Guest account logged in
+	expectedStatus   int
+	expectedLocation string
+}{
+	{
+		name:   "register",
+		method: "POST",
+		url:    "/account/register",
+		postedData: url.Values{
+			"first_name":       {"Mary"},
+			"last_name":        {"Jones"},
+			"email":            {"mary@jones.com"},
+			"password":         {"secret-password"},
+			"password_confirm": {"secret-password"},
+		},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account/login",
+	},
+	{
+		name:   "register-claiming-a-reservation",
+		method: "POST",
+		url:    "/account/register",
+		postedData: url.Values{
+			"first_name":       {"Mary"},
+			"last_name":        {"Jones"},
+			"email":            {"mary@jones.com"},
+			"code":             {"wxyz6789"},
+			"password":         {"secret-password"},
+			"password_confirm": {"secret-password"},
+		},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account/login",
+	},
+	{
+		name:   "register-code-of-another-email",
+		method: "POST",
+		url:    "/account/register",
+		postedData: url.Values{
+			"first_name":       {"Mary"},
+			"last_name":        {"Jones"},
+			"email":            {"mary@jones.com"},
+			"code":             {"ABCD2345"},
+			"password":         {"secret-password"},
+			"password_confirm": {"secret-password"},
+		},
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:   "register-passwords-differ",
+		method: "POST",
+		url:    "/account/register",
+		postedData: url.Values{
+			"first_name":       {"Mary"},
+			"last_name":        {"Jones"},
+			"email":            {"mary@jones.com"},
+			"password":         {"secret-password"},
+			"password_confirm": {"other-password"},
+		},
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:   "register-email-taken",
+		method: "POST",
+		url:    "/account/register",
+		postedData: url.Values{
+			"first_name":       {"John"},
+			"last_name":        {"Smith"},
+			"email":            {"John@Smith.com"},
+			"password":         {"secret-password"},
+			"password_confirm": {"secret-password"},
+		},
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:             "verify",
+		method:           "GET",
+		url:              "/account/verify?token=valid-token",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account",
+	},
+	{
+		name:             "verify-unknown-token",
+		method:           "GET",
+		url:              "/account/verify?token=other-token",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account/login",
+	},
+	{
+		name:             "login",
+		method:           "POST",
+		url:              "/account/login",
+		postedData:       url.Values{"email": {"john@smith.com"}, "password": {"password"}},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account",
+	},
+	{
+		name:             "login-unverified",
+		method:           "POST",
+		url:              "/account/login",
+		postedData:       url.Values{"email": {"johnny@smith.com"}, "password": {"password"}},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account/login",
+	},
+	{
+		name:             "login-wrong-password",
+		method:           "POST",
+		url:              "/account/login",
+		postedData:       url.Values{"email": {"john@smith.com"}, "password": {"wrong"}},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account/login",
+	},
+	{
+		name:           "login-invalid-email",
+		method:         "POST",
+		url:            "/account/login",
+		postedData:     url.Values{"email": {"john"}, "password": {"password"}},
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:           "account",
+		method:         "GET",
+		url:            "/account",
+		accountID:      1,
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:   "rebook",
+		method: "POST",
+		url:    "/account/rebook",
+		postedData: url.Values{
+			"reservation_id": {"1"},
+			"start":          {"2050-08-01"},
+			"end":            {"2050-08-03"},
+			"adults":         {"2"},
+			"children":       {"0"},
+		},
+		accountID:        1,
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/book-room?a=2&c=0&e=2050-08-03&id=2&s=2050-08-01",
+	},
+	{
+		name:   "rebook-reservation-of-another-guest",
+		method: "POST",
+		url:    "/account/rebook",
+		postedData: url.Values{
+			"reservation_id": {"2"},
+			"start":          {"2050-08-01"},
+			"end":            {"2050-08-03"},
+		},
+		accountID:        1,
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account",
+	},
+	{
+		name:   "rebook-departure-before-arrival",
+		method: "POST",
+		url:    "/account/rebook",
+		postedData: url.Values{
+			"reservation_id": {"1"},
+			"start":          {"2050-08-03"},
+			"end":            {"2050-08-01"},
+		},
+		accountID:        1,
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/account",
+	},
+}
+
+// TestGuestAccounts tests registering, verifying, logging in and rebooking through the router
+func TestGuestAccounts(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range guestAccountTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if e.accountID > 0 {
+			session.Put(ctx, "guest_account_id", e.accountID)
+		}
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+// TestReservationPrefill tests that make-reservation is filled in from the profile of the guest logged in
+func TestReservationPrefill(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", models.Reservation{RoomID: 1})
+	session.Put(ctx, "guest_account_id", 1)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.Reservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	for _, value := range []string{`value="John"`, `value="Smith"`, `value="john@smith.com"`, `value="0989123456"`} {
+		if !strings.Contains(rr.Body.String(), value) {
+			t.Errorf("make-reservation is missing %s", value)
+		}
+	}
+
+	reservation := session.Get(ctx, "reservation").(models.Reservation)
+	if reservation.GuestID != 1 {
+		t.Errorf("expected the reservation of guest 1, got guest %d", reservation.GuestID)
+	}
+}
+
+// TestPostReservationForAccount tests that a guest logged in books for its profile only under its own email
+func TestPostReservationForAccount(t *testing.T) {
+	repo := &Repository{App: &app, DB: dbrepo.NewMemoryRepo(&app)}
+	ctx := context.Background()
+
+	accountID, err := repo.DB.InsertGuestAccount(ctx, models.GuestAccount{
+		Email: "ann@example.com",
+		Guest: models.Guest{FirstName: "Ann", LastName: "Lee", Phone: "0989000111"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := repo.DB.GetGuestAccountByID(ctx, accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ann books for Bob, with his details, from her account
+	tests := []struct {
+		name      string
+		firstName string
+		email     string
+		phone     string
+		day       int
+		ownGuest  bool
+	}{
+		{"own-email", "Ann", "Ann@Example.com", "0989000111", 1, true},
+		{"someone-else", "Bob", "bob@example.com", "0989000222", 5, false},
+	}
+	for _, e := range tests {
+		postedData := url.Values{
+			"first_name": {e.firstName},
+			"last_name":  {"Lee"},
+			"email":      {e.email},
+			"phone":      {e.phone},
+		}
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(req.Context(), "guest_account_id", accountID)
+		session.Put(req.Context(), "reservation", models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2060, time.June, e.day, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2060, time.June, e.day+2, 0, 0, 0, 0, time.UTC),
+			Adults:    1,
+			GuestID:   account.GuestID,
+		})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(repo.PostReservation).ServeHTTP(rr, req)
+
+		reservations, err := repo.DB.GuestReservations(ctx, account.GuestID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, res := range reservations {
+			if res.StartDate.Day() == e.day {
+				found = true
+			}
+		}
+		if found != e.ownGuest {
+			t.Errorf("failed %s: expected the booking in the history of the account %v, got %v", e.name, e.ownGuest, found)
+		}
+	}
+}
+
+func TestPostRegisterKeepsMailWithoutToken(t *testing.T) {
+	repo := &Repository{App: &app, DB: dbrepo.NewMemoryRepo(&app)}
+
+	postedData := url.Values{
+		"first_name":       {"Ann"},
+		"last_name":        {"Lee"},
+		"email":            {"ann@example.com"},
+		"password":         {"secret-password"},
+		"password_confirm": {"secret-password"},
+	}
+	req, _ := http.NewRequest("POST", "/account/register", strings.NewReader(postedData.Encode()))
+	req = req.WithContext(getCtx(req))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(repo.PostRegister).ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected code %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	data, err := repo.DB.PersonalData(context.Background(), "ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Emails) != 1 {
+		t.Fatalf("expected 1 kept email, got %d", len(data.Emails))
+	}
+	if content := data.Emails[0].Content; !strings.Contains(content, "token="+redactedSecret+`"`) {
+		t.Errorf("expected the kept email without the token, got %s", content)
+	}
+}
+
+var adminPrivacyTests = []struct {
+	name             string
+	method           string
+	url              string
+	postedData       url.Values
+	expectedStatus   int
+	expectedLocation string
+	expectedType     string
+	expected         []string // Parts of the export
+}{
+	{
+		name:           "export-json",
+		method:         "GET",
+		url:            "/admin/privacy/export?email=John@Smith.com&format=json",
+		expectedStatus: http.StatusOK,
+		expectedType:   "application/json",
+		expected:       []string{"ABCD2345", "late check-out", "Reservation confirmation"},
+	},
+	{
+		name:           "export-zip",
+		method:         "GET",
+		url:            "/admin/privacy/export?email=john@smith.com&format=zip",
+		expectedStatus: http.StatusOK,
+		expectedType:   "application/zip",
+		expected:       []string{"personal-data.json"},
+	},
+	{
+		name:             "export-unknown-format",
+		method:           "GET",
+		url:              "/admin/privacy/export?email=john@smith.com&format=xml",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/privacy?email=john%40smith.com",
+	},
+	{
+		name:             "export-without-email",
+		method:           "GET",
+		url:              "/admin/privacy/export?format=json",
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/privacy",
+	},
+	{
+		name:             "erase",
+		method:           "POST",
+		url:              "/admin/privacy/erase",
+		postedData:       url.Values{"email": {"john@smith.com"}, "confirm": {"John@Smith.com "}},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/privacy",
+	},
+	{
+		name:             "erase-not-confirmed",
+		method:           "POST",
+		url:              "/admin/privacy/erase",
+		postedData:       url.Values{"email": {"john@smith.com"}, "confirm": {"johnny@smith.com"}},
+		expectedStatus:   http.StatusSeeOther,
+		expectedLocation: "/admin/privacy?email=john%40smith.com",
+	},
+}
+
+// TestAdminPrivacy tests the export and the erasure of the personal data of a guest
+func TestAdminPrivacy(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminPrivacyTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedType != "" && rr.Header().Get("Content-Type") != e.expectedType {
+			t.Errorf("failed %s: expected a %s export, got %s", e.name, e.expectedType, rr.Header().Get("Content-Type"))
+		}
+		for _, part := range e.expected {
+			if !strings.Contains(rr.Body.String(), part) {
+				t.Errorf("failed %s: export is missing %s", e.name, part)
+			}
+		}
+		if strings.Contains(rr.Body.String(), "$2a$12$hash") {
+			t.Errorf("failed %s: export leaks the password hash", e.name)
+		}
+	}
+}
+
+var adminAuditTests = []struct {
+	name     string
+	url      string
+	expected []string // Parts of the page
+	missing  []string
+}{
+	{
+		name: "everything",
+		url:  "/admin/audit",
+		expected: []string{"Showing 1 to 1 of 1 changes", "Admin User", "10.0.0.1", "first_name", "Jon",
+			"/admin/reservations/all/1/show"},
+	},
+	{
+		name:     "filtered",
+		url:      "/admin/audit?user=1&action=update&entity=reservation&entity_id=1&start=2050-05-01&end=2050-05-01",
+		expected: []string{"Showing 1 to 1 of 1 changes", "2050-05-01 10:00:00"},
+	},
+	{
+		name:     "other-user",
+		url:      "/admin/audit?user=2",
+		expected: []string{"No change found"},
+		missing:  []string{"Admin User"},
+	},
+	{
+		name:     "before-the-change",
+		url:      "/admin/audit?end=2050-04-30",
+		expected: []string{"No change found"},
+	},
+	{
+		name:     "unknown-action",
+		url:      "/admin/audit?action=drop",
+		expected: []string{"Showing 1 to 1 of 1 changes"},
+	},
+	{
+		name:     "reservation-history",
+		url:      "/admin/reservations/all/1/show",
+		expected: []string{"History (1)", "Admin User", "first_name"},
+	},
+}
+
+func TestAdminAudit(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminAuditTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		// The reservation page reads its id from RequestURI
+		req.RequestURI = e.url
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+			continue
+		}
+		for _, part := range e.expected {
+			if !pageHas(rr.Body.String(), part) {
+				t.Errorf("failed %s: page is missing %s", e.name, part)
+			}
+		}
+		for _, part := range e.missing {
+			if pageHas(rr.Body.String(), part) {
+				t.Errorf("failed %s: page shouldn't have %s", e.name, part)
+			}
+		}
+	}
+}
+
+func TestActor(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/admin/reservations/all/1", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.RemoteAddr = "10.0.0.1:54321"
+	session.Put(ctx, "user_id", 7)
+
+	actor := Repo.actor(req)
+	if actor.UserID != 7 || actor.IP != "10.0.0.1" {
+		t.Errorf("expected user 7 from 10.0.0.1, got %+v", actor)
+	}
+}
+
+func TestAdminReservationNotFound(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range []struct {
+		method, url string
+	}{
+		{"GET", "/admin/reservations/all/99/show"},
+		{"GET", "/admin/process-reservation/all/99/do"},
+		{"GET", "/admin/delete-reservation/all/99/do"},
+	} {
+		req, _ := http.NewRequest(e.method, e.url, nil)
+		// The reservation page reads its id from RequestURI
+		req.RequestURI = e.url
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected code %d, but got %d", e.method, e.url, http.StatusNotFound, rr.Code)
+		}
+	}
+}
+
+func TestAdminTrash(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/trash", nil)
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	for _, part := range []string{"Doe", "Roe", "Admin User", "/admin/trash/7/restore"} {
+		if !pageHas(rr.Body.String(), part) {
+			t.Errorf("trash is missing %s", part)
+		}
+	}
+}
+
+var adminRestoreReservationTests = []struct {
+	name             string
+	url              string
+	expectedLocation string
+}{
+	{"restored", "/admin/trash/7/restore", "/admin/reservations/all/7/show"},
+	{"room taken since", "/admin/trash/8/restore", "/admin/trash"},
+	{"not in the trash", "/admin/trash/9/restore", "/admin/trash"},
+}
+
+func TestAdminRestoreReservation(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range adminRestoreReservationTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+			continue
+		}
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+	}
+}
@@ -12,8 +12,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/availability"
 	"github.com/TranQuocToan1996/bookings/internal/config"
+	"github.com/TranQuocToan1996/bookings/internal/helpers"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
 	"github.com/TranQuocToan1996/bookings/internal/render"
 	"github.com/TranQuocToan1996/bookings/internal/repository/dbrepo"
 	"github.com/alexedwards/scs/v2"
@@ -31,13 +34,17 @@ var functions = template.FuncMap{
 	"formatDate": render.FormatDate,
 	"iterate":    render.Iterate,
 	"add":        render.Add,
+	"price":      pricing.Format,
+	"weekdays":   availability.Weekdays,
 }
 
 // NewRepo creates a new Repository
 func NewTestRepo(a *config.AppConfig) *Repository {
+	grid := availability.NewGridCache(gridCacheTTL, gridCacheSize)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		App:  a,
+		DB:   dbrepo.NewInvalidatingRepo(dbrepo.NewTestingRepo(a), grid.Invalidate),
+		Grid: grid,
 	}
 }
 
@@ -57,6 +64,7 @@ func TestMain(m *testing.M) {
 	app.InfoLog = infoLog
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
+	helpers.NewHelpers(&app)
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -121,21 +129,59 @@ func getRoutes() http.Handler {
 	// Handlers Post request
 	mux.Post("/search-availability", Repo.PostAvailability)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
+	mux.Get("/availability-grid", Repo.AvailabilityGridJSON)
 	mux.Post("/make-reservation", Repo.PostReservation)
 
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
 	mux.Post("/user/login", Repo.PostShowLogin)
 
+	mux.Get("/account/register", Repo.ShowRegister)
+	mux.Post("/account/register", Repo.PostRegister)
+	mux.Get("/account/verify", Repo.VerifyAccount)
+	mux.Get("/account/login", Repo.ShowGuestLogin)
+	mux.Post("/account/login", Repo.PostGuestLogin)
+	mux.Get("/account/logout", Repo.GuestLogout)
+	mux.Get("/account", Repo.Account)
+	mux.Post("/account/rebook", Repo.AccountRebook)
+
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
+	mux.Get("/admin/search", Repo.AdminSearch)
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalendar)
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservations)
 	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Get("/admin/room-assignment", Repo.AdminRoomAssignment)
+	mux.Get("/admin/stay-rules", Repo.AdminStayRules)
+	mux.Get("/admin/delete-stay-rule/{id}/do", Repo.AdminDeleteStayRule)
+	mux.Get("/admin/blocks", Repo.AdminBlocks)
+	mux.Get("/admin/blocks/{id}", Repo.AdminShowBlock)
+	mux.Get("/admin/delete-block/{id}/do", Repo.AdminDeleteBlock)
+	mux.Get("/admin/delete-block-series/{id}/do", Repo.AdminDeleteBlockSeries)
+	mux.Get("/admin/api/calendar", Repo.AdminCalendarJSON)
+	mux.Get("/admin/api/dashboard", Repo.AdminDashboardJSON)
+	mux.Get("/admin/reports", Repo.AdminReports)
+	mux.Get("/admin/reports/export", Repo.AdminExportReport)
+	mux.Get("/admin/guests", Repo.AdminGuests)
+	mux.Get("/admin/guests/{id}", Repo.AdminShowGuest)
+	mux.Post("/admin/guests/{id}", Repo.AdminPostShowGuest)
+	mux.Post("/admin/guests/{id}/merge", Repo.AdminMergeGuest)
+	mux.Get("/admin/privacy", Repo.AdminPrivacy)
+	mux.Get("/admin/privacy/export", Repo.AdminExportPersonalData)
+	mux.Post("/admin/privacy/erase", Repo.AdminErasePersonalData)
+	mux.Get("/admin/audit", Repo.AdminAudit)
+	mux.Get("/admin/trash", Repo.AdminTrash)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservations)
 	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalendar)
+	mux.Post("/admin/room-assignment", Repo.AdminPostRoomAssignment)
+	mux.Post("/admin/stay-rules", Repo.AdminPostStayRules)
+	mux.Post("/admin/blocks", Repo.AdminPostBlocks)
+	mux.Post("/admin/blocks/{id}", Repo.AdminPostShowBlock)
+	mux.Post("/admin/api/reservations/{id}/move", Repo.AdminMoveReservationJSON)
+	mux.Post("/admin/api/blocks/{id}/resize", Repo.AdminResizeBlockJSON)
+	mux.Post("/admin/trash/{id}/restore", Repo.AdminRestoreReservation)
 
 	// FileServer is the place to get static files
 	fileServer := http.FileServer(http.Dir("./static/"))
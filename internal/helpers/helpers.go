@@ -1,6 +1,9 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"runtime/debug"
@@ -33,3 +36,44 @@ func ServerError(w http.ResponseWriter, err error) {
 func IsAuthenticate(r *http.Request) bool {
 	return app.Session.Exists(r.Context(), "user_id")
 }
+
+// IsGuestAuthenticate reports whether a guest is logged in to its account. Guests never get the
+// "user_id" of the staff, so a guest account can't open the admin pages.
+func IsGuestAuthenticate(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "guest_account_id")
+}
+
+// codeAlphabet leaves out the characters read the wrong way over the phone (0/O, 1/I/L)
+const codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// ConfirmationCode returns a random 8 characters code for a new reservation
+func ConfirmationCode() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on the supported platforms
+		panic(err)
+	}
+
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b)
+}
+
+// Token returns a random token to send by email, only its hash (see HashToken) is stored
+func Token() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on the supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// HashToken returns the hash of a token kept in the database, a leaked table gives no usable link
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
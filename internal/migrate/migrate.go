@@ -0,0 +1,443 @@
+// Package migrate applies and rolls back the SQL migrations of the database schema. Applied migrations
+// are recorded with a checksum in a table of their own, and a Postgres advisory lock keeps two
+// instances from migrating at the same time. SQLite databases, which only one instance uses, are
+// migrated the same way without the lock.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNothingToRollBack is returned by Down and Redo when no migration has been applied
+var ErrNothingToRollBack = errors.New("no migration to roll back")
+
+// ErrModified is returned by Up when an applied migration no longer matches its file
+var ErrModified = errors.New("migration changed after it was applied")
+
+// lockKey is the advisory lock held while migrating, "bookings" in ASCII
+const lockKey = 0x626f6f6b696e6773
+
+// table records the applied migrations
+const table = "bookings_migrations"
+
+// sodaTable is where Soda recorded the migrations it applied, before they were embedded
+const sodaTable = "schema_migration"
+
+// Migration is a change of the schema with the SQL undoing it
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // Of Up, it must not change once the migration is applied
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d_%s", m.Version, m.Name)
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations of fsys, oldest first. Every migration needs an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		parts := fileName.FindStringSubmatch(file)
+		if parts == nil {
+			return nil, fmt.Errorf("%s: not named <version>_<name>.up.sql or .down.sql", file)
+		}
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[2] {
+			return nil, fmt.Errorf("%s: version %d is also %s", file, version, m)
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Checksum == "" {
+			return nil, fmt.Errorf("%s: missing its up file", m)
+		}
+		if m.Down == "" {
+			return nil, fmt.Errorf("%s: missing its down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Status is where a migration stands in the database
+type Status struct {
+	Migration
+	AppliedAt time.Time // Zero while pending
+	Modified  bool      // Applied with another checksum
+	Missing   bool      // Applied but no longer among the migrations, only Version and Name are known
+}
+
+// Applied reports whether the migration was applied
+func (s Status) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+// applied is a row of the migrations table
+type applied struct {
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// statuses lists the migrations with the applied ones unknown to them, by version
+func statuses(migrations []Migration, done map[int64]applied) []Status {
+	var list []Status
+	known := make(map[int64]bool)
+	for _, m := range migrations {
+		known[m.Version] = true
+		s := Status{Migration: m}
+		if a, ok := done[m.Version]; ok {
+			s.AppliedAt = a.AppliedAt
+			s.Modified = a.Checksum != m.Checksum
+		}
+		list = append(list, s)
+	}
+	for version, a := range done {
+		if !known[version] {
+			list = append(list, Status{
+				Migration: Migration{Version: version, Name: a.Name, Checksum: a.Checksum},
+				AppliedAt: a.AppliedAt,
+				Missing:   true,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	return list
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+	// SQLite is set when DB is a SQLite database rather than a Postgres one
+	SQLite bool
+}
+
+// New returns a migrator of db for the migrations of fsys
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+// NewSQLite returns a migrator of the SQLite database db for the migrations of fsys
+func NewSQLite(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	m, err := New(db, fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	m.SQLite = true
+	return m, nil
+}
+
+// Status lists every migration, applied or pending, and the applied ones no longer known
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var list []Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		done, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		list = statuses(m.Migrations, done)
+		return nil
+	})
+	return list, err
+}
+
+// Up applies the pending migrations, oldest first, and returns them. Nothing is applied when an
+// applied migration was changed since.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		var pending []Migration
+		for _, s := range statuses(m.Migrations, applied) {
+			if s.Modified {
+				return fmt.Errorf("%w: %s", ErrModified, s.Migration)
+			}
+			if !s.Applied() {
+				pending = append(pending, s.Migration)
+			}
+		}
+
+		for _, migration := range pending {
+			err = apply(ctx, conn, migration)
+			if err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the last migration applied and returns it
+func (m *Migrator) Down(ctx context.Context) (Migration, error) {
+	var last Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		last, err = m.rollBackLast(ctx, conn)
+		return err
+	})
+	return last, err
+}
+
+// Redo rolls back the last migration applied and applies it again, from its current file
+func (m *Migrator) Redo(ctx context.Context) (Migration, error) {
+	var last Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		last, err = m.rollBackLast(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return apply(ctx, conn, last)
+	})
+	return last, err
+}
+
+// rollBackLast rolls back the applied migration with the highest version
+func (m *Migrator) rollBackLast(ctx context.Context, conn *sql.Conn) (Migration, error) {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	list := statuses(m.Migrations, applied)
+	for i := len(list) - 1; i >= 0; i-- {
+		if !list[i].Applied() {
+			continue
+		}
+		if list[i].Missing {
+			return list[i].Migration, fmt.Errorf("%s: no file to roll it back", list[i].Migration)
+		}
+		return list[i].Migration, rollBack(ctx, conn, list[i].Migration)
+	}
+
+	return Migration{}, ErrNothingToRollBack
+}
+
+// locked runs fn on a connection holding the migration lock, once the migrations table exists
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Another instance migrating holds the lock until it is done. SQLite has no such lock, a migration
+	// applied twice fails on its version in the migrations table and is rolled back.
+	if !m.SQLite {
+		_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, int64(lockKey))
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, int64(lockKey))
+	}
+
+	err = m.createTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// createTable creates the migrations table. A Postgres database migrated by Soda starts with the
+// migrations Soda applied, they are the same ones.
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `create table if not exists `+table+` (
+			version bigint primary key,
+			name varchar(255) not null,
+			checksum varchar(64) not null,
+			applied_at timestamp not null
+		)`)
+	if err != nil || m.SQLite {
+		return err
+	}
+
+	var recorded int
+	var soda sql.NullString
+	err = conn.QueryRowContext(ctx, `select (select count(*) from `+table+`), to_regclass($1)::text`,
+		sodaTable).Scan(&recorded, &soda)
+	if err != nil || recorded > 0 || !soda.Valid {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `select version from `+sodaTable)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]bool)
+	for rows.Next() {
+		var version string
+		err = rows.Scan(&version)
+		if err != nil {
+			return err
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(version), 10, 64)
+		if err != nil {
+			return fmt.Errorf("soda migration %q: %w", version, err)
+		}
+		versions[v] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, migration := range m.Migrations {
+		if !versions[migration.Version] {
+			continue
+		}
+		err = record(ctx, conn, migration, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execer runs statements on the connection or in a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// record adds a migration to the applied ones
+func record(ctx context.Context, db execer, migration Migration, at time.Time) error {
+	_, err := db.ExecContext(ctx, `insert into `+table+` (version, name, checksum, applied_at)
+			values ($1, $2, $3, $4)`, migration.Version, migration.Name, migration.Checksum, at)
+	return err
+}
+
+// appliedMigrations reads the migrations table by version
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]applied, error) {
+	rows, err := conn.QueryContext(ctx, `select version, name, checksum, applied_at from `+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var a applied
+		err = rows.Scan(&version, &a.Name, &a.Checksum, &a.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+
+	return done, rows.Err()
+}
+
+// apply runs the up file of a migration and records it, in one transaction
+func apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migration.Up)
+	if err != nil {
+		return fmt.Errorf("%s: %w", migration, err)
+	}
+
+	err = record(ctx, tx, migration, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rollBack runs the down file of a migration and forgets it, in one transaction
+func rollBack(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migration.Down)
+	if err != nil {
+		return fmt.Errorf("%s: %w", migration, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from `+table+` where version = $1`, migration.Version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,176 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/driver"
+	"github.com/TranQuocToan1996/bookings/migrations"
+	"github.com/TranQuocToan1996/bookings/migrations/sqlite"
+)
+
+var files = fstest.MapFS{
+	"20220209144848_create_rooms.up.sql":        {Data: []byte("create table rooms (id serial primary key);\n")},
+	"20220209144848_create_rooms.down.sql":      {Data: []byte("drop table rooms;\n")},
+	"20220209130722_create_users.up.sql":        {Data: []byte("create table users (id serial primary key);\n")},
+	"20220209130722_create_users.down.sql":      {Data: []byte("drop table users;\n")},
+	"20261019143000_add_room_type.up.sql":       {Data: []byte("alter table rooms add column room_type text;\n")},
+	"20261019143000_add_room_type.down.sql":     {Data: []byte("alter table rooms drop column room_type;\n")},
+	"20261019143000_add_room_type.unrelated.md": {Data: []byte("not a migration")},
+}
+
+func TestLoad(t *testing.T) {
+	list, err := Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"20220209130722_create_users", "20220209144848_create_rooms", "20261019143000_add_room_type"}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %d migrations, got %d", len(expected), len(list))
+	}
+	for i, m := range list {
+		if m.String() != expected[i] {
+			t.Errorf("expected %s at %d, got %s", expected[i], i, m)
+		}
+		if len(m.Checksum) != 64 || m.Up == "" || m.Down == "" {
+			t.Errorf("%s incomplete: %+v", m, m)
+		}
+	}
+	if list[0].Checksum == list[1].Checksum {
+		t.Error("different migrations have the same checksum")
+	}
+}
+
+func TestLoadBroken(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"missing down", fstest.MapFS{
+			"1_a.up.sql": {Data: []byte("select 1;")},
+		}},
+		{"missing up", fstest.MapFS{
+			"1_a.down.sql": {Data: []byte("select 1;")},
+		}},
+		{"two names for a version", fstest.MapFS{
+			"1_a.up.sql":   {Data: []byte("select 1;")},
+			"1_b.down.sql": {Data: []byte("select 1;")},
+		}},
+		{"badly named", fstest.MapFS{
+			"create_users.up.sql": {Data: []byte("select 1;")},
+		}},
+	}
+
+	for _, e := range tests {
+		if _, err := Load(e.files); err == nil {
+			t.Errorf("%s: no error", e.name)
+		}
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	list, err := Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2050, time.May, 1, 10, 0, 0, 0, time.UTC)
+	done := map[int64]applied{
+		20220209130722: {Name: "create_users", Checksum: list[0].Checksum, AppliedAt: at},
+		20220209144848: {Name: "create_rooms", Checksum: "changed since", AppliedAt: at},
+		20210101000000: {Name: "dropped", Checksum: "gone", AppliedAt: at},
+	}
+
+	got := statuses(list, done)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 statuses, got %d", len(got))
+	}
+	if !got[0].Missing || got[0].Name != "dropped" || !got[0].Applied() {
+		t.Errorf("expected the dropped migration first, got %+v", got[0])
+	}
+	if !got[1].Applied() || got[1].Modified {
+		t.Errorf("expected create_users applied as is, got %+v", got[1])
+	}
+	if !got[2].Modified {
+		t.Errorf("expected create_rooms modified, got %+v", got[2])
+	}
+	if got[3].Applied() {
+		t.Errorf("expected add_room_type pending, got %+v", got[3])
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	list, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Fatal("no migration embedded")
+	}
+	if list[0].Name != "create_create_user_tables" {
+		t.Errorf("expected the users table first, got %s", list[0])
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	db, err := driver.NewSQLite(filepath.Join(t.TempDir(), "bookings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := NewSQLite(db, sqlite.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(m.Migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(m.Migrations), len(applied))
+	}
+
+	var rooms int
+	err = db.QueryRow(`select count(*) from rooms`).Scan(&rooms)
+	if err != nil || rooms != 2 {
+		t.Errorf("expected the two seeded rooms, got %d, %v", rooms, err)
+	}
+
+	list, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range list {
+		if !s.Applied() || s.Modified || s.Missing {
+			t.Errorf("expected %s applied as is, got %+v", s.Migration, s)
+		}
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("expected nothing left to apply, got %v, %v", applied, err)
+	}
+
+	for range m.Migrations {
+		_, err = m.Down(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = m.Down(ctx)
+	if !errors.Is(err, ErrNothingToRollBack) {
+		t.Errorf("expected nothing to roll back, got %v", err)
+	}
+	err = db.QueryRow(`select count(*) from rooms`).Scan(&rooms)
+	if err == nil {
+		t.Error("expected the rooms table dropped")
+	}
+}
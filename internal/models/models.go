@@ -18,10 +18,15 @@ type User struct {
 
 // Room is the rooms model
 type Room struct {
-	ID       int
-	RoomName string
-	CreateAt time.Time
-	UpdateAt time.Time
+	ID            int
+	RoomName      string
+	RoomType      string // Rooms sharing the same type are interchangeable for room assignment
+	MaxOccupancy  int    // Most guests (adults and children) the room can sleep
+	BaseOccupancy int    // Guests included in the nightly price
+	PricePerNight int    // In cents
+	ExtraGuestFee int    // In cents, per night for every guest above BaseOccupancy
+	CreateAt      time.Time
+	UpdateAt      time.Time
 }
 
 // Restriction is the restrictions model
@@ -34,18 +39,28 @@ type Restriction struct {
 
 // Revervation is the Revervations model
 type Reservation struct {
-	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
-	RoomID    int
-	CreateAt  time.Time
-	UpdateAt  time.Time
-	Room      Room
-	Processed int
+	ID               int
+	FirstName        string
+	LastName         string
+	Email            string
+	Phone            string
+	StartDate        time.Time
+	EndDate          time.Time
+	RoomID           int
+	CreateAt         time.Time
+	UpdateAt         time.Time
+	Room             Room
+	Processed        int
+	RoomLocked       bool // Guest asked for this exact room, never move it to another one
+	Adults           int
+	Children         int
+	TotalPrice       int       // In cents
+	ConfirmationCode string    // Given to the guest to refer to the reservation
+	Notes            string    // Front desk notes, never shown to the guest
+	GuestID          int       // 0 until the reservation is matched to a guest
+	DeletedAt        time.Time // Zero unless the reservation is in the trash
+	DeletedBy        int       // User who moved it to the trash
+	DeletedByName    string    // First and last name of DeletedBy
 }
 
 // RoomRestriction is the RoomRestriction model
@@ -56,6 +71,8 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
+	Note          string // Why the owner blocked the room
+	SeriesID      int    // Recurring block this block belongs to, 0 for a one-off block
 	CreateAt      time.Time
 	UpdateAt      time.Time
 	Room          Room
@@ -63,6 +80,188 @@ type RoomRestriction struct {
 	Restriction   Restriction
 }
 
+// BlockSeries is the block_series model, a recurring owner block. The first block runs from
+// StartDate to EndDate and is repeated every week or year while it starts on or before UntilDate
+type BlockSeries struct {
+	ID        int
+	RoomID    int
+	StartDate time.Time
+	EndDate   time.Time
+	Frequency string // "weekly" or "yearly"
+	UntilDate time.Time
+	Note      string
+	CreateAt  time.Time
+	UpdateAt  time.Time
+	Room      Room
+}
+
+// StayRule is the stay_rules model, it limits the stays of a room arriving between StartDate and EndDate
+type StayRule struct {
+	ID                int
+	RoomID            int
+	StartDate         time.Time
+	EndDate           time.Time
+	MinNights         int // 0 means no minimum
+	MaxNights         int // 0 means no maximum
+	ClosedToArrival   int // Bitmask of time.Weekday, 1 << time.Sunday ...
+	ClosedToDeparture int // Bitmask of time.Weekday
+	MinAdvanceDays    int // Days between booking and arrival, 0 means same day bookings are fine
+	MaxAdvanceDays    int // Booking horizon, 0 means no limit
+	CreateAt          time.Time
+	UpdateAt          time.Time
+	Room              Room
+}
+
+// DashboardStats are the figures of the reservations arriving in a date range, for the admin dashboard
+type DashboardStats struct {
+	Reservations       int
+	New                int
+	Processed          int
+	AverageStay        float64 // Nights
+	AverageLeadTime    float64 // Days between the booking and the arrival
+	PricedReservations int     // Reservations booked with a price, older ones have none
+	Revenue            int     // In cents, of the priced reservations
+}
+
+// RoomOccupancy is how many nights of a month a room is booked, counting only the nights inside the range asked for
+type RoomOccupancy struct {
+	RoomID       int
+	RoomName     string
+	Month        time.Time
+	Nights       int
+	BookedNights int
+}
+
+// Cancellation is the cancellations model, a copy of a reservation kept when it is cancelled
+type Cancellation struct {
+	ID            int
+	ReservationID int
+	FirstName     string
+	LastName      string
+	Email         string
+	Phone         string
+	StartDate     time.Time
+	EndDate       time.Time
+	RoomID        int
+	BookedAt      time.Time
+	TotalPrice    int       // In cents
+	CreateAt      time.Time // When the reservation was cancelled
+	UpdateAt      time.Time
+	Room          Room
+}
+
+// ReportFilter selects the rows of a report
+type ReportFilter struct {
+	Start         time.Time
+	End           time.Time // Excluded
+	RoomIDs       []int     // Empty means every room
+	ByBookingDate bool      // Reservations booked in the range rather than staying in it
+}
+
+// ReservationFilter selects a page of the admin reservation lists
+type ReservationFilter struct {
+	RoomID  int       // 0 means every room
+	Start   time.Time // Stays with a night on or after Start, zero means no limit
+	End     time.Time // Stays with a night before End, zero means no limit
+	Status  string    // "new", "processed" or empty for both
+	Query   string    // Part of the guest name, email or phone
+	Sort    string    // One of repository.ReservationSorts
+	Desc    bool
+	Page    int // From 1
+	PerPage int
+}
+
+// Guest is the guests model, the person behind one or more reservations
+type Guest struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Email     string
+	Phone     string
+	Notes     string
+	Tags      []string // See guests.Tags
+	CreateAt  time.Time
+	UpdateAt  time.Time
+	// Computed from the reservations of the guest
+	Stays         int
+	Nights        int
+	LifetimeValue int // In cents
+}
+
+// GuestAccount lets a guest log in to see the reservations of its guest profile. It is kept apart from
+// the users of the staff, a guest account never gets an access level.
+type GuestAccount struct {
+	ID            int
+	GuestID       int
+	Email         string // Normalized
+	Password      string // Bcrypt hash
+	Verified      bool   // The guest opened the link of the verification email
+	VerifyToken   string // SHA-256 of the token sent by email
+	VerifyExpires time.Time
+	CreateAt      time.Time
+	UpdateAt      time.Time
+	Guest         Guest
+}
+
+// SearchResult is a reservation found by the admin search, Kind tells which of its fields matched
+type SearchResult struct {
+	Kind        string  // "code", "guest", "notes" or "room"
+	Rank        float64 // Higher is closer
+	Snippet     string  // Matching part of the notes
+	Reservation Reservation
+}
+
+// SentEmail is an email sent to a guest, kept for the exports of personal data
+type SentEmail struct {
+	ID       int
+	To       string
+	Subject  string
+	Content  string
+	CreateAt time.Time
+	UpdateAt time.Time
+}
+
+// PersonalData is everything held about a guest email address
+type PersonalData struct {
+	Email         string
+	Guests        []Guest
+	Accounts      []GuestAccount
+	Reservations  []Reservation
+	Cancellations []Cancellation
+	Emails        []SentEmail
+}
+
+// Actor is the staff user behind a change, recorded in the audit log
+type Actor struct {
+	UserID int
+	IP     string
+}
+
+// AuditEntry is a change recorded in the audit log
+type AuditEntry struct {
+	ID       int
+	UserID   int
+	UserName string // First and last name of the user, empty when the user is gone
+	Action   string // See audit.Actions
+	Entity   string // See audit.Entities
+	EntityID int
+	Changes  string // JSON, see audit.Diff
+	IP       string
+	CreateAt time.Time
+}
+
+// AuditFilter selects the entries of the audit log viewer
+type AuditFilter struct {
+	UserID   int       // 0 means every user
+	Action   string    // Empty means every action
+	Entity   string    // Empty means every entity
+	EntityID int       // 0 means every entity of the kind
+	Start    time.Time // Entries on or after Start, zero means no limit
+	End      time.Time // Entries before End, zero means no limit
+	Page     int       // From 1
+	PerPage  int
+}
+
 // MailData holds data for an email message
 type MailData struct {
 	To       string
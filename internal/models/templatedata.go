@@ -16,4 +16,5 @@ type TemplateData struct {
 	Error          string
 	Form           *forms.Form
 	IsAuthenticate int
+	IsGuest        int // A guest is logged in to its account
 }
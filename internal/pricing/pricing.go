@@ -0,0 +1,43 @@
+package pricing
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// Nights returns the number of nights between the start and end date of a stay
+func Nights(start, end time.Time) int {
+	return int(math.Round(end.Sub(start).Hours() / 24))
+}
+
+// Fits reports whether a party of adults and children can sleep in the room
+func Fits(room models.Room, adults, children int) bool {
+	return adults+children <= room.MaxOccupancy
+}
+
+// NightlyPrice returns the price in cents of one night for the party, every guest
+// above the base occupancy of the room pays the extra guest supplement
+func NightlyPrice(room models.Room, adults, children int) int {
+	price := room.PricePerNight
+	if extra := adults + children - room.BaseOccupancy; extra > 0 {
+		price += extra * room.ExtraGuestFee
+	}
+	return price
+}
+
+// Quote returns the total price in cents of a stay
+func Quote(room models.Room, start, end time.Time, adults, children int) int {
+	nights := Nights(start, end)
+	if nights <= 0 {
+		return 0
+	}
+	return nights * NightlyPrice(room, adults, children)
+}
+
+// Format turns a price in cents into a human readable amount, ie 12050 -> "120.50"
+func Format(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
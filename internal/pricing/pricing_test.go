@@ -0,0 +1,57 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+var room = models.Room{
+	MaxOccupancy:  4,
+	BaseOccupancy: 2,
+	PricePerNight: 10000,
+	ExtraGuestFee: 2500,
+}
+
+func TestFits(t *testing.T) {
+	if !Fits(room, 2, 2) {
+		t.Error("party of 4 should fit a room for 4")
+	}
+	if Fits(room, 3, 2) {
+		t.Error("party of 5 should not fit a room for 4")
+	}
+}
+
+var quoteTests = []struct {
+	name     string
+	nights   int
+	adults   int
+	children int
+	expected int
+}{
+	{"base-occupancy", 2, 2, 0, 20000},
+	{"single-guest", 1, 1, 0, 10000},
+	{"one-extra-child", 3, 2, 1, 37500},
+	{"two-extra-guests", 1, 3, 1, 15000},
+	{"no-nights", 0, 2, 0, 0},
+}
+
+func TestQuote(t *testing.T) {
+	start := time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range quoteTests {
+		got := Quote(room, start, start.AddDate(0, 0, e.nights), e.adults, e.children)
+		if got != e.expected {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if Format(12050) != "120.50" {
+		t.Errorf("expected 120.50, got %s", Format(12050))
+	}
+	if Format(7) != "0.07" {
+		t.Errorf("expected 0.07, got %s", Format(7))
+	}
+}
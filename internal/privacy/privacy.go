@@ -0,0 +1,114 @@
+// Package privacy exports and erases the personal data held about a guest, and anonymizes old reservations
+package privacy
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// ErasedName replaces the first name of an anonymized reservation, its other personal fields are emptied
+const ErasedName = "Erased"
+
+// Export formats
+const (
+	FormatJSON = "json"
+	FormatZIP  = "zip"
+)
+
+// Redact drops the secrets of the accounts, a bundle never carries password hashes or tokens
+func Redact(data models.PersonalData) models.PersonalData {
+	accounts := make([]models.GuestAccount, len(data.Accounts))
+	for i, a := range data.Accounts {
+		a.Password = ""
+		a.VerifyToken = ""
+		accounts[i] = a
+	}
+	data.Accounts = accounts
+	return data
+}
+
+// WriteJSON writes data as indented JSON
+func WriteJSON(w io.Writer, data models.PersonalData) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Redact(data))
+}
+
+// WriteZIP writes a bundle with data as personal-data.json and every email sent as an HTML file
+func WriteZIP(w io.Writer, data models.PersonalData) error {
+	z := zip.NewWriter(w)
+
+	f, err := z.Create("personal-data.json")
+	if err != nil {
+		return err
+	}
+	err = WriteJSON(f, data)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range data.Emails {
+		f, err = z.Create(EmailFileName(e))
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, e.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// EmailFileName names the file of an email in a bundle after its date and subject
+func EmailFileName(e models.SentEmail) string {
+	subject := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, e.Subject)
+
+	return fmt.Sprintf("emails/%s-%d-%s.html", e.CreateAt.Format("2006-01-02"), e.ID, subject)
+}
+
+// Cutoff is the first day kept when reservations are kept for years, stays ending before it are anonymized
+func Cutoff(now time.Time, years int) time.Time {
+	year, month, day := now.AddDate(-years, 0, 0).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Anonymizer anonymizes the reservations ending before cutoff and returns how many it changed
+type Anonymizer interface {
+	AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// Retain anonymizes the reservations older than years right away and then every interval, until ctx is done
+func Retain(ctx context.Context, repo Anonymizer, years int, interval time.Duration, infoLog, errorLog *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := repo.AnonymizeBefore(ctx, Cutoff(time.Now(), years))
+		if err != nil {
+			errorLog.Println("retention:", err)
+		} else if n > 0 {
+			infoLog.Printf("retention: %d reservations older than %d years anonymized", n, years)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
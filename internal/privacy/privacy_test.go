@@ -0,0 +1,117 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+var testData = models.PersonalData{
+	Email:    "john@smith.com",
+	Accounts: []models.GuestAccount{{ID: 1, Email: "john@smith.com", Password: "$2a$12$hash", VerifyToken: "token"}},
+	Reservations: []models.Reservation{
+		{ID: 1, FirstName: "John", Email: "john@smith.com", Notes: "Late check-out"},
+	},
+	Emails: []models.SentEmail{
+		{ID: 7, To: "john@smith.com", Subject: "Reservation confirmation", Content: "<strong>Dear John</strong>",
+			CreateAt: time.Date(2050, time.May, 1, 10, 0, 0, 0, time.UTC)},
+	},
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteJSON(&buf, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, part := range []string{"john@smith.com", "Late check-out", "Reservation confirmation"} {
+		if !strings.Contains(buf.String(), part) {
+			t.Errorf("export is missing %s", part)
+		}
+	}
+	for _, secret := range []string{"$2a$12$hash", "token"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("export leaks %s", secret)
+		}
+	}
+	if testData.Accounts[0].Password == "" {
+		t.Error("export changed the data it was given")
+	}
+}
+
+func TestWriteZIP(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteZIP(&buf, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(b)
+	}
+
+	if !strings.Contains(files["personal-data.json"], "Late check-out") {
+		t.Error("bundle is missing personal-data.json")
+	}
+	email := "emails/2050-05-01-7-Reservation-confirmation.html"
+	if files[email] != "<strong>Dear John</strong>" {
+		t.Errorf("bundle is missing %s, got files %v", email, z.File)
+	}
+}
+
+func TestCutoff(t *testing.T) {
+	now := time.Date(2050, time.March, 15, 18, 30, 0, 0, time.UTC)
+	if got := Cutoff(now, 3); !got.Equal(time.Date(2047, time.March, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 2047-03-15, got %s", got)
+	}
+}
+
+type countingAnonymizer struct {
+	cutoffs []time.Time
+	cancel  context.CancelFunc
+}
+
+func (c *countingAnonymizer) AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	c.cutoffs = append(c.cutoffs, cutoff)
+	if len(c.cutoffs) == 2 {
+		c.cancel()
+	}
+	return 1, nil
+}
+
+func TestRetain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	repo := &countingAnonymizer{cancel: cancel}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	Retain(ctx, repo, 2, time.Millisecond, logger, logger)
+
+	// A tick may win the race against the cancel once
+	if len(repo.cutoffs) < 2 || len(repo.cutoffs) > 3 {
+		t.Fatalf("expected 2 runs, got %d", len(repo.cutoffs))
+	}
+	if !repo.cutoffs[0].Equal(Cutoff(time.Now(), 2)) {
+		t.Errorf("expected a cutoff 2 years ago, got %s", repo.cutoffs[0])
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/availability"
 	"github.com/TranQuocToan1996/bookings/internal/config"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
 
 	"github.com/justinas/nosurf"
 )
@@ -22,6 +24,8 @@ var functions = template.FuncMap{
 	"formatDate": FormatDate,
 	"iterate":    Iterate,
 	"add":        Add,
+	"price":      pricing.Format,
+	"weekdays":   availability.Weekdays,
 }
 
 var app *config.AppConfig
@@ -64,6 +68,9 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticate = 1
 	}
+	if app.Session.Exists(r.Context(), "guest_account_id") {
+		td.IsGuest = 1
+	}
 
 	td.CSRFToken = nosurf.Token(r)
 	return td
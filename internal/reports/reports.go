@@ -0,0 +1,196 @@
+// Package reports defines the spreadsheets of the admin panel and streams them as CSV or XLSX
+package reports
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/pricing"
+)
+
+// Source streams the rows behind the reports. fn is called once per row and an error returned by fn
+// stops the stream and is handed back.
+type Source interface {
+	EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error
+	EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error
+	EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error
+}
+
+// Report is a spreadsheet the admin can export
+type Report struct {
+	Name    string // Used in URLs and file names
+	Title   string
+	Header  []string
+	Numeric []int // Columns holding numbers
+	run     func(ctx context.Context, src Source, f models.ReportFilter, write func([]string) error) error
+}
+
+// Run writes the header and every row of the report to w, then closes w
+func (r Report) Run(ctx context.Context, src Source, f models.ReportFilter, w RowWriter) error {
+	err := w.WriteRow(r.Header)
+	if err != nil {
+		return err
+	}
+
+	err = r.run(ctx, src, f, w.WriteRow)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+var reservationHeader = []string{"Reservation", "Booked", "Arrival", "Departure", "Nights", "Room",
+	"First name", "Last name", "Email", "Phone", "Adults", "Children", "Processed", "Total"}
+
+// All lists the reports in the order of the admin panel
+var All = []Report{
+	{
+		Name:    "reservations-by-stay",
+		Title:   "Reservations by stay date",
+		Header:  reservationHeader,
+		Numeric: []int{0, 4, 10, 11, 13},
+		run:     reservations(false),
+	},
+	{
+		Name:    "reservations-by-booking",
+		Title:   "Reservations by booking date",
+		Header:  reservationHeader,
+		Numeric: []int{0, 4, 10, 11, 13},
+		run:     reservations(true),
+	},
+	{
+		Name:  "cancellations",
+		Title: "Cancellations",
+		Header: []string{"Reservation", "Cancelled", "Booked", "Arrival", "Departure", "Nights", "Room",
+			"First name", "Last name", "Email", "Phone", "Total"},
+		Numeric: []int{0, 5, 11},
+		run:     cancellations,
+	},
+	{
+		Name:    "blocks",
+		Title:   "Owner blocks",
+		Header:  []string{"Block", "Room", "From", "To", "Nights", "Note", "Series"},
+		Numeric: []int{0, 4, 6},
+		run:     blocks,
+	},
+	{
+		Name:    "guests",
+		Title:   "Guest list",
+		Header:  []string{"Arrival", "Departure", "Room", "Last name", "First name", "Email", "Phone", "Adults", "Children"},
+		Numeric: []int{7, 8},
+		run:     guests,
+	},
+}
+
+// Find returns the report called name
+func Find(name string) (Report, bool) {
+	for _, r := range All {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Report{}, false
+}
+
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04"
+)
+
+// reservations lists the reservations staying in the range, or booked in it
+func reservations(byBookingDate bool) func(context.Context, Source, models.ReportFilter, func([]string) error) error {
+	return func(ctx context.Context, src Source, f models.ReportFilter, write func([]string) error) error {
+		f.ByBookingDate = byBookingDate
+		return src.EachReservation(ctx, f, func(r models.Reservation) error {
+			processed := "no"
+			if r.Processed == 1 {
+				processed = "yes"
+			}
+
+			return write([]string{
+				strconv.Itoa(r.ID),
+				r.CreateAt.Format(dateTimeLayout),
+				r.StartDate.Format(dateLayout),
+				r.EndDate.Format(dateLayout),
+				strconv.Itoa(pricing.Nights(r.StartDate, r.EndDate)),
+				r.Room.RoomName,
+				r.FirstName,
+				r.LastName,
+				r.Email,
+				r.Phone,
+				strconv.Itoa(r.Adults),
+				strconv.Itoa(r.Children),
+				processed,
+				total(r.TotalPrice),
+			})
+		})
+	}
+}
+
+// cancellations lists the reservations cancelled in the range
+func cancellations(ctx context.Context, src Source, f models.ReportFilter, write func([]string) error) error {
+	return src.EachCancellation(ctx, f, func(c models.Cancellation) error {
+		return write([]string{
+			strconv.Itoa(c.ReservationID),
+			c.CreateAt.Format(dateTimeLayout),
+			c.BookedAt.Format(dateTimeLayout),
+			c.StartDate.Format(dateLayout),
+			c.EndDate.Format(dateLayout),
+			strconv.Itoa(pricing.Nights(c.StartDate, c.EndDate)),
+			c.Room.RoomName,
+			c.FirstName,
+			c.LastName,
+			c.Email,
+			c.Phone,
+			total(c.TotalPrice),
+		})
+	})
+}
+
+// blocks lists the owner blocks overlapping the range
+func blocks(ctx context.Context, src Source, f models.ReportFilter, write func([]string) error) error {
+	return src.EachBlock(ctx, f, func(b models.RoomRestriction) error {
+		series := ""
+		if b.SeriesID > 0 {
+			series = strconv.Itoa(b.SeriesID)
+		}
+
+		return write([]string{
+			strconv.Itoa(b.ID),
+			b.Room.RoomName,
+			b.StartDate.Format(dateLayout),
+			b.EndDate.Format(dateLayout),
+			strconv.Itoa(pricing.Nights(b.StartDate, b.EndDate)),
+			b.Note,
+			series,
+		})
+	})
+}
+
+// guests lists who stays in the range, with how to reach them
+func guests(ctx context.Context, src Source, f models.ReportFilter, write func([]string) error) error {
+	f.ByBookingDate = false
+	return src.EachReservation(ctx, f, func(r models.Reservation) error {
+		return write([]string{
+			r.StartDate.Format(dateLayout),
+			r.EndDate.Format(dateLayout),
+			r.Room.RoomName,
+			r.LastName,
+			r.FirstName,
+			r.Email,
+			r.Phone,
+			strconv.Itoa(r.Adults),
+			strconv.Itoa(r.Children),
+		})
+	})
+}
+
+// total formats a price in cents, reservations made before prices existed have none
+func total(cents int) string {
+	if cents == 0 {
+		return ""
+	}
+	return pricing.Format(cents)
+}
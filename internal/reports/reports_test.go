@@ -0,0 +1,189 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// fakeSource holds the rows it streams and remembers the last filter
+type fakeSource struct {
+	reservations  []models.Reservation
+	cancellations []models.Cancellation
+	blocks        []models.RoomRestriction
+	filter        models.ReportFilter
+}
+
+func (s *fakeSource) EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error {
+	s.filter = f
+	for _, r := range s.reservations {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSource) EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error {
+	s.filter = f
+	for _, c := range s.cancellations {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSource) EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error {
+	s.filter = f
+	for _, b := range s.blocks {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func date(value string) time.Time {
+	t, _ := time.Parse("2006-01-02", value)
+	return t
+}
+
+var source = &fakeSource{
+	reservations: []models.Reservation{
+		{
+			ID:         7,
+			FirstName:  "Jane",
+			LastName:   "Doe, Jr",
+			Email:      "jane@doe.com",
+			StartDate:  date("2050-01-01"),
+			EndDate:    date("2050-01-04"),
+			CreateAt:   time.Date(2049, time.December, 1, 9, 30, 0, 0, time.UTC),
+			Room:       models.Room{RoomName: "General's Quarters"},
+			Adults:     2,
+			Processed:  1,
+			TotalPrice: 36050,
+		},
+	},
+	cancellations: []models.Cancellation{
+		{
+			ReservationID: 8,
+			LastName:      "Smith",
+			StartDate:     date("2050-02-01"),
+			EndDate:       date("2050-02-02"),
+			BookedAt:      time.Date(2050, time.January, 2, 10, 0, 0, 0, time.UTC),
+			CreateAt:      time.Date(2050, time.January, 5, 11, 0, 0, 0, time.UTC),
+			Room:          models.Room{RoomName: "Major's Suite"},
+		},
+	},
+	blocks: []models.RoomRestriction{
+		{ID: 3, StartDate: date("2050-01-10"), EndDate: date("2050-01-12"), Note: "paint", SeriesID: 2,
+			Room: models.Room{RoomName: "Major's Suite"}},
+	},
+}
+
+var reportTests = []struct {
+	name          string
+	rows          []string
+	byBookingDate bool
+}{
+	{
+		name: "reservations-by-stay",
+		rows: []string{
+			"7,2049-12-01 09:30,2050-01-01,2050-01-04,3,General's Quarters,Jane,\"Doe, Jr\",jane@doe.com,,2,0,yes,360.50",
+		},
+	},
+	{
+		name: "reservations-by-booking",
+		rows: []string{
+			"7,2049-12-01 09:30,2050-01-01,2050-01-04,3,General's Quarters,Jane,\"Doe, Jr\",jane@doe.com,,2,0,yes,360.50",
+		},
+		byBookingDate: true,
+	},
+	{
+		name: "cancellations",
+		rows: []string{"8,2050-01-05 11:00,2050-01-02 10:00,2050-02-01,2050-02-02,1,Major's Suite,,Smith,,,"},
+	},
+	{
+		name: "blocks",
+		rows: []string{"3,Major's Suite,2050-01-10,2050-01-12,2,paint,2"},
+	},
+	{
+		name: "guests",
+		rows: []string{"2050-01-01,2050-01-04,General's Quarters,\"Doe, Jr\",Jane,jane@doe.com,,2,0"},
+	},
+}
+
+func TestReports(t *testing.T) {
+	if len(All) != len(reportTests) {
+		t.Errorf("expected %d reports, got %d", len(reportTests), len(All))
+	}
+
+	for _, e := range reportTests {
+		report, ok := Find(e.name)
+		if !ok {
+			t.Errorf("%s: report not found", e.name)
+			continue
+		}
+
+		var b bytes.Buffer
+		err := report.Run(context.Background(), source, models.ReportFilter{RoomIDs: []int{1}}, NewCSV(&b))
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		if lines[0] != strings.Join(report.Header, ",") {
+			t.Errorf("%s: unexpected header %s", e.name, lines[0])
+		}
+		if strings.Join(lines[1:], "\n") != strings.Join(e.rows, "\n") {
+			t.Errorf("%s: expected rows\n%s\ngot\n%s", e.name, strings.Join(e.rows, "\n"), strings.Join(lines[1:], "\n"))
+		}
+		for _, column := range report.Numeric {
+			if column >= len(report.Header) {
+				t.Errorf("%s: numeric column %d is out of the header", e.name, column)
+			}
+		}
+		if e.name != "cancellations" && e.name != "blocks" && source.filter.ByBookingDate != e.byBookingDate {
+			t.Errorf("%s: expected ByBookingDate %v", e.name, e.byBookingDate)
+		}
+		if len(source.filter.RoomIDs) != 1 {
+			t.Errorf("%s: lost the room filter", e.name)
+		}
+	}
+
+	if _, ok := Find("payroll"); ok {
+		t.Error("found an unknown report")
+	}
+}
+
+// failingWriter fails on the first row after the header
+type failingWriter struct {
+	rows int
+}
+
+func (f *failingWriter) WriteRow(row []string) error {
+	f.rows++
+	if f.rows > 1 {
+		return errors.New("client went away")
+	}
+	return nil
+}
+
+func (f *failingWriter) Close() error {
+	return nil
+}
+
+func TestReportStopsOnWriteError(t *testing.T) {
+	report, _ := Find("guests")
+	err := report.Run(context.Background(), source, models.ReportFilter{}, &failingWriter{})
+	if err == nil || err.Error() != "client went away" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RowWriter writes a spreadsheet row by row, so a report never has to be held in memory
+type RowWriter interface {
+	WriteRow(row []string) error
+	// Close flushes what is left, the underlying writer stays open
+	Close() error
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+// NewCSV writes the rows as CSV to w
+func NewCSV(w io.Writer) RowWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) WriteRow(row []string) error {
+	cells := make([]string, len(row))
+	for i, cell := range row {
+		cells[i] = neutralise(cell)
+	}
+	return c.w.Write(cells)
+}
+
+// neutralise keeps a spreadsheet from running a cell as a formula: guests type their names and notes,
+// so a cell starting with one of the characters that begin a formula is written after a quote.
+// Plain numbers, negative ones included, are left as they are.
+func neutralise(cell string) string {
+	if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	return "'" + cell
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// The parts of a workbook with a single sheet, the sheet itself is streamed
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// maxSheetName is the longest sheet name Excel accepts
+const maxSheetName = 31
+
+type xlsxWriter struct {
+	zip     *zip.Writer
+	sheet   io.Writer
+	numeric map[int]bool
+	row     int
+}
+
+// NewXLSX writes the rows as a workbook with a single sheet to w. Cells of the numeric columns
+// holding a number are written as numbers so they can be summed, every other cell is text.
+func NewXLSX(w io.Writer, sheetName string, numeric []int) (RowWriter, error) {
+	x := &xlsxWriter{
+		zip:     zip.NewWriter(w),
+		numeric: make(map[int]bool),
+	}
+	for _, column := range numeric {
+		x.numeric[column] = true
+	}
+
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, escape(sheetTitle(sheetName)))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, part := range parts {
+		f, err := x.zip.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	// The sheet is the last part, rows go straight to it
+	sheet, err := x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(sheet, xlsxSheetStart); err != nil {
+		return nil, err
+	}
+	x.sheet = sheet
+
+	return x, nil
+}
+
+func (x *xlsxWriter) WriteRow(row []string) error {
+	x.row++
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<row r="%d">`, x.row)
+	for i, value := range row {
+		if _, err := strconv.ParseFloat(value, 64); err == nil && x.numeric[i] {
+			fmt.Fprintf(&b, `<c><v>%s</v></c>`, value)
+			continue
+		}
+		fmt.Fprintf(&b, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, escape(value))
+	}
+	b.WriteString(`</row>`)
+
+	_, err := x.sheet.Write(b.Bytes())
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, xlsxSheetEnd); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// escape makes a value safe inside an XML element or attribute
+func escape(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// sheetTitle drops the characters Excel refuses in a sheet name and shortens it
+func sheetTitle(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	if runes := []rune(name); len(runes) > maxSheetName {
+		name = string(runes[:maxSheetName])
+	}
+	if name == "" {
+		name = "Report"
+	}
+	return name
+}
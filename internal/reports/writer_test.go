@@ -0,0 +1,92 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestXLSX(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewXLSX(&b, "Guests: [list]/2050 and a very long name", []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := [][]string{
+		{"Name", "Nights"},
+		{"Doe & <Sons>", "3"},
+		{"0123", "n/a"},
+	}
+	for _, row := range rows {
+		if err = w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("not a zip file: %s", err)
+	}
+
+	parts := make(map[string]string)
+	for _, f := range z.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(content)
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("missing part %s", name)
+		}
+	}
+
+	if !strings.Contains(parts["xl/workbook.xml"], `name="Guests list2050 and a very long"`) {
+		t.Errorf("unexpected sheet name in %s", parts["xl/workbook.xml"])
+	}
+
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	for _, expected := range []string{
+		`<row r="1"><c t="inlineStr"><is><t xml:space="preserve">Name</t></is></c><c t="inlineStr"><is><t xml:space="preserve">Nights</t></is></c></row>`,
+		`<t xml:space="preserve">Doe &amp; &lt;Sons&gt;</t>`,
+		`<c><v>3</v></c>`,
+		// Numbers are only numbers in numeric columns, leading zeros are kept
+		`<t xml:space="preserve">0123</t>`,
+		`<t xml:space="preserve">n/a</t>`,
+	} {
+		if !strings.Contains(sheet, expected) {
+			t.Errorf("sheet is missing %s", expected)
+		}
+	}
+	if !strings.HasSuffix(sheet, "</sheetData></worksheet>") {
+		t.Error("sheet isn't closed")
+	}
+}
+
+func TestCSVFormulas(t *testing.T) {
+	var b bytes.Buffer
+	w := NewCSV(&b)
+	err := w.WriteRow([]string{"=HYPERLINK(\"http://evil\")", "+1+1", "-1+1", "@SUM(A1)", "\tcmd", "\rcmd", "-12.50", "Smith"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "\"'=HYPERLINK(\"\"http://evil\"\")\",'+1+1,'-1+1,'@SUM(A1),'\tcmd,\"'\rcmd\",-12.50,Smith\n"
+	if b.String() != expected {
+		t.Errorf("expected %q, got %q", expected, b.String())
+	}
+}
@@ -0,0 +1,184 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/audit"
+	"github.com/TranQuocToan1996/bookings/internal/models"
+)
+
+// rowState reads the row id of table for the audit log, nil when there is no such row. Encrypted emails
+// and phones are decrypted, so that writing them again doesn't count as a change.
+func (p *postgresDBRepo) rowState(ctx context.Context, tx dbtx, table string, id int) (map[string]interface{}, error) {
+	var state map[string]interface{}
+	var err error
+	if p.sqlite {
+		state, err = sqliteRowState(ctx, tx, table, id)
+		if state == nil || err != nil {
+			return nil, err
+		}
+	} else {
+		var raw []byte
+		err = tx.QueryRowContext(ctx, `select row_to_json(t) from `+table+` t where id = $1`, id).Scan(&raw)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(raw, &state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range []string{"email", "phone"} {
+		if value, ok := state[field].(string); ok {
+			state[field], err = p.Crypt.Decrypt(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// audited runs change in tx between two reads of the row id of table, and records in the same
+// transaction what it changed
+func (p *postgresDBRepo) audited(ctx context.Context, tx dbtx, actor models.Actor, action, entity, table string,
+	id int, change func() error) error {
+	before, err := p.rowState(ctx, tx, table, id)
+	if err != nil {
+		return err
+	}
+
+	err = change()
+	if err != nil {
+		return err
+	}
+
+	after, err := p.rowState(ctx, tx, table, id)
+	if err != nil {
+		return err
+	}
+
+	return insertAudit(ctx, tx, actor, action, entity, id, before, after)
+}
+
+// insertAudit adds an entry to the audit log, nothing is recorded when no field changed
+func insertAudit(ctx context.Context, tx dbtx, actor models.Actor, action, entity string, id int,
+	before, after map[string]interface{}) error {
+	changes := audit.Diff(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into audit_log (user_id, action, entity, entity_id, changes, ip, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $7)`
+	_, err = tx.ExecContext(ctx, query, actor.UserID, action, entity, id, string(encoded), actor.IP, time.Now())
+	return err
+}
+
+// AuditLog returns a page of the audit log entries matching f, the latest first, and how many entries
+// match in all
+func (p *postgresDBRepo) AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var entries []models.AuditEntry
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.UserID > 0 {
+		where = append(where, "a.user_id = "+arg(f.UserID))
+	}
+	if f.Action != "" {
+		where = append(where, "a.action = "+arg(f.Action))
+	}
+	if f.Entity != "" {
+		where = append(where, "a.entity = "+arg(f.Entity))
+	}
+	if f.EntityID > 0 {
+		where = append(where, "a.entity_id = "+arg(f.EntityID))
+	}
+	if !f.Start.IsZero() {
+		where = append(where, "a.created_at >= "+arg(f.Start))
+	}
+	if !f.End.IsZero() {
+		where = append(where, "a.created_at < "+arg(f.End))
+	}
+
+	conditions := ""
+	if len(where) > 0 {
+		conditions = "where " + strings.Join(where, " and ")
+	}
+
+	var total int
+	err := p.conn().QueryRowContext(ctx, `select count(*) from audit_log a `+conditions, args...).Scan(&total)
+	if err != nil {
+		return entries, 0, err
+	}
+
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	limit := arg(f.PerPage)
+	offset := arg((f.Page - 1) * f.PerPage)
+
+	query := `
+			select a.id, a.user_id, coalesce(u.first_name || ' ' || u.last_name, ''), a.action, a.entity,
+			a.entity_id, a.changes, a.ip, a.created_at
+			from audit_log a
+			left join users u on (a.user_id = u.id)
+			` + conditions + `
+			order by a.created_at desc, a.id desc
+			limit ` + limit + ` offset ` + offset
+
+	rows, err := p.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return entries, total, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEntry
+		err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.UserName,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&e.Changes,
+			&e.IP,
+			&e.CreateAt,
+		)
+		if err != nil {
+			return entries, total, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, total, err
+	}
+
+	return entries, total, nil
+}
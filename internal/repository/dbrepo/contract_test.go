@@ -0,0 +1,1277 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/config"
+	"github.com/TranQuocToan1996/bookings/internal/driver"
+	"github.com/TranQuocToan1996/bookings/internal/migrate"
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/privacy"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
+	"github.com/TranQuocToan1996/bookings/migrations"
+	"github.com/TranQuocToan1996/bookings/migrations/sqlite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// contractDSN names the environment variable holding the DSN of a Postgres database to run the contract
+// against, the Postgres repository is skipped without it. The database is migrated, and every test runs
+// in a transaction rolled back at its end so it is left as migrated.
+const contractDSN = "BOOKINGS_TEST_DSN"
+
+func TestMemoryRepoContract(t *testing.T) {
+	runContract(t, func(t *testing.T) repository.DatabaseRepo {
+		return NewMemoryRepo(&config.AppConfig{})
+	})
+}
+
+func TestPostgresRepoContract(t *testing.T) {
+	dsn := os.Getenv(contractDSN)
+	if dsn == "" {
+		t.Skipf("%s is not set", contractDSN)
+	}
+
+	db, err := driver.NewDatabase(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewPostgresRepo(db, &config.AppConfig{}).(*postgresDBRepo)
+	runContract(t, func(t *testing.T) repository.DatabaseRepo {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tx.Rollback() })
+
+		unit := *repo
+		unit.tx = tx
+		unit.savepoints = new(int)
+		return &unit
+	})
+}
+
+// Every test gets a new SQLite database, migrated
+func TestSQLiteRepoContract(t *testing.T) {
+	runContract(t, func(t *testing.T) repository.DatabaseRepo {
+		db, err := driver.NewSQLite(filepath.Join(t.TempDir(), "bookings.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		migrator, err := migrate.NewSQLite(db, sqlite.FS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = migrator.Up(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return NewSQLiteRepo(db, &config.AppConfig{})
+	})
+}
+
+// contractTests are what every DatabaseRepo does, whatever keeps the data. They start from a database
+// as the migrations seed it: two rooms and the admin user 1.
+var contractTests = []struct {
+	name string
+	test func(t *testing.T, repo repository.DatabaseRepo)
+}{
+	{"seed", contractSeed},
+	{"users", contractUsers},
+	{"availability", contractAvailability},
+	{"overlaps", contractOverlaps},
+	{"find reservations", contractFindReservations},
+	{"trash", contractTrash},
+	{"guests", contractGuests},
+	{"guest accounts", contractGuestAccounts},
+	{"personal data", contractPersonalData},
+	{"audit log", contractAuditLog},
+	{"transaction", contractTransaction},
+	{"search", contractSearch},
+	{"reports", contractReports},
+	{"stay rules", contractStayRules},
+	{"block series", contractBlockSeries},
+	{"foreign keys", contractForeignKeys},
+}
+
+// runContract runs every contract test on a repo given by open
+func runContract(t *testing.T, open func(t *testing.T) repository.DatabaseRepo) {
+	for _, c := range contractTests {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, open(t))
+		})
+	}
+}
+
+var contractActor = models.Actor{UserID: 1, IP: "127.0.0.1"}
+
+// date parses a day of the contract, far enough in the future to meet no real stay
+func date(day string) time.Time {
+	d, err := time.Parse(layout, day)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// stay is a reservation of room from start to end
+func stay(room int, start, end string) models.Reservation {
+	return models.Reservation{
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@example.com",
+		Phone:     "555 0100",
+		StartDate: date(start),
+		EndDate:   date(end),
+		RoomID:    room,
+		Adults:    1,
+	}
+}
+
+// codes numbers the confirmation codes of the contract
+var codes int
+
+// book inserts a reservation and its room restriction, as a booking does, and returns its id
+func book(t *testing.T, repo repository.DatabaseRepo, res models.Reservation) int {
+	t.Helper()
+	ctx := context.Background()
+
+	if res.ConfirmationCode == "" {
+		codes++
+		res.ConfirmationCode = fmt.Sprintf("CT%06d", codes)
+	}
+	id, err := repo.InsertReservation(ctx, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.InsertRoomRestriction(ctx, &models.RoomRestriction{
+		StartDate:     res.StartDate,
+		EndDate:       res.EndDate,
+		RoomID:        res.RoomID,
+		ReservationID: id,
+		RestrictionID: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// blockIDs returns the ids of the owner blocks of a room from start to end
+func blockIDs(t *testing.T, repo repository.DatabaseRepo, room int, start, end string) []int {
+	t.Helper()
+
+	list, err := repo.GetRestrictionsForRoomByDate(context.Background(), room, date(start), date(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, rr := range list {
+		if rr.ReservationID == 0 {
+			ids = append(ids, rr.ID)
+		}
+	}
+	return ids
+}
+
+func contractSeed(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	rooms, err := repo.AllRooms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].RoomName != "General's Quarters" || rooms[1].RoomName != "Major's Suite" {
+		t.Fatalf("expected the two seeded rooms by name, got %+v", rooms)
+	}
+
+	room, err := repo.GetRoomByID(ctx, rooms[1].ID)
+	if err != nil || room.RoomName != "Major's Suite" || room.MaxOccupancy != 2 {
+		t.Errorf("expected Major's Suite sleeping 2, got %+v, %v", room, err)
+	}
+	_, err = repo.GetRoomByID(ctx, 999)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows for an unknown room, got %v", err)
+	}
+
+	u, err := repo.GetUserByID(ctx, 1)
+	if err != nil || u.Email != "admin@admin.com" || u.AccessLevel != 3 {
+		t.Errorf("expected the admin user, got %+v, %v", u, err)
+	}
+	_, _, err = repo.Authenticate(ctx, "admin@admin.com", "not the password")
+	if err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+	_, _, err = repo.Authenticate(ctx, "nobody@example.com", "password")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows for an unknown user, got %v", err)
+	}
+}
+
+// addUser adds a user next to the seeded admin, the repository has no way to, and returns its id
+func addUser(t *testing.T, repo repository.DatabaseRepo, u models.User) int {
+	t.Helper()
+
+	switch r := repo.(type) {
+	case *memoryDBRepo:
+		defer r.lock()()
+		u.ID = r.db.nextID("users")
+		r.db.users[u.ID] = u
+		return u.ID
+	case *postgresDBRepo:
+		err := r.conn().QueryRowContext(context.Background(), `insert into users
+			(first_name, last_name, email, password, access_level, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`,
+			u.FirstName, u.LastName, u.Email, u.Password, u.AccessLevel, time.Now(), time.Now(),
+		).Scan(&u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.ID
+	}
+	t.Fatalf("can't add a user to a %T", repo)
+	return 0
+}
+
+func contractUsers(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	id := addUser(t, repo, models.User{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", AccessLevel: 1})
+
+	admin, err := repo.GetUserByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.FirstName = "Ada"
+	admin.Email = "ada@example.com"
+	err = repo.UpdateUser(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = repo.GetUserByID(ctx, 1)
+	if err != nil || admin.FirstName != "Ada" || admin.Email != "ada@example.com" || admin.AccessLevel != 3 {
+		t.Errorf("expected the admin updated, got %+v, %v", admin, err)
+	}
+	// Only the user of the id is updated
+	jane, err := repo.GetUserByID(ctx, id)
+	if err != nil || jane.FirstName != "Jane" || jane.Email != "jane@example.com" || jane.AccessLevel != 1 {
+		t.Errorf("expected the other user left as it was, got %+v, %v", jane, err)
+	}
+
+	jane.Email = "ada@example.com"
+	err = repo.UpdateUser(ctx, jane)
+	if err == nil {
+		t.Error("updated a user to the email of another")
+	}
+}
+
+func contractAvailability(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	book(t, repo, stay(1, "2060-03-01", "2060-03-05"))
+
+	tests := []struct {
+		room       int
+		start, end string
+		free       bool
+	}{
+		{1, "2060-03-04", "2060-03-06", false},
+		{1, "2060-02-25", "2060-03-02", false},
+		{1, "2060-03-05", "2060-03-07", true},
+		{1, "2060-02-25", "2060-03-01", true},
+		{2, "2060-03-01", "2060-03-05", true},
+	}
+	for _, e := range tests {
+		free, err := repo.SearchAvailabilityByRoomID(ctx, date(e.start), date(e.end), e.room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if free != e.free {
+			t.Errorf("room %d from %s to %s: expected free %v, got %v", e.room, e.start, e.end, e.free, free)
+		}
+	}
+
+	// Only the days count, as in the date columns
+	free, err := repo.SearchAvailabilityByRoomID(ctx, date("2060-02-25").Add(9*time.Hour),
+		date("2060-03-01").Add(11*time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !free {
+		t.Error("expected room 1 free up to the morning of its arrival day")
+	}
+	free, err = repo.SearchAvailabilityByRoomID(ctx, date("2060-03-04").Add(15*time.Hour), date("2060-03-06"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free {
+		t.Error("expected room 1 taken from the afternoon of its last night")
+	}
+
+	rooms, err := repo.SearchAvailabilityForAllRooms(ctx, date("2060-03-02"), date("2060-03-03"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != 2 {
+		t.Errorf("expected room 2 only, got %+v", rooms)
+	}
+
+	rooms, err = repo.SearchAvailabilityForAllRooms(ctx, date("2060-04-01"), date("2060-04-03"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 0 {
+		t.Errorf("expected no room for 3 guests, got %+v", rooms)
+	}
+}
+
+func contractOverlaps(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	book(t, repo, stay(1, "2060-03-01", "2060-03-05"))
+	moved := book(t, repo, stay(2, "2060-03-01", "2060-03-05"))
+
+	// A booking of nights taken since the search is refused, its reservation goes with it as in PostReservation
+	var late int
+	err := repo.Transaction(ctx, func(tx repository.DatabaseRepo) error {
+		res := stay(1, "2060-03-04", "2060-03-06")
+		res.ConfirmationCode = "CTLATE"
+		var err error
+		late, err = tx.InsertReservation(ctx, &res)
+		if err != nil {
+			return err
+		}
+		return tx.InsertRoomRestriction(ctx, &models.RoomRestriction{StartDate: res.StartDate, EndDate: res.EndDate,
+			RoomID: 1, ReservationID: late, RestrictionID: 1})
+	})
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Fatalf("expected an overlap booking a taken night, got %v", err)
+	}
+	_, err = repo.GetReservationByID(ctx, late)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the reservation of the refused booking rolled back, got %v", err)
+	}
+
+	err = repo.MoveReservation(ctx, contractActor, moved, 1, date("2060-03-03"), date("2060-03-07"), 40000)
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Fatalf("expected an overlap moving onto a stay, got %v", err)
+	}
+
+	err = repo.MoveReservation(ctx, contractActor, moved, 1, date("2060-03-05"), date("2060-03-08"), 30000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := repo.GetReservationByID(ctx, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RoomID != 1 || !res.StartDate.Equal(date("2060-03-05")) || !res.EndDate.Equal(date("2060-03-08")) ||
+		res.TotalPrice != 30000 {
+		t.Errorf("expected the stay moved to room 1 from 5 to 8 March for 300.00, got %+v", res)
+	}
+	free, err := repo.SearchAvailabilityByRoomID(ctx, date("2060-03-01"), date("2060-03-05"), 2)
+	if err != nil || !free {
+		t.Errorf("expected room 2 freed, got %v, %v", free, err)
+	}
+
+	// A reservation moves onto its own nights
+	err = repo.MoveReservation(ctx, contractActor, moved, 1, date("2060-03-06"), date("2060-03-09"), 30000)
+	if err != nil {
+		t.Errorf("expected a stay to move over its own nights, got %v", err)
+	}
+
+	// Changing only the room checks the stay the same way
+	err = repo.UpdateRoomForReservation(ctx, contractActor, moved, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := book(t, repo, stay(1, "2060-03-07", "2060-03-08"))
+	err = repo.UpdateRoomForReservation(ctx, contractActor, other, 2)
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Errorf("expected an overlap changing the room onto a stay, got %v", err)
+	}
+	err = repo.DeleteReservation(ctx, contractActor, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.UpdateRoomForReservation(ctx, contractActor, moved, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.InsertBlockForRoom(ctx, contractActor, models.RoomRestriction{
+		StartDate: date("2060-03-07"),
+		EndDate:   date("2060-03-14"),
+		RoomID:    1,
+		Note:      "Painting",
+	})
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Errorf("expected an overlap blocking the nights of a stay, got %v", err)
+	}
+
+	err = repo.InsertBlockForRoom(ctx, contractActor, models.RoomRestriction{
+		StartDate: date("2060-03-12"),
+		EndDate:   date("2060-03-14"),
+		RoomID:    1,
+		Note:      "Painting",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := blockIDs(t, repo, 1, "2060-03-01", "2060-04-01")
+	if len(ids) != 1 {
+		t.Fatalf("expected one block, got %v", ids)
+	}
+
+	block, err := repo.GetBlockByID(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Note != "Painting" || block.RestrictionID != 2 || block.Room.RoomName != "General's Quarters" {
+		t.Errorf("expected the painting block of General's Quarters, got %+v", block)
+	}
+
+	block.StartDate = date("2060-03-08")
+	err = repo.UpdateBlock(ctx, contractActor, block)
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Errorf("expected an overlap stretching a block onto a stay, got %v", err)
+	}
+	block.StartDate = date("2060-03-09")
+	block.Note = "Painting and floors"
+	err = repo.UpdateBlock(ctx, contractActor, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err = repo.GetBlockByID(ctx, ids[0])
+	if err != nil || !block.StartDate.Equal(date("2060-03-09")) || block.Note != "Painting and floors" {
+		t.Errorf("expected the block from 9 March with its new note, got %+v, %v", block, err)
+	}
+
+	err = repo.DeleteBlockByID(ctx, contractActor, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetBlockByID(ctx, ids[0])
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the block deleted, got %v", err)
+	}
+	err = repo.DeleteBlockByID(ctx, contractActor, ids[0])
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows deleting the block again, got %v", err)
+	}
+
+	// Reservations aren't blocks
+	list, err := repo.GetRestrictionsByDate(ctx, date("2060-03-01"), date("2060-04-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected the two stays, got %+v", list)
+	}
+	if list[0].Reservation.LastName != "Smith" || list[0].ReservationID == 0 {
+		t.Errorf("expected the stays with their guest, got %+v", list[0])
+	}
+	_, err = repo.GetBlockByID(ctx, list[0].ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a stay not to be found as a block, got %v", err)
+	}
+	err = repo.DeleteBlockByID(ctx, contractActor, list[0].ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a stay not to be deleted as a block, got %v", err)
+	}
+	list, err = repo.GetRestrictionsByDate(ctx, date("2060-03-01"), date("2060-04-01"))
+	if err != nil || len(list) != 2 {
+		t.Errorf("expected the two stays left, got %+v, %v", list, err)
+	}
+}
+
+func contractFindReservations(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	for i, name := range []string{"Zed", "Amy", "Kim"} {
+		res := stay(1, fmt.Sprintf("2060-05-%02d", 1+i*3), fmt.Sprintf("2060-05-%02d", 3+i*3))
+		res.FirstName = name
+		book(t, repo, res)
+	}
+	other := book(t, repo, stay(2, "2060-05-01", "2060-05-03"))
+	err := repo.UpdateProcessedForReservation(ctx, contractActor, other, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(list []models.Reservation) string {
+		var s []string
+		for _, r := range list {
+			s = append(s, r.FirstName)
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		name     string
+		filter   models.ReservationFilter
+		expected string
+		total    int
+	}{
+		{"first page by name", models.ReservationFilter{RoomID: 1, Sort: "first_name", Page: 1, PerPage: 2}, "Amy,Kim", 3},
+		{"second page by name", models.ReservationFilter{RoomID: 1, Sort: "first_name", Page: 2, PerPage: 2}, "Zed", 3},
+		{"by start date, latest first", models.ReservationFilter{RoomID: 1, Desc: true, PerPage: 10}, "Kim,Amy,Zed", 3},
+		{"dates", models.ReservationFilter{Start: date("2060-05-04"), End: date("2060-05-05"), PerPage: 10}, "Amy", 1},
+		{"name", models.ReservationFilter{Query: "kim", PerPage: 10}, "Kim", 1},
+		{"email", models.ReservationFilter{RoomID: 2, Query: "JOHN@example.com", PerPage: 10}, "John", 1},
+		{"processed", models.ReservationFilter{Status: "processed", Start: date("2060-01-01"), PerPage: 10}, "John", 1},
+		{"new", models.ReservationFilter{Status: "new", Start: date("2060-01-01"), Sort: "first_name", PerPage: 10}, "Amy,Kim,Zed", 3},
+	}
+	for _, e := range tests {
+		list, total, err := repo.FindReservations(ctx, e.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names(list) != e.expected || total != e.total {
+			t.Errorf("%s: expected %s of %d, got %s of %d", e.name, e.expected, e.total, names(list), total)
+		}
+	}
+}
+
+func contractTrash(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	deleted := book(t, repo, stay(1, "2060-03-01", "2060-03-05"))
+
+	err := repo.DeleteReservation(ctx, contractActor, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free, err := repo.SearchAvailabilityByRoomID(ctx, date("2060-03-01"), date("2060-03-05"), 1)
+	if err != nil || !free {
+		t.Errorf("expected the nights freed, got %v, %v", free, err)
+	}
+	res, err := repo.GetReservationByID(ctx, deleted)
+	if err != nil || res.DeletedAt.IsZero() || res.DeletedBy != 1 {
+		t.Errorf("expected the reservation in the trash, got %+v, %v", res, err)
+	}
+	_, total, err := repo.FindReservations(ctx, models.ReservationFilter{PerPage: 10})
+	if err != nil || total != 0 {
+		t.Errorf("expected the trash left out of the lists, got %d, %v", total, err)
+	}
+	trashed, err := repo.TrashedReservations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 1 || trashed[0].ID != deleted || trashed[0].DeletedByName != "Toan Tran" {
+		t.Errorf("expected the reservation deleted by Toan Tran in the trash, got %+v", trashed)
+	}
+
+	// A reservation in the trash can only be restored
+	res.Notes = "Changed in the trash"
+	changes := map[string]func() error{
+		"update":  func() error { return repo.UpdateReservation(ctx, contractActor, res) },
+		"process": func() error { return repo.UpdateProcessedForReservation(ctx, contractActor, deleted, 1) },
+		"delete":  func() error { return repo.DeleteReservation(ctx, contractActor, deleted) },
+		"room":    func() error { return repo.UpdateRoomForReservation(ctx, contractActor, deleted, 2) },
+		"move": func() error {
+			return repo.MoveReservation(ctx, contractActor, deleted, 2, date("2060-04-01"), date("2060-04-03"), 0)
+		},
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s: expected no rows changing a reservation in the trash, got %v", name, err)
+		}
+	}
+	res, err = repo.GetReservationByID(ctx, deleted)
+	if err != nil || res.Notes != "" || res.RoomID != 1 || res.Processed != 0 {
+		t.Errorf("expected the reservation in the trash unchanged, got %+v, %v", res, err)
+	}
+
+	// The nights were booked again in the meantime
+	taken := book(t, repo, stay(1, "2060-03-04", "2060-03-06"))
+	err = repo.RestoreReservation(ctx, contractActor, deleted)
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Fatalf("expected an overlap restoring onto a stay, got %v", err)
+	}
+
+	err = repo.DeleteReservation(ctx, contractActor, taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.RestoreReservation(ctx, contractActor, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, err = repo.SearchAvailabilityByRoomID(ctx, date("2060-03-01"), date("2060-03-05"), 1)
+	if err != nil || free {
+		t.Errorf("expected the nights booked again, got %v, %v", free, err)
+	}
+	err = repo.RestoreReservation(ctx, contractActor, deleted)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows restoring a reservation out of the trash, got %v", err)
+	}
+
+	var cancelled []int
+	err = repo.EachCancellation(ctx, models.ReportFilter{Start: time.Now().AddDate(0, 0, -1), End: time.Now().AddDate(0, 0, 1)},
+		func(c models.Cancellation) error {
+			cancelled = append(cancelled, c.ReservationID)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 1 || cancelled[0] != taken {
+		t.Errorf("expected only the reservation left in the trash cancelled, got %v", cancelled)
+	}
+
+	n, err := repo.PurgeDeletedBefore(ctx, time.Now().Add(time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 reservation purged, got %d, %v", n, err)
+	}
+	_, err = repo.GetReservationByID(ctx, taken)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the purged reservation gone, got %v", err)
+	}
+	_, err = repo.GetReservationByID(ctx, deleted)
+	if err != nil {
+		t.Errorf("expected the restored reservation kept, got %v", err)
+	}
+}
+
+func contractGuests(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	first := stay(1, "2060-03-01", "2060-03-05")
+	first.FirstName, first.LastName, first.Email, first.Phone = "Ann", "Lee", "Ann@Example.com", "+84 989 123"
+	first.TotalPrice = 40000
+	again := first
+	again.Email = " ann@example.com"
+	again.StartDate, again.EndDate = date("2060-04-01"), date("2060-04-03")
+	byPhone := first
+	byPhone.Email, byPhone.Phone = "ann.lee@example.com", "0084989123"
+	byPhone.StartDate, byPhone.EndDate = date("2060-05-01"), date("2060-05-02")
+
+	var guestIDs []int
+	for _, res := range []models.Reservation{first, again, byPhone} {
+		r, err := repo.GetReservationByID(ctx, book(t, repo, res))
+		if err != nil {
+			t.Fatal(err)
+		}
+		guestIDs = append(guestIDs, r.GuestID)
+	}
+	if guestIDs[0] == 0 || guestIDs[1] != guestIDs[0] || guestIDs[2] != guestIDs[0] {
+		t.Fatalf("expected the three stays matched to one guest, got %v", guestIDs)
+	}
+	id := guestIDs[0]
+
+	g, err := repo.GetGuestByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Email != "Ann@Example.com" || g.Stays != 3 || g.Nights != 7 || g.LifetimeValue != 120000 {
+		t.Errorf("expected Ann with 3 stays, 7 nights and 1200.00, got %+v", g)
+	}
+
+	stays, err := repo.GuestReservations(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stays) != 3 || !stays[0].StartDate.Equal(date("2060-05-01")) {
+		t.Errorf("expected the latest stay first, got %+v", stays)
+	}
+
+	found, err := repo.AllGuests(ctx, "ann l", 10)
+	if err != nil || len(found) != 1 || found[0].ID != id {
+		t.Errorf("expected Ann found by name, got %+v, %v", found, err)
+	}
+	found, err = repo.AllGuests(ctx, "+84989123", 10)
+	if err != nil || len(found) != 1 || found[0].ID != id {
+		t.Errorf("expected Ann found by phone, got %+v, %v", found, err)
+	}
+
+	// Another Ann Lee, unknown by email and phone
+	other := first
+	other.Email, other.Phone = "al@example.net", ""
+	other.RoomID = 2
+	res, err := repo.GetReservationByID(ctx, book(t, repo, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := res.GuestID
+	if duplicate == id {
+		t.Fatal("expected a new guest for another email and phone")
+	}
+
+	duplicates, err := repo.GuestDuplicates(ctx, id)
+	if err != nil || len(duplicates) != 1 || duplicates[0].ID != duplicate {
+		t.Fatalf("expected the other Ann Lee as duplicate, got %+v, %v", duplicates, err)
+	}
+
+	// An email belongs to one guest, the two are merged instead
+	taken := g
+	taken.Email = "AL@example.net"
+	err = repo.UpdateGuest(ctx, contractActor, taken)
+	if !errors.Is(err, repository.ErrGuestEmailTaken) {
+		t.Errorf("expected the email of the other Ann Lee taken, got %v", err)
+	}
+
+	g.Email = "al@example.net"
+	g.Tags = []string{"vip"}
+	g.Notes = "Likes the garden view"
+	err = repo.MergeGuests(ctx, contractActor, g, duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetGuestByID(ctx, duplicate)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the duplicate deleted, got %v", err)
+	}
+	g, err = repo.GetGuestByID(ctx, id)
+	if err != nil || g.Stays != 4 || g.Notes != "Likes the garden view" || len(g.Tags) != 1 || g.Tags[0] != "vip" ||
+		g.Email != "al@example.net" {
+		t.Errorf("expected the merged guest with 4 stays, the email of the duplicate, its notes and tags, got %+v, %v", g, err)
+	}
+
+	// A booking with the email again finds the merged guest
+	other.StartDate, other.EndDate = date("2060-06-01"), date("2060-06-02")
+	res, err = repo.GetReservationByID(ctx, book(t, repo, other))
+	if err != nil || res.GuestID != id {
+		t.Errorf("expected the stay of the merged guest, got %d, %v", res.GuestID, err)
+	}
+}
+
+func contractGuestAccounts(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := models.GuestAccount{
+		Email:         "bob@example.com",
+		Password:      string(hash),
+		VerifyToken:   "contract token",
+		VerifyExpires: time.Now().Add(time.Hour),
+		Guest:         models.Guest{FirstName: "Bob", LastName: "Stone"},
+	}
+	id, err := repo.InsertGuestAccount(ctx, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.InsertGuestAccount(ctx, account)
+	if !errors.Is(err, repository.ErrEmailTaken) {
+		t.Errorf("expected the email taken, got %v", err)
+	}
+
+	a, err := repo.AuthenticateGuest(ctx, " Bob@Example.com", "secret password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != id || a.Verified || a.Guest.FirstName != "Bob" || a.Guest.Email != "bob@example.com" {
+		t.Errorf("expected the unverified account of Bob, got %+v", a)
+	}
+	_, err = repo.AuthenticateGuest(ctx, "bob@example.com", "wrong")
+	if err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+
+	// Bookings with the email of the account go to its guest
+	booked, err := repo.GetReservationByID(ctx, book(t, repo, models.Reservation{
+		FirstName: "Robert",
+		LastName:  "Stone",
+		Email:     "bob@example.com",
+		StartDate: date("2060-03-01"),
+		EndDate:   date("2060-03-02"),
+		RoomID:    1,
+		Adults:    1,
+	}))
+	if err != nil || booked.GuestID != a.GuestID {
+		t.Errorf("expected the stay booked for the guest %d of the account, got %+v, %v", a.GuestID, booked, err)
+	}
+
+	// Nobody checks a phone, an account with the phone of a guest doesn't get its profile
+	err = repo.UpdateGuest(ctx, contractActor, models.Guest{ID: a.GuestID, FirstName: "Bob", LastName: "Stone",
+		Email: "bob@example.com", Phone: "555 0142"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruder, err := repo.InsertGuestAccount(ctx, models.GuestAccount{
+		Email:         "mallory@example.com",
+		Password:      string(hash),
+		VerifyToken:   "intruder token",
+		VerifyExpires: time.Now().Add(time.Hour),
+		Guest:         models.Guest{FirstName: "Mallory", LastName: "Stone", Phone: "555 0142"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := repo.GetGuestAccountByID(ctx, intruder)
+	if err != nil || other.GuestID == a.GuestID || other.Guest.Phone != "555 0142" {
+		t.Errorf("expected a new guest with the phone, not the guest %d, got %+v, %v", a.GuestID, other, err)
+	}
+
+	verified, err := repo.VerifyGuestAccount(ctx, "contract token")
+	if err != nil || verified != id {
+		t.Fatalf("expected the account %d verified, got %d, %v", id, verified, err)
+	}
+	_, err = repo.VerifyGuestAccount(ctx, "contract token")
+	if !errors.Is(err, repository.ErrInvalidToken) {
+		t.Errorf("expected a token to work once, got %v", err)
+	}
+	a, err = repo.GetGuestAccountByID(ctx, id)
+	if err != nil || !a.Verified {
+		t.Errorf("expected the account verified, got %+v, %v", a, err)
+	}
+
+	err = repo.SetGuestAccountToken(ctx, id, "expired token", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.VerifyGuestAccount(ctx, "expired token")
+	if !errors.Is(err, repository.ErrInvalidToken) {
+		t.Errorf("expected an expired token refused, got %v", err)
+	}
+}
+
+func contractPersonalData(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	res := stay(1, "2060-03-01", "2060-03-05")
+	res.FirstName, res.Email, res.Phone = "Eve", "eve@example.com", "555 0199"
+	id := book(t, repo, res)
+	book(t, repo, stay(2, "2060-03-01", "2060-03-05"))
+
+	err := repo.InsertSentEmail(ctx, models.MailData{To: "Eve@example.com", Subject: "Your stay", Content: "Welcome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := repo.PersonalData(ctx, " EVE@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Email != "eve@example.com" || len(data.Guests) != 1 || len(data.Reservations) != 1 || len(data.Emails) != 1 {
+		t.Fatalf("expected the guest, stay and email of Eve, got %+v", data)
+	}
+	if data.Reservations[0].ID != id || data.Emails[0].Subject != "Your stay" {
+		t.Errorf("expected the stay and email of Eve, got %+v", data)
+	}
+
+	// Changes of Eve made by the admin pages get in the audit log
+	eve := data.Reservations[0]
+	eve.LastName, eve.Notes = "Adams", "Eve asks for a cot"
+	err = repo.UpdateReservation(ctx, contractActor, eve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := data.Guests[0]
+	guest.LastName, guest.Notes, guest.Tags = "Adams", "Eve is allergic to nuts", []string{"eve-regular"}
+	err = repo.UpdateGuest(ctx, contractActor, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := repo.ErasePersonalData(ctx, "eve@example.com")
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 reservation anonymized, got %d, %v", n, err)
+	}
+	data, err = repo.PersonalData(ctx, "eve@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Guests)+len(data.Reservations)+len(data.Emails) != 0 {
+		t.Errorf("expected nothing left about Eve, got %+v", data)
+	}
+
+	erased, err := repo.GetReservationByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased.FirstName != privacy.ErasedName || erased.Email != "" || erased.GuestID != 0 || erased.RoomID != 1 {
+		t.Errorf("expected the stay kept without its guest, got %+v", erased)
+	}
+
+	// The stay of John ended long before
+	n, err = repo.AnonymizeBefore(ctx, date("2060-03-06"))
+	if err != nil || n != 1 {
+		t.Errorf("expected the stay of John anonymized, got %d, %v", n, err)
+	}
+
+	// The audit log is append-only, an erasure can't reach it: it must hold nothing about Eve
+	for _, f := range []models.AuditFilter{
+		{Entity: "reservation", EntityID: id, Page: 1, PerPage: 10},
+		{Entity: "guest", EntityID: guest.ID, Page: 1, PerPage: 10},
+	} {
+		entries, total, err := repo.AuditLog(ctx, f)
+		if err != nil || total == 0 {
+			t.Fatalf("expected the changes of the %s of Eve logged, got %d, %v", f.Entity, total, err)
+		}
+		for _, e := range entries {
+			for _, value := range []string{"Eve", "eve@", "0199", "Adams", "nuts", "cot", "eve-regular"} {
+				if strings.Contains(e.Changes, value) {
+					t.Errorf("expected nothing about Eve in the audit log, got %s", e.Changes)
+				}
+			}
+		}
+	}
+}
+
+func contractAuditLog(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	id := book(t, repo, stay(1, "2060-03-01", "2060-03-05"))
+
+	for i := 0; i < 2; i++ {
+		err := repo.UpdateProcessedForReservation(ctx, contractActor, id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := models.AuditFilter{Entity: "reservation", EntityID: id, Page: 1, PerPage: 10}
+	entries, total, err := repo.AuditLog(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(entries) != 1 {
+		t.Fatalf("expected one entry, the second change changed nothing, got %d", total)
+	}
+	e := entries[0]
+	if e.Action != "process" || e.UserName != "Toan Tran" || e.IP != "127.0.0.1" || !strings.Contains(e.Changes, `"processed"`) {
+		t.Errorf("expected Toan Tran processing the reservation, got %+v", e)
+	}
+
+	res, err := repo.GetReservationByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Email = "someone.else@example.com"
+	res.FirstName = "Jonathan"
+	res.Notes = "Arrives late"
+	err = repo.UpdateReservation(ctx, contractActor, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, total, err = repo.AuditLog(ctx, f)
+	if err != nil || total != 2 || entries[0].Action != "update" {
+		t.Fatalf("expected the update first, got %+v, %v", entries, err)
+	}
+	for _, value := range []string{"someone.else", "Jonathan", "Arrives late"} {
+		if strings.Contains(entries[0].Changes, value) {
+			t.Errorf("expected the personal fields redacted, got %s", entries[0].Changes)
+		}
+	}
+
+	entries, total, err = repo.AuditLog(ctx, models.AuditFilter{Action: "update", EntityID: id, Page: 2, PerPage: 1})
+	if err != nil || total != 1 || len(entries) != 0 {
+		t.Errorf("expected an empty second page of one entry, got %d of %d, %v", len(entries), total, err)
+	}
+}
+
+func contractTransaction(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	failed := errors.New("failed")
+
+	var rolledBack int
+	err := repo.Transaction(ctx, func(tx repository.DatabaseRepo) error {
+		rolledBack = book(t, tx, stay(1, "2060-03-01", "2060-03-05"))
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+	_, err = repo.GetReservationByID(ctx, rolledBack)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the reservation rolled back, got %v", err)
+	}
+	free, err := repo.SearchAvailabilityByRoomID(ctx, date("2060-03-01"), date("2060-03-05"), 1)
+	if err != nil || !free {
+		t.Errorf("expected the nights free again, got %v, %v", free, err)
+	}
+
+	var kept, nested int
+	err = repo.Transaction(ctx, func(tx repository.DatabaseRepo) error {
+		kept = book(t, tx, stay(1, "2060-03-01", "2060-03-05"))
+
+		// A unit of work failing within another one only undoes its own changes
+		err := tx.Transaction(ctx, func(tx repository.DatabaseRepo) error {
+			nested = book(t, tx, stay(2, "2060-03-01", "2060-03-05"))
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			return fmt.Errorf("expected the error of the nested unit, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetReservationByID(ctx, kept)
+	if err != nil {
+		t.Errorf("expected the reservation committed, got %v", err)
+	}
+	_, err = repo.GetReservationByID(ctx, nested)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the nested reservation rolled back, got %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic of fn to go through")
+			}
+		}()
+		repo.Transaction(ctx, func(tx repository.DatabaseRepo) error {
+			err := tx.DeleteReservation(ctx, contractActor, kept)
+			if err != nil {
+				return err
+			}
+			panic("in the middle of a change")
+		})
+	}()
+	res, err := repo.GetReservationByID(ctx, kept)
+	if err != nil || !res.DeletedAt.IsZero() {
+		t.Errorf("expected the deletion rolled back after a panic, got %+v, %v", res, err)
+	}
+}
+
+func contractSearch(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	res := stay(2, "2060-07-01", "2060-07-04")
+	res.FirstName, res.LastName, res.ConfirmationCode = "Harriet", "Vane", "SRCH1234"
+	id := book(t, repo, res)
+	book(t, repo, stay(1, "2060-08-01", "2060-08-03"))
+
+	found, err := repo.GetReservationByCode(ctx, " srch1234 ")
+	if err != nil || found.ID != id {
+		t.Errorf("expected the reservation found by its code, got %+v, %v", found, err)
+	}
+	_, err = repo.GetReservationByCode(ctx, "NOPE0000")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows for an unknown code, got %v", err)
+	}
+
+	results, err := repo.SearchReservations(ctx, "SRCH", 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].Kind != "code" || results[0].Reservation.ID != id {
+		t.Errorf("expected the code matched first, got %+v", results)
+	}
+
+	results, err = repo.SearchReservations(ctx, "Harriet Vane", time.July, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].Kind != "guest" || results[0].Reservation.ID != id {
+		t.Errorf("expected the guest matched, got %+v", results)
+	}
+
+	results, err = repo.SearchReservations(ctx, "Harriet Vane", time.August, 5)
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected nothing arriving in August, got %+v, %v", results, err)
+	}
+}
+
+func contractReports(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	res := stay(1, "2060-03-30", "2060-04-03")
+	res.TotalPrice = 30000
+	id := book(t, repo, res)
+	err := repo.InsertBlockForRoom(ctx, contractActor, models.RoomRestriction{
+		StartDate: date("2060-04-10"),
+		EndDate:   date("2060-04-12"),
+		RoomID:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := repo.DashboardStats(ctx, date("2060-03-01"), date("2060-04-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Reservations != 1 || stats.New != 1 || stats.AverageStay != 4 || stats.Revenue != 30000 {
+		t.Errorf("expected one new stay of 4 nights for 300.00, got %+v", stats)
+	}
+
+	occupancy, err := repo.OccupancyByMonth(ctx, date("2060-03-15"), date("2060-05-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occupancy) != 4 {
+		t.Fatalf("expected 2 rooms by 2 months, got %+v", occupancy)
+	}
+	march, april := occupancy[0], occupancy[1]
+	if march.Nights != 17 || march.BookedNights != 2 || april.Nights != 30 || april.BookedNights != 2 {
+		t.Errorf("expected 2 nights booked in each month, got %+v and %+v", march, april)
+	}
+	if occupancy[3].BookedNights != 0 {
+		t.Errorf("expected blocks not counted as booked, got %+v", occupancy[3])
+	}
+
+	f := models.ReportFilter{Start: date("2060-04-01"), End: date("2060-05-01")}
+	var reservations []int
+	err = repo.EachReservation(ctx, f, func(r models.Reservation) error {
+		reservations = append(reservations, r.ID)
+		return nil
+	})
+	if err != nil || len(reservations) != 1 || reservations[0] != id {
+		t.Errorf("expected the stay over the end of March, got %v, %v", reservations, err)
+	}
+
+	var blocks []string
+	err = repo.EachBlock(ctx, f, func(b models.RoomRestriction) error {
+		blocks = append(blocks, b.Room.RoomName)
+		return nil
+	})
+	if err != nil || len(blocks) != 1 || blocks[0] != "Major's Suite" {
+		t.Errorf("expected the block of Major's Suite, got %v, %v", blocks, err)
+	}
+
+	f.RoomIDs = []int{2}
+	reservations = nil
+	err = repo.EachReservation(ctx, f, func(r models.Reservation) error {
+		reservations = append(reservations, r.ID)
+		return nil
+	})
+	if err != nil || len(reservations) != 0 {
+		t.Errorf("expected no stay in room 2, got %v, %v", reservations, err)
+	}
+}
+
+func contractStayRules(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	err := repo.InsertStayRule(ctx, contractActor, models.StayRule{
+		RoomID:    2,
+		StartDate: date("2060-06-01"),
+		EndDate:   date("2060-06-30"),
+		MinNights: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := repo.GetStayRulesByDate(ctx, date("2060-06-30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].MinNights != 3 || rules[0].Room.RoomName != "Major's Suite" {
+		t.Fatalf("expected the rule of Major's Suite on its last day, got %+v", rules)
+	}
+	rules, err = repo.GetStayRulesByDate(ctx, date("2060-07-01"))
+	if err != nil || len(rules) != 0 {
+		t.Errorf("expected no rule after it ends, got %+v, %v", rules, err)
+	}
+
+	all, err := repo.AllStayRules(ctx)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("expected one rule, got %+v, %v", all, err)
+	}
+	err = repo.DeleteStayRule(ctx, contractActor, all[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err = repo.AllStayRules(ctx)
+	if err != nil || len(all) != 0 {
+		t.Errorf("expected the rule deleted, got %+v, %v", all, err)
+	}
+}
+
+func contractBlockSeries(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+	series := models.BlockSeries{
+		RoomID:    1,
+		StartDate: date("2060-01-03"),
+		EndDate:   date("2060-01-04"),
+		Frequency: "weekly",
+		UntilDate: date("2060-01-10"),
+		Note:      "Cleaning",
+	}
+	blocks := []models.RoomRestriction{
+		{RoomID: 1, StartDate: date("2060-01-03"), EndDate: date("2060-01-04"), Note: "Cleaning"},
+		{RoomID: 1, StartDate: date("2060-01-10"), EndDate: date("2060-01-11"), Note: "Cleaning"},
+	}
+	err := repo.InsertBlockSeries(ctx, contractActor, series, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := repo.AllBlockSeries(ctx)
+	if err != nil || len(all) != 1 || all[0].Frequency != "weekly" || all[0].Room.RoomName != "General's Quarters" {
+		t.Fatalf("expected the weekly series of General's Quarters, got %+v, %v", all, err)
+	}
+
+	ids := blockIDs(t, repo, 1, "2060-01-01", "2060-02-01")
+	if len(ids) != 2 {
+		t.Fatalf("expected the two blocks of the series, got %v", ids)
+	}
+	block, err := repo.GetBlockByID(ctx, ids[0])
+	if err != nil || block.SeriesID != all[0].ID {
+		t.Errorf("expected the block in the series, got %+v, %v", block, err)
+	}
+
+	err = repo.DeleteBlockSeries(ctx, contractActor, all[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids = blockIDs(t, repo, 1, "2060-01-01", "2060-02-01"); len(ids) != 0 {
+		t.Errorf("expected the blocks deleted with the series, got %v", ids)
+	}
+	err = repo.DeleteBlockSeries(ctx, contractActor, all[0].ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows deleting the series again, got %v", err)
+	}
+
+	// A series running into a stay is not inserted at all
+	book(t, repo, stay(1, "2060-01-17", "2060-01-19"))
+	series.UntilDate = date("2060-01-31")
+	blocks = append(blocks, models.RoomRestriction{RoomID: 1, StartDate: date("2060-01-17"), EndDate: date("2060-01-18")})
+	err = repo.InsertBlockSeries(ctx, contractActor, series, blocks)
+	if !errors.Is(err, repository.ErrOverlap) {
+		t.Errorf("expected an overlap blocking the nights of a stay, got %v", err)
+	}
+	all, err = repo.AllBlockSeries(ctx)
+	if err != nil || len(all) != 0 {
+		t.Errorf("expected no series, got %+v, %v", all, err)
+	}
+	if ids = blockIDs(t, repo, 1, "2060-01-01", "2060-02-01"); len(ids) != 0 {
+		t.Errorf("expected no block, got %v", ids)
+	}
+}
+
+// contractForeignKeys runs last: Postgres can't go on with a transaction after a failed statement
+func contractForeignKeys(t *testing.T, repo repository.DatabaseRepo) {
+	ctx := context.Background()
+
+	res := stay(999, "2060-03-01", "2060-03-05")
+	res.ConfirmationCode = "NOROOM01"
+	_, err := repo.InsertReservation(ctx, &res)
+	if err == nil {
+		t.Error("inserted a reservation of an unknown room")
+	}
+
+	err = repo.InsertRoomRestriction(ctx, &models.RoomRestriction{
+		StartDate:     date("2060-03-01"),
+		EndDate:       date("2060-03-05"),
+		RoomID:        1,
+		ReservationID: 999999,
+		RestrictionID: 1,
+	})
+	if err == nil {
+		t.Error("inserted a room restriction of an unknown reservation")
+	}
+}
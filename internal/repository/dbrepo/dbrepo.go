@@ -1,9 +1,13 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"sync"
+	"time"
 
 	"github.com/TranQuocToan1996/bookings/internal/config"
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
 	"github.com/TranQuocToan1996/bookings/internal/repository"
 )
 
@@ -19,16 +23,67 @@ func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 	}
 }
 
+// DefaultQueryTimeout bounds a query when the configuration doesn't say otherwise
+const DefaultQueryTimeout = 3 * time.Second
+
 type postgresDBRepo struct {
-	App *config.AppConfig
-	DB  *sql.DB
+	App   *config.AppConfig
+	DB    *sql.DB
+	Crypt *fieldcrypt.Keyring
+	// Timeout bounds every query that isn't a report
+	Timeout time.Duration
+	// tx is the transaction of the unit of work the repo belongs to, nil outside of one
+	tx *sql.Tx
+	// savepoints numbers the savepoints of the unit of work
+	savepoints *int
+	// sqlite is set when DB is a SQLite database, for the few queries SQLite writes otherwise
+	sqlite bool
 }
 
 // Return new repo for postgres database
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
+	timeout := a.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+
 	return &postgresDBRepo{
+		App:     a,
+		DB:      conn,
+		Crypt:   a.FieldKeys,
+		Timeout: timeout,
+	}
+}
+
+// Return new repo for a SQLite database opened by driver.NewSQLite. It shares the queries of the Postgres
+// repo, but for the ones SQLite writes otherwise.
+func NewSQLiteRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
+	p := NewPostgresRepo(conn, a).(*postgresDBRepo)
+	p.sqlite = true
+	return p
+}
+
+// withTimeout bounds a query by the query timeout. The query is also cancelled as soon as ctx is,
+// when the client of a request goes away for instance, pgx then stops it on the server.
+func (p *postgresDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+type memoryDBRepo struct {
+	App *config.AppConfig
+	mu  *sync.Mutex
+	db  *memoryData
+	// inUnit is set for the repo of a unit of work, which holds mu until the unit ends
+	inUnit bool
+}
+
+// Return new repo keeping its data in memory, seeded as the migrations seed a new database. Nothing
+// outlives the process.
+func NewMemoryRepo(a *config.AppConfig) repository.DatabaseRepo {
+	return &memoryDBRepo{
 		App: a,
-		DB:  conn,
+		mu:  &sync.Mutex{},
+		db:  newMemoryData(),
 	}
 }
 
@@ -0,0 +1,267 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
+	"github.com/TranQuocToan1996/bookings/internal/guests"
+)
+
+// contact is an email and a phone as stored: encrypted, with the blind indexes of their normalized
+// values to look them up
+type contact struct {
+	Email      string
+	Phone      string
+	EmailIndex string
+	PhoneIndex string
+}
+
+// sealContact encrypts an email and a phone with the active key and indexes them
+func (p *postgresDBRepo) sealContact(email, phone string) (contact, error) {
+	var c contact
+	var err error
+
+	c.Email, err = p.Crypt.Encrypt(email)
+	if err != nil {
+		return c, err
+	}
+	c.Phone, err = p.Crypt.Encrypt(phone)
+	if err != nil {
+		return c, err
+	}
+	c.EmailIndex = p.Crypt.Index(guests.NormalizeEmail(email))
+	c.PhoneIndex = p.Crypt.Index(guests.NormalizePhone(phone))
+
+	return c, nil
+}
+
+// openContact decrypts a stored email and phone in place
+func (p *postgresDBRepo) openContact(email, phone *string) error {
+	var err error
+
+	*email, err = p.Crypt.Decrypt(*email)
+	if err != nil {
+		return err
+	}
+	*phone, err = p.Crypt.Decrypt(*phone)
+	return err
+}
+
+// encryptedTable is a table with encrypted columns and the blind indexes of some of them
+type encryptedTable struct {
+	name    string
+	columns []string
+	indexes []blindIndex
+}
+
+// blindIndex is a column holding the blind index of the normalized plain value of another column
+type blindIndex struct {
+	column    string
+	of        string
+	normalize func(string) string
+}
+
+// contactIndexes are the blind indexes of an email and a phone
+var contactIndexes = []blindIndex{
+	{"email_index", "email", guests.NormalizeEmail},
+	{"phone_index", "phone", guests.NormalizePhone},
+}
+
+// encryptedTables are the tables holding personal data encrypted
+var encryptedTables = []encryptedTable{
+	{"reservations", []string{"email", "phone"}, contactIndexes},
+	{"cancellations", []string{"email", "phone"}, contactIndexes},
+	{"guests", []string{"email", "phone"}, contactIndexes},
+	{"guest_accounts", []string{"email"}, contactIndexes[:1]},
+	{"sent_emails", []string{"to_address", "content"}, []blindIndex{{"email_index", "to_address", guests.NormalizeEmail}}},
+}
+
+// Unindexed returns the number of rows with a blind index in plain text, written without keys. These
+// rows can't be looked up with keys until Reencrypt indexed them.
+func Unindexed(ctx context.Context, conn *sql.DB) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	total := 0
+	for _, table := range encryptedTables {
+		var plain []string
+		for _, index := range table.indexes {
+			plain = append(plain, fmt.Sprintf("(%s <> '' and %s not like '%s%%')", index.column, index.column, fieldcrypt.IndexPrefix))
+		}
+
+		n := 0
+		err := conn.QueryRowContext(ctx, `select count(*) from `+table.name+` where `+strings.Join(plain, " or ")).Scan(&n)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", table.name, err)
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// reencryptBatch is the number of rows re-encrypted in a transaction
+const reencryptBatch = 500
+
+// Reencrypt rewrites every encrypted column not encrypted with the active key of k, plain text ones
+// included, and recomputes their blind indexes. Run it after adding a key in front of the keyring,
+// or after turning encryption on; the old keys can be dropped once it is done. It returns the number
+// of rows rewritten.
+func Reencrypt(ctx context.Context, conn *sql.DB, k *fieldcrypt.Keyring) (int, error) {
+	p := &postgresDBRepo{DB: conn, Crypt: k}
+
+	total := 0
+	for _, table := range encryptedTables {
+		lastID := 0
+		for {
+			n, next, err := p.reencryptBatch(ctx, table, lastID)
+			if err != nil {
+				return total, fmt.Errorf("%s after id %d: %w", table.name, lastID, err)
+			}
+			total += n
+			if next == lastID {
+				break
+			}
+			lastID = next
+		}
+	}
+
+	return total, nil
+}
+
+// reencryptBatch re-encrypts the rows of table following the id after, it returns the number of
+// rows rewritten and the last id seen, after itself when there are no rows left
+func (p *postgresDBRepo) reencryptBatch(ctx context.Context, table encryptedTable, after int) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	// A row is its id, then the values of the encrypted columns and of the blind indexes
+	columns := append([]string{}, table.columns...)
+	for _, index := range table.indexes {
+		columns = append(columns, index.column)
+	}
+	type row struct {
+		id     int
+		values []string
+	}
+
+	rows, err := p.conn().QueryContext(ctx, `select id, `+strings.Join(columns, ", ")+` from `+table.name+`
+			where id > $1
+			order by id
+			limit $2`, after, reencryptBatch)
+	if err != nil {
+		return 0, after, err
+	}
+	defer rows.Close()
+
+	var batch []row
+	for rows.Next() {
+		r := row{values: make([]string, len(columns))}
+		dest := []interface{}{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return 0, after, err
+		}
+		batch = append(batch, r)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, after, err
+	}
+	rows.Close()
+
+	if len(batch) == 0 {
+		return 0, after, nil
+	}
+
+	// The row is read outside of the transaction, a write of the application since then sealed it with
+	// the active key already and wins: the row is left when its encrypted values changed
+	var set, unchanged []string
+	for i, column := range columns {
+		set = append(set, fmt.Sprintf("%s = $%d", column, i+1))
+	}
+	for i, column := range table.columns {
+		unchanged = append(unchanged, fmt.Sprintf("%s = $%d", column, len(columns)+i+2))
+	}
+	update := `update ` + table.name + ` set ` + strings.Join(set, ", ") +
+		fmt.Sprintf(` where id = $%d and `, len(columns)+1) + strings.Join(unchanged, " and ")
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return 0, after, err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	n := 0
+	for _, r := range batch {
+		values, stale, err := p.reseal(table, r.values)
+		if err != nil {
+			return 0, after, fmt.Errorf("id %d: %w", r.id, err)
+		}
+		if !stale {
+			continue
+		}
+
+		args := []interface{}{}
+		for _, v := range values {
+			args = append(args, v)
+		}
+		args = append(args, r.id)
+		for _, v := range r.values[:len(table.columns)] {
+			args = append(args, v)
+		}
+		result, err := tx.ExecContext(ctx, update, args...)
+		if err != nil {
+			return 0, after, err
+		}
+		rewritten, err := result.RowsAffected()
+		if err != nil {
+			return 0, after, err
+		}
+		n += int(rewritten)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, after, err
+	}
+
+	return n, batch[len(batch)-1].id, nil
+}
+
+// reseal encrypts the values of a row of table with the active key and recomputes its blind indexes, the
+// values being the encrypted columns then the indexes. It reports whether the row was stale: a value not
+// encrypted with the active key or an index that differs.
+func (p *postgresDBRepo) reseal(table encryptedTable, values []string) ([]string, bool, error) {
+	sealed := make([]string, len(values))
+	plain := make(map[string]string, len(table.columns))
+	stale := false
+
+	for i, column := range table.columns {
+		v, err := p.Crypt.Decrypt(values[i])
+		if err != nil {
+			return nil, false, err
+		}
+		plain[column] = v
+
+		sealed[i], err = p.Crypt.Encrypt(v)
+		if err != nil {
+			return nil, false, err
+		}
+		stale = stale || p.Crypt.Stale(values[i])
+	}
+
+	for i, index := range table.indexes {
+		at := len(table.columns) + i
+		sealed[at] = p.Crypt.Index(index.normalize(plain[index.of]))
+		stale = stale || sealed[at] != values[at]
+	}
+
+	return sealed, stale, nil
+}
@@ -0,0 +1,97 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TranQuocToan1996/bookings/internal/config"
+	"github.com/TranQuocToan1996/bookings/internal/driver"
+	"github.com/TranQuocToan1996/bookings/internal/fieldcrypt"
+	"github.com/TranQuocToan1996/bookings/internal/migrate"
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/migrations/sqlite"
+)
+
+// Data written in plain text is encrypted by Reencrypt, and read back by a repo with the keys
+func TestReencrypt(t *testing.T) {
+	ctx := context.Background()
+	db, err := driver.NewSQLite(filepath.Join(t.TempDir(), "bookings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator, err := migrate.NewSQLite(db, sqlite.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrator.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewSQLiteRepo(db, &config.AppConfig{})
+	id := book(t, plain, stay(1, "2060-03-01", "2060-03-05"))
+	_, err = plain.InsertGuestAccount(ctx, models.GuestAccount{Email: "john@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plain.InsertSentEmail(ctx, models.MailData{To: "John@example.com", Subject: "Your stay", Content: "Welcome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := fieldcrypt.New("1:"+fieldcrypt.NewKey(), fieldcrypt.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Unindexed(ctx, db)
+	if err != nil || n != 4 {
+		t.Fatalf("expected the reservation, the guest, the account and the email unindexed, got %d, %v", n, err)
+	}
+	n, err = Reencrypt(ctx, db, keys)
+	if err != nil || n != 4 {
+		t.Fatalf("expected the reservation, the guest, the account and the email re-encrypted, got %d, %v", n, err)
+	}
+	n, err = Reencrypt(ctx, db, keys)
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing left to re-encrypt, got %d, %v", n, err)
+	}
+	n, err = Unindexed(ctx, db)
+	if err != nil || n != 0 {
+		t.Errorf("expected every row indexed, got %d, %v", n, err)
+	}
+
+	for _, column := range []string{"reservations.email", "guest_accounts.email", "sent_emails.to_address",
+		"sent_emails.content"} {
+		parts := strings.Split(column, ".")
+		var value string
+		err = db.QueryRow(`select ` + parts[1] + ` from ` + parts[0]).Scan(&value)
+		if err != nil || !strings.HasPrefix(value, "enc1:1:") {
+			t.Errorf("expected %s encrypted with key 1, got %q, %v", column, value, err)
+		}
+	}
+
+	repo := NewSQLiteRepo(db, &config.AppConfig{FieldKeys: keys})
+	res, err := repo.GetReservationByID(ctx, id)
+	if err != nil || res.Email != "john@example.com" || res.Phone != "555 0100" {
+		t.Errorf("expected the contact of John decrypted, got %+v, %v", res, err)
+	}
+	data, err := repo.PersonalData(ctx, "john@example.com")
+	if err != nil || len(data.Guests) != 1 || len(data.Reservations) != 1 || len(data.Accounts) != 1 ||
+		len(data.Emails) != 1 {
+		t.Fatalf("expected John found by the blind index of his email, got %+v, %v", data, err)
+	}
+	if data.Accounts[0].Email != "john@example.com" || data.Emails[0].To != "John@example.com" ||
+		data.Emails[0].Content != "Welcome" {
+		t.Errorf("expected the account and the email of John decrypted, got %+v", data)
+	}
+	_, err = repo.AuthenticateGuest(ctx, "john@example.com", "secret password")
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the account of John found by the blind index, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
+)
+
+// invalidatingRepo calls onChange after every successful change to reservations, blocks or stay rules,
+// so caches built from them (availability grids) never outlive the data. Reads go straight to repo.
+type invalidatingRepo struct {
+	repository.DatabaseRepo
+	onChange func()
+}
+
+// NewInvalidatingRepo wraps a repo so that onChange runs after every change of availability
+func NewInvalidatingRepo(repo repository.DatabaseRepo, onChange func()) repository.DatabaseRepo {
+	return &invalidatingRepo{
+		DatabaseRepo: repo,
+		onChange:     onChange,
+	}
+}
+
+// Transaction tells the changes made in fn apart, and runs onChange once they are committed: a grid
+// built in between would miss them
+func (i *invalidatingRepo) Transaction(ctx context.Context, fn func(repository.DatabaseRepo) error) error {
+	changed := false
+	err := i.DatabaseRepo.Transaction(ctx, func(repo repository.DatabaseRepo) error {
+		return fn(&invalidatingRepo{DatabaseRepo: repo, onChange: func() { changed = true }})
+	})
+	if changed {
+		return i.changed(err)
+	}
+	return err
+}
+
+// changed runs onChange when the change went through and hands back its error
+func (i *invalidatingRepo) changed(err error) error {
+	if err == nil {
+		i.onChange()
+	}
+	return err
+}
+
+func (i *invalidatingRepo) InsertReservation(ctx context.Context, res *models.Reservation) (int, error) {
+	id, err := i.DatabaseRepo.InsertReservation(ctx, res)
+	return id, i.changed(err)
+}
+
+func (i *invalidatingRepo) InsertRoomRestriction(ctx context.Context, r *models.RoomRestriction) error {
+	return i.changed(i.DatabaseRepo.InsertRoomRestriction(ctx, r))
+}
+
+func (i *invalidatingRepo) UpdateReservation(ctx context.Context, actor models.Actor, r models.Reservation) error {
+	return i.changed(i.DatabaseRepo.UpdateReservation(ctx, actor, r))
+}
+
+func (i *invalidatingRepo) DeleteReservation(ctx context.Context, actor models.Actor, id int) error {
+	return i.changed(i.DatabaseRepo.DeleteReservation(ctx, actor, id))
+}
+
+func (i *invalidatingRepo) RestoreReservation(ctx context.Context, actor models.Actor, id int) error {
+	return i.changed(i.DatabaseRepo.RestoreReservation(ctx, actor, id))
+}
+
+func (i *invalidatingRepo) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	n, err := i.DatabaseRepo.PurgeDeletedBefore(ctx, cutoff)
+	return n, i.changed(err)
+}
+
+func (i *invalidatingRepo) InsertBlockForRoom(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	return i.changed(i.DatabaseRepo.InsertBlockForRoom(ctx, actor, r))
+}
+
+func (i *invalidatingRepo) UpdateBlock(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	return i.changed(i.DatabaseRepo.UpdateBlock(ctx, actor, r))
+}
+
+func (i *invalidatingRepo) DeleteBlockByID(ctx context.Context, actor models.Actor, id int) error {
+	return i.changed(i.DatabaseRepo.DeleteBlockByID(ctx, actor, id))
+}
+
+func (i *invalidatingRepo) InsertBlockSeries(ctx context.Context, actor models.Actor, s models.BlockSeries, blocks []models.RoomRestriction) error {
+	return i.changed(i.DatabaseRepo.InsertBlockSeries(ctx, actor, s, blocks))
+}
+
+func (i *invalidatingRepo) DeleteBlockSeries(ctx context.Context, actor models.Actor, id int) error {
+	return i.changed(i.DatabaseRepo.DeleteBlockSeries(ctx, actor, id))
+}
+
+func (i *invalidatingRepo) UpdateRoomForReservation(ctx context.Context, actor models.Actor, id, roomID int) error {
+	return i.changed(i.DatabaseRepo.UpdateRoomForReservation(ctx, actor, id, roomID))
+}
+
+func (i *invalidatingRepo) MoveReservation(ctx context.Context, actor models.Actor, id, roomID int, start, end time.Time, totalPrice int) error {
+	return i.changed(i.DatabaseRepo.MoveReservation(ctx, actor, id, roomID, start, end, totalPrice))
+}
+
+func (i *invalidatingRepo) InsertStayRule(ctx context.Context, actor models.Actor, r models.StayRule) error {
+	return i.changed(i.DatabaseRepo.InsertStayRule(ctx, actor, r))
+}
+
+func (i *invalidatingRepo) DeleteStayRule(ctx context.Context, actor models.Actor, id int) error {
+	return i.changed(i.DatabaseRepo.DeleteStayRule(ctx, actor, id))
+}
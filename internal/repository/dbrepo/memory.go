@@ -0,0 +1,2306 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TranQuocToan1996/bookings/internal/audit"
+	"github.com/TranQuocToan1996/bookings/internal/guests"
+	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/privacy"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryReservation is a row of reservations, with the column the model doesn't carry
+type memoryReservation struct {
+	models.Reservation
+	AnonymizedAt time.Time
+}
+
+// memoryCancellation is a row of cancellations, with the column the model doesn't carry
+type memoryCancellation struct {
+	models.Cancellation
+	AnonymizedAt time.Time
+}
+
+// memoryData holds the tables of the in-memory repository, keyed by id
+type memoryData struct {
+	users         map[int]models.User
+	rooms         map[int]models.Room
+	restrictions  map[int]models.Restriction
+	reservations  map[int]memoryReservation
+	roomBlocks    map[int]models.RoomRestriction // room_restriction
+	series        map[int]models.BlockSeries
+	stayRules     map[int]models.StayRule
+	cancellations map[int]memoryCancellation
+	guests        map[int]models.Guest
+	accounts      map[int]models.GuestAccount
+	emails        map[int]models.SentEmail
+	audit         []models.AuditEntry
+	// ids is the last id given in every table, ids are never reused
+	ids map[string]int
+}
+
+// newMemoryData returns the tables as the migrations leave them: the two rooms, the two kinds of
+// restriction and the admin user
+func newMemoryData() *memoryData {
+	seeded := time.Date(2022, time.February, 12, 0, 0, 0, 0, time.UTC)
+	room := func(id int, name string, created time.Time) models.Room {
+		return models.Room{ID: id, RoomName: name, MaxOccupancy: 2, BaseOccupancy: 2, CreateAt: created, UpdateAt: created}
+	}
+
+	return &memoryData{
+		users: map[int]models.User{
+			1: {
+				ID:          1,
+				FirstName:   "Toan",
+				LastName:    "Tran",
+				Email:       "admin@admin.com",
+				Password:    "$2a$12$4jMAUKGaBx3x.aEl/zgHcevkdoWPxv9zXJMesvUvt6Rp5GyWu3fbK",
+				AccessLevel: 3,
+				CreateAt:    time.Date(2022, time.February, 20, 0, 0, 0, 0, time.UTC),
+				UpdateAt:    time.Date(2022, time.February, 20, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		rooms: map[int]models.Room{
+			1: room(1, "General's Quarters", seeded.AddDate(0, 0, -1)),
+			2: room(2, "Major's Suite", seeded),
+		},
+		restrictions: map[int]models.Restriction{
+			1: {ID: 1, RestrictionName: "Reservation", CreateAt: seeded, UpdateAt: seeded},
+			2: {ID: 2, RestrictionName: "Owner Block", CreateAt: seeded, UpdateAt: seeded},
+		},
+		reservations:  make(map[int]memoryReservation),
+		roomBlocks:    make(map[int]models.RoomRestriction),
+		series:        make(map[int]models.BlockSeries),
+		stayRules:     make(map[int]models.StayRule),
+		cancellations: make(map[int]memoryCancellation),
+		guests:        make(map[int]models.Guest),
+		accounts:      make(map[int]models.GuestAccount),
+		emails:        make(map[int]models.SentEmail),
+		ids:           map[string]int{"users": 1, "rooms": 2, "restrictions": 2},
+	}
+}
+
+// clone copies the tables, for a unit of work to roll back to. Rows are values, the slices they hold
+// are replaced rather than changed in place.
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		users:         make(map[int]models.User, len(d.users)),
+		rooms:         make(map[int]models.Room, len(d.rooms)),
+		restrictions:  make(map[int]models.Restriction, len(d.restrictions)),
+		reservations:  make(map[int]memoryReservation, len(d.reservations)),
+		roomBlocks:    make(map[int]models.RoomRestriction, len(d.roomBlocks)),
+		series:        make(map[int]models.BlockSeries, len(d.series)),
+		stayRules:     make(map[int]models.StayRule, len(d.stayRules)),
+		cancellations: make(map[int]memoryCancellation, len(d.cancellations)),
+		guests:        make(map[int]models.Guest, len(d.guests)),
+		accounts:      make(map[int]models.GuestAccount, len(d.accounts)),
+		emails:        make(map[int]models.SentEmail, len(d.emails)),
+		audit:         append([]models.AuditEntry(nil), d.audit...),
+		ids:           make(map[string]int, len(d.ids)),
+	}
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+	for k, v := range d.rooms {
+		c.rooms[k] = v
+	}
+	for k, v := range d.restrictions {
+		c.restrictions[k] = v
+	}
+	for k, v := range d.reservations {
+		c.reservations[k] = v
+	}
+	for k, v := range d.roomBlocks {
+		c.roomBlocks[k] = v
+	}
+	for k, v := range d.series {
+		c.series[k] = v
+	}
+	for k, v := range d.stayRules {
+		c.stayRules[k] = v
+	}
+	for k, v := range d.cancellations {
+		c.cancellations[k] = v
+	}
+	for k, v := range d.guests {
+		c.guests[k] = v
+	}
+	for k, v := range d.accounts {
+		c.accounts[k] = v
+	}
+	for k, v := range d.emails {
+		c.emails[k] = v
+	}
+	for k, v := range d.ids {
+		c.ids[k] = v
+	}
+	return c
+}
+
+// nextID returns the id of a new row of table
+func (d *memoryData) nextID(table string) int {
+	d.ids[table]++
+	return d.ids[table]
+}
+
+// errForeignKey is returned for a row referring to a row that doesn't exist, as the foreign keys make
+// Postgres do
+func errForeignKey(table string, id int) error {
+	return fmt.Errorf("foreign key violation: no row %d in %s", id, table)
+}
+
+// errUnique is returned for a row repeating the value of a unique index
+func errUnique(index string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint %q", index)
+}
+
+// lock locks the tables until the returned func is called. A repo of a unit of work holds the lock
+// from the start of the unit, it doesn't lock again.
+func (m *memoryDBRepo) lock() func() {
+	if m.inUnit {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// Transaction runs fn with the tables locked, and puts them back as they were when fn returns an error
+// or panics. Called within a unit of work, it nests in it.
+func (m *memoryDBRepo) Transaction(ctx context.Context, fn func(repository.DatabaseRepo) error) error {
+	defer m.lock()()
+
+	snapshot := m.db.clone()
+	unit := *m
+	unit.inUnit = true
+
+	defer func() {
+		if v := recover(); v != nil {
+			*m.db = *snapshot
+			panic(v)
+		}
+	}()
+
+	err := fn(&unit)
+	if err != nil {
+		*m.db = *snapshot
+	}
+	return err
+}
+
+// dateOf is the day of t, as a date column keeps it
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// daysBetween is the number of days from the day of start to the day of end
+func daysBetween(start, end time.Time) int {
+	return int(dateOf(end).Sub(dateOf(start)).Hours() / 24)
+}
+
+// overlaps reports whether the nights from start to end meet the ones from otherStart to otherEnd,
+// comparing days as the date columns do
+func overlaps(start, end, otherStart, otherEnd time.Time) bool {
+	return dateOf(start).Before(dateOf(otherEnd)) && dateOf(end).After(dateOf(otherStart))
+}
+
+// sameEmail and samePhone compare contacts the way their blind indexes do, empty ones never match
+func sameEmail(a, b string) bool {
+	a = guests.NormalizeEmail(a)
+	return a != "" && a == guests.NormalizeEmail(b)
+}
+
+func samePhone(a, b string) bool {
+	a = guests.NormalizePhone(a)
+	return a != "" && a == guests.NormalizePhone(b)
+}
+
+// containsFold reports whether s contains substr, ignoring case as ilike does
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// withRoom returns r with its room filled in
+func (d *memoryData) withRoom(r models.Reservation) models.Reservation {
+	r.Room = d.rooms[r.RoomID]
+	return r
+}
+
+// userName is the first and last name of a user, empty when the user is gone
+func (d *memoryData) userName(id int) string {
+	u, ok := d.users[id]
+	if !ok {
+		return ""
+	}
+	return u.FirstName + " " + u.LastName
+}
+
+// checkRoomIsFree returns repository.ErrOverlap when a restriction other than the one being changed
+// (exceptID, or the ones of exceptReservationID) overlaps the range
+func (d *memoryData) checkRoomIsFree(roomID int, start, end time.Time, exceptID, exceptReservationID int) error {
+	for _, rr := range d.roomBlocks {
+		if rr.RoomID != roomID || rr.ID == exceptID {
+			continue
+		}
+		if rr.ReservationID != 0 && rr.ReservationID == exceptReservationID {
+			continue
+		}
+		if overlaps(start, end, rr.StartDate, rr.EndDate) {
+			return repository.ErrOverlap
+		}
+	}
+	return nil
+}
+
+// recordAudit adds an entry to the audit log, nothing is recorded when no field changed
+func (d *memoryData) recordAudit(actor models.Actor, action, entity string, id int, before, after map[string]interface{}) error {
+	changes := audit.Diff(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	d.audit = append(d.audit, models.AuditEntry{
+		ID:       d.nextID("audit_log"),
+		UserID:   actor.UserID,
+		Action:   action,
+		Entity:   entity,
+		EntityID: id,
+		Changes:  string(encoded),
+		IP:       actor.IP,
+		CreateAt: time.Now(),
+	})
+	return nil
+}
+
+// The states below are the rows of the audit log, with the columns and formats of row_to_json
+
+const (
+	dateFormat      = "2006-01-02"
+	timestampFormat = "2006-01-02T15:04:05.999999"
+)
+
+// nullable is nil for the zero value of a nullable column
+func nullable(v interface{}, null bool) interface{} {
+	if null {
+		return nil
+	}
+	return v
+}
+
+func timestamp(t time.Time) interface{} {
+	return nullable(t.Format(timestampFormat), t.IsZero())
+}
+
+func (d *memoryData) reservationState(id int) map[string]interface{} {
+	r, ok := d.reservations[id]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":                r.ID,
+		"first_name":        r.FirstName,
+		"last_name":         r.LastName,
+		"email":             r.Email,
+		"phone":             r.Phone,
+		"start_date":        r.StartDate.Format(dateFormat),
+		"end_date":          r.EndDate.Format(dateFormat),
+		"room_id":           r.RoomID,
+		"created_at":        timestamp(r.CreateAt),
+		"updated_at":        timestamp(r.UpdateAt),
+		"processed":         r.Processed,
+		"room_locked":       r.RoomLocked,
+		"adults":            r.Adults,
+		"children":          r.Children,
+		"total_price":       r.TotalPrice,
+		"confirmation_code": r.ConfirmationCode,
+		"notes":             r.Notes,
+		"guest_id":          nullable(r.GuestID, r.GuestID == 0),
+		"anonymized_at":     timestamp(r.AnonymizedAt),
+		"deleted_at":        timestamp(r.DeletedAt),
+		"deleted_by":        nullable(r.DeletedBy, r.DeletedBy == 0),
+	}
+}
+
+func (d *memoryData) blockState(id int) map[string]interface{} {
+	rr, ok := d.roomBlocks[id]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":              rr.ID,
+		"start_date":      rr.StartDate.Format(dateFormat),
+		"end_date":        rr.EndDate.Format(dateFormat),
+		"room_id":         rr.RoomID,
+		"reservation_id":  nullable(rr.ReservationID, rr.ReservationID == 0),
+		"restriction_id":  rr.RestrictionID,
+		"note":            rr.Note,
+		"block_series_id": nullable(rr.SeriesID, rr.SeriesID == 0),
+		"created_at":      timestamp(rr.CreateAt),
+		"updated_at":      timestamp(rr.UpdateAt),
+	}
+}
+
+func (d *memoryData) seriesState(id int) map[string]interface{} {
+	s, ok := d.series[id]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":         s.ID,
+		"room_id":    s.RoomID,
+		"start_date": s.StartDate.Format(dateFormat),
+		"end_date":   s.EndDate.Format(dateFormat),
+		"frequency":  s.Frequency,
+		"until_date": s.UntilDate.Format(dateFormat),
+		"note":       s.Note,
+		"created_at": timestamp(s.CreateAt),
+		"updated_at": timestamp(s.UpdateAt),
+	}
+}
+
+func (d *memoryData) stayRuleState(id int) map[string]interface{} {
+	r, ok := d.stayRules[id]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":                  r.ID,
+		"room_id":             r.RoomID,
+		"start_date":          r.StartDate.Format(dateFormat),
+		"end_date":            r.EndDate.Format(dateFormat),
+		"min_nights":          r.MinNights,
+		"max_nights":          r.MaxNights,
+		"closed_to_arrival":   r.ClosedToArrival,
+		"closed_to_departure": r.ClosedToDeparture,
+		"min_advance_days":    r.MinAdvanceDays,
+		"max_advance_days":    r.MaxAdvanceDays,
+		"created_at":          timestamp(r.CreateAt),
+		"updated_at":          timestamp(r.UpdateAt),
+	}
+}
+
+func (d *memoryData) guestState(id int) map[string]interface{} {
+	g, ok := d.guests[id]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":         g.ID,
+		"first_name": g.FirstName,
+		"last_name":  g.LastName,
+		"email":      g.Email,
+		"phone":      g.Phone,
+		"notes":      g.Notes,
+		"tags":       strings.Join(g.Tags, ","),
+		"created_at": timestamp(g.CreateAt),
+		"updated_at": timestamp(g.UpdateAt),
+	}
+}
+
+// audited runs change between two reads of the state of an entity, and records what it changed
+func (d *memoryData) audited(actor models.Actor, action, entity string, id int,
+	state func(int) map[string]interface{}, change func() error) error {
+	before := state(id)
+
+	err := change()
+	if err != nil {
+		return err
+	}
+
+	return d.recordAudit(actor, action, entity, id, before, state(id))
+}
+
+// deleteReservation removes a reservation and its room restrictions
+func (d *memoryData) deleteReservation(id int) {
+	delete(d.reservations, id)
+	for rid, rr := range d.roomBlocks {
+		if rr.ReservationID == id {
+			delete(d.roomBlocks, rid)
+		}
+	}
+}
+
+// deleteGuest removes a guest and its accounts, its reservations are left without guest
+func (d *memoryData) deleteGuest(id int) {
+	delete(d.guests, id)
+	for aid, a := range d.accounts {
+		if a.GuestID == id {
+			delete(d.accounts, aid)
+		}
+	}
+	for rid, r := range d.reservations {
+		if r.GuestID == id {
+			r.GuestID = 0
+			d.reservations[rid] = r
+		}
+	}
+}
+
+// AllUsers implements the DatabaseRepo interface
+func (m *memoryDBRepo) AllUsers(ctx context.Context) bool {
+	return true
+}
+
+// InsertReservation inserts a reservation, matched to a guest when it has none
+func (m *memoryDBRepo) InsertReservation(ctx context.Context, res *models.Reservation) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	if _, ok := d.rooms[res.RoomID]; !ok {
+		return 0, errForeignKey("rooms", res.RoomID)
+	}
+	for _, r := range d.reservations {
+		if r.ConfirmationCode == res.ConfirmationCode {
+			return 0, errUnique("reservations_confirmation_code_idx")
+		}
+	}
+	if res.GuestID != 0 {
+		if _, ok := d.guests[res.GuestID]; !ok {
+			return 0, errForeignKey("guests", res.GuestID)
+		}
+	} else {
+		res.GuestID = d.matchGuest(res, true)
+	}
+
+	now := time.Now()
+	r := memoryReservation{Reservation: models.Reservation{
+		ID:               d.nextID("reservations"),
+		FirstName:        res.FirstName,
+		LastName:         res.LastName,
+		Email:            res.Email,
+		Phone:            res.Phone,
+		StartDate:        res.StartDate,
+		EndDate:          res.EndDate,
+		RoomID:           res.RoomID,
+		CreateAt:         now,
+		UpdateAt:         now,
+		Adults:           res.Adults,
+		Children:         res.Children,
+		TotalPrice:       res.TotalPrice,
+		ConfirmationCode: res.ConfirmationCode,
+		GuestID:          res.GuestID,
+	}}
+	d.reservations[r.ID] = r
+
+	return r.ID, nil
+}
+
+// matchGuest returns the guest of a new reservation, found by email first and, when matchPhone, by phone then,
+// a guest is added when it is a new customer
+func (d *memoryData) matchGuest(res *models.Reservation, matchPhone bool) int {
+	byEmail, byPhone := 0, 0
+	for id, g := range d.guests {
+		if sameEmail(res.Email, g.Email) && (byEmail == 0 || id < byEmail) {
+			byEmail = id
+		}
+		if matchPhone && samePhone(res.Phone, g.Phone) && (byPhone == 0 || id < byPhone) {
+			byPhone = id
+		}
+	}
+	if byEmail != 0 {
+		return byEmail
+	}
+	if byPhone != 0 {
+		return byPhone
+	}
+
+	now := time.Now()
+	g := models.Guest{
+		ID:        d.nextID("guests"),
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		CreateAt:  now,
+		UpdateAt:  now,
+	}
+	d.guests[g.ID] = g
+	return g.ID
+}
+
+// InsertRoomRestriction inserts a room restriction, it returns repository.ErrOverlap when the room is not
+// free from its start to its end
+func (m *memoryDBRepo) InsertRoomRestriction(ctx context.Context, r *models.RoomRestriction) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkRoomIsFree(r.RoomID, r.StartDate, r.EndDate, 0, 0)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.rooms[r.RoomID]; !ok {
+		return errForeignKey("rooms", r.RoomID)
+	}
+	if _, ok := d.reservations[r.ReservationID]; !ok {
+		return errForeignKey("reservations", r.ReservationID)
+	}
+	if _, ok := d.restrictions[r.RestrictionID]; !ok {
+		return errForeignKey("restrictions", r.RestrictionID)
+	}
+
+	now := time.Now()
+	rr := models.RoomRestriction{
+		ID:            d.nextID("room_restriction"),
+		StartDate:     r.StartDate,
+		EndDate:       r.EndDate,
+		RoomID:        r.RoomID,
+		ReservationID: r.ReservationID,
+		RestrictionID: r.RestrictionID,
+		CreateAt:      now,
+		UpdateAt:      now,
+	}
+	d.roomBlocks[rr.ID] = rr
+
+	return nil
+}
+
+// SearchAvailabilityByRoomID reports whether a room is free from start to end
+func (m *memoryDBRepo) SearchAvailabilityByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
+	defer m.lock()()
+
+	for _, rr := range m.db.roomBlocks {
+		if rr.RoomID == roomID && overlaps(start, end, rr.StartDate, rr.EndDate) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SearchAvailabilityForAllRooms returns the rooms free from start to end that can sleep the number of guests
+func (m *memoryDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error) {
+	defer m.lock()()
+	d := m.db
+
+	taken := make(map[int]bool)
+	for _, rr := range d.roomBlocks {
+		if overlaps(start, end, rr.StartDate, rr.EndDate) {
+			taken[rr.RoomID] = true
+		}
+	}
+
+	var rooms []models.Room
+	for _, room := range d.rooms {
+		if !taken[room.ID] && room.MaxOccupancy >= guests {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].ID < rooms[j].ID
+	})
+
+	return rooms, nil
+}
+
+// GetRoomByID gets a room by id
+func (m *memoryDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	defer m.lock()()
+
+	room, ok := m.db.rooms[id]
+	if !ok {
+		return room, sql.ErrNoRows
+	}
+	return room, nil
+}
+
+// GetUserByID returns a user by id
+func (m *memoryDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	defer m.lock()()
+
+	u, ok := m.db.users[id]
+	if !ok {
+		return u, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+// UpdateUser updates the details and access level of a user
+func (m *memoryDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	defer m.lock()()
+	d := m.db
+
+	existing, ok := d.users[u.ID]
+	if !ok {
+		return nil
+	}
+	for _, other := range d.users {
+		if other.ID != u.ID && other.Email == u.Email {
+			return errUnique("users_email_idx")
+		}
+	}
+
+	existing.FirstName = u.FirstName
+	existing.LastName = u.LastName
+	existing.Email = u.Email
+	existing.AccessLevel = u.AccessLevel
+	existing.UpdateAt = time.Now()
+	d.users[u.ID] = existing
+
+	return nil
+}
+
+// Authenticate returns the id and password hash of the user of email when testPassword is its password
+func (m *memoryDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	defer m.lock()()
+
+	for _, u := range m.db.users {
+		if u.Email != email {
+			continue
+		}
+
+		err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(testPassword))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return 0, "", errors.New("incorrect password")
+		} else if err != nil {
+			return 0, "", err
+		}
+		return u.ID, u.Password, nil
+	}
+
+	return 0, "", sql.ErrNoRows
+}
+
+// pageBounds returns the bounds of a page, from 1, of perPage rows out of total
+func pageBounds(total, page, perPage int) (int, int) {
+	if page < 1 {
+		page = 1
+	}
+	from := (page - 1) * perPage
+	if from > total {
+		from = total
+	}
+	to := from + perPage
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+// compareReservations orders two reservations on a column of repository.ReservationSorts
+func compareReservations(a, b models.Reservation, column string) int {
+	compareStrings := func(x, y string) int {
+		return strings.Compare(strings.ToLower(x), strings.ToLower(y))
+	}
+	compareTimes := func(x, y time.Time) int {
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	}
+	compareInts := func(x, y int) int {
+		return x - y
+	}
+
+	switch column {
+	case "id":
+		return compareInts(a.ID, b.ID)
+	case "first_name":
+		return compareStrings(a.FirstName, b.FirstName)
+	case "last_name":
+		return compareStrings(a.LastName, b.LastName)
+	case "room":
+		return compareStrings(a.Room.RoomName, b.Room.RoomName)
+	case "end_date":
+		return compareTimes(a.EndDate, b.EndDate)
+	case "created_at":
+		return compareTimes(a.CreateAt, b.CreateAt)
+	case "processed":
+		return compareInts(a.Processed, b.Processed)
+	}
+	return compareTimes(a.StartDate, b.StartDate)
+}
+
+// FindReservations returns a page of the reservations matching f, sorted on f.Sort (start date by default),
+// and how many reservations match in all
+func (m *memoryDBRepo) FindReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	defer m.lock()()
+	d := m.db
+
+	var matching []models.Reservation
+	for _, r := range d.reservations {
+		switch {
+		case !r.DeletedAt.IsZero():
+			continue
+		case f.RoomID > 0 && r.RoomID != f.RoomID:
+			continue
+		case !f.Start.IsZero() && !r.EndDate.After(f.Start):
+			continue
+		case !f.End.IsZero() && !r.StartDate.Before(f.End):
+			continue
+		case f.Status == "new" && r.Processed != 0, f.Status == "processed" && r.Processed != 1:
+			continue
+		}
+		if f.Query != "" && !containsFold(r.FirstName+" "+r.LastName, f.Query) &&
+			!sameEmail(f.Query, r.Email) && !samePhone(f.Query, r.Phone) {
+			continue
+		}
+		matching = append(matching, d.withRoom(r.Reservation))
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		c := compareReservations(matching[i], matching[j], f.Sort)
+		if c == 0 {
+			c = compareReservations(matching[i], matching[j], "id")
+		}
+		if f.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	from, to := pageBounds(len(matching), f.Page, f.PerPage)
+	return matching[from:to], len(matching), nil
+}
+
+// wordPattern finds the words of a text, as the simple text search configuration splits them
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// trigrams returns the trigrams of the words of s, the way pg_trgm pads them
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range wordPattern.FindAllString(strings.ToLower(s), -1) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// similarity is the share of trigrams two texts have in common, as pg_trgm computes it
+func similarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+	all := len(ta) + len(tb) - shared
+	if all == 0 {
+		return 0
+	}
+	return float64(shared) / float64(all)
+}
+
+// similarityThreshold is the similarity from which the % operator of pg_trgm matches
+const similarityThreshold = 0.3
+
+// matchNotes returns the rank of notes for the words of text and the notes with those words in
+// brackets, false when a word is missing from them
+func matchNotes(notes, text string) (float64, string, bool) {
+	words := wordPattern.FindAllString(strings.ToLower(text), -1)
+	if len(words) == 0 {
+		return 0, "", false
+	}
+
+	count := make(map[string]int)
+	found := wordPattern.FindAllString(strings.ToLower(notes), -1)
+	for _, w := range found {
+		count[w]++
+	}
+
+	wanted := make(map[string]bool)
+	hits := 0
+	for _, w := range words {
+		if count[w] == 0 {
+			return 0, "", false
+		}
+		wanted[w] = true
+		hits += count[w]
+	}
+
+	snippet := wordPattern.ReplaceAllStringFunc(notes, func(w string) string {
+		if wanted[strings.ToLower(w)] {
+			return "[" + w + "]"
+		}
+		return w
+	})
+	return float64(hits) / float64(len(found)), snippet, true
+}
+
+// searchKinds orders the kinds of match of SearchReservations
+var searchKinds = map[string]int{"code": 1, "guest": 2, "notes": 3, "room": 4}
+
+// SearchReservations looks for text in the guest fields, confirmation codes, notes and room names of the
+// reservations, arriving in month when it isn't 0. It returns up to limit reservations per kind of match,
+// codes first then guests, notes and rooms, the closest first. Ranks follow pg_trgm and the text search of
+// Postgres closely, not to the decimal.
+func (m *memoryDBRepo) SearchReservations(ctx context.Context, text string, month time.Month, limit int) ([]models.SearchResult, error) {
+	defer m.lock()()
+	d := m.db
+
+	byKind := make(map[string][]models.SearchResult)
+	add := func(kind string, rank float64, snippet string, r models.Reservation) {
+		byKind[kind] = append(byKind[kind], models.SearchResult{Kind: kind, Rank: rank, Snippet: snippet, Reservation: r})
+	}
+
+	for _, r := range d.reservations {
+		if !r.DeletedAt.IsZero() || (month != 0 && r.StartDate.Month() != month) {
+			continue
+		}
+		res := d.withRoom(r.Reservation)
+
+		if strings.HasPrefix(strings.ToLower(r.ConfirmationCode), strings.ToLower(text)) {
+			add("code", 1, "", res)
+		}
+
+		name := r.FirstName + " " + r.LastName
+		switch {
+		case sameEmail(text, r.Email) || samePhone(text, r.Phone):
+			add("guest", 1, "", res)
+		case similarity(name, text) >= similarityThreshold || containsFold(name, text):
+			add("guest", similarity(name, text), "", res)
+		}
+
+		if rank, snippet, ok := matchNotes(r.Notes, text); ok {
+			add("notes", rank, snippet, res)
+		}
+
+		if room, ok := d.rooms[r.RoomID]; ok {
+			if s := similarity(room.RoomName, text); s >= similarityThreshold || containsFold(room.RoomName, text) {
+				add("room", s, "", res)
+			}
+		}
+	}
+
+	var results []models.SearchResult
+	for _, hits := range byKind {
+		sort.Slice(hits, func(i, j int) bool {
+			if hits[i].Rank != hits[j].Rank {
+				return hits[i].Rank > hits[j].Rank
+			}
+			return hits[i].Reservation.ID > hits[j].Reservation.ID
+		})
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+		results = append(results, hits...)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Kind != b.Kind {
+			return searchKinds[a.Kind] < searchKinds[b.Kind]
+		}
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		return a.Reservation.ID > b.Reservation.ID
+	})
+
+	return results, nil
+}
+
+// GetReservationByID returns a reservation, in the trash or not
+func (m *memoryDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	defer m.lock()()
+
+	r, ok := m.db.reservations[id]
+	if !ok {
+		return models.Reservation{}, sql.ErrNoRows
+	}
+	return m.db.withRoom(r.Reservation), nil
+}
+
+// checkLive returns sql.ErrNoRows unless the reservation id exists out of the trash, a reservation in the
+// trash can only be restored
+func (d *memoryData) checkLive(id int) error {
+	r, ok := d.reservations[id]
+	if !ok || !r.DeletedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateReservation updates the guest details, notes and room lock of a reservation
+func (m *memoryDBRepo) UpdateReservation(ctx context.Context, actor models.Actor, r models.Reservation) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkLive(r.ID)
+	if err != nil {
+		return err
+	}
+
+	return d.audited(actor, audit.ActionUpdate, audit.EntityReservation, r.ID, d.reservationState, func() error {
+		existing, ok := d.reservations[r.ID]
+		if !ok {
+			return nil
+		}
+		existing.FirstName = r.FirstName
+		existing.LastName = r.LastName
+		existing.Email = r.Email
+		existing.Phone = r.Phone
+		existing.RoomLocked = r.RoomLocked
+		existing.Notes = r.Notes
+		existing.UpdateAt = time.Now()
+		d.reservations[r.ID] = existing
+		return nil
+	})
+}
+
+// DeleteReservation moves a reservation to the trash and frees its dates, it stays there until it is
+// restored or purged
+func (m *memoryDBRepo) DeleteReservation(ctx context.Context, actor models.Actor, id int) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkLive(id)
+	if err != nil {
+		return err
+	}
+
+	return d.audited(actor, audit.ActionDelete, audit.EntityReservation, id, d.reservationState, func() error {
+		r, ok := d.reservations[id]
+		if !ok || !r.DeletedAt.IsZero() {
+			return nil
+		}
+
+		// Keep a copy for the cancellations report
+		now := time.Now()
+		c := memoryCancellation{Cancellation: models.Cancellation{
+			ID:            d.nextID("cancellations"),
+			ReservationID: r.ID,
+			FirstName:     r.FirstName,
+			LastName:      r.LastName,
+			Email:         r.Email,
+			Phone:         r.Phone,
+			StartDate:     r.StartDate,
+			EndDate:       r.EndDate,
+			RoomID:        r.RoomID,
+			BookedAt:      r.CreateAt,
+			TotalPrice:    r.TotalPrice,
+			CreateAt:      now,
+			UpdateAt:      now,
+		}}
+		d.cancellations[c.ID] = c
+
+		for rid, rr := range d.roomBlocks {
+			if rr.ReservationID == id {
+				delete(d.roomBlocks, rid)
+			}
+		}
+
+		r.DeletedAt = now
+		r.DeletedBy = actor.UserID
+		r.UpdateAt = now
+		d.reservations[id] = r
+		return nil
+	})
+}
+
+// TrashedReservations returns the reservations in the trash, the last deleted first
+func (m *memoryDBRepo) TrashedReservations(ctx context.Context) ([]models.Reservation, error) {
+	defer m.lock()()
+	d := m.db
+
+	var reservations []models.Reservation
+	for _, r := range d.reservations {
+		if r.DeletedAt.IsZero() {
+			continue
+		}
+		item := d.withRoom(r.Reservation)
+		item.DeletedByName = d.userName(r.DeletedBy)
+		reservations = append(reservations, item)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		a, b := reservations[i], reservations[j]
+		if !a.DeletedAt.Equal(b.DeletedAt) {
+			return a.DeletedAt.After(b.DeletedAt)
+		}
+		return a.ID > b.ID
+	})
+
+	return reservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash and books its dates again, it returns
+// repository.ErrOverlap when the room was taken for some of them in the meantime
+func (m *memoryDBRepo) RestoreReservation(ctx context.Context, actor models.Actor, id int) error {
+	defer m.lock()()
+	d := m.db
+
+	r, ok := d.reservations[id]
+	if !ok || r.DeletedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+
+	err := d.checkRoomIsFree(r.RoomID, r.StartDate, r.EndDate, 0, id)
+	if err != nil {
+		return err
+	}
+
+	return d.audited(actor, audit.ActionRestore, audit.EntityReservation, id, d.reservationState, func() error {
+		now := time.Now()
+		rr := models.RoomRestriction{
+			ID:            d.nextID("room_restriction"),
+			StartDate:     r.StartDate,
+			EndDate:       r.EndDate,
+			RoomID:        r.RoomID,
+			ReservationID: id,
+			RestrictionID: 1,
+			CreateAt:      now,
+			UpdateAt:      now,
+		}
+		d.roomBlocks[rr.ID] = rr
+
+		// The stay is no longer cancelled
+		for cid, c := range d.cancellations {
+			if c.ReservationID == id {
+				delete(d.cancellations, cid)
+			}
+		}
+
+		r.DeletedAt = time.Time{}
+		r.DeletedBy = 0
+		r.UpdateAt = now
+		d.reservations[id] = r
+		return nil
+	})
+}
+
+// PurgeDeletedBefore removes for good the reservations moved to the trash before cutoff, and returns
+// how many it removed. They stay in the cancellations report.
+func (m *memoryDBRepo) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	n := 0
+	for id, r := range d.reservations {
+		if !r.DeletedAt.IsZero() && r.DeletedAt.Before(cutoff) {
+			d.deleteReservation(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// UpdateProcessedForReservation marks a reservation processed or new
+func (m *memoryDBRepo) UpdateProcessedForReservation(ctx context.Context, actor models.Actor, id, processed int) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkLive(id)
+	if err != nil {
+		return err
+	}
+
+	return d.audited(actor, audit.ActionProcess, audit.EntityReservation, id, d.reservationState, func() error {
+		r, ok := d.reservations[id]
+		if !ok {
+			return nil
+		}
+		r.Processed = processed
+		d.reservations[id] = r
+		return nil
+	})
+}
+
+// AllRooms returns every room by name
+func (m *memoryDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	defer m.lock()()
+
+	var rooms []models.Room
+	for _, room := range m.db.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomName < rooms[j].RoomName
+	})
+
+	return rooms, nil
+}
+
+// sortRestrictions orders room restrictions by room and start date
+func sortRestrictions(list []models.RoomRestriction) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.RoomID != b.RoomID {
+			return a.RoomID < b.RoomID
+		}
+		if !a.StartDate.Equal(b.StartDate) {
+			return a.StartDate.Before(b.StartDate)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// GetRestrictionsForRoomByDate returns the restrictions of a room overlapping the date range
+func (m *memoryDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	defer m.lock()()
+
+	var list []models.RoomRestriction
+	for _, rr := range m.db.roomBlocks {
+		if rr.RoomID == roomID && overlaps(start, end, rr.StartDate, rr.EndDate) {
+			list = append(list, rr)
+		}
+	}
+	sortRestrictions(list)
+
+	return list, nil
+}
+
+// InsertBlockForRoom inserts an owner block from r.StartDate to r.EndDate, it returns repository.ErrOverlap
+// when the room is not free for the whole range
+func (m *memoryDBRepo) InsertBlockForRoom(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkRoomIsFree(r.RoomID, r.StartDate, r.EndDate, 0, 0)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.rooms[r.RoomID]; !ok {
+		return errForeignKey("rooms", r.RoomID)
+	}
+
+	now := time.Now()
+	block := models.RoomRestriction{
+		ID:            d.nextID("room_restriction"),
+		StartDate:     r.StartDate,
+		EndDate:       r.EndDate,
+		RoomID:        r.RoomID,
+		RestrictionID: 2,
+		Note:          r.Note,
+		CreateAt:      now,
+		UpdateAt:      now,
+	}
+	d.roomBlocks[block.ID] = block
+
+	return d.recordAudit(actor, audit.ActionCreate, audit.EntityBlock, block.ID, nil, d.blockState(block.ID))
+}
+
+// GetBlockByID returns an owner block with its room
+func (m *memoryDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	defer m.lock()()
+
+	b, ok := m.db.roomBlocks[id]
+	if !ok || b.ReservationID != 0 {
+		return models.RoomRestriction{}, sql.ErrNoRows
+	}
+	b.Room = m.db.rooms[b.RoomID]
+	return b, nil
+}
+
+// UpdateBlock changes the dates and the note of an owner block, it returns repository.ErrOverlap
+// when the new dates run into another reservation or block of the room
+func (m *memoryDBRepo) UpdateBlock(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkRoomIsFree(r.RoomID, r.StartDate, r.EndDate, r.ID, 0)
+	if err != nil {
+		return err
+	}
+
+	return d.audited(actor, audit.ActionUpdate, audit.EntityBlock, r.ID, d.blockState, func() error {
+		b, ok := d.roomBlocks[r.ID]
+		if !ok || b.ReservationID != 0 {
+			return nil
+		}
+		b.StartDate = r.StartDate
+		b.EndDate = r.EndDate
+		b.Note = r.Note
+		b.UpdateAt = time.Now()
+		d.roomBlocks[r.ID] = b
+		return nil
+	})
+}
+
+// DeleteBlockByID deletes an owner block, it returns sql.ErrNoRows when id is not one, the restriction
+// of a reservation included
+func (m *memoryDBRepo) DeleteBlockByID(ctx context.Context, actor models.Actor, id int) error {
+	defer m.lock()()
+	d := m.db
+
+	if b, ok := d.roomBlocks[id]; !ok || b.ReservationID != 0 {
+		return sql.ErrNoRows
+	}
+
+	return d.audited(actor, audit.ActionDelete, audit.EntityBlock, id, d.blockState, func() error {
+		delete(d.roomBlocks, id)
+		return nil
+	})
+}
+
+// AllBlockSeries returns every recurring owner block with its room
+func (m *memoryDBRepo) AllBlockSeries(ctx context.Context) ([]models.BlockSeries, error) {
+	defer m.lock()()
+	d := m.db
+
+	var series []models.BlockSeries
+	for _, s := range d.series {
+		s.Room = d.rooms[s.RoomID]
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.Room.RoomName != b.Room.RoomName {
+			return a.Room.RoomName < b.Room.RoomName
+		}
+		return a.StartDate.Before(b.StartDate)
+	})
+
+	return series, nil
+}
+
+// InsertBlockSeries inserts a recurring owner block and the blocks of its occurrences, it returns
+// repository.ErrOverlap when the room is not free for one of them
+func (m *memoryDBRepo) InsertBlockSeries(ctx context.Context, actor models.Actor, s models.BlockSeries, blocks []models.RoomRestriction) error {
+	defer m.lock()()
+	d := m.db
+
+	if _, ok := d.rooms[s.RoomID]; !ok {
+		return errForeignKey("rooms", s.RoomID)
+	}
+	for _, b := range blocks {
+		err := d.checkRoomIsFree(b.RoomID, b.StartDate, b.EndDate, 0, 0)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.rooms[b.RoomID]; !ok {
+			return errForeignKey("rooms", b.RoomID)
+		}
+	}
+
+	now := time.Now()
+	series := models.BlockSeries{
+		ID:        d.nextID("block_series"),
+		RoomID:    s.RoomID,
+		StartDate: s.StartDate,
+		EndDate:   s.EndDate,
+		Frequency: s.Frequency,
+		UntilDate: s.UntilDate,
+		Note:      s.Note,
+		CreateAt:  now,
+		UpdateAt:  now,
+	}
+	d.series[series.ID] = series
+
+	for _, b := range blocks {
+		block := models.RoomRestriction{
+			ID:            d.nextID("room_restriction"),
+			StartDate:     b.StartDate,
+			EndDate:       b.EndDate,
+			RoomID:        b.RoomID,
+			RestrictionID: 2,
+			Note:          b.Note,
+			SeriesID:      series.ID,
+			CreateAt:      now,
+			UpdateAt:      now,
+		}
+		d.roomBlocks[block.ID] = block
+	}
+
+	return d.recordAudit(actor, audit.ActionCreate, audit.EntityBlockSeries, series.ID, nil, d.seriesState(series.ID))
+}
+
+// DeleteBlockSeries deletes a recurring owner block and every block it created, it returns sql.ErrNoRows
+// when there is no such series
+func (m *memoryDBRepo) DeleteBlockSeries(ctx context.Context, actor models.Actor, id int) error {
+	defer m.lock()()
+	d := m.db
+
+	if _, ok := d.series[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	for rid, rr := range d.roomBlocks {
+		if rr.SeriesID == id {
+			delete(d.roomBlocks, rid)
+		}
+	}
+
+	return d.audited(actor, audit.ActionDelete, audit.EntityBlockSeries, id, d.seriesState, func() error {
+		delete(d.series, id)
+		return nil
+	})
+}
+
+// GetRestrictionsByDate returns the restrictions of every room overlapping the date range,
+// reservations come with the guest name and the room lock flag
+func (m *memoryDBRepo) GetRestrictionsByDate(ctx context.Context, start, end time.Time) ([]models.RoomRestriction, error) {
+	defer m.lock()()
+	d := m.db
+
+	var list []models.RoomRestriction
+	for _, rr := range d.roomBlocks {
+		if !overlaps(start, end, rr.StartDate, rr.EndDate) {
+			continue
+		}
+		if r, ok := d.reservations[rr.ReservationID]; ok {
+			rr.Reservation.FirstName = r.FirstName
+			rr.Reservation.LastName = r.LastName
+			rr.Reservation.RoomLocked = r.RoomLocked
+		}
+		rr.Reservation.ID = rr.ReservationID
+		rr.Reservation.RoomID = rr.RoomID
+		rr.Reservation.StartDate = rr.StartDate
+		rr.Reservation.EndDate = rr.EndDate
+		list = append(list, rr)
+	}
+	sortRestrictions(list)
+
+	return list, nil
+}
+
+// UpdateRoomForReservation moves a reservation and its room restriction into another room, it returns
+// repository.ErrOverlap when the room is not free for the stay
+func (m *memoryDBRepo) UpdateRoomForReservation(ctx context.Context, actor models.Actor, id, roomID int) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkLive(id)
+	if err != nil {
+		return err
+	}
+	r := d.reservations[id]
+	err = d.checkRoomIsFree(roomID, r.StartDate, r.EndDate, 0, id)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.rooms[roomID]; !ok {
+		return errForeignKey("rooms", roomID)
+	}
+
+	return d.audited(actor, audit.ActionMove, audit.EntityReservation, id, d.reservationState, func() error {
+		now := time.Now()
+		if r, ok := d.reservations[id]; ok {
+			r.RoomID = roomID
+			r.UpdateAt = now
+			d.reservations[id] = r
+		}
+		for rid, rr := range d.roomBlocks {
+			if rr.ReservationID == id {
+				rr.RoomID = roomID
+				rr.UpdateAt = now
+				d.roomBlocks[rid] = rr
+			}
+		}
+		return nil
+	})
+}
+
+// MoveReservation moves a reservation to another room and dates at its new total price, it returns
+// repository.ErrOverlap when the room is not free for the whole stay
+func (m *memoryDBRepo) MoveReservation(ctx context.Context, actor models.Actor, id, roomID int, start, end time.Time, totalPrice int) error {
+	defer m.lock()()
+	d := m.db
+
+	err := d.checkLive(id)
+	if err != nil {
+		return err
+	}
+	err = d.checkRoomIsFree(roomID, start, end, 0, id)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.rooms[roomID]; !ok {
+		return errForeignKey("rooms", roomID)
+	}
+
+	return d.audited(actor, audit.ActionMove, audit.EntityReservation, id, d.reservationState, func() error {
+		now := time.Now()
+		if r, ok := d.reservations[id]; ok {
+			r.RoomID = roomID
+			r.StartDate = start
+			r.EndDate = end
+			r.TotalPrice = totalPrice
+			r.UpdateAt = now
+			d.reservations[id] = r
+		}
+		for rid, rr := range d.roomBlocks {
+			if rr.ReservationID == id {
+				rr.RoomID = roomID
+				rr.StartDate = start
+				rr.EndDate = end
+				rr.UpdateAt = now
+				d.roomBlocks[rid] = rr
+			}
+		}
+		return nil
+	})
+}
+
+// stayRulesWhere returns the stay rules keep accepts with their room, by room name and start date
+func (d *memoryData) stayRulesWhere(keep func(models.StayRule) bool) []models.StayRule {
+	var rules []models.StayRule
+	for _, r := range d.stayRules {
+		if !keep(r) {
+			continue
+		}
+		r.Room = d.rooms[r.RoomID]
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.Room.RoomName != b.Room.RoomName {
+			return a.Room.RoomName < b.Room.RoomName
+		}
+		if !a.StartDate.Equal(b.StartDate) {
+			return a.StartDate.Before(b.StartDate)
+		}
+		return a.ID < b.ID
+	})
+	return rules
+}
+
+// GetStayRulesByDate returns the stay rules of every room that apply to an arrival date
+func (m *memoryDBRepo) GetStayRulesByDate(ctx context.Context, arrival time.Time) ([]models.StayRule, error) {
+	defer m.lock()()
+
+	return m.db.stayRulesWhere(func(r models.StayRule) bool {
+		return !r.StartDate.After(arrival) && !r.EndDate.Before(arrival)
+	}), nil
+}
+
+// AllStayRules returns every stay rule
+func (m *memoryDBRepo) AllStayRules(ctx context.Context) ([]models.StayRule, error) {
+	defer m.lock()()
+
+	return m.db.stayRulesWhere(func(models.StayRule) bool { return true }), nil
+}
+
+// InsertStayRule inserts a stay rule for a room
+func (m *memoryDBRepo) InsertStayRule(ctx context.Context, actor models.Actor, r models.StayRule) error {
+	defer m.lock()()
+	d := m.db
+
+	if _, ok := d.rooms[r.RoomID]; !ok {
+		return errForeignKey("rooms", r.RoomID)
+	}
+
+	now := time.Now()
+	rule := models.StayRule{
+		ID:                d.nextID("stay_rules"),
+		RoomID:            r.RoomID,
+		StartDate:         r.StartDate,
+		EndDate:           r.EndDate,
+		MinNights:         r.MinNights,
+		MaxNights:         r.MaxNights,
+		ClosedToArrival:   r.ClosedToArrival,
+		ClosedToDeparture: r.ClosedToDeparture,
+		MinAdvanceDays:    r.MinAdvanceDays,
+		MaxAdvanceDays:    r.MaxAdvanceDays,
+		CreateAt:          now,
+		UpdateAt:          now,
+	}
+	d.stayRules[rule.ID] = rule
+
+	return d.recordAudit(actor, audit.ActionCreate, audit.EntityStayRule, rule.ID, nil, d.stayRuleState(rule.ID))
+}
+
+// DeleteStayRule deletes a stay rule by id
+func (m *memoryDBRepo) DeleteStayRule(ctx context.Context, actor models.Actor, id int) error {
+	defer m.lock()()
+	d := m.db
+
+	return d.audited(actor, audit.ActionDelete, audit.EntityStayRule, id, d.stayRuleState, func() error {
+		delete(d.stayRules, id)
+		return nil
+	})
+}
+
+// ArrivalsOn returns the reservations starting on day
+func (m *memoryDBRepo) ArrivalsOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	return m.reservationsOnDay(func(r models.Reservation) time.Time { return r.StartDate }, day)
+}
+
+// DeparturesOn returns the reservations ending on day
+func (m *memoryDBRepo) DeparturesOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	return m.reservationsOnDay(func(r models.Reservation) time.Time { return r.EndDate }, day)
+}
+
+// reservationsOnDay returns the reservations whose date is day, by room name and last name
+func (m *memoryDBRepo) reservationsOnDay(date func(models.Reservation) time.Time, day time.Time) ([]models.Reservation, error) {
+	defer m.lock()()
+	d := m.db
+
+	var reservations []models.Reservation
+	for _, r := range d.reservations {
+		if r.DeletedAt.IsZero() && dateOf(date(r.Reservation)).Equal(dateOf(day)) {
+			reservations = append(reservations, d.withRoom(r.Reservation))
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		a, b := reservations[i], reservations[j]
+		if a.Room.RoomName != b.Room.RoomName {
+			return a.Room.RoomName < b.Room.RoomName
+		}
+		if a.LastName != b.LastName {
+			return a.LastName < b.LastName
+		}
+		return a.ID < b.ID
+	})
+
+	return reservations, nil
+}
+
+// DashboardStats sums up the reservations arriving from start to end (excluded)
+func (m *memoryDBRepo) DashboardStats(ctx context.Context, start, end time.Time) (models.DashboardStats, error) {
+	defer m.lock()()
+
+	var stats models.DashboardStats
+	nights, leadDays := 0, 0
+	for _, r := range m.db.reservations {
+		if !r.DeletedAt.IsZero() || r.StartDate.Before(start) || !r.StartDate.Before(end) {
+			continue
+		}
+		stats.Reservations++
+		switch r.Processed {
+		case 0:
+			stats.New++
+		case 1:
+			stats.Processed++
+		}
+		nights += daysBetween(r.StartDate, r.EndDate)
+		leadDays += daysBetween(r.CreateAt, r.StartDate)
+		if r.TotalPrice > 0 {
+			stats.PricedReservations++
+		}
+		stats.Revenue += r.TotalPrice
+	}
+	if stats.Reservations > 0 {
+		stats.AverageStay = float64(nights) / float64(stats.Reservations)
+		stats.AverageLeadTime = float64(leadDays) / float64(stats.Reservations)
+	}
+
+	return stats, nil
+}
+
+// OccupancyByMonth counts the booked nights of every room in every month from start to end (excluded).
+// The first and last months only count the nights inside the range.
+func (m *memoryDBRepo) OccupancyByMonth(ctx context.Context, start, end time.Time) ([]models.RoomOccupancy, error) {
+	defer m.lock()()
+	d := m.db
+
+	start, end = dateOf(start), dateOf(end)
+	rooms := make([]models.Room, 0, len(d.rooms))
+	for _, room := range d.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomName < rooms[j].RoomName
+	})
+
+	var occupancy []models.RoomOccupancy
+	for _, room := range rooms {
+		for month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(end); month = month.AddDate(0, 1, 0) {
+			first, last := month, month.AddDate(0, 1, 0)
+			if first.Before(start) {
+				first = start
+			}
+			if last.After(end) {
+				last = end
+			}
+
+			item := models.RoomOccupancy{
+				RoomID:   room.ID,
+				RoomName: room.RoomName,
+				Month:    month,
+				Nights:   daysBetween(first, last),
+			}
+			for _, rr := range d.roomBlocks {
+				if rr.RoomID != room.ID || rr.RestrictionID != 1 || !overlaps(first, last, rr.StartDate, rr.EndDate) {
+					continue
+				}
+				from, to := rr.StartDate, rr.EndDate
+				if from.Before(first) {
+					from = first
+				}
+				if to.After(last) {
+					to = last
+				}
+				item.BookedNights += daysBetween(from, to)
+			}
+			occupancy = append(occupancy, item)
+		}
+	}
+
+	return occupancy, nil
+}
+
+// inReportRooms reports whether a room is among the rooms of a report
+func inReportRooms(f models.ReportFilter, roomID int) bool {
+	if len(f.RoomIDs) == 0 {
+		return true
+	}
+	for _, id := range f.RoomIDs {
+		if id == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// EachReservation calls fn for every reservation staying from f.Start to f.End, or booked then
+// when f.ByBookingDate is set. fn runs once the tables are unlocked.
+func (m *memoryDBRepo) EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error {
+	unlock := m.lock()
+	d := m.db
+
+	var reservations []models.Reservation
+	for _, r := range d.reservations {
+		if !r.DeletedAt.IsZero() || !inReportRooms(f, r.RoomID) {
+			continue
+		}
+		if f.ByBookingDate {
+			if r.CreateAt.Before(f.Start) || !r.CreateAt.Before(f.End) {
+				continue
+			}
+		} else if !overlaps(f.Start, f.End, r.StartDate, r.EndDate) {
+			continue
+		}
+		reservations = append(reservations, d.withRoom(r.Reservation))
+	}
+	unlock()
+
+	sort.Slice(reservations, func(i, j int) bool {
+		a, b := reservations[i], reservations[j]
+		at, bt := a.StartDate, b.StartDate
+		if f.ByBookingDate {
+			at, bt = a.CreateAt, b.CreateAt
+		}
+		if !at.Equal(bt) {
+			return at.Before(bt)
+		}
+		return a.ID < b.ID
+	})
+
+	for _, r := range reservations {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachCancellation calls fn for every reservation cancelled from f.Start to f.End
+func (m *memoryDBRepo) EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error {
+	unlock := m.lock()
+	d := m.db
+
+	var cancellations []models.Cancellation
+	for _, c := range d.cancellations {
+		if c.CreateAt.Before(f.Start) || !c.CreateAt.Before(f.End) || !inReportRooms(f, c.RoomID) {
+			continue
+		}
+		item := c.Cancellation
+		item.Room.ID = item.RoomID
+		item.Room.RoomName = d.rooms[item.RoomID].RoomName
+		cancellations = append(cancellations, item)
+	}
+	unlock()
+
+	sort.Slice(cancellations, func(i, j int) bool {
+		a, b := cancellations[i], cancellations[j]
+		if !a.CreateAt.Equal(b.CreateAt) {
+			return a.CreateAt.Before(b.CreateAt)
+		}
+		return a.ID < b.ID
+	})
+
+	for _, c := range cancellations {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachBlock calls fn for every owner block overlapping f.Start to f.End
+func (m *memoryDBRepo) EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error {
+	unlock := m.lock()
+	d := m.db
+
+	var blocks []models.RoomRestriction
+	for _, rr := range d.roomBlocks {
+		if rr.RestrictionID != 2 || !overlaps(f.Start, f.End, rr.StartDate, rr.EndDate) || !inReportRooms(f, rr.RoomID) {
+			continue
+		}
+		rr.Room.ID = rr.RoomID
+		rr.Room.RoomName = d.rooms[rr.RoomID].RoomName
+		blocks = append(blocks, rr)
+	}
+	unlock()
+
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if !a.StartDate.Equal(b.StartDate) {
+			return a.StartDate.Before(b.StartDate)
+		}
+		return a.ID < b.ID
+	})
+
+	for _, b := range blocks {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guestWithFigures returns a guest with the figures of its reservations out of the trash
+func (d *memoryData) guestWithFigures(g models.Guest) models.Guest {
+	for _, r := range d.reservations {
+		if r.GuestID != g.ID || !r.DeletedAt.IsZero() {
+			continue
+		}
+		g.Stays++
+		g.Nights += daysBetween(r.StartDate, r.EndDate)
+		g.LifetimeValue += r.TotalPrice
+	}
+	return g
+}
+
+// guestsWhere returns the guests keep accepts with their figures, sorted by less
+func (d *memoryData) guestsWhere(keep func(models.Guest) bool, less func(a, b models.Guest) bool) []models.Guest {
+	var list []models.Guest
+	for _, g := range d.guests {
+		if keep(g) {
+			list = append(list, d.guestWithFigures(g))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return less(list[i], list[j])
+	})
+	return list
+}
+
+// byGuestID orders guests by id
+func byGuestID(a, b models.Guest) bool {
+	return a.ID < b.ID
+}
+
+// AllGuests returns up to limit guests whose name contains text or whose email or phone is text, every guest
+// for an empty text
+func (m *memoryDBRepo) AllGuests(ctx context.Context, text string, limit int) ([]models.Guest, error) {
+	defer m.lock()()
+
+	list := m.db.guestsWhere(func(g models.Guest) bool {
+		return text == "" || containsFold(g.FirstName+" "+g.LastName, text) ||
+			sameEmail(text, g.Email) || samePhone(text, g.Phone)
+	}, func(a, b models.Guest) bool {
+		if a.LastName != b.LastName {
+			return a.LastName < b.LastName
+		}
+		if a.FirstName != b.FirstName {
+			return a.FirstName < b.FirstName
+		}
+		return a.ID < b.ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	return list, nil
+}
+
+// GetGuestByID returns a guest with the figures of its reservations
+func (m *memoryDBRepo) GetGuestByID(ctx context.Context, id int) (models.Guest, error) {
+	defer m.lock()()
+
+	return m.db.guestByID(id)
+}
+
+func (d *memoryData) guestByID(id int) (models.Guest, error) {
+	g, ok := d.guests[id]
+	if !ok {
+		return models.Guest{}, sql.ErrNoRows
+	}
+	return d.guestWithFigures(g), nil
+}
+
+// GuestDuplicates returns the other guests with the same email, phone or name as the guest id
+func (m *memoryDBRepo) GuestDuplicates(ctx context.Context, id int) ([]models.Guest, error) {
+	defer m.lock()()
+
+	o, ok := m.db.guests[id]
+	if !ok {
+		return nil, nil
+	}
+	name := strings.ToLower(o.FirstName + " " + o.LastName)
+
+	return m.db.guestsWhere(func(g models.Guest) bool {
+		return g.ID != o.ID && (sameEmail(o.Email, g.Email) || samePhone(o.Phone, g.Phone) ||
+			strings.ToLower(g.FirstName+" "+g.LastName) == name)
+	}, byGuestID), nil
+}
+
+// GuestReservations returns the reservations of a guest, the latest stay first
+func (m *memoryDBRepo) GuestReservations(ctx context.Context, guestID int) ([]models.Reservation, error) {
+	defer m.lock()()
+	d := m.db
+
+	var reservations []models.Reservation
+	for _, r := range d.reservations {
+		if r.GuestID == guestID && r.DeletedAt.IsZero() {
+			reservations = append(reservations, d.withRoom(r.Reservation))
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].StartDate.After(reservations[j].StartDate)
+	})
+
+	return reservations, nil
+}
+
+// UpdateGuest saves the details, notes and tags of a guest, it returns repository.ErrGuestEmailTaken
+// when another guest has the email
+func (m *memoryDBRepo) UpdateGuest(ctx context.Context, actor models.Actor, g models.Guest) error {
+	defer m.lock()()
+
+	return m.db.updateGuest(actor, g)
+}
+
+// updateGuest saves a guest, it returns repository.ErrGuestEmailTaken when another guest has the email
+func (d *memoryData) updateGuest(actor models.Actor, g models.Guest) error {
+	for id, other := range d.guests {
+		if id != g.ID && sameEmail(g.Email, other.Email) {
+			return repository.ErrGuestEmailTaken
+		}
+	}
+
+	return d.audited(actor, audit.ActionUpdate, audit.EntityGuest, g.ID, d.guestState, func() error {
+		existing, ok := d.guests[g.ID]
+		if !ok {
+			return nil
+		}
+		existing.FirstName = g.FirstName
+		existing.LastName = g.LastName
+		existing.Email = g.Email
+		existing.Phone = g.Phone
+		existing.Notes = g.Notes
+		existing.Tags = append([]string(nil), g.Tags...)
+		existing.UpdateAt = time.Now()
+		d.guests[g.ID] = existing
+		return nil
+	})
+}
+
+// MergeGuests moves the reservations of the guest duplicateID to keep, saves keep and deletes the duplicate
+func (m *memoryDBRepo) MergeGuests(ctx context.Context, actor models.Actor, keep models.Guest, duplicateID int) error {
+	defer m.lock()()
+	d := m.db
+
+	if _, ok := d.guests[keep.ID]; !ok {
+		for _, r := range d.reservations {
+			if r.GuestID == duplicateID {
+				return errForeignKey("guests", keep.ID)
+			}
+		}
+	}
+
+	for id, r := range d.reservations {
+		if r.GuestID == duplicateID {
+			r.GuestID = keep.ID
+			d.reservations[id] = r
+		}
+	}
+
+	// The duplicate goes first, keep may take its email
+	err := d.audited(actor, audit.ActionMerge, audit.EntityGuest, duplicateID, d.guestState, func() error {
+		d.deleteGuest(duplicateID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.updateGuest(actor, keep)
+}
+
+// GetReservationByCode returns the reservation with a confirmation code
+func (m *memoryDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	defer m.lock()()
+	d := m.db
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, r := range d.reservations {
+		if r.ConfirmationCode == code && r.DeletedAt.IsZero() {
+			return d.withRoom(r.Reservation), nil
+		}
+	}
+	return models.Reservation{}, sql.ErrNoRows
+}
+
+// InsertGuestAccount adds an unverified guest account. An account without a guest is matched to the guest
+// profile of its email, never of its phone as nobody checks the phone, a.Guest being used for a new guest. It returns repository.ErrEmailTaken when the
+// email already has an account.
+func (m *memoryDBRepo) InsertGuestAccount(ctx context.Context, a models.GuestAccount) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	for _, other := range d.accounts {
+		if other.Email == a.Email {
+			return 0, repository.ErrEmailTaken
+		}
+		if a.VerifyToken != "" && other.VerifyToken == a.VerifyToken {
+			return 0, errUnique("guest_accounts_verify_token_idx")
+		}
+	}
+
+	if a.GuestID != 0 {
+		if _, ok := d.guests[a.GuestID]; !ok {
+			return 0, errForeignKey("guests", a.GuestID)
+		}
+	} else {
+		a.GuestID = d.matchGuest(&models.Reservation{
+			FirstName: a.Guest.FirstName,
+			LastName:  a.Guest.LastName,
+			Email:     a.Email,
+			Phone:     a.Guest.Phone,
+		}, false)
+	}
+
+	now := time.Now()
+	account := models.GuestAccount{
+		ID:            d.nextID("guest_accounts"),
+		GuestID:       a.GuestID,
+		Email:         a.Email,
+		Password:      a.Password,
+		VerifyToken:   a.VerifyToken,
+		VerifyExpires: a.VerifyExpires,
+		CreateAt:      now,
+		UpdateAt:      now,
+	}
+	d.accounts[account.ID] = account
+
+	return account.ID, nil
+}
+
+// GetGuestAccountByID returns a guest account with its guest profile
+func (m *memoryDBRepo) GetGuestAccountByID(ctx context.Context, id int) (models.GuestAccount, error) {
+	defer m.lock()()
+
+	return m.db.guestAccountByID(id)
+}
+
+func (d *memoryData) guestAccountByID(id int) (models.GuestAccount, error) {
+	a, ok := d.accounts[id]
+	if !ok {
+		return models.GuestAccount{}, sql.ErrNoRows
+	}
+	// The token is only ever compared, it isn't read back
+	a.VerifyToken = ""
+	a.VerifyExpires = time.Time{}
+
+	var err error
+	a.Guest, err = d.guestByID(a.GuestID)
+	return a, err
+}
+
+// AuthenticateGuest returns the guest account of email when testPassword is its password,
+// verified or not
+func (m *memoryDBRepo) AuthenticateGuest(ctx context.Context, email, testPassword string) (models.GuestAccount, error) {
+	defer m.lock()()
+	d := m.db
+
+	email = guests.NormalizeEmail(email)
+	for _, a := range d.accounts {
+		if a.Email != email {
+			continue
+		}
+
+		err := bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(testPassword))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return models.GuestAccount{}, errors.New("incorrect password")
+		} else if err != nil {
+			return models.GuestAccount{}, err
+		}
+		return d.guestAccountByID(a.ID)
+	}
+
+	return models.GuestAccount{}, sql.ErrNoRows
+}
+
+// SetGuestAccountToken replaces the verification token of a guest account
+func (m *memoryDBRepo) SetGuestAccountToken(ctx context.Context, id int, token string, expires time.Time) error {
+	defer m.lock()()
+	d := m.db
+
+	a, ok := d.accounts[id]
+	if !ok {
+		return nil
+	}
+	for _, other := range d.accounts {
+		if other.ID != id && token != "" && other.VerifyToken == token {
+			return errUnique("guest_accounts_verify_token_idx")
+		}
+	}
+	a.VerifyToken = token
+	a.VerifyExpires = expires
+	a.UpdateAt = time.Now()
+	d.accounts[id] = a
+
+	return nil
+}
+
+// VerifyGuestAccount marks the account of a verification token as verified and returns its id. The token
+// can be used once, repository.ErrInvalidToken is returned for an unknown or expired token.
+func (m *memoryDBRepo) VerifyGuestAccount(ctx context.Context, token string) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	now := time.Now()
+	for id, a := range d.accounts {
+		if a.VerifyToken == "" || a.VerifyToken != token || !a.VerifyExpires.After(now) {
+			continue
+		}
+		a.Verified = true
+		a.VerifyToken = ""
+		a.VerifyExpires = time.Time{}
+		a.UpdateAt = now
+		d.accounts[id] = a
+		return id, nil
+	}
+
+	return 0, repository.ErrInvalidToken
+}
+
+// InsertSentEmail keeps a copy of an email sent to a guest
+func (m *memoryDBRepo) InsertSentEmail(ctx context.Context, mail models.MailData) error {
+	defer m.lock()()
+	d := m.db
+
+	now := time.Now()
+	e := models.SentEmail{
+		ID:       d.nextID("sent_emails"),
+		To:       mail.To,
+		Subject:  mail.Subject,
+		Content:  mail.Content,
+		CreateAt: now,
+		UpdateAt: now,
+	}
+	d.emails[e.ID] = e
+
+	return nil
+}
+
+// personalReservation reports whether a reservation was made with email, or by a guest profile of email
+func (d *memoryData) personalReservation(r memoryReservation, email string) bool {
+	if sameEmail(email, r.Email) {
+		return true
+	}
+	g, ok := d.guests[r.GuestID]
+	return ok && sameEmail(email, g.Email)
+}
+
+// PersonalData returns everything held about an email: guest profiles, accounts, reservations,
+// cancellations and the emails sent to it
+func (m *memoryDBRepo) PersonalData(ctx context.Context, email string) (models.PersonalData, error) {
+	defer m.lock()()
+	d := m.db
+
+	email = guests.NormalizeEmail(email)
+	data := models.PersonalData{Email: email}
+
+	data.Guests = d.guestsWhere(func(g models.Guest) bool {
+		return sameEmail(email, g.Email)
+	}, byGuestID)
+
+	for _, a := range d.accounts {
+		if g, ok := d.guests[a.GuestID]; a.Email == email || (ok && sameEmail(email, g.Email)) {
+			a.Password = ""
+			a.VerifyToken = ""
+			a.VerifyExpires = time.Time{}
+			data.Accounts = append(data.Accounts, a)
+		}
+	}
+	sort.Slice(data.Accounts, func(i, j int) bool {
+		return data.Accounts[i].ID < data.Accounts[j].ID
+	})
+
+	for _, r := range d.reservations {
+		if d.personalReservation(r, email) {
+			data.Reservations = append(data.Reservations, d.withRoom(r.Reservation))
+		}
+	}
+	sort.Slice(data.Reservations, func(i, j int) bool {
+		return data.Reservations[i].StartDate.Before(data.Reservations[j].StartDate)
+	})
+
+	for _, c := range d.cancellations {
+		if sameEmail(email, c.Email) {
+			data.Cancellations = append(data.Cancellations, c.Cancellation)
+		}
+	}
+	sort.Slice(data.Cancellations, func(i, j int) bool {
+		return data.Cancellations[i].CreateAt.Before(data.Cancellations[j].CreateAt)
+	})
+
+	for _, e := range d.emails {
+		if sameEmail(email, e.To) {
+			data.Emails = append(data.Emails, e)
+		}
+	}
+	sort.Slice(data.Emails, func(i, j int) bool {
+		return data.Emails[i].CreateAt.Before(data.Emails[j].CreateAt)
+	})
+
+	return data, nil
+}
+
+// anonymize empties the personal fields of a reservation
+func (r *memoryReservation) anonymize(now time.Time) {
+	r.FirstName = privacy.ErasedName
+	r.LastName = ""
+	r.Email = ""
+	r.Phone = ""
+	r.Notes = ""
+	r.GuestID = 0
+	r.AnonymizedAt = now
+	r.UpdateAt = now
+}
+
+// anonymize empties the personal fields of a cancellation
+func (c *memoryCancellation) anonymize(now time.Time) {
+	c.FirstName = privacy.ErasedName
+	c.LastName = ""
+	c.Email = ""
+	c.Phone = ""
+	c.AnonymizedAt = now
+	c.UpdateAt = now
+}
+
+// ErasePersonalData anonymizes the reservations and cancellations of an email, keeping their dates, rooms and
+// prices for the statistics, and deletes its guest profiles, accounts and sent emails. The audit log is left
+// as is, it only holds the personal fields redacted. It returns the number of reservations anonymized.
+func (m *memoryDBRepo) ErasePersonalData(ctx context.Context, email string) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	email = guests.NormalizeEmail(email)
+	now := time.Now()
+
+	n := 0
+	for id, r := range d.reservations {
+		if d.personalReservation(r, email) {
+			r.anonymize(now)
+			d.reservations[id] = r
+			n++
+		}
+	}
+
+	for id, c := range d.cancellations {
+		if sameEmail(email, c.Email) {
+			c.anonymize(now)
+			d.cancellations[id] = c
+		}
+	}
+
+	for id, e := range d.emails {
+		if sameEmail(email, e.To) {
+			delete(d.emails, id)
+		}
+	}
+
+	// Accounts of the guest profiles go with them
+	for id, a := range d.accounts {
+		if a.Email == email {
+			delete(d.accounts, id)
+		}
+	}
+
+	for id, g := range d.guests {
+		if sameEmail(email, g.Email) {
+			d.deleteGuest(id)
+		}
+	}
+
+	return n, nil
+}
+
+// AnonymizeBefore anonymizes the reservations and cancellations of stays ending before cutoff, deletes the
+// emails sent before it and the guest profiles left without reservations nor account. The audit log is left as
+// is, it only holds the personal fields redacted. It returns the number of reservations anonymized.
+func (m *memoryDBRepo) AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	defer m.lock()()
+	d := m.db
+
+	now := time.Now()
+	n := 0
+	for id, r := range d.reservations {
+		if r.EndDate.Before(cutoff) && r.AnonymizedAt.IsZero() {
+			r.anonymize(now)
+			d.reservations[id] = r
+			n++
+		}
+	}
+
+	for id, c := range d.cancellations {
+		if c.EndDate.Before(cutoff) && c.AnonymizedAt.IsZero() {
+			c.anonymize(now)
+			d.cancellations[id] = c
+		}
+	}
+
+	for id, e := range d.emails {
+		if e.CreateAt.Before(cutoff) {
+			delete(d.emails, id)
+		}
+	}
+
+	used := make(map[int]bool)
+	for _, r := range d.reservations {
+		used[r.GuestID] = true
+	}
+	for _, a := range d.accounts {
+		used[a.GuestID] = true
+	}
+	for id, g := range d.guests {
+		if g.CreateAt.Before(cutoff) && !used[id] {
+			d.deleteGuest(id)
+		}
+	}
+
+	return n, nil
+}
+
+// AuditLog returns a page of the audit log entries matching f, the latest first, and how many entries
+// match in all
+func (m *memoryDBRepo) AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, int, error) {
+	defer m.lock()()
+	d := m.db
+
+	var entries []models.AuditEntry
+	for _, e := range d.audit {
+		switch {
+		case f.UserID > 0 && e.UserID != f.UserID,
+			f.Action != "" && e.Action != f.Action,
+			f.Entity != "" && e.Entity != f.Entity,
+			f.EntityID > 0 && e.EntityID != f.EntityID,
+			!f.Start.IsZero() && e.CreateAt.Before(f.Start),
+			!f.End.IsZero() && !e.CreateAt.Before(f.End):
+			continue
+		}
+		e.UserName = d.userName(e.UserID)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.CreateAt.Equal(b.CreateAt) {
+			return a.CreateAt.After(b.CreateAt)
+		}
+		return a.ID > b.ID
+	})
+
+	from, to := pageBounds(len(entries), f.Page, f.PerPage)
+	return entries[from:to], len(entries), nil
+}
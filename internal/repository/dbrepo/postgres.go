@@ -2,61 +2,154 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/TranQuocToan1996/bookings/internal/audit"
+	"github.com/TranQuocToan1996/bookings/internal/guests"
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/privacy"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // implement for DatabaseRepo interface
-func (p *postgresDBRepo) AllUsers() bool {
+func (p *postgresDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
 // InsertReservation inserts a reservation into database (C in CRUD)
-func (p *postgresDBRepo) InsertReservation(res *models.Reservation) (int, error) {
+func (p *postgresDBRepo) InsertReservation(ctx context.Context, res *models.Reservation) (int, error) {
 
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	// A guest logged in to its account books for its own profile
+	if res.GuestID == 0 {
+		res.GuestID, err = p.matchGuest(ctx, tx, res, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	c, err := p.sealContact(res.Email, res.Phone)
+	if err != nil {
+		return 0, err
+	}
+
 	// Insert post data into database and returning reservation id
 	query := `insert into reservations
-	(first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at) 
-	values  ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	(first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at,
+	adults, children, total_price, confirmation_code, guest_id, email_index, phone_index) 
+	values  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) returning id`
 	var newID int
-	err := p.DB.QueryRowContext(ctx, query,
+	err = tx.QueryRowContext(ctx, query,
 		res.FirstName,
 		res.LastName,
-		res.Email,
-		res.Phone,
-		res.StartDate,
-		res.EndDate,
+		c.Email,
+		c.Phone,
+		p.day(res.StartDate),
+		p.day(res.EndDate),
 		res.RoomID,
 		time.Now(),
 		time.Now(),
+		res.Adults,
+		res.Children,
+		res.TotalPrice,
+		res.ConfirmationCode,
+		res.GuestID,
+		c.EmailIndex,
+		c.PhoneIndex,
 	).Scan(&newID)
 	if err != nil {
 		return 0, err
 	}
 
-	return newID, nil
+	return newID, tx.Commit()
+}
+
+// matchGuest returns the guest of a new reservation, found by email first and, when matchPhone, by phone then,
+// a guest is added when it is a new customer
+func (p *postgresDBRepo) matchGuest(ctx context.Context, tx dbtx, res *models.Reservation, matchPhone bool) (int, error) {
+	c, err := p.sealContact(res.Email, res.Phone)
+	if err != nil {
+		return 0, err
+	}
+	phoneIndex := c.PhoneIndex
+	if !matchPhone {
+		phoneIndex = ""
+	}
+
+	var id int
+	query := `select id from guests
+			where (email_index = $1 and $1 <> '') or (phone_index = $2 and $2 <> '')
+			order by email_index = $1 desc, id
+			limit 1`
+	err = tx.QueryRowContext(ctx, query, c.EmailIndex, phoneIndex).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// Two bookings of a new customer at once both miss the select, the second one gets the guest
+	// the first one added
+	query = `insert into guests (first_name, last_name, email, phone, email_index, phone_index,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)
+			on conflict (email_index) where email_index <> '' do update set updated_at = excluded.updated_at
+			returning id`
+	err = tx.QueryRowContext(ctx, query,
+		res.FirstName,
+		res.LastName,
+		c.Email,
+		c.Phone,
+		c.EmailIndex,
+		c.PhoneIndex,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
 }
 
-// InsertRoomRestriction inserts Room restriction data into database
-func (p *postgresDBRepo) InsertRoomRestriction(r *models.RoomRestriction) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertRoomRestriction inserts Room restriction data into database, it returns repository.ErrOverlap when
+// the room is not free from its start to its end. Two bookings of the same nights at once are checked one
+// after the other, the second one gets the overlap.
+func (p *postgresDBRepo) InsertRoomRestriction(ctx context.Context, r *models.RoomRestriction) error {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.checkRoomIsFree(ctx, tx, r.RoomID, r.StartDate, r.EndDate, 0, 0)
+	if err != nil {
+		return err
+	}
+
 	query := `insert into	room_restriction 
 	(start_date, end_date, room_ID, reservation_id , created_at, updated_at, restriction_id)
 	values  ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := p.DB.ExecContext(ctx, query,
-		r.StartDate,
-		r.EndDate,
+	_, err = tx.ExecContext(ctx, query,
+		p.day(r.StartDate),
+		p.day(r.EndDate),
 		r.RoomID,
 		r.ReservationID,
 		time.Now(),
@@ -67,14 +160,13 @@ func (p *postgresDBRepo) InsertRoomRestriction(r *models.RoomRestriction) error
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 // SearchAvailabilityByDate checks availability of a specific room
-func (p *postgresDBRepo) SearchAvailabilityByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (p *postgresDBRepo) SearchAvailabilityByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
 
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var numRows int
@@ -85,9 +177,9 @@ func (p *postgresDBRepo) SearchAvailabilityByRoomID(start, end time.Time, roomID
 					where 
 						$1 < end_date and $2 > start_date
 						and room_id = $3;`
-	err := p.DB.QueryRowContext(ctx, query,
-		start,
-		end,
+	err := p.conn().QueryRowContext(ctx, query,
+		p.day(start),
+		p.day(end),
 		roomID,
 	).Scan(&numRows)
 	if err != nil {
@@ -98,33 +190,40 @@ func (p *postgresDBRepo) SearchAvailabilityByRoomID(start, end time.Time, roomID
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available room(s) if any for given date range
-func (p *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// that can sleep the number of guests
+func (p *postgresDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var rooms []models.Room
 	query := `select 
-						r.id, r.room_name 
+						r.id, r.room_name, r.max_occupancy, r.base_occupancy, r.price_per_night, r.extra_guest_fee
 					from
 						rooms r
 					where r.id not in (
 							select room_id from room_restriction rr
 							where $1 < rr.end_date and $2 > rr.start_date
-					)`
-	rows, err := p.DB.QueryContext(ctx, query,
-		start,
-		end,
+					)
+					and r.max_occupancy >= $3`
+	rows, err := p.conn().QueryContext(ctx, query,
+		p.day(start),
+		p.day(end),
+		guests,
 	)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		room := models.Room{}
 		err := rows.Scan(
 			&room.ID,
 			&room.RoomName,
+			&room.MaxOccupancy,
+			&room.BaseOccupancy,
+			&room.PricePerNight,
+			&room.ExtraGuestFee,
 		)
 		if err != nil {
 			return rooms, err
@@ -141,19 +240,24 @@ func (p *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 }
 
 // GetRoomByID gets a room struct by id
-func (p *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var room models.Room
-	query := `select id, room_name, created_at, updated_at from rooms	where id = $1`
-	row := p.DB.QueryRowContext(ctx, query,
+	query := `select id, room_name, room_type, max_occupancy, base_occupancy, price_per_night, extra_guest_fee,
+				created_at, updated_at from rooms	where id = $1`
+	row := p.conn().QueryRowContext(ctx, query,
 		id,
 	)
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.RoomType,
+		&room.MaxOccupancy,
+		&room.BaseOccupancy,
+		&room.PricePerNight,
+		&room.ExtraGuestFee,
 		&room.CreateAt,
 		&room.UpdateAt,
 	)
@@ -165,15 +269,14 @@ func (p *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 }
 
 // GetUserByID return the user information by ID
-func (p *postgresDBRepo) GetUserByID(id int) (models.User, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at
 				from users where id=$1`
 	var u models.User
-	err := p.DB.QueryRowContext(ctx, query, id).Scan(
+	err := p.conn().QueryRowContext(ctx, query, id).Scan(
 		&u.ID,
 		&u.FirstName,
 		&u.LastName,
@@ -191,18 +294,18 @@ func (p *postgresDBRepo) GetUserByID(id int) (models.User, error) {
 }
 
 // UpdateUser updates a user in the database
-func (p *postgresDBRepo) UpdateUser(u models.User) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5`
-	_, err := p.DB.ExecContext(ctx, query,
+	query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5 where id=$6`
+	_, err := p.conn().ExecContext(ctx, query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.AccessLevel,
 		time.Now(),
+		u.ID,
 	)
 	if err != nil {
 		return err
@@ -212,15 +315,14 @@ func (p *postgresDBRepo) UpdateUser(u models.User) error {
 }
 
 // Authenticate authenticates the user and send back user_id, hashPassword, and an error if any
-func (p *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var id int
 	var hashedPassword string // This one will store in the database instead of plain text password
 
-	row := p.DB.QueryRowContext(ctx, "select id, password from users where email=$1", email)
+	row := p.conn().QueryRowContext(ctx, "select id, password from users where email=$1", email)
 	err := row.Scan(&id, &hashedPassword)
 	if err != nil {
 		return id, "", err
@@ -237,26 +339,98 @@ func (p *postgresDBRepo) Authenticate(email, testPassword string) (int, string,
 	return id, hashedPassword, nil
 }
 
-// AllReservations returns a slice of all reservations
-func (p *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// reservationSorts maps repository.ReservationSorts to their column
+var reservationSorts = map[string]string{
+	"id":         "r.id",
+	"first_name": "r.first_name",
+	"last_name":  "r.last_name",
+	"room":       "rm.room_name",
+	"start_date": "r.start_date",
+	"end_date":   "r.end_date",
+	"created_at": "r.created_at",
+	"processed":  "r.processed",
+}
+
+// likeEscaper keeps the wildcards typed in a search as plain characters
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// FindReservations returns a page of the reservations matching f, sorted on f.Sort (start date by default),
+// and how many reservations match in all
+func (p *postgresDBRepo) FindReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var reservations []models.Reservation
-	query := `
-			select r.id, r.first_name, r.last_name, r.email, r.phone, 
+	// Reservations in the trash are only listed by TrashedReservations
+	where := []string{"r.deleted_at is null"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.RoomID > 0 {
+		where = append(where, "r.room_id = "+arg(f.RoomID))
+	}
+	if !f.Start.IsZero() {
+		where = append(where, "r.end_date > "+arg(p.day(f.Start)))
+	}
+	if !f.End.IsZero() {
+		where = append(where, "r.start_date < "+arg(p.day(f.End)))
+	}
+	switch f.Status {
+	case "new":
+		where = append(where, "r.processed = 0")
+	case "processed":
+		where = append(where, "r.processed = 1")
+	}
+	if f.Query != "" {
+		// Emails and phones may be encrypted, they match as a whole through their blind index
+		like := arg("%" + likeEscaper.Replace(f.Query) + "%")
+		email := arg(p.Crypt.Index(guests.NormalizeEmail(f.Query)))
+		phone := arg(p.Crypt.Index(guests.NormalizePhone(f.Query)))
+		where = append(where, fmt.Sprintf(`(%s or r.email_index = %s
+				or (r.phone_index = %s and r.phone_index <> ''))`,
+			p.ilike(`(r.first_name || ' ' || r.last_name)`, like), email, phone))
+	}
+
+	conditions := "where " + strings.Join(where, " and ")
+
+	var total int
+	query := `select count(*) from reservations r ` + conditions
+	err := p.conn().QueryRowContext(ctx, query, args...).Scan(&total)
+	if err != nil {
+		return reservations, 0, err
+	}
+
+	column, ok := reservationSorts[f.Sort]
+	if !ok {
+		column = reservationSorts["start_date"]
+	}
+	direction := "asc"
+	if f.Desc {
+		direction = "desc"
+	}
+
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	limit := arg(f.PerPage)
+	offset := arg((f.Page - 1) * f.PerPage)
+
+	query = `
+			select r.id, r.first_name, r.last_name, r.email, r.phone,
 			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
 			rm.id, rm.room_name
-
 			from reservations r
 			left join rooms rm on (r.room_id = rm.id)
-			order by r.start_date asc
-	`
+			` + conditions + `
+			order by ` + column + ` ` + direction + `, r.id ` + direction + `
+			limit ` + limit + ` offset ` + offset
 
-	rows, err := p.DB.QueryContext(ctx, query)
+	rows, err := p.conn().QueryContext(ctx, query, args...)
 	if err != nil {
-		return reservations, err
+		return reservations, total, err
 	}
 	defer rows.Close()
 
@@ -279,37 +453,193 @@ func (p *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 			&item.Room.RoomName,
 		)
 		if err != nil {
-			return reservations, err
+			return reservations, total, err
+		}
+		if err = p.openContact(&item.Email, &item.Phone); err != nil {
+			return reservations, total, err
 		}
 		reservations = append(reservations, item)
 	}
 
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return reservations, total, err
 	}
 
-	return reservations, nil
+	return reservations, total, nil
 }
 
-// AllNewReservations returns a slice of all new reservations
-func (p *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	var reservations []models.Reservation
+	var res models.Reservation
 	query := `
 			select r.id, r.first_name, r.last_name, r.email, r.phone, 
-			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at,
-			rm.id, rm.room_name
+			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed, r.room_locked,
+			r.adults, r.children, r.total_price, r.confirmation_code, r.notes, coalesce(r.guest_id, 0),
+			r.deleted_at, coalesce(r.deleted_by, 0), rm.id, rm.room_name
+			from reservations r
+			left join rooms rm on (r.room_id = rm.id)
+			where r.id = $1
+	`
+
+	// Set when the reservation is in the trash
+	var deletedAt sql.NullTime
+	row := p.conn().QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&res.ID,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomID,
+		&res.CreateAt,
+		&res.UpdateAt,
+		&res.Processed,
+		&res.RoomLocked,
+		&res.Adults,
+		&res.Children,
+		&res.TotalPrice,
+		&res.ConfirmationCode,
+		&res.Notes,
+		&res.GuestID,
+		&deletedAt,
+		&res.DeletedBy,
+
+		&res.Room.ID,
+		&res.Room.RoomName,
+	)
+
+	if err != nil {
+		return res, err
+	}
+	res.DeletedAt = deletedAt.Time
+
+	return res, p.openContact(&res.Email, &res.Phone)
+}
+
+// checkLive returns sql.ErrNoRows unless the reservation id exists out of the trash, a reservation in the
+// trash can only be restored
+func (p *postgresDBRepo) checkLive(ctx context.Context, tx dbtx, id int) error {
+	var found int
+	return tx.QueryRowContext(ctx, `select id from reservations where id = $1 and deleted_at is null`, id).Scan(&found)
+}
+
+// UpdateReservation updates the reservation info in the database
+func (p *postgresDBRepo) UpdateReservation(ctx context.Context, actor models.Actor, r models.Reservation) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	c, err := p.sealContact(r.Email, r.Phone)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.checkLive(ctx, tx, r.ID)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionUpdate, audit.EntityReservation, "reservations", r.ID, func() error {
+		query := `update reservations set first_name=$1, last_name=$2, email=$3, phone=$4, room_locked=$5, notes=$6,
+				updated_at=$7, email_index=$8, phone_index=$9
+				where id = $10`
+		_, err := tx.ExecContext(ctx, query,
+			r.FirstName,
+			r.LastName,
+			c.Email,
+			c.Phone,
+			r.RoomLocked,
+			r.Notes,
+			time.Now(),
+			c.EmailIndex,
+			c.PhoneIndex,
+			r.ID,
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteReservation moves a reservation to the trash and frees its dates, it stays there until it is
+// restored or purged
+func (p *postgresDBRepo) DeleteReservation(ctx context.Context, actor models.Actor, id int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.checkLive(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionDelete, audit.EntityReservation, "reservations", id, func() error {
+		// Keep a copy for the cancellations report
+		query := `insert into cancellations (reservation_id, first_name, last_name, email, phone, start_date, end_date,
+				room_id, booked_at, total_price, created_at, updated_at, email_index, phone_index)
+			select id, first_name, last_name, email, phone, start_date, end_date,
+				room_id, created_at, total_price, $2, $2, email_index, phone_index
+			from reservations where id = $1 and deleted_at is null
+	`
+		_, err := tx.ExecContext(ctx, query, id, time.Now())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from room_restriction where reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		query = `update reservations set deleted_at = $2, deleted_by = $3, updated_at = $2
+			where id = $1 and deleted_at is null`
+		_, err = tx.ExecContext(ctx, query, id, time.Now(), actor.UserID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TrashedReservations returns the reservations in the trash, the last deleted first
+func (p *postgresDBRepo) TrashedReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
 
+	var reservations []models.Reservation
+	query := `
+			select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+			r.created_at, r.total_price, r.confirmation_code, r.deleted_at, coalesce(r.deleted_by, 0),
+			coalesce(u.first_name || ' ' || u.last_name, ''), rm.id, rm.room_name
 			from reservations r
 			left join rooms rm on (r.room_id = rm.id)
-			where r.processed = 0
-			order by r.start_date asc
+			left join users u on (r.deleted_by = u.id)
+			where r.deleted_at is not null
+			order by r.deleted_at desc, r.id desc
 	`
 
-	rows, err := p.DB.QueryContext(ctx, query)
+	rows, err := p.conn().QueryContext(ctx, query)
 	if err != nil {
 		return reservations, err
 	}
@@ -327,14 +657,20 @@ func (p *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&item.EndDate,
 			&item.RoomID,
 			&item.CreateAt,
-			&item.UpdateAt,
-
+			&item.TotalPrice,
+			&item.ConfirmationCode,
+			&item.DeletedAt,
+			&item.DeletedBy,
+			&item.DeletedByName,
 			&item.Room.ID,
 			&item.Room.RoomName,
 		)
 		if err != nil {
 			return reservations, err
 		}
+		if err = p.openContact(&item.Email, &item.Phone); err != nil {
+			return reservations, err
+		}
 		reservations = append(reservations, item)
 	}
 
@@ -345,109 +681,111 @@ func (p *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 	return reservations, nil
 }
 
-func (p *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// RestoreReservation takes a reservation out of the trash and books its dates again, it returns
+// repository.ErrOverlap when the room was taken for some of them in the meantime
+func (p *postgresDBRepo) RestoreReservation(ctx context.Context, actor models.Actor, id int) error {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	var res models.Reservation
-	query := `
-			select r.id, r.first_name, r.last_name, r.email, r.phone, 
-			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-			rm.id, rm.room_name
-			from reservations r
-			left join rooms rm on (r.room_id = rm.id)
-			where r.id = $1
-	`
-
-	row := p.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&res.ID,
-		&res.FirstName,
-		&res.LastName,
-		&res.Email,
-		&res.Phone,
-		&res.StartDate,
-		&res.EndDate,
-		&res.RoomID,
-		&res.CreateAt,
-		&res.UpdateAt,
-		&res.Processed,
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
 
-		&res.Room.ID,
-		&res.Room.RoomName,
-	)
+	var roomID int
+	var start, end time.Time
+	err = tx.QueryRowContext(ctx, `select room_id, start_date, end_date from reservations
+			where id = $1 and deleted_at is not null`, id).Scan(&roomID, &start, &end)
+	if err != nil {
+		return err
+	}
 
+	err = p.checkRoomIsFree(ctx, tx, roomID, start, end, 0, id)
 	if err != nil {
-		return res, err
+		return err
 	}
 
-	return res, nil
-}
+	err = p.audited(ctx, tx, actor, audit.ActionRestore, audit.EntityReservation, "reservations", id, func() error {
+		query := `insert into room_restriction (start_date, end_date, room_id, reservation_id, restriction_id,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $6)`
+		_, err := tx.ExecContext(ctx, query, p.day(start), p.day(end), roomID, id, 1, time.Now())
+		if err != nil {
+			return err
+		}
 
-// UpdateReservation updates the reservation info in the database
-func (p *postgresDBRepo) UpdateReservation(r models.Reservation) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := `update reservations set first_name=$1, last_name=$2, email=$3, phone=$4, updated_at=$5
-				where id = $6`
-	_, err := p.DB.ExecContext(ctx, query,
-		r.FirstName,
-		r.LastName,
-		r.Email,
-		r.Phone,
-		time.Now(),
-		r.ID,
-	)
+		// The stay is no longer cancelled
+		_, err = tx.ExecContext(ctx, `delete from cancellations where reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `update reservations set deleted_at = null, deleted_by = null, updated_at = $2
+				where id = $1`, id, time.Now())
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-// DeleteReservation deletes a reservation by ID
-func (p *postgresDBRepo) DeleteReservation(id int) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// PurgeDeletedBefore removes for good the reservations moved to the trash before cutoff, and returns
+// how many it removed. They stay in the cancellations report.
+func (p *postgresDBRepo) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
 	defer cancel()
 
-	query := `delete from reservations where id = $1`
-	_, err := p.DB.ExecContext(ctx, query, id)
+	result, err := p.conn().ExecContext(ctx, `delete from reservations where deleted_at < $1`, cutoff)
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	return nil
+	n, err := result.RowsAffected()
+	return int(n), err
 }
 
 // UpdateProcessedForReservation updates processed-index in the database by id
-func (p *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) UpdateProcessedForReservation(ctx context.Context, actor models.Actor, id, processed int) error {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	query := `update reservations set processed = $1 where id = $2`
-	_, err := p.DB.ExecContext(ctx, query, processed, id)
+	tx, err := p.begin(ctx)
 	if err != nil {
 		return err
 	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
 
-	return nil
+	err = p.checkLive(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionProcess, audit.EntityReservation, "reservations", id, func() error {
+		query := `update reservations set processed = $1 where id = $2`
+		_, err := tx.ExecContext(ctx, query, processed, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // AllRooms returns all room from the database
-func (p *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var rooms []models.Room
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	query := `select id, room_name, room_type, max_occupancy, base_occupancy, price_per_night, extra_guest_fee,
+				created_at, updated_at from rooms order by room_name`
 
-	rows, err := p.DB.QueryContext(ctx, query)
+	rows, err := p.conn().QueryContext(ctx, query)
 	if err != nil {
 		return rooms, err
 	}
@@ -458,6 +796,11 @@ func (p *postgresDBRepo) AllRooms() ([]models.Room, error) {
 		err := rows.Scan(
 			&rm.ID,
 			&rm.RoomName,
+			&rm.RoomType,
+			&rm.MaxOccupancy,
+			&rm.BaseOccupancy,
+			&rm.PricePerNight,
+			&rm.ExtraGuestFee,
 			&rm.CreateAt,
 			&rm.UpdateAt,
 		)
@@ -474,18 +817,18 @@ func (p *postgresDBRepo) AllRooms() ([]models.Room, error) {
 	return rooms, nil
 }
 
-func (p *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (p *postgresDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
 	var restriction []models.RoomRestriction
 	// coalesce: if reservation_id is null using 0 instead
-	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date,
+		note, coalesce(block_series_id, 0)
 	from room_restriction where $1 < end_date and $2 > start_date and room_id = $3
 	`
 
-	rows, err := p.DB.QueryContext(ctx, query, start, end, roomID)
+	rows, err := p.conn().QueryContext(ctx, query, p.day(start), p.day(end), roomID)
 	if err != nil {
 		return nil, err
 	}
@@ -500,6 +843,8 @@ func (p *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 			&r.RoomID,
 			&r.StartDate,
 			&r.EndDate,
+			&r.Note,
+			&r.SeriesID,
 		)
 		if err != nil {
 			return nil, err
@@ -513,38 +858,1708 @@ func (p *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 	return restriction, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (p *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertBlockForRoom inserts an owner block from r.StartDate to r.EndDate, it returns repository.ErrOverlap
+// when the room is not free for the whole range
+func (p *postgresDBRepo) InsertBlockForRoom(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	query := `insert into room_restriction (start_date, end_date, room_id, restriction_id, created_at, updated_at)
-				values ($1, $2, $3, $4, $5, $6)
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.checkRoomIsFree(ctx, tx, r.RoomID, r.StartDate, r.EndDate, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into room_restriction (start_date, end_date, room_id, restriction_id, note, created_at, updated_at)
+				values ($1, $2, $3, $4, $5, $6, $7) returning id
 	`
 
-	_, err := p.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	var id int
+	err = tx.QueryRowContext(ctx, query, p.day(r.StartDate), p.day(r.EndDate), r.RoomID, 2, r.Note, time.Now(),
+		time.Now()).Scan(&id)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 
-	return nil
+	after, err := p.rowState(ctx, tx, "room_restriction", id)
+	if err != nil {
+		return err
+	}
+	err = insertAudit(ctx, tx, actor, audit.ActionCreate, audit.EntityBlock, id, nil, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// DeleteBlockByID deletes a room restriction
-func (p *postgresDBRepo) DeleteBlockByID(id int) error {
-	// Context, if for any reasons that Insert not complete within 3 seconds, cancel connection
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetBlockByID returns an owner block with its room
+func (p *postgresDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	ctx, cancel := p.withTimeout(ctx)
 	defer cancel()
 
-	query := `delete from room_restriction where id = $1`
+	var b models.RoomRestriction
+	query := `select rr.id, rr.start_date, rr.end_date, rr.room_id, rr.restriction_id, rr.note,
+				coalesce(rr.block_series_id, 0), rr.created_at, rr.updated_at, rm.id, rm.room_name
+			from room_restriction rr
+			left join rooms rm on (rr.room_id = rm.id)
+			where rr.id = $1 and rr.reservation_id is null
+	`
 
-	_, err := p.DB.ExecContext(ctx, query, id)
+	row := p.conn().QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&b.ID,
+		&b.StartDate,
+		&b.EndDate,
+		&b.RoomID,
+		&b.RestrictionID,
+		&b.Note,
+		&b.SeriesID,
+		&b.CreateAt,
+		&b.UpdateAt,
+		&b.Room.ID,
+		&b.Room.RoomName,
+	)
+	if err != nil {
+		return b, err
+	}
+
+	return b, nil
+}
+
+// UpdateBlock changes the dates and the note of an owner block, it returns repository.ErrOverlap
+// when the new dates run into another reservation or block of the room
+func (p *postgresDBRepo) UpdateBlock(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
 
-	return nil
+	err = p.checkRoomIsFree(ctx, tx, r.RoomID, r.StartDate, r.EndDate, r.ID, 0)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionUpdate, audit.EntityBlock, "room_restriction", r.ID, func() error {
+		query := `update room_restriction set start_date = $1, end_date = $2, note = $3, updated_at = $4
+			where id = $5 and reservation_id is null
+	`
+		_, err := tx.ExecContext(ctx, query, p.day(r.StartDate), p.day(r.EndDate), r.Note, time.Now(), r.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkRoomIsFree locks the room until the transaction ends and returns repository.ErrOverlap when
+// a restriction other than the one being changed (exceptID, or the ones of exceptReservationID) overlaps the range
+func (p *postgresDBRepo) checkRoomIsFree(ctx context.Context, tx dbtx, roomID int, start, end time.Time,
+	exceptID, exceptReservationID int) error {
+	// Two admins dragging into the same room at once are served one after the other. SQLite transactions
+	// take the write lock as they begin, which serves every writer that way.
+	if !p.sqlite {
+		_, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, roomID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var numRows int
+	query := `select count(id) from room_restriction
+			where room_id = $1 and $2 < end_date and $3 > start_date
+			and id <> $4 and (reservation_id is null or reservation_id <> $5)
+	`
+	err := tx.QueryRowContext(ctx, query, roomID, p.day(start), p.day(end), exceptID, exceptReservationID).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+	if numRows > 0 {
+		return repository.ErrOverlap
+	}
+
+	return nil
+}
+
+// DeleteBlockByID deletes an owner block, it returns sql.ErrNoRows when id is not one, the restriction
+// of a reservation included
+func (p *postgresDBRepo) DeleteBlockByID(ctx context.Context, actor models.Actor, id int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.audited(ctx, tx, actor, audit.ActionDelete, audit.EntityBlock, "room_restriction", id, func() error {
+		query := `delete from room_restriction where id = $1 and reservation_id is null`
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRestrictionsByDate returns the restrictions of every room overlapping the date range,
+// reservations come with the guest name and the room lock flag
+func (p *postgresDBRepo) GetRestrictionsByDate(ctx context.Context, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+	query := `select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, rr.start_date, rr.end_date,
+				coalesce(r.first_name, ''), coalesce(r.last_name, ''), coalesce(r.room_locked, false),
+				rr.note, coalesce(rr.block_series_id, 0)
+			from room_restriction rr
+			left join reservations r on (rr.reservation_id = r.id)
+			where $1 < rr.end_date and $2 > rr.start_date
+			order by rr.room_id, rr.start_date
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query, p.day(start), p.day(end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.Reservation.FirstName,
+			&r.Reservation.LastName,
+			&r.Reservation.RoomLocked,
+			&r.Note,
+			&r.SeriesID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.Reservation.ID = r.ReservationID
+		r.Reservation.RoomID = r.RoomID
+		r.Reservation.StartDate = r.StartDate
+		r.Reservation.EndDate = r.EndDate
+		restrictions = append(restrictions, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// UpdateRoomForReservation moves a reservation and its room restriction into another room, it returns
+// repository.ErrOverlap when the room is not free for the stay
+func (p *postgresDBRepo) UpdateRoomForReservation(ctx context.Context, actor models.Actor, id, roomID int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	var start, end time.Time
+	err = tx.QueryRowContext(ctx, `select start_date, end_date from reservations where id = $1 and deleted_at is null`,
+		id).Scan(&start, &end)
+	if err != nil {
+		return err
+	}
+
+	err = p.checkRoomIsFree(ctx, tx, roomID, start, end, 0, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionMove, audit.EntityReservation, "reservations", id, func() error {
+		_, err := tx.ExecContext(ctx, `update reservations set room_id = $1, updated_at = $2 where id = $3`,
+			roomID, time.Now(), id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update room_restriction set room_id = $1, updated_at = $2 where reservation_id = $3`,
+		roomID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MoveReservation moves a reservation to another room and dates at its new total price in one transaction,
+// it returns repository.ErrOverlap when the room is not free for the whole stay
+func (p *postgresDBRepo) MoveReservation(ctx context.Context, actor models.Actor, id, roomID int, start, end time.Time, totalPrice int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.checkLive(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.checkRoomIsFree(ctx, tx, roomID, start, end, 0, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionMove, audit.EntityReservation, "reservations", id, func() error {
+		_, err := tx.ExecContext(ctx, `update reservations set room_id = $1, start_date = $2, end_date = $3,
+				total_price = $4, updated_at = $5
+			where id = $6`,
+			roomID, p.day(start), p.day(end), totalPrice, time.Now(), id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update room_restriction set room_id = $1, start_date = $2, end_date = $3, updated_at = $4
+			where reservation_id = $5`,
+		roomID, p.day(start), p.day(end), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// scanStayRules reads the rows of a stay_rules query joined with rooms
+func scanStayRules(rows *sql.Rows) ([]models.StayRule, error) {
+	var rules []models.StayRule
+	for rows.Next() {
+		var r models.StayRule
+		err := rows.Scan(
+			&r.ID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.MinNights,
+			&r.MaxNights,
+			&r.ClosedToArrival,
+			&r.ClosedToDeparture,
+			&r.MinAdvanceDays,
+			&r.MaxAdvanceDays,
+			&r.CreateAt,
+			&r.UpdateAt,
+			&r.Room.ID,
+			&r.Room.RoomName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// GetStayRulesByDate returns the stay rules of every room that apply to an arrival date
+func (p *postgresDBRepo) GetStayRulesByDate(ctx context.Context, arrival time.Time) ([]models.StayRule, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `select s.id, s.room_id, s.start_date, s.end_date, s.min_nights, s.max_nights,
+				s.closed_to_arrival, s.closed_to_departure, s.min_advance_days, s.max_advance_days,
+				s.created_at, s.updated_at, rm.id, rm.room_name
+			from stay_rules s
+			left join rooms rm on (s.room_id = rm.id)
+			where s.start_date <= $1 and s.end_date >= $1
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query, p.day(arrival))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanStayRules(rows)
+}
+
+// AllStayRules returns every stay rule
+func (p *postgresDBRepo) AllStayRules(ctx context.Context) ([]models.StayRule, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `select s.id, s.room_id, s.start_date, s.end_date, s.min_nights, s.max_nights,
+				s.closed_to_arrival, s.closed_to_departure, s.min_advance_days, s.max_advance_days,
+				s.created_at, s.updated_at, rm.id, rm.room_name
+			from stay_rules s
+			left join rooms rm on (s.room_id = rm.id)
+			order by rm.room_name, s.start_date
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanStayRules(rows)
+}
+
+// InsertStayRule inserts a stay rule for a room
+func (p *postgresDBRepo) InsertStayRule(ctx context.Context, actor models.Actor, r models.StayRule) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	query := `insert into stay_rules (room_id, start_date, end_date, min_nights, max_nights,
+				closed_to_arrival, closed_to_departure, min_advance_days, max_advance_days, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id
+	`
+
+	var id int
+	err = tx.QueryRowContext(ctx, query,
+		r.RoomID,
+		p.day(r.StartDate),
+		p.day(r.EndDate),
+		r.MinNights,
+		r.MaxNights,
+		r.ClosedToArrival,
+		r.ClosedToDeparture,
+		r.MinAdvanceDays,
+		r.MaxAdvanceDays,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	after, err := p.rowState(ctx, tx, "stay_rules", id)
+	if err != nil {
+		return err
+	}
+	err = insertAudit(ctx, tx, actor, audit.ActionCreate, audit.EntityStayRule, id, nil, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteStayRule deletes a stay rule by id
+func (p *postgresDBRepo) DeleteStayRule(ctx context.Context, actor models.Actor, id int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.audited(ctx, tx, actor, audit.ActionDelete, audit.EntityStayRule, "stay_rules", id, func() error {
+		_, err := tx.ExecContext(ctx, `delete from stay_rules where id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AllBlockSeries returns every recurring owner block with its room
+func (p *postgresDBRepo) AllBlockSeries(ctx context.Context) ([]models.BlockSeries, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var series []models.BlockSeries
+	query := `select s.id, s.room_id, s.start_date, s.end_date, s.frequency, s.until_date, s.note,
+				s.created_at, s.updated_at, rm.id, rm.room_name
+			from block_series s
+			left join rooms rm on (s.room_id = rm.id)
+			order by rm.room_name, s.start_date
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query)
+	if err != nil {
+		return series, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.BlockSeries
+		err := rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.StartDate,
+			&s.EndDate,
+			&s.Frequency,
+			&s.UntilDate,
+			&s.Note,
+			&s.CreateAt,
+			&s.UpdateAt,
+			&s.Room.ID,
+			&s.Room.RoomName,
+		)
+		if err != nil {
+			return series, err
+		}
+		series = append(series, s)
+	}
+	if err = rows.Err(); err != nil {
+		return series, err
+	}
+
+	return series, nil
+}
+
+// InsertBlockSeries inserts a recurring owner block and the blocks of its occurrences in one transaction,
+// it returns repository.ErrOverlap when the room is not free for one of them
+func (p *postgresDBRepo) InsertBlockSeries(ctx context.Context, actor models.Actor, s models.BlockSeries, blocks []models.RoomRestriction) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	var seriesID int
+	query := `insert into block_series (room_id, start_date, end_date, frequency, until_date, note, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id
+	`
+	err = tx.QueryRowContext(ctx, query,
+		s.RoomID,
+		p.day(s.StartDate),
+		p.day(s.EndDate),
+		s.Frequency,
+		p.day(s.UntilDate),
+		s.Note,
+		time.Now(),
+		time.Now(),
+	).Scan(&seriesID)
+	if err != nil {
+		return err
+	}
+
+	query = `insert into room_restriction (start_date, end_date, room_id, restriction_id, note, block_series_id,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	for _, b := range blocks {
+		err = p.checkRoomIsFree(ctx, tx, b.RoomID, b.StartDate, b.EndDate, 0, 0)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, p.day(b.StartDate), p.day(b.EndDate), b.RoomID, 2, b.Note, seriesID,
+			time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	after, err := p.rowState(ctx, tx, "block_series", seriesID)
+	if err != nil {
+		return err
+	}
+	err = insertAudit(ctx, tx, actor, audit.ActionCreate, audit.EntityBlockSeries, seriesID, nil, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteBlockSeries deletes a recurring owner block and every block it created, it returns sql.ErrNoRows
+// when there is no such series
+func (p *postgresDBRepo) DeleteBlockSeries(ctx context.Context, actor models.Actor, id int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from room_restriction where block_series_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.audited(ctx, tx, actor, audit.ActionDelete, audit.EntityBlockSeries, "block_series", id, func() error {
+		result, err := tx.ExecContext(ctx, `delete from block_series where id = $1`, id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ArrivalsOn returns the reservations starting on day
+func (p *postgresDBRepo) ArrivalsOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	return p.reservationsOnDay(ctx, "r.start_date", day)
+}
+
+// DeparturesOn returns the reservations ending on day
+func (p *postgresDBRepo) DeparturesOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	return p.reservationsOnDay(ctx, "r.end_date", day)
+}
+
+// reservationsOnDay returns the reservations whose date column is day
+func (p *postgresDBRepo) reservationsOnDay(ctx context.Context, column string, day time.Time) ([]models.Reservation, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var reservations []models.Reservation
+	query := `
+			select r.id, r.first_name, r.last_name, r.email, r.phone,
+			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
+			rm.id, rm.room_name
+			from reservations r
+			left join rooms rm on (r.room_id = rm.id)
+			where ` + column + ` = $1 and r.deleted_at is null
+			order by rm.room_name, r.last_name
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query, p.day(day))
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.Reservation
+		err := rows.Scan(
+			&item.ID,
+			&item.FirstName,
+			&item.LastName,
+			&item.Email,
+			&item.Phone,
+			&item.StartDate,
+			&item.EndDate,
+			&item.RoomID,
+			&item.CreateAt,
+			&item.UpdateAt,
+			&item.Processed,
+
+			&item.Room.ID,
+			&item.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		if err = p.openContact(&item.Email, &item.Phone); err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// DashboardStats sums up the reservations arriving from start to end (excluded)
+func (p *postgresDBRepo) DashboardStats(ctx context.Context, start, end time.Time) (models.DashboardStats, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var stats models.DashboardStats
+	query := `
+			select count(*),
+			count(*) filter (where processed = 0),
+			count(*) filter (where processed = 1),
+			coalesce(avg(end_date - start_date), 0)::float8,
+			coalesce(avg(start_date - created_at::date), 0)::float8,
+			count(*) filter (where total_price > 0),
+			coalesce(sum(total_price), 0)
+			from reservations
+			where start_date >= $1 and start_date < $2 and deleted_at is null
+	`
+	if p.sqlite {
+		query = sqliteDashboardStats
+	}
+
+	err := p.conn().QueryRowContext(ctx, query, p.day(start), p.day(end)).Scan(
+		&stats.Reservations,
+		&stats.New,
+		&stats.Processed,
+		&stats.AverageStay,
+		&stats.AverageLeadTime,
+		&stats.PricedReservations,
+		&stats.Revenue,
+	)
+
+	return stats, err
+}
+
+// OccupancyByMonth counts the booked nights of every room in every month from start to end (excluded).
+// The first and last months only count the nights inside the range.
+func (p *postgresDBRepo) OccupancyByMonth(ctx context.Context, start, end time.Time) ([]models.RoomOccupancy, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var occupancy []models.RoomOccupancy
+	query := `
+			with months as (
+				select m::date as month,
+				greatest(m, $1::date)::date as first_night,
+				least(m + interval '1 month', $2::date)::date as last_night
+				from generate_series(date_trunc('month', $1::date), $2::date - 1, interval '1 month') as m
+			)
+			select rm.id, rm.room_name, mo.month, mo.last_night - mo.first_night,
+			coalesce(sum(least(rr.end_date, mo.last_night) - greatest(rr.start_date, mo.first_night)), 0)
+			from rooms rm
+			cross join months mo
+			left join room_restriction rr on (rr.room_id = rm.id and rr.restriction_id = 1
+				and rr.start_date < mo.last_night and rr.end_date > mo.first_night)
+			group by rm.id, rm.room_name, mo.month, mo.first_night, mo.last_night
+			order by rm.room_name, mo.month
+	`
+	if p.sqlite {
+		query = sqliteOccupancyByMonth
+	}
+
+	rows, err := p.conn().QueryContext(ctx, query, p.day(start), p.day(end))
+	if err != nil {
+		return occupancy, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.RoomOccupancy
+		err := rows.Scan(
+			&item.RoomID,
+			&item.RoomName,
+			dateValue{&item.Month},
+			&item.Nights,
+			&item.BookedNights,
+		)
+		if err != nil {
+			return occupancy, err
+		}
+		occupancy = append(occupancy, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return occupancy, err
+	}
+
+	return occupancy, nil
+}
+
+// reportTimeout bounds a report export, rows are streamed to the client while the query runs
+const reportTimeout = 2 * time.Minute
+
+// reportRooms adds the room filter of a report to a query whose first arguments are args
+func reportRooms(column string, f models.ReportFilter, args []interface{}) (string, []interface{}) {
+	if len(f.RoomIDs) == 0 {
+		return "", args
+	}
+
+	placeholders := make([]string, 0, len(f.RoomIDs))
+	for _, id := range f.RoomIDs {
+		args = append(args, id)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	return fmt.Sprintf(" and %s in (%s)", column, strings.Join(placeholders, ", ")), args
+}
+
+// EachReservation calls fn for every reservation staying from f.Start to f.End, or booked then
+// when f.ByBookingDate is set, without loading them all
+func (p *postgresDBRepo) EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	where := `r.start_date < $2 and r.end_date > $1`
+	order := `r.start_date, r.id`
+	args := []interface{}{p.day(f.Start), p.day(f.End)}
+	if f.ByBookingDate {
+		where = `r.created_at >= $1 and r.created_at < $2`
+		order = `r.created_at, r.id`
+		args = []interface{}{f.Start, f.End}
+	}
+	rooms, args := reportRooms("r.room_id", f, args)
+
+	query := `
+			select r.id, r.first_name, r.last_name, r.email, r.phone,
+			r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
+			r.adults, r.children, r.total_price,
+			rm.id, rm.room_name
+			from reservations r
+			left join rooms rm on (r.room_id = rm.id)
+			where r.deleted_at is null and ` + where + rooms + `
+			order by ` + order
+
+	rows, err := p.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.Reservation
+		err := rows.Scan(
+			&item.ID,
+			&item.FirstName,
+			&item.LastName,
+			&item.Email,
+			&item.Phone,
+			&item.StartDate,
+			&item.EndDate,
+			&item.RoomID,
+			&item.CreateAt,
+			&item.UpdateAt,
+			&item.Processed,
+			&item.Adults,
+			&item.Children,
+			&item.TotalPrice,
+
+			&item.Room.ID,
+			&item.Room.RoomName,
+		)
+		if err != nil {
+			return err
+		}
+		if err = p.openContact(&item.Email, &item.Phone); err != nil {
+			return err
+		}
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachCancellation calls fn for every reservation cancelled from f.Start to f.End
+func (p *postgresDBRepo) EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	rooms, args := reportRooms("c.room_id", f, []interface{}{f.Start, f.End})
+	query := `
+			select c.id, c.reservation_id, c.first_name, c.last_name, c.email, c.phone,
+			c.start_date, c.end_date, c.room_id, c.booked_at, c.total_price, c.created_at, c.updated_at,
+			coalesce(rm.room_name, '')
+			from cancellations c
+			left join rooms rm on (c.room_id = rm.id)
+			where c.created_at >= $1 and c.created_at < $2` + rooms + `
+			order by c.created_at, c.id`
+
+	rows, err := p.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.Cancellation
+		err := rows.Scan(
+			&item.ID,
+			&item.ReservationID,
+			&item.FirstName,
+			&item.LastName,
+			&item.Email,
+			&item.Phone,
+			&item.StartDate,
+			&item.EndDate,
+			&item.RoomID,
+			&item.BookedAt,
+			&item.TotalPrice,
+			&item.CreateAt,
+			&item.UpdateAt,
+			&item.Room.RoomName,
+		)
+		if err != nil {
+			return err
+		}
+		if err = p.openContact(&item.Email, &item.Phone); err != nil {
+			return err
+		}
+		item.Room.ID = item.RoomID
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachBlock calls fn for every owner block overlapping f.Start to f.End
+func (p *postgresDBRepo) EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	rooms, args := reportRooms("rr.room_id", f, []interface{}{p.day(f.Start), p.day(f.End)})
+	query := `
+			select rr.id, rr.start_date, rr.end_date, rr.room_id, rr.note, coalesce(rr.block_series_id, 0),
+			rm.room_name
+			from room_restriction rr
+			left join rooms rm on (rr.room_id = rm.id)
+			where rr.restriction_id = 2 and rr.start_date < $2 and rr.end_date > $1` + rooms + `
+			order by rr.start_date, rr.id`
+
+	rows, err := p.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.RoomRestriction
+		err := rows.Scan(
+			&item.ID,
+			&item.StartDate,
+			&item.EndDate,
+			&item.RoomID,
+			&item.Note,
+			&item.SeriesID,
+			&item.Room.RoomName,
+		)
+		if err != nil {
+			return err
+		}
+		item.RestrictionID = 2
+		item.Room.ID = item.RoomID
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// SearchReservations looks for text in the guest fields, confirmation codes, notes and room names of the
+// reservations, arriving in month when it isn't 0. It returns up to limit reservations per kind of match,
+// codes first then guests, notes and rooms, the closest first.
+func (p *postgresDBRepo) SearchReservations(ctx context.Context, text string, month time.Month, limit int) ([]models.SearchResult, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var results []models.SearchResult
+	// Each kind of hit filters the candidates its own way, not materialized lets every branch run on the
+	// reservations with its own index rather than scan one copy of them all
+	query := `
+			with candidates as not materialized (
+				select * from reservations
+				where deleted_at is null and ($4 = 0 or extract(month from start_date) = $4)
+			), hits as (
+				select 'code' as kind, c.id, 1.0::float8 as rank, '' as snippet
+				from candidates c
+				where c.confirmation_code ilike $2 || '%'
+				union all
+				select 'guest', c.id, case when c.email_index = $5 or c.phone_index = $6 then 1.0::float8
+					else similarity(c.first_name || ' ' || c.last_name, $1) end, ''
+				from candidates c
+				where (c.first_name || ' ' || c.last_name) % $1
+					or (c.first_name || ' ' || c.last_name) ilike '%' || $2 || '%'
+					or c.email_index = $5 or (c.phone_index = $6 and c.phone_index <> '')
+				union all
+				select 'notes', c.id, ts_rank(to_tsvector('simple', c.notes), plainto_tsquery('simple', $1)),
+					ts_headline('simple', c.notes, plainto_tsquery('simple', $1), 'StartSel=[, StopSel=], MaxFragments=1')
+				from candidates c
+				where to_tsvector('simple', c.notes) @@ plainto_tsquery('simple', $1)
+				union all
+				select 'room', c.id, similarity(rm.room_name, $1), ''
+				from candidates c
+				join rooms rm on (c.room_id = rm.id)
+				where rm.room_name % $1 or rm.room_name ilike '%' || $2 || '%'
+			), ranked as (
+				select h.*, row_number() over (partition by h.kind order by h.rank desc, h.id desc) as n
+				from hits h
+			)
+			select ranked.kind, ranked.rank, ranked.snippet,
+			r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+			r.processed, r.confirmation_code,
+			rm.id, rm.room_name
+			from ranked
+			join reservations r on (r.id = ranked.id)
+			left join rooms rm on (r.room_id = rm.id)
+			where ranked.n <= $3
+			order by case ranked.kind when 'code' then 1 when 'guest' then 2 when 'notes' then 3 else 4 end,
+				ranked.rank desc, r.id desc
+	`
+	if p.sqlite {
+		query = sqliteSearchReservations
+	}
+
+	// Emails and phones may be encrypted, they match as a whole through their blind index
+	rows, err := p.conn().QueryContext(ctx, query, text, likeEscaper.Replace(text), limit, int(month),
+		p.Crypt.Index(guests.NormalizeEmail(text)), p.Crypt.Index(guests.NormalizePhone(text)))
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.SearchResult
+		err := rows.Scan(
+			&item.Kind,
+			&item.Rank,
+			&item.Snippet,
+			&item.Reservation.ID,
+			&item.Reservation.FirstName,
+			&item.Reservation.LastName,
+			&item.Reservation.Email,
+			&item.Reservation.Phone,
+			&item.Reservation.StartDate,
+			&item.Reservation.EndDate,
+			&item.Reservation.RoomID,
+			&item.Reservation.Processed,
+			&item.Reservation.ConfirmationCode,
+
+			&item.Reservation.Room.ID,
+			&item.Reservation.Room.RoomName,
+		)
+		if err != nil {
+			return results, err
+		}
+		if err = p.openContact(&item.Reservation.Email, &item.Reservation.Phone); err != nil {
+			return results, err
+		}
+		results = append(results, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// guestColumns are the columns read by scanGuest, with the figures of the reservations of the guest
+// joined as r
+func (p *postgresDBRepo) guestColumns() string {
+	return `g.id, g.first_name, g.last_name, g.email, g.phone, g.notes, g.tags, g.created_at, g.updated_at,
+			count(r.id), coalesce(sum(` + p.nights("r.start_date", "r.end_date") + `), 0), coalesce(sum(r.total_price), 0)`
+}
+
+// scanGuest reads a row of guestColumns
+func (p *postgresDBRepo) scanGuest(row interface{ Scan(...interface{}) error }) (models.Guest, error) {
+	var g models.Guest
+	var tags string
+	err := row.Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.Notes,
+		&tags,
+		&g.CreateAt,
+		&g.UpdateAt,
+		&g.Stays,
+		&g.Nights,
+		&g.LifetimeValue,
+	)
+	if err != nil {
+		return g, err
+	}
+	if tags != "" {
+		g.Tags = strings.Split(tags, ",")
+	}
+	return g, p.openContact(&g.Email, &g.Phone)
+}
+
+// queryGuests runs a query selecting guestColumns
+func (p *postgresDBRepo) queryGuests(ctx context.Context, query string, args ...interface{}) ([]models.Guest, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var list []models.Guest
+	rows, err := p.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := p.scanGuest(rows)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, g)
+	}
+
+	if err = rows.Err(); err != nil {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// AllGuests returns up to limit guests whose name contains text or whose email or phone is text, every guest
+// for an empty text
+func (p *postgresDBRepo) AllGuests(ctx context.Context, text string, limit int) ([]models.Guest, error) {
+	query := `select ` + p.guestColumns() + `
+			from guests g
+			left join reservations r on (r.guest_id = g.id and r.deleted_at is null)
+			where $1 = '' or ` + p.ilike(`(g.first_name || ' ' || g.last_name)`, `'%' || $1 || '%'`) + `
+				or g.email_index = $3 or (g.phone_index = $4 and g.phone_index <> '')
+			group by g.id
+			order by g.last_name, g.first_name, g.id
+			limit $2`
+
+	return p.queryGuests(ctx, query, likeEscaper.Replace(text), limit,
+		p.Crypt.Index(guests.NormalizeEmail(text)), p.Crypt.Index(guests.NormalizePhone(text)))
+}
+
+// GetGuestByID returns a guest with the figures of its reservations
+func (p *postgresDBRepo) GetGuestByID(ctx context.Context, id int) (models.Guest, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + p.guestColumns() + `
+			from guests g
+			left join reservations r on (r.guest_id = g.id and r.deleted_at is null)
+			where g.id = $1
+			group by g.id`
+
+	return p.scanGuest(p.conn().QueryRowContext(ctx, query, id))
+}
+
+// GuestDuplicates returns the other guests with the same email, phone or name as the guest id
+func (p *postgresDBRepo) GuestDuplicates(ctx context.Context, id int) ([]models.Guest, error) {
+	query := `select ` + p.guestColumns() + `
+			from guests g
+			join guests o on (o.id = $1 and g.id <> o.id and (
+				(g.email_index = o.email_index and o.email_index <> '')
+				or (g.phone_index = o.phone_index and o.phone_index <> '')
+				or (lower(g.first_name || ' ' || g.last_name) = lower(o.first_name || ' ' || o.last_name))))
+			left join reservations r on (r.guest_id = g.id and r.deleted_at is null)
+			group by g.id
+			order by g.id`
+
+	return p.queryGuests(ctx, query, id)
+}
+
+// GuestReservations returns the reservations of a guest, the latest stay first
+func (p *postgresDBRepo) GuestReservations(ctx context.Context, guestID int) ([]models.Reservation, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var reservations []models.Reservation
+	query := `
+			select r.id, r.start_date, r.end_date, r.room_id, r.created_at, r.processed, r.adults, r.children,
+			r.total_price, r.confirmation_code, rm.id, rm.room_name
+			from reservations r
+			left join rooms rm on (r.room_id = rm.id)
+			where r.guest_id = $1 and r.deleted_at is null
+			order by r.start_date desc
+	`
+
+	rows, err := p.conn().QueryContext(ctx, query, guestID)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.Reservation
+		err := rows.Scan(
+			&item.ID,
+			&item.StartDate,
+			&item.EndDate,
+			&item.RoomID,
+			&item.CreateAt,
+			&item.Processed,
+			&item.Adults,
+			&item.Children,
+			&item.TotalPrice,
+			&item.ConfirmationCode,
+			&item.Room.ID,
+			&item.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		item.GuestID = guestID
+		reservations = append(reservations, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// UpdateGuest saves the details, notes and tags of a guest, it returns repository.ErrGuestEmailTaken
+// when another guest has the email
+func (p *postgresDBRepo) UpdateGuest(ctx context.Context, actor models.Actor, g models.Guest) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	err = p.updateGuest(ctx, tx, actor, g)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateGuest saves a guest in tx, it returns repository.ErrGuestEmailTaken when another guest has the email
+func (p *postgresDBRepo) updateGuest(ctx context.Context, tx dbtx, actor models.Actor, g models.Guest) error {
+	c, err := p.sealContact(g.Email, g.Phone)
+	if err != nil {
+		return err
+	}
+
+	var taken int
+	err = tx.QueryRowContext(ctx, `select count(id) from guests where email_index = $1 and $1 <> '' and id <> $2`,
+		c.EmailIndex, g.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return repository.ErrGuestEmailTaken
+	}
+
+	return p.audited(ctx, tx, actor, audit.ActionUpdate, audit.EntityGuest, "guests", g.ID, func() error {
+		query := `update guests set first_name = $1, last_name = $2, email = $3, phone = $4, email_index = $5,
+				phone_index = $6, notes = $7, tags = $8, updated_at = $9
+			where id = $10`
+		_, err := tx.ExecContext(ctx, query,
+			g.FirstName,
+			g.LastName,
+			c.Email,
+			c.Phone,
+			c.EmailIndex,
+			c.PhoneIndex,
+			g.Notes,
+			strings.Join(g.Tags, ","),
+			time.Now(),
+			g.ID,
+		)
+		return err
+	})
+}
+
+// MergeGuests moves the reservations of the guest duplicateID to keep, saves keep and deletes the duplicate
+func (p *postgresDBRepo) MergeGuests(ctx context.Context, actor models.Actor, keep models.Guest, duplicateID int) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update reservations set guest_id = $1 where guest_id = $2`, keep.ID, duplicateID)
+	if err != nil {
+		return err
+	}
+
+	// The duplicate goes first, keep may take its email
+	err = p.audited(ctx, tx, actor, audit.ActionMerge, audit.EntityGuest, "guests", duplicateID, func() error {
+		_, err := tx.ExecContext(ctx, `delete from guests where id = $1`, duplicateID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.updateGuest(ctx, tx, actor, keep)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetReservationByCode returns the reservation with a confirmation code
+func (p *postgresDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var id int
+	err := p.conn().QueryRowContext(ctx, `select id from reservations where confirmation_code = $1 and deleted_at is null`,
+		strings.ToUpper(strings.TrimSpace(code))).Scan(&id)
+	if err != nil {
+		return models.Reservation{}, err
+	}
+
+	return p.GetReservationByID(ctx, id)
+}
+
+// InsertGuestAccount adds an unverified guest account. An account without a guest is matched to the guest
+// profile of its email, never of its phone as nobody checks the phone, a.Guest being used for a new guest. It returns repository.ErrEmailTaken when the
+// email already has an account.
+func (p *postgresDBRepo) InsertGuestAccount(ctx context.Context, a models.GuestAccount) (int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	index := p.Crypt.Index(guests.NormalizeEmail(a.Email))
+	email, err := p.Crypt.Encrypt(a.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	var taken int
+	err = tx.QueryRowContext(ctx, `select count(id) from guest_accounts where email_index = $1`, index).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, repository.ErrEmailTaken
+	}
+
+	if a.GuestID == 0 {
+		a.GuestID, err = p.matchGuest(ctx, tx, &models.Reservation{
+			FirstName: a.Guest.FirstName,
+			LastName:  a.Guest.LastName,
+			Email:     a.Email,
+			Phone:     a.Guest.Phone,
+		}, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	query := `insert into guest_accounts (guest_id, email, email_index, password, verify_token, verify_expires,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+	var newID int
+	err = tx.QueryRowContext(ctx, query,
+		a.GuestID,
+		email,
+		index,
+		a.Password,
+		a.VerifyToken,
+		a.VerifyExpires,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// GetGuestAccountByID returns a guest account with its guest profile
+func (p *postgresDBRepo) GetGuestAccountByID(ctx context.Context, id int) (models.GuestAccount, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var a models.GuestAccount
+	query := `select id, guest_id, email, password, verified, created_at, updated_at
+			from guest_accounts where id = $1`
+	err := p.conn().QueryRowContext(ctx, query, id).Scan(
+		&a.ID,
+		&a.GuestID,
+		&a.Email,
+		&a.Password,
+		&a.Verified,
+		&a.CreateAt,
+		&a.UpdateAt,
+	)
+	if err != nil {
+		return a, err
+	}
+	a.Email, err = p.Crypt.Decrypt(a.Email)
+	if err != nil {
+		return a, err
+	}
+
+	a.Guest, err = p.GetGuestByID(ctx, a.GuestID)
+	return a, err
+}
+
+// AuthenticateGuest returns the guest account of email when testPassword is its password,
+// verified or not
+func (p *postgresDBRepo) AuthenticateGuest(ctx context.Context, email, testPassword string) (models.GuestAccount, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+	row := p.conn().QueryRowContext(ctx, "select id, password from guest_accounts where email_index = $1",
+		p.Crypt.Index(guests.NormalizeEmail(email)))
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return models.GuestAccount{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return models.GuestAccount{}, errors.New("incorrect password")
+	} else if err != nil {
+		return models.GuestAccount{}, err
+	}
+
+	return p.GetGuestAccountByID(ctx, id)
+}
+
+// SetGuestAccountToken replaces the verification token of a guest account
+func (p *postgresDBRepo) SetGuestAccountToken(ctx context.Context, id int, token string, expires time.Time) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `update guest_accounts set verify_token = $1, verify_expires = $2, updated_at = $3 where id = $4`
+	_, err := p.conn().ExecContext(ctx, query, token, expires, time.Now(), id)
+	return err
+}
+
+// VerifyGuestAccount marks the account of a verification token as verified and returns its id. The token
+// can be used once, repository.ErrInvalidToken is returned for an unknown or expired token.
+func (p *postgresDBRepo) VerifyGuestAccount(ctx context.Context, token string) (int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var id int
+	query := `update guest_accounts set verified = true, verify_token = null, verify_expires = null, updated_at = $1
+			where verify_token = $2 and verify_expires > $1
+			returning id`
+	err := p.conn().QueryRowContext(ctx, query, time.Now(), token).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	}
+
+	return id, err
+}
+
+// InsertSentEmail keeps a copy of an email sent to a guest, its address and content encrypted
+func (p *postgresDBRepo) InsertSentEmail(ctx context.Context, m models.MailData) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	to, err := p.Crypt.Encrypt(m.To)
+	if err != nil {
+		return err
+	}
+	content, err := p.Crypt.Encrypt(m.Content)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into sent_emails (to_address, email_index, subject, content, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+	_, err = p.conn().ExecContext(ctx, query,
+		to,
+		p.Crypt.Index(guests.NormalizeEmail(m.To)),
+		m.Subject,
+		content,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// personalReservations selects the reservations made with an email, or by the guest profiles of that email,
+// $1 being the blind index of the email
+const personalReservations = `(email_index = $1
+			or guest_id in (select id from guests where email_index = $1))`
+
+// PersonalData returns everything held about an email: guest profiles, accounts, reservations,
+// cancellations and the emails sent to it
+func (p *postgresDBRepo) PersonalData(ctx context.Context, email string) (models.PersonalData, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	email = guests.NormalizeEmail(email)
+	index := p.Crypt.Index(email)
+	data := models.PersonalData{Email: email}
+
+	var err error
+	data.Guests, err = p.queryGuests(ctx, `select `+p.guestColumns()+`
+			from guests g
+			left join reservations r on (r.guest_id = g.id and r.deleted_at is null)
+			where g.email_index = $1
+			group by g.id
+			order by g.id`, index)
+	if err != nil {
+		return data, err
+	}
+
+	rows, err := p.conn().QueryContext(ctx, `select id, guest_id, email, verified, created_at, updated_at
+			from guest_accounts
+			where email_index = $1 or guest_id in (select id from guests where email_index = $1)
+			order by id`, index)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var a models.GuestAccount
+		err = rows.Scan(&a.ID, &a.GuestID, &a.Email, &a.Verified, &a.CreateAt, &a.UpdateAt)
+		if err == nil {
+			a.Email, err = p.Crypt.Decrypt(a.Email)
+		}
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Accounts = append(data.Accounts, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = p.conn().QueryContext(ctx, `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+				r.end_date, r.room_id, r.created_at, r.updated_at, r.adults, r.children, r.total_price,
+				r.confirmation_code, r.notes, rm.id, rm.room_name
+			from reservations r
+			left join rooms rm on (r.room_id = rm.id)
+			where r.id in (select id from reservations where `+personalReservations+`)
+			order by r.start_date`, index)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var r models.Reservation
+		err = rows.Scan(&r.ID, &r.FirstName, &r.LastName, &r.Email, &r.Phone, &r.StartDate, &r.EndDate,
+			&r.RoomID, &r.CreateAt, &r.UpdateAt, &r.Adults, &r.Children, &r.TotalPrice, &r.ConfirmationCode,
+			&r.Notes, &r.Room.ID, &r.Room.RoomName)
+		if err == nil {
+			err = p.openContact(&r.Email, &r.Phone)
+		}
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Reservations = append(data.Reservations, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = p.conn().QueryContext(ctx, `select id, reservation_id, first_name, last_name, email, phone, start_date,
+				end_date, room_id, booked_at, total_price, created_at, updated_at
+			from cancellations
+			where email_index = $1
+			order by created_at`, index)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var c models.Cancellation
+		err = rows.Scan(&c.ID, &c.ReservationID, &c.FirstName, &c.LastName, &c.Email, &c.Phone, &c.StartDate,
+			&c.EndDate, &c.RoomID, &c.BookedAt, &c.TotalPrice, &c.CreateAt, &c.UpdateAt)
+		if err == nil {
+			err = p.openContact(&c.Email, &c.Phone)
+		}
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Cancellations = append(data.Cancellations, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = p.conn().QueryContext(ctx, `select id, to_address, subject, content, created_at, updated_at
+			from sent_emails
+			where email_index = $1
+			order by created_at`, index)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e models.SentEmail
+		err = rows.Scan(&e.ID, &e.To, &e.Subject, &e.Content, &e.CreateAt, &e.UpdateAt)
+		if err == nil {
+			e.To, err = p.Crypt.Decrypt(e.To)
+		}
+		if err == nil {
+			e.Content, err = p.Crypt.Decrypt(e.Content)
+		}
+		if err != nil {
+			return data, err
+		}
+		data.Emails = append(data.Emails, e)
+	}
+
+	return data, rows.Err()
+}
+
+// ErasePersonalData anonymizes the reservations and cancellations of an email, keeping their dates, rooms and
+// prices for the statistics, and deletes its guest profiles, accounts and sent emails. The audit log is left
+// as is, it only holds the personal fields redacted. It returns the number of reservations anonymized.
+func (p *postgresDBRepo) ErasePersonalData(ctx context.Context, email string) (int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	email = guests.NormalizeEmail(email)
+	index := p.Crypt.Index(email)
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `update reservations set first_name = $2, last_name = '', email = '', phone = '',
+				email_index = '', phone_index = '', notes = '', guest_id = null, anonymized_at = $3, updated_at = $3
+			where `+personalReservations, index, privacy.ErasedName, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update cancellations set first_name = $2, last_name = '', email = '', phone = '',
+				email_index = '', phone_index = '', anonymized_at = $3, updated_at = $3
+			where email_index = $1`, index, privacy.ErasedName, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from sent_emails where email_index = $1`, index)
+	if err != nil {
+		return 0, err
+	}
+
+	// Accounts of the guest profiles go with them
+	_, err = tx.ExecContext(ctx, `delete from guest_accounts where email_index = $1`, index)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from guests where email_index = $1`, index)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), tx.Commit()
+}
+
+// AnonymizeBefore anonymizes the reservations and cancellations of stays ending before cutoff, deletes the
+// emails sent before it and the guest profiles left without reservations nor account. The audit log is left as
+// is, it only holds the personal fields redacted. It returns the number of reservations anonymized.
+func (p *postgresDBRepo) AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	tx, err := p.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Rollback is a no-op after Commit
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `update reservations set first_name = $2, last_name = '', email = '', phone = '',
+				email_index = '', phone_index = '', notes = '', guest_id = null, anonymized_at = $3, updated_at = $3
+			where end_date < $1 and anonymized_at is null`, p.day(cutoff), privacy.ErasedName, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update cancellations set first_name = $2, last_name = '', email = '', phone = '',
+				email_index = '', phone_index = '', anonymized_at = $3, updated_at = $3
+			where end_date < $1 and anonymized_at is null`, p.day(cutoff), privacy.ErasedName, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from sent_emails where created_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from guests as g
+			where g.created_at < $1
+			and not exists (select 1 from reservations r where r.guest_id = g.id)
+			and not exists (select 1 from guest_accounts a where a.guest_id = g.id)`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), tx.Commit()
 }
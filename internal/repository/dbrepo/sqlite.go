@@ -0,0 +1,230 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// The functions of pg_trgm and of the text search the queries need, registered for every SQLite
+// connection as the memory repo computes them
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("similarity", 2,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			return similarity(sqliteText(args[0]), sqliteText(args[1])), nil
+		})
+
+	// notes_rank is the rank of notes for the words of a text, null when a word is missing from them
+	sqlite.MustRegisterDeterministicScalarFunction("notes_rank", 2,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			rank, _, ok := matchNotes(sqliteText(args[0]), sqliteText(args[1]))
+			if !ok {
+				return nil, nil
+			}
+			return rank, nil
+		})
+
+	// notes_snippet is notes with the words of a text in brackets
+	sqlite.MustRegisterDeterministicScalarFunction("notes_snippet", 2,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			_, snippet, _ := matchNotes(sqliteText(args[0]), sqliteText(args[1]))
+			return snippet, nil
+		})
+}
+
+// sqliteText is the text of an argument of a SQLite function, empty for null
+func sqliteText(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// dateLayout is how SQLite stores dates
+const dateLayout = "2006-01-02"
+
+// day passes t as a date: Postgres takes the date of t, SQLite compares dates as YYYY-MM-DD text
+func (p *postgresDBRepo) day(t time.Time) interface{} {
+	if p.sqlite {
+		return t.Format(dateLayout)
+	}
+	return t
+}
+
+// ilike matches text with a LIKE pattern whatever the case, \ escaping the wildcards
+func (p *postgresDBRepo) ilike(text, pattern string) string {
+	if p.sqlite {
+		// like ignores the case of ASCII letters in SQLite, which has no escape character by default
+		return text + ` like ` + pattern + ` escape '\'`
+	}
+	return text + ` ilike ` + pattern
+}
+
+// nights is the SQL for the number of nights from the date start to end
+func (p *postgresDBRepo) nights(start, end string) string {
+	if p.sqlite {
+		return `cast(julianday(` + end + `) - julianday(` + start + `) as integer)`
+	}
+	return end + ` - ` + start
+}
+
+// dateValue scans a date, which SQLite returns as text when it is computed rather than a column
+type dateValue struct {
+	t *time.Time
+}
+
+func (d dateValue) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case time.Time:
+		*d.t = v
+		return nil
+	case string:
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return err
+		}
+		*d.t = t
+		return nil
+	}
+	return fmt.Errorf("can't scan %T as a date", v)
+}
+
+// sqliteRowState reads the row id of table the way row_to_json writes it in Postgres: dates as
+// YYYY-MM-DD, times as ISO 8601, booleans as such and numbers as JSON numbers. It is nil when there
+// is no such row.
+func sqliteRowState(ctx context.Context, tx dbtx, table string, id int) (map[string]interface{}, error) {
+	rows, err := tx.QueryContext(ctx, `select * from `+table+` where id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err = rows.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]interface{}, len(columns))
+	for i, c := range columns {
+		v := values[i]
+		switch v := v.(type) {
+		case time.Time:
+			if c.DatabaseTypeName() == "DATE" {
+				state[c.Name()] = v.Format(dateLayout)
+			} else {
+				state[c.Name()] = v.Format("2006-01-02T15:04:05.999999")
+			}
+		case int64:
+			if c.DatabaseTypeName() == "BOOLEAN" {
+				state[c.Name()] = v != 0
+			} else {
+				state[c.Name()] = float64(v)
+			}
+		case []byte:
+			state[c.Name()] = string(v)
+		default:
+			state[c.Name()] = v
+		}
+	}
+
+	return state, rows.Err()
+}
+
+// sqliteDashboardStats is the query of DashboardStats for SQLite
+const sqliteDashboardStats = `
+			select count(*),
+			count(*) filter (where processed = 0),
+			count(*) filter (where processed = 1),
+			coalesce(avg(julianday(end_date) - julianday(start_date)), 0),
+			coalesce(avg(julianday(start_date) - julianday(date(created_at))), 0),
+			count(*) filter (where total_price > 0),
+			coalesce(sum(total_price), 0)
+			from reservations
+			where start_date >= $1 and start_date < $2 and deleted_at is null
+	`
+
+// sqliteOccupancyByMonth is the query of OccupancyByMonth for SQLite, the months coming from a recursive
+// query rather than generate_series
+const sqliteOccupancyByMonth = `
+			with recursive months (month, first_night, last_night) as (
+				select date($1, 'start of month'), $1, min(date($1, 'start of month', '+1 month'), $2)
+				where date($1, 'start of month') < $2
+				union all
+				select date(month, '+1 month'), date(month, '+1 month'), min(date(month, '+2 months'), $2)
+				from months
+				where date(month, '+1 month') < $2
+			)
+			select rm.id, rm.room_name, mo.month,
+			cast(julianday(mo.last_night) - julianday(mo.first_night) as integer),
+			cast(coalesce(sum(julianday(min(rr.end_date, mo.last_night))
+				- julianday(max(rr.start_date, mo.first_night))), 0) as integer)
+			from rooms rm
+			cross join months mo
+			left join room_restriction rr on (rr.room_id = rm.id and rr.restriction_id = 1
+				and rr.start_date < mo.last_night and rr.end_date > mo.first_night)
+			group by rm.id, rm.room_name, mo.month, mo.first_night, mo.last_night
+			order by rm.room_name, mo.month
+	`
+
+// sqliteSearchReservations is the query of SearchReservations for SQLite. The registered functions
+// stand in for pg_trgm, whose % operator matches from a similarity of 0.3, and for the text search.
+const sqliteSearchReservations = `
+			with candidates as (
+				select * from reservations
+				where deleted_at is null and ($4 = 0 or cast(strftime('%m', start_date) as integer) = $4)
+			), hits as (
+				select 'code' as kind, c.id, 1.0 as rank, '' as snippet
+				from candidates c
+				where c.confirmation_code like $2 || '%' escape '\'
+				union all
+				select 'guest', c.id, case when c.email_index = $5 or c.phone_index = $6 then 1.0
+					else similarity(c.first_name || ' ' || c.last_name, $1) end, ''
+				from candidates c
+				where similarity(c.first_name || ' ' || c.last_name, $1) >= 0.3
+					or (c.first_name || ' ' || c.last_name) like '%' || $2 || '%' escape '\'
+					or c.email_index = $5 or (c.phone_index = $6 and c.phone_index <> '')
+				union all
+				select 'notes', c.id, notes_rank(c.notes, $1), notes_snippet(c.notes, $1)
+				from candidates c
+				where notes_rank(c.notes, $1) is not null
+				union all
+				select 'room', c.id, similarity(rm.room_name, $1), ''
+				from candidates c
+				join rooms rm on (c.room_id = rm.id)
+				where similarity(rm.room_name, $1) >= 0.3 or rm.room_name like '%' || $2 || '%' escape '\'
+			), ranked as (
+				select h.*, row_number() over (partition by h.kind order by h.rank desc, h.id desc) as n
+				from hits h
+			)
+			select ranked.kind, ranked.rank, ranked.snippet,
+			r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+			r.processed, r.confirmation_code,
+			rm.id, rm.room_name
+			from ranked
+			join reservations r on (r.id = ranked.id)
+			left join rooms rm on (r.room_id = rm.id)
+			where ranked.n <= $3
+			order by case ranked.kind when 'code' then 1 when 'guest' then 2 when 'notes' then 3 else 4 end,
+				ranked.rank desc, r.id desc
+	`
@@ -1,24 +1,36 @@
 package dbrepo
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/TranQuocToan1996/bookings/internal/models"
+	"github.com/TranQuocToan1996/bookings/internal/repository"
 )
 
 // Format time.Time
 const layout string = "2006-01-02"
 const finalDate string = "2099-12-31"
 
+// Transaction runs fn on the test repository, which keeps no changes to commit or roll back
+func (t *testDBRepo) Transaction(ctx context.Context, fn func(repository.DatabaseRepo) error) error {
+	return fn(t)
+}
+
 // implement for DatabaseRepo interface
-func (t *testDBRepo) AllUsers() bool {
+func (t *testDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
 // InsertReservation inserts a reservation into database
-func (t *testDBRepo) InsertReservation(res *models.Reservation) (int, error) {
+func (t *testDBRepo) InsertReservation(ctx context.Context, res *models.Reservation) (int, error) {
 	// if room id 2, then fail; otherwise, pass
 	if res.RoomID == 2 {
 		return 0, errors.New("some err")
@@ -27,15 +39,18 @@ func (t *testDBRepo) InsertReservation(res *models.Reservation) (int, error) {
 }
 
 // InsertRoomRestriction inserts Room restriction data into database
-func (t *testDBRepo) InsertRoomRestriction(r *models.RoomRestriction) error {
+func (t *testDBRepo) InsertRoomRestriction(ctx context.Context, r *models.RoomRestriction) error {
 	if r.RoomID == 1000 {
 		return errors.New("some err")
 	}
+	if overlapsTakenNights(r.StartDate, r.EndDate) {
+		return repository.ErrOverlap
+	}
 	return nil
 }
 
 // SearchAvailabilityByDate checks availability of a specific room
-func (t *testDBRepo) SearchAvailabilityByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (t *testDBRepo) SearchAvailabilityByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
 
 	startDate, err := time.Parse("2006-01-02", "2050-01-01")
 	if err != nil {
@@ -58,7 +73,7 @@ func (t *testDBRepo) SearchAvailabilityByRoomID(start, end time.Time, roomID int
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available room(s) if any for given date range
-func (t *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (t *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error) {
 
 	var rooms []models.Room
 	startDate, _ := time.Parse("2006-01-02", "2050-01-01")
@@ -75,17 +90,23 @@ func (t *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 		return nil, errors.New("out of date range")
 	}
 
+	// No test room sleeps more than 4 guests
+	if guests > 4 {
+		return rooms, nil
+	}
+
 	// otherwise, put an entry into the slice, indicating that some room is
 	// available for search dates
 	room := models.Room{
-		ID: 1,
+		ID:           1,
+		MaxOccupancy: 4,
 	}
 	rooms = append(rooms, room)
 	return rooms, nil
 }
 
 // GetRoomByID gets a room struct by id
-func (t *testDBRepo) GetRoomByID(id int) (models.Room, error) {
+func (t *testDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
 
 	var room models.Room
 
@@ -93,19 +114,23 @@ func (t *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 		return room, errors.New("some error")
 	}
 
+	room.ID = id
+	room.MaxOccupancy = 4
+	room.BaseOccupancy = 2
+
 	return room, nil
 }
 
-func (t *testDBRepo) GetUserByID(id int) (models.User, error) {
+func (t *testDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
 	var u models.User
 	return u, nil
 }
 
-func (t *testDBRepo) UpdateUser(u models.User) error {
+func (t *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
 	return nil
 }
 
-func (t *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+func (t *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
 	if email == "validEmail@here.com" {
 
 		return 1, "", nil
@@ -113,67 +138,788 @@ func (t *testDBRepo) Authenticate(email, testPassword string) (int, string, erro
 	return 0, "", errors.New("error Authenticate in testing mode, successful testing")
 }
 
-// AllReservations returns a slice of all reservations (R in CRUD)
-func (t *testDBRepo) AllReservations() ([]models.Reservation, error) {
+// FindReservations pages through 45 reservations starting every day from 2050-01-01, in room 1 for odd ids
+// and room 2 for even ones, one in three processed, guests named Smith for odd ids and Jones for even ones
+func (t *testDBRepo) FindReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	var matches []models.Reservation
+
+	for id := 1; id <= 45; id++ {
+		r := models.Reservation{
+			ID:        id,
+			FirstName: "John",
+			LastName:  "Jones",
+			Email:     fmt.Sprintf("guest%d@example.com", id),
+			StartDate: time.Date(2050, time.January, id, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, time.January, id+2, 0, 0, 0, 0, time.UTC),
+			RoomID:    2 - id%2,
+		}
+		if id%2 == 1 {
+			r.LastName = "Smith"
+		}
+		if id%3 == 0 {
+			r.Processed = 1
+		}
+
+		switch {
+		case f.RoomID > 0 && r.RoomID != f.RoomID,
+			!f.Start.IsZero() && !r.EndDate.After(f.Start),
+			!f.End.IsZero() && !r.StartDate.Before(f.End),
+			f.Status == "new" && r.Processed != 0,
+			f.Status == "processed" && r.Processed != 1,
+			f.Query != "" && !strings.Contains(strings.ToLower(r.FirstName+" "+r.LastName+" "+r.Email), strings.ToLower(f.Query)):
+			continue
+		}
+		matches = append(matches, r)
+	}
 
-	var reservations []models.Reservation
+	// Ids follow the start dates, sorting on any other column keeps the id order
+	if f.Desc {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
 
-	return reservations, nil
+	from := (f.Page - 1) * f.PerPage
+	if from < 0 || from >= len(matches) {
+		return nil, len(matches), nil
+	}
+	to := from + f.PerPage
+	if to > len(matches) {
+		to = len(matches)
+	}
+	return matches[from:to], len(matches), nil
 }
 
-// AllNewReservations returns a slice of all new reservations
-func (t *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
+// GetReservationByID returns the reservations of the trash as they are, there is no reservation 99
+func (t *testDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
 
-	var reservations []models.Reservation
+	var res models.Reservation
+	if id == 99 {
+		return res, sql.ErrNoRows
+	}
+	for _, trashed := range trashedReservations {
+		if trashed.ID == id {
+			return trashed, nil
+		}
+	}
+	if id == 6 {
+		return inHouseReservation(), nil
+	}
 
-	return reservations, nil
+	return res, nil
 }
 
-func (t *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-
-	var res models.Reservation
+// inHouseReservation is reservation 6 of room 1, its guest arrived two days ago and leaves tomorrow
+func inHouseReservation() models.Reservation {
+	year, month, day := time.Now().Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return models.Reservation{
+		ID:        6,
+		FirstName: "John",
+		LastName:  "Smith",
+		StartDate: today.AddDate(0, 0, -2),
+		EndDate:   today.AddDate(0, 0, 1),
+		RoomID:    1,
+		Adults:    1,
+	}
+}
 
-	return res, nil
+// checkLive returns sql.ErrNoRows for a reservation in the trash or the reservation 99
+func checkLive(id int) error {
+	if id == 99 {
+		return sql.ErrNoRows
+	}
+	for _, trashed := range trashedReservations {
+		if trashed.ID == id {
+			return sql.ErrNoRows
+		}
+	}
+	return nil
 }
 
 // UpdateReservation updates the reservation info in the database
-func (t *testDBRepo) UpdateReservation(r models.Reservation) error {
+func (t *testDBRepo) UpdateReservation(ctx context.Context, actor models.Actor, r models.Reservation) error {
 
-	return nil
+	return checkLive(r.ID)
 }
 
-// DeleteReservation deletes a reservation by ID
-func (t *testDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash
+func (t *testDBRepo) DeleteReservation(ctx context.Context, actor models.Actor, id int) error {
 
-	return nil
+	return checkLive(id)
+}
+
+// trashedReservations are in the trash of the test repository, the dates of the second one have been
+// taken since
+var trashedReservations = []models.Reservation{
+	{
+		ID:            7,
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		Email:         "jane@doe.com",
+		StartDate:     time.Date(2050, time.March, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, time.March, 3, 0, 0, 0, 0, time.UTC),
+		RoomID:        1,
+		Room:          models.Room{ID: 1, RoomName: "General's Quarters"},
+		DeletedAt:     time.Date(2050, time.January, 10, 9, 0, 0, 0, time.UTC),
+		DeletedBy:     1,
+		DeletedByName: "Admin User",
+	},
+	{
+		ID:            8,
+		FirstName:     "Richard",
+		LastName:      "Roe",
+		Email:         "richard@roe.com",
+		StartDate:     time.Date(2050, time.February, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, time.February, 3, 0, 0, 0, 0, time.UTC),
+		RoomID:        2,
+		Room:          models.Room{ID: 2, RoomName: "Major's Suite"},
+		DeletedAt:     time.Date(2050, time.January, 5, 9, 0, 0, 0, time.UTC),
+		DeletedBy:     1,
+		DeletedByName: "Admin User",
+	},
+}
+
+// TrashedReservations returns the reservations in the trash
+func (t *testDBRepo) TrashedReservations(ctx context.Context) ([]models.Reservation, error) {
+	return trashedReservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash, the nights of 2050-02-01 to 2050-02-04 are taken
+func (t *testDBRepo) RestoreReservation(ctx context.Context, actor models.Actor, id int) error {
+	for _, res := range trashedReservations {
+		if res.ID != id {
+			continue
+		}
+		if overlapsTakenNights(res.StartDate, res.EndDate) {
+			return repository.ErrOverlap
+		}
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// PurgeDeletedBefore removes for good the reservations moved to the trash before cutoff
+func (t *testDBRepo) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	n := 0
+	for _, res := range trashedReservations {
+		if res.DeletedAt.Before(cutoff) {
+			n++
+		}
+	}
+	return n, nil
 }
 
 // UpdateProcessedForReservation updates processed-index in the database by id
-func (t *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (t *testDBRepo) UpdateProcessedForReservation(ctx context.Context, actor models.Actor, id, processed int) error {
 
-	return nil
+	return checkLive(id)
 }
 
-func (t *testDBRepo) AllRooms() ([]models.Room, error) {
-	var rooms []models.Room
+func (t *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	rooms := []models.Room{
+		{ID: 1, RoomName: "General's Quarters", MaxOccupancy: 4, BaseOccupancy: 2},
+		{ID: 2, RoomName: "Major's Suite", MaxOccupancy: 4, BaseOccupancy: 2},
+	}
 	return rooms, nil
 }
 
-func (t *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+// GetRestrictionsForRoomByDate returns a reservation of room 1 on the nights of 2050-07-02 and 2050-07-03,
+// and the in-house reservation 6, when the range covers them
+func (t *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 
 	var restriction []models.RoomRestriction
 
+	inHouse := inHouseReservation()
+	if roomID == inHouse.RoomID && start.Before(inHouse.EndDate) && end.After(inHouse.StartDate) {
+		restriction = append(restriction, models.RoomRestriction{
+			ID:            6,
+			RoomID:        inHouse.RoomID,
+			ReservationID: inHouse.ID,
+			RestrictionID: 1,
+			StartDate:     inHouse.StartDate,
+			EndDate:       inHouse.EndDate,
+		})
+	}
+
+	resStart := time.Date(2050, time.July, 2, 0, 0, 0, 0, time.UTC)
+	resEnd := time.Date(2050, time.July, 4, 0, 0, 0, 0, time.UTC)
+	if roomID == 1 && start.Before(resEnd) && end.After(resStart) {
+		restriction = append(restriction, models.RoomRestriction{
+			ID:            2,
+			RoomID:        1,
+			ReservationID: 1,
+			RestrictionID: 1,
+			StartDate:     resStart,
+			EndDate:       resEnd,
+		})
+	}
+
 	return restriction, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (t *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// InsertBlockForRoom inserts an owner block, the nights of 2050-02-01 to 2050-02-04 are taken
+func (t *testDBRepo) InsertBlockForRoom(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	if r.RoomID == 1000 {
+		return errors.New("some err")
+	}
+	if overlapsTakenNights(r.StartDate, r.EndDate) {
+		return repository.ErrOverlap
+	}
+	return nil
+}
+
+// GetBlockByID returns a one night block on 2050-01-01 for room 1, other ids than 1 are not found
+func (t *testDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	var b models.RoomRestriction
+	if id != 1 {
+		return b, sql.ErrNoRows
+	}
+
+	b = models.RoomRestriction{
+		ID:            1,
+		RoomID:        1,
+		RestrictionID: 2,
+		StartDate:     time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, time.January, 2, 0, 0, 0, 0, time.UTC),
+		Note:          "maintenance",
+		Room:          models.Room{ID: 1, RoomName: "General's Quarters"},
+	}
+	return b, nil
+}
+
+// UpdateBlock changes an owner block, the nights of 2050-02-01 to 2050-02-04 are taken
+func (t *testDBRepo) UpdateBlock(ctx context.Context, actor models.Actor, r models.RoomRestriction) error {
+	if overlapsTakenNights(r.StartDate, r.EndDate) {
+		return repository.ErrOverlap
+	}
+	return nil
+}
+
+// overlapsTakenNights reports whether a range runs into the nights taken in every room of the test repository
+func overlapsTakenNights(start, end time.Time) bool {
+	takenStart := time.Date(2050, time.February, 1, 0, 0, 0, 0, time.UTC)
+	takenEnd := time.Date(2050, time.February, 5, 0, 0, 0, 0, time.UTC)
+	return start.Before(takenEnd) && end.After(takenStart)
+}
+
+// DeleteBlockByID deletes owner block 1, there is no other block
+func (t *testDBRepo) DeleteBlockByID(ctx context.Context, actor models.Actor, id int) error {
+	if id != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetRestrictionsByDate returns an owner block of room 1 on the nights of 2050-01-01 and 2050-01-02
+// when the range covers January 2050
+func (t *testDBRepo) GetRestrictionsByDate(ctx context.Context, start, end time.Time) ([]models.RoomRestriction, error) {
+
+	var restrictions []models.RoomRestriction
+
+	blockStart := time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC)
+	blockEnd := time.Date(2050, time.January, 3, 0, 0, 0, 0, time.UTC)
+	if start.Before(blockEnd) && end.After(blockStart) {
+		restrictions = append(restrictions, models.RoomRestriction{
+			ID:            1,
+			RoomID:        1,
+			RestrictionID: 2,
+			StartDate:     blockStart,
+			EndDate:       blockEnd,
+		})
+	}
+
+	return restrictions, nil
+}
+
+// UpdateRoomForReservation moves a reservation into another room
+func (t *testDBRepo) UpdateRoomForReservation(ctx context.Context, actor models.Actor, id, roomID int) error {
+	if roomID == 1000 {
+		return errors.New("some err")
+	}
+	return nil
+}
+
+// MoveReservation moves a reservation, the nights of 2050-02-01 to 2050-02-04 are taken
+func (t *testDBRepo) MoveReservation(ctx context.Context, actor models.Actor, id, roomID int, start, end time.Time, totalPrice int) error {
+	if err := checkLive(id); err != nil {
+		return err
+	}
+	if roomID == 1000 {
+		return errors.New("some err")
+	}
+	if overlapsTakenNights(start, end) {
+		return repository.ErrOverlap
+	}
+	return nil
+}
+
+// GetStayRulesByDate returns a minimum stay of 3 nights for room 1 on arrivals in 2070
+func (t *testDBRepo) GetStayRulesByDate(ctx context.Context, arrival time.Time) ([]models.StayRule, error) {
+	var rules []models.StayRule
+
+	if arrival.Year() == 2070 {
+		rules = append(rules, models.StayRule{
+			RoomID:    1,
+			StartDate: time.Date(2070, time.January, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2070, time.December, 31, 0, 0, 0, 0, time.UTC),
+			MinNights: 3,
+		})
+	}
+
+	return rules, nil
+}
+
+// AllStayRules returns the minimum stay of 3 nights for room 1 on arrivals in 2070
+func (t *testDBRepo) AllStayRules(ctx context.Context) ([]models.StayRule, error) {
+	return t.GetStayRulesByDate(ctx, time.Date(2070, time.January, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (t *testDBRepo) InsertStayRule(ctx context.Context, actor models.Actor, r models.StayRule) error {
+	if r.RoomID == 1000 {
+		return errors.New("some err")
+	}
+	return nil
+}
+
+func (t *testDBRepo) DeleteStayRule(ctx context.Context, actor models.Actor, id int) error {
+	return nil
+}
+
+func (t *testDBRepo) AllBlockSeries(ctx context.Context) ([]models.BlockSeries, error) {
+	var series []models.BlockSeries
+	return series, nil
+}
+
+func (t *testDBRepo) InsertBlockSeries(ctx context.Context, actor models.Actor, s models.BlockSeries, blocks []models.RoomRestriction) error {
+	if s.RoomID == 1000 {
+		return errors.New("some err")
+	}
+	for _, b := range blocks {
+		if overlapsTakenNights(b.StartDate, b.EndDate) {
+			return repository.ErrOverlap
+		}
+	}
+	return nil
+}
+
+// DeleteBlockSeries deletes recurring block 1, there is no other series
+func (t *testDBRepo) DeleteBlockSeries(ctx context.Context, actor models.Actor, id int) error {
+	if id != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ArrivalsOn returns one reservation of room 1 arriving on any day
+func (t *testDBRepo) ArrivalsOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	return []models.Reservation{
+		{
+			ID:        1,
+			FirstName: "John",
+			LastName:  "Smith",
+			StartDate: day,
+			EndDate:   day.AddDate(0, 0, 2),
+			RoomID:    1,
+			Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+		},
+	}, nil
+}
+
+func (t *testDBRepo) DeparturesOn(ctx context.Context, day time.Time) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	return reservations, nil
+}
+
+func (t *testDBRepo) DashboardStats(ctx context.Context, start, end time.Time) (models.DashboardStats, error) {
+	return models.DashboardStats{
+		Reservations:       4,
+		New:                1,
+		Processed:          3,
+		AverageStay:        2.5,
+		AverageLeadTime:    10,
+		PricedReservations: 2,
+		Revenue:            45000,
+	}, nil
+}
+
+// OccupancyByMonth returns room 1 booked 10 nights of every month and room 2 never booked
+func (t *testDBRepo) OccupancyByMonth(ctx context.Context, start, end time.Time) ([]models.RoomOccupancy, error) {
+	var occupancy []models.RoomOccupancy
+
+	for _, room := range []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}} {
+		for month := start.AddDate(0, 0, 1-start.Day()); month.Before(end); month = month.AddDate(0, 1, 0) {
+			first, last := month, month.AddDate(0, 1, 0)
+			if first.Before(start) {
+				first = start
+			}
+			if last.After(end) {
+				last = end
+			}
+
+			item := models.RoomOccupancy{
+				RoomID:   room.ID,
+				RoomName: room.RoomName,
+				Month:    month,
+				Nights:   int(last.Sub(first).Hours() / 24),
+			}
+			if room.ID == 1 {
+				item.BookedNights = 10
+			}
+			occupancy = append(occupancy, item)
+		}
+	}
+
+	return occupancy, nil
+}
+
+// EachReservation streams a priced reservation of room 1 and an older one of room 2 without price,
+// filtered on f.RoomIDs
+func (t *testDBRepo) EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error {
+	reservations := []models.Reservation{
+		{
+			ID:         1,
+			FirstName:  "John",
+			LastName:   "Smith",
+			Email:      "john@smith.com",
+			StartDate:  time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:    time.Date(2050, time.January, 3, 0, 0, 0, 0, time.UTC),
+			RoomID:     1,
+			Room:       models.Room{ID: 1, RoomName: "General's Quarters"},
+			Adults:     2,
+			TotalPrice: 30000,
+		},
+		{
+			ID:        2,
+			FirstName: "Jane",
+			LastName:  "Doe, Jr",
+			Email:     "jane@doe.com",
+			StartDate: time.Date(2050, time.January, 5, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, time.January, 6, 0, 0, 0, 0, time.UTC),
+			RoomID:    2,
+			Room:      models.Room{ID: 2, RoomName: "Major's Suite"},
+			Adults:    1,
+			Processed: 1,
+		},
+	}
+
+	for _, r := range reservations {
+		if !inRooms(f.RoomIDs, r.RoomID) {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *testDBRepo) EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error {
+	if !inRooms(f.RoomIDs, 1) {
+		return nil
+	}
+	return fn(models.Cancellation{
+		ID:            1,
+		ReservationID: 3,
+		FirstName:     "John",
+		LastName:      "Smith",
+		StartDate:     time.Date(2050, time.February, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, time.February, 4, 0, 0, 0, 0, time.UTC),
+		RoomID:        1,
+		Room:          models.Room{ID: 1, RoomName: "General's Quarters"},
+	})
+}
+
+func (t *testDBRepo) EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error {
+	restrictions, err := t.GetRestrictionsByDate(ctx, f.Start, f.End)
+	if err != nil {
+		return err
+	}
+	for _, r := range restrictions {
+		if !inRooms(f.RoomIDs, r.RoomID) {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inRooms reports whether roomID passes a report room filter
+func inRooms(roomIDs []int, roomID int) bool {
+	if len(roomIDs) == 0 {
+		return true
+	}
+	for _, id := range roomIDs {
+		if id == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchReservations finds reservation 1 of John Smith in May 2050 by guest, notes and code ("ABCD2345"),
+// and reservation 2 in the General's Quarters by room
+func (t *testDBRepo) SearchReservations(ctx context.Context, text string, month time.Month, limit int) ([]models.SearchResult, error) {
+	var results []models.SearchResult
+
+	smith := models.Reservation{
+		ID:               1,
+		FirstName:        "John",
+		LastName:         "Smith",
+		StartDate:        time.Date(2050, time.May, 3, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, time.May, 5, 0, 0, 0, 0, time.UTC),
+		RoomID:           2,
+		Room:             models.Room{ID: 2, RoomName: "Major's Suite"},
+		ConfirmationCode: "ABCD2345",
+	}
+	general := models.Reservation{
+		ID:        2,
+		FirstName: "Jane",
+		LastName:  "Doe",
+		StartDate: time.Date(2050, time.June, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, time.June, 2, 0, 0, 0, 0, time.UTC),
+		RoomID:    1,
+		Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+	}
+
+	text = strings.ToLower(text)
+	if month == 0 || month == time.May {
+		if strings.HasPrefix("abcd2345", text) {
+			results = append(results, models.SearchResult{Kind: "code", Rank: 1, Reservation: smith})
+		}
+		if strings.Contains("john smith", text) {
+			results = append(results, models.SearchResult{Kind: "guest", Rank: 0.8, Reservation: smith})
+			results = append(results, models.SearchResult{Kind: "notes", Rank: 0.1, Snippet: "[Smith] asked for a late check-out",
+				Reservation: smith})
+		}
+	}
+	if (month == 0 || month == time.June) && strings.Contains("general's quarters", text) {
+		results = append(results, models.SearchResult{Kind: "room", Rank: 0.5, Reservation: general})
+	}
+
+	return results, nil
+}
+
+// testGuests are guest 1 John Smith, a VIP with two stays, and guest 2, the same guest booked again
+// with another email
+var testGuests = []models.Guest{
+	{
+		ID:            1,
+		FirstName:     "John",
+		LastName:      "Smith",
+		Email:         "john@smith.com",
+		Phone:         "0989123456",
+		Notes:         "Likes a quiet room",
+		Tags:          []string{"vip"},
+		Stays:         2,
+		Nights:        5,
+		LifetimeValue: 62500,
+	},
+	{
+		ID:        2,
+		FirstName: "Johnny",
+		LastName:  "Smith",
+		Email:     "johnny@work.com",
+		Phone:     "+84 989 123 456",
+		Stays:     1,
+		Nights:    1,
+	},
+}
+
+func (t *testDBRepo) AllGuests(ctx context.Context, text string, limit int) ([]models.Guest, error) {
+	var list []models.Guest
+	for _, g := range testGuests {
+		if strings.Contains(strings.ToLower(g.FirstName+" "+g.LastName+" "+g.Email+" "+g.Phone), strings.ToLower(text)) {
+			list = append(list, g)
+		}
+	}
+	return list, nil
+}
+
+func (t *testDBRepo) GetGuestByID(ctx context.Context, id int) (models.Guest, error) {
+	for _, g := range testGuests {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return models.Guest{}, sql.ErrNoRows
+}
+
+// GuestDuplicates returns the other test guest
+func (t *testDBRepo) GuestDuplicates(ctx context.Context, id int) ([]models.Guest, error) {
+	var list []models.Guest
+	for _, g := range testGuests {
+		if g.ID != id {
+			list = append(list, g)
+		}
+	}
+	return list, nil
+}
+
+func (t *testDBRepo) GuestReservations(ctx context.Context, guestID int) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	if guestID == 1 {
+		reservations = append(reservations, models.Reservation{
+			ID:               1,
+			StartDate:        time.Date(2050, time.May, 3, 0, 0, 0, 0, time.UTC),
+			EndDate:          time.Date(2050, time.May, 5, 0, 0, 0, 0, time.UTC),
+			RoomID:           2,
+			Room:             models.Room{ID: 2, RoomName: "Major's Suite"},
+			Adults:           2,
+			TotalPrice:       25000,
+			ConfirmationCode: "ABCD2345",
+			GuestID:          1,
+		})
+	}
+	return reservations, nil
+}
+
+// UpdateGuest saves a guest, the emails of the test guests are taken
+func (t *testDBRepo) UpdateGuest(ctx context.Context, actor models.Actor, g models.Guest) error {
+	for _, other := range testGuests {
+		if other.ID != g.ID && strings.EqualFold(other.Email, g.Email) {
+			return repository.ErrGuestEmailTaken
+		}
+	}
+	return nil
+}
 
+func (t *testDBRepo) MergeGuests(ctx context.Context, actor models.Actor, keep models.Guest, duplicateID int) error {
 	return nil
 }
 
-// DeleteBlockByID deletes a room restriction
-func (t *testDBRepo) DeleteBlockByID(id int) error {
+// GetReservationByCode knows ABCD2345, a stay of guest 1, and WXYZ6789, made by a guest without an account
+func (t *testDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	switch strings.ToUpper(code) {
+	case "ABCD2345":
+		return models.Reservation{ID: 1, Email: "john@smith.com", ConfirmationCode: "ABCD2345", GuestID: 1}, nil
+	case "WXYZ6789":
+		return models.Reservation{ID: 2, Email: "Mary@Jones.com", ConfirmationCode: "WXYZ6789", GuestID: 3}, nil
+	}
+	return models.Reservation{}, errors.New("reservation not found")
+}
+
+// testGuestAccounts are account 1 of guest 1, verified, and account 2 of guest 2, not verified yet.
+// Their password is "password".
+var testGuestAccounts = []models.GuestAccount{
+	{ID: 1, GuestID: 1, Email: "john@smith.com", Verified: true},
+	{ID: 2, GuestID: 2, Email: "johnny@smith.com"},
+}
+
+// testVerifyToken is the stored hash of the verification token "valid-token"
+var testVerifyToken = func() string {
+	sum := sha256.Sum256([]byte("valid-token"))
+	return hex.EncodeToString(sum[:])
+}()
+
+func (t *testDBRepo) InsertGuestAccount(ctx context.Context, a models.GuestAccount) (int, error) {
+	for _, account := range testGuestAccounts {
+		if account.Email == a.Email {
+			return 0, repository.ErrEmailTaken
+		}
+	}
+	return 3, nil
+}
+
+func (t *testDBRepo) GetGuestAccountByID(ctx context.Context, id int) (models.GuestAccount, error) {
+	for _, a := range testGuestAccounts {
+		if a.ID == id {
+			guest, err := t.GetGuestByID(ctx, a.GuestID)
+			a.Guest = guest
+			return a, err
+		}
+	}
+	return models.GuestAccount{}, errors.New("guest account not found")
+}
 
+func (t *testDBRepo) AuthenticateGuest(ctx context.Context, email, testPassword string) (models.GuestAccount, error) {
+	for _, a := range testGuestAccounts {
+		if a.Email == email && testPassword == "password" {
+			return t.GetGuestAccountByID(ctx, a.ID)
+		}
+	}
+	return models.GuestAccount{}, errors.New("incorrect password")
+}
+
+func (t *testDBRepo) SetGuestAccountToken(ctx context.Context, id int, token string, expires time.Time) error {
 	return nil
 }
+
+func (t *testDBRepo) VerifyGuestAccount(ctx context.Context, token string) (int, error) {
+	if token != testVerifyToken {
+		return 0, repository.ErrInvalidToken
+	}
+	return 2, nil
+}
+
+func (t *testDBRepo) InsertSentEmail(ctx context.Context, m models.MailData) error {
+	return nil
+}
+
+// PersonalData knows john@smith.com, guest 1 with an account, a reservation and an email
+func (t *testDBRepo) PersonalData(ctx context.Context, email string) (models.PersonalData, error) {
+	data := models.PersonalData{Email: email}
+	if email != "john@smith.com" {
+		return data, nil
+	}
+
+	account := testGuestAccounts[0]
+	account.Password = "$2a$12$hash"
+	data.Guests = testGuests[:1]
+	data.Accounts = []models.GuestAccount{account}
+	data.Reservations = []models.Reservation{
+		{
+			ID:               1,
+			FirstName:        "John",
+			LastName:         "Smith",
+			Email:            "john@smith.com",
+			StartDate:        time.Date(2050, time.May, 3, 0, 0, 0, 0, time.UTC),
+			EndDate:          time.Date(2050, time.May, 5, 0, 0, 0, 0, time.UTC),
+			Room:             models.Room{ID: 2, RoomName: "Major's Suite"},
+			ConfirmationCode: "ABCD2345",
+			Notes:            "[Smith] asked for a late check-out",
+		},
+	}
+	data.Emails = []models.SentEmail{
+		{ID: 1, To: "john@smith.com", Subject: "Reservation confirmation", Content: "Dear John"},
+	}
+	return data, nil
+}
+
+func (t *testDBRepo) ErasePersonalData(ctx context.Context, email string) (int, error) {
+	if email == "john@smith.com" {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (t *testDBRepo) AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	return 0, nil
+}
+
+// AuditLog returns the change of the first name of reservation 1 by user 1, when f matches it
+func (t *testDBRepo) AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, int, error) {
+	var entries []models.AuditEntry
+
+	entry := models.AuditEntry{
+		ID:       1,
+		UserID:   1,
+		UserName: "Admin User",
+		Action:   "update",
+		Entity:   "reservation",
+		EntityID: 1,
+		Changes:  `{"first_name":{"from":"Jon","to":"John"}}`,
+		IP:       "10.0.0.1",
+		CreateAt: time.Date(2050, time.May, 1, 10, 0, 0, 0, time.UTC),
+	}
+	if (f.UserID > 0 && f.UserID != entry.UserID) || (f.Action != "" && f.Action != entry.Action) ||
+		(f.Entity != "" && f.Entity != entry.Entity) || (f.EntityID > 0 && f.EntityID != entry.EntityID) ||
+		(!f.Start.IsZero() && entry.CreateAt.Before(f.Start)) || (!f.End.IsZero() && !entry.CreateAt.Before(f.End)) {
+		return entries, 0, nil
+	}
+
+	entries = append(entries, entry)
+	return entries, len(entries), nil
+}
@@ -0,0 +1,115 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/TranQuocToan1996/bookings/internal/repository"
+)
+
+// dbtx runs queries, on the pool or in the transaction of a unit of work
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// txn is a transaction begun by a method of the repository
+type txn interface {
+	dbtx
+	Commit() error
+	Rollback() error
+}
+
+// savepoint is the transaction of a method running in a unit of work: its commit releases the savepoint
+// and its rollback undoes the changes of the method only, the unit of work decides for the rest
+type savepoint struct {
+	*sql.Tx
+	ctx  context.Context
+	name string
+	done bool
+}
+
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.ExecContext(s.ctx, "release savepoint "+s.name)
+	return err
+}
+
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.ExecContext(s.ctx, "rollback to savepoint "+s.name)
+	return err
+}
+
+// conn is where the queries of the repo run
+func (p *postgresDBRepo) conn() dbtx {
+	if p.tx != nil {
+		return p.tx
+	}
+	return p.DB
+}
+
+// begin starts a transaction, or a savepoint in the transaction of the unit of work the repo belongs to
+func (p *postgresDBRepo) begin(ctx context.Context) (txn, error) {
+	if p.tx == nil {
+		tx, err := p.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	*p.savepoints++
+	s := &savepoint{Tx: p.tx, ctx: ctx, name: fmt.Sprintf("unit_%d", *p.savepoints)}
+	_, err := p.tx.ExecContext(ctx, "savepoint "+s.name)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Transaction runs fn with a repo whose every call goes to one transaction, committed when fn returns
+// nil and rolled back when it returns an error or panics. The transaction lasts as long as ctx, the
+// queries in it are still bounded by the query timeout. Called within a unit of work, it nests in it.
+func (p *postgresDBRepo) Transaction(ctx context.Context, fn func(repository.DatabaseRepo) error) (err error) {
+	unit := *p
+
+	var tx txn
+	if p.tx == nil {
+		sqlTx, err := p.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		tx = sqlTx
+		unit.tx = sqlTx
+		unit.savepoints = new(int)
+	} else {
+		tx, err = p.begin(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			tx.Rollback()
+			panic(v)
+		}
+	}()
+
+	err = fn(&unit)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,48 +1,149 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/TranQuocToan1996/bookings/internal/models"
 )
 
+// ErrOverlap is returned when a change would put a reservation or a block on nights already taken in the room
+var ErrOverlap = errors.New("the dates overlap another reservation or block")
+
+// ErrEmailTaken is returned when a guest account already exists for the email
+var ErrEmailTaken = errors.New("an account already exists for this email")
+
+// ErrGuestEmailTaken is returned when a guest would get the email of another guest, the two should be merged
+var ErrGuestEmailTaken = errors.New("another guest has this email")
+
+// ErrInvalidToken is returned for an unknown or expired verification token
+var ErrInvalidToken = errors.New("the link is invalid or has expired")
+
+// ReservationSorts are the columns the admin reservation lists can be sorted on, emails and phones may be
+// encrypted so they can't
+var ReservationSorts = []string{"id", "first_name", "last_name", "room", "start_date", "end_date",
+	"created_at", "processed"}
+
 // Contains method to contact with table in database
 type DatabaseRepo interface {
-	AllUsers() bool
+	// Transaction runs fn with a repo whose calls succeed or fail together: they are committed when fn
+	// returns nil and rolled back when it returns an error or panics
+	Transaction(ctx context.Context, fn func(repo DatabaseRepo) error) error
+
+	AllUsers(ctx context.Context) bool
+
+	InsertReservation(ctx context.Context, res *models.Reservation) (int, error)
+
+	InsertRoomRestriction(ctx context.Context, r *models.RoomRestriction) error
+
+	SearchAvailabilityByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error)
+
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error)
+
+	GetRoomByID(ctx context.Context, id int) (models.Room, error)
+
+	GetUserByID(ctx context.Context, id int) (models.User, error)
+
+	UpdateUser(ctx context.Context, u models.User) error
+
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+
+	FindReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error)
+
+	SearchReservations(ctx context.Context, text string, month time.Month, limit int) ([]models.SearchResult, error)
+
+	GetReservationByID(ctx context.Context, id int) (models.Reservation, error)
+
+	UpdateReservation(ctx context.Context, actor models.Actor, r models.Reservation) error
+
+	DeleteReservation(ctx context.Context, actor models.Actor, id int) error
+
+	TrashedReservations(ctx context.Context) ([]models.Reservation, error)
+
+	RestoreReservation(ctx context.Context, actor models.Actor, id int) error
+
+	PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error)
+
+	UpdateProcessedForReservation(ctx context.Context, actor models.Actor, id, processed int) error
+
+	AllRooms(ctx context.Context) ([]models.Room, error)
+
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+
+	InsertBlockForRoom(ctx context.Context, actor models.Actor, r models.RoomRestriction) error
+
+	GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error)
+
+	UpdateBlock(ctx context.Context, actor models.Actor, r models.RoomRestriction) error
+
+	DeleteBlockByID(ctx context.Context, actor models.Actor, id int) error
+
+	AllBlockSeries(ctx context.Context) ([]models.BlockSeries, error)
+
+	InsertBlockSeries(ctx context.Context, actor models.Actor, s models.BlockSeries, blocks []models.RoomRestriction) error
+
+	DeleteBlockSeries(ctx context.Context, actor models.Actor, id int) error
+
+	GetRestrictionsByDate(ctx context.Context, start, end time.Time) ([]models.RoomRestriction, error)
+
+	UpdateRoomForReservation(ctx context.Context, actor models.Actor, id, roomID int) error
+
+	MoveReservation(ctx context.Context, actor models.Actor, id, roomID int, start, end time.Time, totalPrice int) error
+
+	GetStayRulesByDate(ctx context.Context, arrival time.Time) ([]models.StayRule, error)
+
+	AllStayRules(ctx context.Context) ([]models.StayRule, error)
+
+	InsertStayRule(ctx context.Context, actor models.Actor, r models.StayRule) error
+
+	DeleteStayRule(ctx context.Context, actor models.Actor, id int) error
+
+	ArrivalsOn(ctx context.Context, day time.Time) ([]models.Reservation, error)
+
+	DeparturesOn(ctx context.Context, day time.Time) ([]models.Reservation, error)
+
+	DashboardStats(ctx context.Context, start, end time.Time) (models.DashboardStats, error)
+
+	OccupancyByMonth(ctx context.Context, start, end time.Time) ([]models.RoomOccupancy, error)
+
+	EachReservation(ctx context.Context, f models.ReportFilter, fn func(models.Reservation) error) error
+
+	EachCancellation(ctx context.Context, f models.ReportFilter, fn func(models.Cancellation) error) error
 
-	InsertReservation(res *models.Reservation) (int, error)
+	EachBlock(ctx context.Context, f models.ReportFilter, fn func(models.RoomRestriction) error) error
 
-	InsertRoomRestriction(r *models.RoomRestriction) error
+	AllGuests(ctx context.Context, text string, limit int) ([]models.Guest, error)
 
-	SearchAvailabilityByRoomID(start, end time.Time, roomID int) (bool, error)
+	GetGuestByID(ctx context.Context, id int) (models.Guest, error)
 
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
+	GuestDuplicates(ctx context.Context, id int) ([]models.Guest, error)
 
-	GetRoomByID(id int) (models.Room, error)
+	GuestReservations(ctx context.Context, guestID int) ([]models.Reservation, error)
 
-	GetUserByID(id int) (models.User, error)
+	UpdateGuest(ctx context.Context, actor models.Actor, g models.Guest) error
 
-	UpdateUser(u models.User) error
+	MergeGuests(ctx context.Context, actor models.Actor, keep models.Guest, duplicateID int) error
 
-	Authenticate(email, testPassword string) (int, string, error)
+	GetReservationByCode(ctx context.Context, code string) (models.Reservation, error)
 
-	AllReservations() ([]models.Reservation, error)
+	InsertGuestAccount(ctx context.Context, a models.GuestAccount) (int, error)
 
-	AllNewReservations() ([]models.Reservation, error)
+	GetGuestAccountByID(ctx context.Context, id int) (models.GuestAccount, error)
 
-	GetReservationByID(id int) (models.Reservation, error)
+	AuthenticateGuest(ctx context.Context, email, testPassword string) (models.GuestAccount, error)
 
-	UpdateReservation(r models.Reservation) error
+	SetGuestAccountToken(ctx context.Context, id int, token string, expires time.Time) error
 
-	DeleteReservation(id int) error
+	VerifyGuestAccount(ctx context.Context, token string) (int, error)
 
-	UpdateProcessedForReservation(id, processed int) error
+	InsertSentEmail(ctx context.Context, m models.MailData) error
 
-	AllRooms() ([]models.Room, error)
+	PersonalData(ctx context.Context, email string) (models.PersonalData, error)
 
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	ErasePersonalData(ctx context.Context, email string) (int, error)
 
-	InsertBlockForRoom(id int, startDate time.Time) error
+	AnonymizeBefore(ctx context.Context, cutoff time.Time) (int, error)
 
-	DeleteBlockByID(id int) error
+	AuditLog(ctx context.Context, f models.AuditFilter) ([]models.AuditEntry, int, error)
 }
@@ -0,0 +1,120 @@
+// Package supervisor runs the background workers of the application, restarts the ones that panic,
+// and stops them all on shutdown.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Worker runs until ctx is done, then returns once it flushed what it had queued
+type Worker func(ctx context.Context)
+
+// restartDelay is how long a worker that panicked waits before it runs again
+var restartDelay = 5 * time.Second
+
+// Supervisor runs workers until Stop
+type Supervisor struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	infoLog  *log.Logger
+	errorLog *log.Logger
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// New returns a Supervisor logging the restarts of its workers
+func New(infoLog, errorLog *log.Logger) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{
+		ctx:      ctx,
+		cancel:   cancel,
+		infoLog:  infoLog,
+		errorLog: errorLog,
+		running:  make(map[string]int),
+	}
+}
+
+// Go runs worker in its own goroutine under name. A worker that panics is run again after a while,
+// unless the supervisor is stopping; one that returns is done.
+func (s *Supervisor) Go(name string, worker Worker) {
+	s.track(name, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.track(name, -1)
+
+		for s.panics(name, worker) {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(restartDelay):
+			}
+			s.infoLog.Printf("supervisor: restarting %s", name)
+		}
+	}()
+}
+
+// panics runs worker and reports whether it panicked
+func (s *Supervisor) panics(name string, worker Worker) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.errorLog.Printf("supervisor: %s panicked: %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+
+	worker(s.ctx)
+	return false
+}
+
+// track counts the workers running under name
+func (s *Supervisor) track(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running[name] += n
+	if s.running[name] == 0 {
+		delete(s.running, name)
+	}
+}
+
+// Running returns the names of the workers still running, sorted
+func (s *Supervisor) Running() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stop tells the workers to stop and waits for them to return. When ctx is done first it returns
+// an error naming the workers still running, which are left behind.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w, still running: %s", ctx.Err(), strings.Join(s.Running(), ", "))
+	}
+}
@@ -0,0 +1,94 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+func TestStopWaitsForWorkers(t *testing.T) {
+	s := New(discard, discard)
+
+	var flushed int32
+	s.Go("mail", func(ctx context.Context) {
+		<-ctx.Done()
+		// Flushing the queue after the stop
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&flushed, 1)
+	})
+	s.Go("done early", func(ctx context.Context) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&flushed) != 1 {
+		t.Error("Stop returned before the worker flushed its queue")
+	}
+	if running := s.Running(); len(running) != 0 {
+		t.Errorf("expected no worker running, got %v", running)
+	}
+}
+
+func TestPanicRestarts(t *testing.T) {
+	restartDelay = time.Millisecond
+	defer func() { restartDelay = 5 * time.Second }()
+
+	s := New(discard, discard)
+
+	var runs int32
+	s.Go("flaky", func(ctx context.Context) {
+		if atomic.AddInt32(&runs, 1) < 3 {
+			panic("boom")
+		}
+		<-ctx.Done()
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&runs) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&runs); n != 3 {
+		t.Fatalf("expected the worker run 3 times, got %d", n)
+	}
+	if running := s.Running(); len(running) != 1 || running[0] != "flaky" {
+		t.Errorf("expected flaky running, got %v", running)
+	}
+
+	err := s.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	s := New(discard, discard)
+
+	release := make(chan struct{})
+	defer close(release)
+	s.Go("stuck", func(ctx context.Context) {
+		<-release
+	})
+	s.Go("polite", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "stuck") || strings.Contains(err.Error(), "polite") {
+		t.Errorf("expected only stuck named, got %v", err)
+	}
+}
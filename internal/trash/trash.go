@@ -0,0 +1,40 @@
+// Package trash empties the trash of deleted reservations once they have been there long enough
+package trash
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Cutoff is the time before which reservations deleted are purged when the trash keeps them for days
+func Cutoff(now time.Time, days int) time.Time {
+	return now.AddDate(0, 0, -days)
+}
+
+// Purger removes for good the reservations moved to the trash before cutoff and returns how many it removed
+type Purger interface {
+	PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// Purge removes the reservations in the trash for more than days right away and then every interval,
+// until ctx is done
+func Purge(ctx context.Context, repo Purger, days int, interval time.Duration, infoLog, errorLog *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := repo.PurgeDeletedBefore(ctx, Cutoff(time.Now(), days))
+		if err != nil {
+			errorLog.Println("trash:", err)
+		} else if n > 0 {
+			infoLog.Printf("trash: %d reservations deleted more than %d days ago purged", n, days)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
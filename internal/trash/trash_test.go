@@ -0,0 +1,46 @@
+package trash
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestCutoff(t *testing.T) {
+	now := time.Date(2050, time.March, 15, 18, 30, 0, 0, time.UTC)
+	if got := Cutoff(now, 30); !got.Equal(time.Date(2050, time.February, 13, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected 2050-02-13 18:30, got %s", got)
+	}
+}
+
+type countingPurger struct {
+	cutoffs []time.Time
+	cancel  context.CancelFunc
+}
+
+func (c *countingPurger) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	c.cutoffs = append(c.cutoffs, cutoff)
+	if len(c.cutoffs) == 2 {
+		c.cancel()
+	}
+	return 1, nil
+}
+
+func TestPurge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	repo := &countingPurger{cancel: cancel}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	before := time.Now()
+	Purge(ctx, repo, 30, time.Millisecond, logger, logger)
+
+	// A tick may win the race against the cancel once
+	if len(repo.cutoffs) < 2 || len(repo.cutoffs) > 3 {
+		t.Fatalf("expected 2 runs, got %d", len(repo.cutoffs))
+	}
+	if repo.cutoffs[0].Before(Cutoff(before, 30)) || repo.cutoffs[0].After(Cutoff(time.Now(), 30)) {
+		t.Errorf("expected a cutoff 30 days ago, got %s", repo.cutoffs[0])
+	}
+}
@@ -3,4 +3,4 @@
 # build ingore test file
 # "host=localhost port=5432 dbname=bookings user=postgres password=postgres"
 env GOOS=linux go build -o bookingsLinux cmd/web/*.go
-# ./bookingsLinux -dbname=bookings -dbuser=postgres -cache=false -production=false -dbpass=postgres
\ No newline at end of file
+# ./bookingsLinux -config=bookings.yml -cache=false -production=false
\ No newline at end of file
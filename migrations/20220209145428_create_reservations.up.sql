@@ -0,0 +1,12 @@
+create table reservations (
+    id serial primary key,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null,
+    phone varchar(255) not null,
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
@@ -0,0 +1,6 @@
+create table restrictions (
+    id serial primary key,
+    restriction_name varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
@@ -0,0 +1,2 @@
+alter table room_restriction drop constraint if exists room_restriction_restrictions_id_fk;
+alter table room_restriction drop constraint if exists room_restriction_rooms_id_fk;
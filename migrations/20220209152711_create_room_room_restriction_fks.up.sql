@@ -0,0 +1,5 @@
+alter table room_restriction add constraint room_restriction_rooms_id_fk foreign key (room_id)
+    references rooms (id) on update cascade on delete cascade;
+
+alter table room_restriction add constraint room_restriction_restrictions_id_fk foreign key (restriction_id)
+    references restrictions (id) on update cascade on delete cascade;
@@ -0,0 +1,3 @@
+drop index room_restriction_reservation_id_idx;
+drop index room_restriction_room_id_idx;
+drop index room_restriction_start_date_end_date_idx;
@@ -0,0 +1,3 @@
+create index room_restriction_start_date_end_date_idx on room_restriction (start_date, end_date);
+create index room_restriction_room_id_idx on room_restriction (room_id);
+create index room_restriction_reservation_id_idx on room_restriction (reservation_id);
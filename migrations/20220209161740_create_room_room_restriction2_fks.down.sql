@@ -0,0 +1 @@
+alter table room_restriction drop constraint if exists room_restriction_reservations_id_fk;
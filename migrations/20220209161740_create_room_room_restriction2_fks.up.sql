@@ -0,0 +1,2 @@
+alter table room_restriction add constraint room_restriction_reservations_id_fk foreign key (reservation_id)
+    references reservations (id) on update cascade on delete cascade;
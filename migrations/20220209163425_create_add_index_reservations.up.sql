@@ -0,0 +1,2 @@
+create index reservations_email_idx on reservations (email);
+create index reservations_last_name_idx on reservations (last_name);
@@ -0,0 +1 @@
+-- The column stays nullable, owner blocks have no reservation
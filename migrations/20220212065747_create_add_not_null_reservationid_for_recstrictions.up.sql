@@ -0,0 +1,2 @@
+-- Owner blocks have no reservation
+alter table room_restriction alter column reservation_id drop not null;
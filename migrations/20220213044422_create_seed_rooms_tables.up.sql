@@ -1,3 +1,3 @@
 INSERT INTO public.rooms (room_name,created_at,updated_at) VALUES
 	 ('General''s Quarters','2022-02-11 00:00:00.000','2022-02-11 00:00:00.000'),
-	 ('Major''s Suite','2022-02-12 00:00:00.000','2022-02-12 00:00:00.000');
\ No newline at end of file
+	 ('Major''s Suite','2022-02-12 00:00:00.000','2022-02-12 00:00:00.000');
@@ -0,0 +1,2 @@
+delete from restrictions;
+-- after delete check again all the foreignKey
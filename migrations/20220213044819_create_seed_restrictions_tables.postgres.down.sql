@@ -1,2 +0,0 @@
-delete from restrictions;
--- after delete check again all the foreignKey
\ No newline at end of file
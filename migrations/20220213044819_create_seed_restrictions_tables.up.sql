@@ -1,3 +1,3 @@
 INSERT INTO public.restrictions (restriction_name,created_at,updated_at) VALUES
 	 ('Reservation','2022-02-12 00:00:00.000','2022-02-12 00:00:00.000'),
-	 ('Owner Block','2022-02-12 00:00:00.000','2022-02-12 00:00:00.000');
\ No newline at end of file
+	 ('Owner Block','2022-02-12 00:00:00.000','2022-02-12 00:00:00.000');
@@ -0,0 +1 @@
+alter table reservations add column processed integer not null default 0;
@@ -0,0 +1,2 @@
+alter table reservations drop column room_locked;
+alter table rooms drop column room_type;
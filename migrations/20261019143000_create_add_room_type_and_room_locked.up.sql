@@ -0,0 +1,2 @@
+alter table rooms add column room_type varchar(255) not null default '';
+alter table reservations add column room_locked boolean not null default false;
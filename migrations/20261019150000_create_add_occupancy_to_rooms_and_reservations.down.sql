@@ -0,0 +1,7 @@
+alter table reservations drop column total_price;
+alter table reservations drop column children;
+alter table reservations drop column adults;
+alter table rooms drop column extra_guest_fee;
+alter table rooms drop column price_per_night;
+alter table rooms drop column base_occupancy;
+alter table rooms drop column max_occupancy;
@@ -0,0 +1,7 @@
+alter table rooms add column max_occupancy integer not null default 2;
+alter table rooms add column base_occupancy integer not null default 2;
+alter table rooms add column price_per_night integer not null default 0;
+alter table rooms add column extra_guest_fee integer not null default 0;
+alter table reservations add column adults integer not null default 1;
+alter table reservations add column children integer not null default 0;
+alter table reservations add column total_price integer not null default 0;
@@ -0,0 +1,5 @@
+drop index room_restriction_block_series_id_idx;
+alter table room_restriction drop constraint if exists room_restriction_block_series_id_fk;
+alter table room_restriction drop column block_series_id;
+alter table room_restriction drop column note;
+drop table block_series;
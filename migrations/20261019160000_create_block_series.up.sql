@@ -0,0 +1,22 @@
+create table block_series (
+    id serial primary key,
+    room_id integer not null,
+    start_date date not null,
+    end_date date not null,
+    frequency varchar(255) not null,
+    until_date date not null,
+    note varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+alter table block_series add constraint block_series_rooms_id_fk foreign key (room_id)
+    references rooms (id) on update cascade on delete cascade;
+
+alter table room_restriction add column note varchar(255) not null default '';
+alter table room_restriction add column block_series_id integer null;
+
+alter table room_restriction add constraint room_restriction_block_series_id_fk foreign key (block_series_id)
+    references block_series (id) on update cascade on delete cascade;
+
+create index room_restriction_block_series_id_idx on room_restriction (block_series_id);
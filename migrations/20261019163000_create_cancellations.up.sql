@@ -0,0 +1,17 @@
+create table cancellations (
+    id serial primary key,
+    reservation_id integer not null,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null default '',
+    phone varchar(255) not null default '',
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null,
+    booked_at timestamp not null,
+    total_price integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index cancellations_created_at_idx on cancellations (created_at);
@@ -0,0 +1,6 @@
+drop index if exists rooms_room_name_trgm_idx;
+drop index if exists reservations_notes_fts_idx;
+drop index if exists reservations_guest_trgm_idx;
+drop index reservations_confirmation_code_idx;
+alter table reservations drop column notes;
+alter table reservations drop column confirmation_code;
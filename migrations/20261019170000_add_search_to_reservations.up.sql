@@ -0,0 +1,11 @@
+alter table reservations add column confirmation_code varchar(255) not null default '';
+alter table reservations add column notes text not null default '';
+
+update reservations set confirmation_code = upper(substr(md5(id::text || created_at::text), 1, 8));
+create unique index reservations_confirmation_code_idx on reservations (confirmation_code);
+
+create extension if not exists pg_trgm;
+create index reservations_guest_trgm_idx on reservations
+    using gin ((first_name || ' ' || last_name || ' ' || email || ' ' || phone) gin_trgm_ops);
+create index reservations_notes_fts_idx on reservations using gin (to_tsvector('simple', notes));
+create index rooms_room_name_trgm_idx on rooms using gin (room_name gin_trgm_ops);
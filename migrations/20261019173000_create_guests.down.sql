@@ -0,0 +1,4 @@
+drop index reservations_guest_id_idx;
+alter table reservations drop constraint if exists reservations_guests_id_fk;
+alter table reservations drop column guest_id;
+drop table guests;
@@ -0,0 +1,31 @@
+create table guests (
+    id serial primary key,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null default '',
+    phone varchar(255) not null default '',
+    email_normalized varchar(255) not null default '',
+    phone_normalized varchar(255) not null default '',
+    notes text not null default '',
+    tags varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index guests_email_normalized_idx on guests (email_normalized);
+create index guests_phone_normalized_idx on guests (phone_normalized);
+
+alter table reservations add column guest_id integer null;
+
+alter table reservations add constraint reservations_guests_id_fk foreign key (guest_id)
+    references guests (id) on update cascade on delete set null;
+
+create index reservations_guest_id_idx on reservations (guest_id);
+
+insert into guests (first_name, last_name, email, phone, email_normalized, phone_normalized, created_at, updated_at)
+    select distinct on (lower(trim(email))) first_name, last_name, email, phone, lower(trim(email)),
+        regexp_replace(regexp_replace(phone, '[^0-9]', '', 'g'), '^00', ''), now(), now()
+    from reservations
+    order by lower(trim(email)), created_at desc;
+
+update reservations r set guest_id = g.id from guests g where g.email_normalized = lower(trim(r.email));
@@ -0,0 +1,17 @@
+create table guest_accounts (
+    id serial primary key,
+    guest_id integer not null,
+    email varchar(255) not null,
+    password varchar(60) not null,
+    verified boolean not null default false,
+    verify_token varchar(255) null,
+    verify_expires timestamp null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create unique index guest_accounts_email_idx on guest_accounts (email);
+create unique index guest_accounts_verify_token_idx on guest_accounts (verify_token);
+
+alter table guest_accounts add constraint guest_accounts_guests_id_fk foreign key (guest_id)
+    references guests (id) on update cascade on delete cascade;
@@ -0,0 +1,4 @@
+drop index reservations_end_date_idx;
+alter table cancellations drop column anonymized_at;
+alter table reservations drop column anonymized_at;
+drop table sent_emails;
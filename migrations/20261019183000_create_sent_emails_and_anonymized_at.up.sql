@@ -0,0 +1,17 @@
+create table sent_emails (
+    id serial primary key,
+    to_address varchar(255) not null,
+    email_normalized varchar(255) not null,
+    subject varchar(255) not null default '',
+    content text not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index sent_emails_email_normalized_idx on sent_emails (email_normalized);
+create index sent_emails_created_at_idx on sent_emails (created_at);
+
+alter table reservations add column anonymized_at timestamp null;
+alter table cancellations add column anonymized_at timestamp null;
+
+create index reservations_end_date_idx on reservations (end_date);
@@ -0,0 +1,18 @@
+drop index cancellations_email_index_idx;
+drop index reservations_phone_index_idx;
+drop index reservations_email_index_idx;
+
+alter table cancellations drop column phone_index;
+alter table cancellations drop column email_index;
+alter table reservations drop column phone_index;
+alter table reservations drop column email_index;
+
+alter table guests rename column phone_index to phone_normalized;
+alter table guests rename column email_index to email_normalized;
+
+alter table guests alter column phone type varchar(255);
+alter table guests alter column email type varchar(255);
+alter table cancellations alter column phone type varchar(255);
+alter table cancellations alter column email type varchar(255);
+alter table reservations alter column phone type varchar(255);
+alter table reservations alter column email type varchar(255);
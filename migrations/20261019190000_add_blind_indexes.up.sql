@@ -0,0 +1,24 @@
+-- Encrypted values don't fit in 255 characters
+alter table reservations alter column email type text;
+alter table reservations alter column phone type text;
+alter table cancellations alter column email type text;
+alter table cancellations alter column phone type text;
+alter table guests alter column email type text;
+alter table guests alter column phone type text;
+
+alter table guests rename column email_normalized to email_index;
+alter table guests rename column phone_normalized to phone_index;
+
+alter table reservations add column email_index varchar(255) not null default '';
+alter table reservations add column phone_index varchar(255) not null default '';
+alter table cancellations add column email_index varchar(255) not null default '';
+alter table cancellations add column phone_index varchar(255) not null default '';
+
+create index reservations_email_index_idx on reservations (email_index);
+create index reservations_phone_index_idx on reservations (phone_index);
+create index cancellations_email_index_idx on cancellations (email_index);
+
+update reservations set email_index = lower(trim(email)),
+    phone_index = regexp_replace(regexp_replace(phone, '[^0-9]', '', 'g'), '^00', '');
+update cancellations set email_index = lower(trim(email)),
+    phone_index = regexp_replace(regexp_replace(phone, '[^0-9]', '', 'g'), '^00', '');
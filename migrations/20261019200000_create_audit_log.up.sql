@@ -0,0 +1,24 @@
+create table audit_log (
+    id serial primary key,
+    user_id integer not null,
+    action varchar(255) not null,
+    entity varchar(255) not null,
+    entity_id integer not null,
+    changes text not null default '',
+    ip varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index audit_log_entity_entity_id_idx on audit_log (entity, entity_id);
+create index audit_log_user_id_idx on audit_log (user_id);
+create index audit_log_created_at_idx on audit_log (created_at);
+
+create function audit_log_append_only() returns trigger as $$
+begin
+    raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+create trigger audit_log_append_only before update or delete on audit_log
+    for each statement execute procedure audit_log_append_only();
@@ -0,0 +1,7 @@
+delete from room_restriction where reservation_id in (select id from reservations where deleted_at is not null);
+delete from reservations where deleted_at is not null;
+
+drop index reservations_deleted_at_idx;
+
+alter table reservations drop column deleted_by;
+alter table reservations drop column deleted_at;
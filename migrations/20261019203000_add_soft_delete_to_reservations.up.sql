@@ -0,0 +1,4 @@
+alter table reservations add column deleted_at timestamp null;
+alter table reservations add column deleted_by integer null;
+
+create index reservations_deleted_at_idx on reservations (deleted_at);
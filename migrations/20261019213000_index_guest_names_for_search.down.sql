@@ -0,0 +1,3 @@
+drop index if exists reservations_guest_name_trgm_idx;
+create index reservations_guest_trgm_idx on reservations
+    using gin ((first_name || ' ' || last_name || ' ' || email || ' ' || phone) gin_trgm_ops);
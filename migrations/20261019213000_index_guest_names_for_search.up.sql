@@ -0,0 +1,4 @@
+-- Search matches the names alone: emails and phones may be encrypted and match through their blind index
+drop index if exists reservations_guest_trgm_idx;
+create index reservations_guest_name_trgm_idx on reservations
+    using gin ((first_name || ' ' || last_name) gin_trgm_ops);
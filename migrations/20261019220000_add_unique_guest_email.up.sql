@@ -0,0 +1,29 @@
+-- Guests that share an email are the same customer: their reservations go to the oldest one
+with duplicates as (
+    select id, min(id) over (partition by email_index) as keep
+    from guests
+    where email_index <> ''
+)
+update reservations r set guest_id = d.keep
+from duplicates d
+where r.guest_id = d.id and d.id <> d.keep;
+
+with duplicates as (
+    select id, min(id) over (partition by email_index) as keep
+    from guests
+    where email_index <> ''
+)
+update guest_accounts a set guest_id = d.keep
+from duplicates d
+where a.guest_id = d.id and d.id <> d.keep;
+
+with duplicates as (
+    select id, min(id) over (partition by email_index) as keep
+    from guests
+    where email_index <> ''
+)
+delete from guests g
+using duplicates d
+where g.id = d.id and d.id <> d.keep;
+
+create unique index guests_email_index_key on guests (email_index) where email_index <> '';
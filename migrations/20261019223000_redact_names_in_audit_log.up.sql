@@ -0,0 +1,15 @@
+-- The log recorded the names, notes and tags of reservations and guests, it now redacts them as it does
+-- the emails and phones. The entries made before get redacted too, for once past the append-only trigger.
+alter table audit_log disable trigger audit_log_append_only;
+
+update audit_log a set changes = (
+    select jsonb_object_agg(c.key, case when c.key in ('first_name', 'last_name', 'notes', 'tags')
+        then jsonb_build_object(
+            'from', case when c.value ->> 'from' <> '' then '"[redacted]"'::jsonb else c.value -> 'from' end,
+            'to', case when c.value ->> 'to' <> '' then '"[redacted]"'::jsonb else c.value -> 'to' end)
+        else c.value end)
+    from jsonb_each(a.changes::jsonb) c
+)::text
+where a.changes <> '' and a.changes::jsonb ?| array['first_name', 'last_name', 'notes', 'tags'];
+
+alter table audit_log enable trigger audit_log_append_only;
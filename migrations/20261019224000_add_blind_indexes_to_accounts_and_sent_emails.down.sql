@@ -0,0 +1,7 @@
+alter index sent_emails_email_index_idx rename to sent_emails_email_normalized_idx;
+alter table sent_emails rename column email_index to email_normalized;
+
+drop index guest_accounts_email_index_idx;
+create unique index guest_accounts_email_idx on guest_accounts (email);
+
+alter table guest_accounts drop column email_index;
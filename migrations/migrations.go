@@ -0,0 +1,11 @@
+// Package migrations holds the SQL migrations of the database schema, embedded in the binary. Every
+// migration is a pair of files named after its version: <version>_<name>.up.sql applies it and
+// <version>_<name>.down.sql rolls it back.
+package migrations
+
+import "embed"
+
+// FS holds the migration files
+//
+//go:embed *.up.sql *.down.sql
+var FS embed.FS
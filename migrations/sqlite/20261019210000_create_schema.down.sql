@@ -0,0 +1,12 @@
+drop table audit_log;
+drop table sent_emails;
+drop table guest_accounts;
+drop table cancellations;
+drop table stay_rules;
+drop table room_restriction;
+drop table block_series;
+drop table reservations;
+drop table guests;
+drop table restrictions;
+drop table rooms;
+drop table users;
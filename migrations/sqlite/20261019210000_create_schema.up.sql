@@ -0,0 +1,223 @@
+-- The schema the Postgres migrations reach at 20261019203000_add_soft_delete_to_reservations, seeded the
+-- same way. Dates are YYYY-MM-DD text, the checks keep times out of them, and times are written as the
+-- driver package formats them.
+
+create table users (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null,
+    password varchar(60) not null,
+    access_level integer not null default 1,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create unique index users_email_idx on users (email);
+
+create table rooms (
+    id integer primary key autoincrement,
+    room_name varchar(255) not null,
+    room_type varchar(255) not null default '',
+    max_occupancy integer not null default 2,
+    base_occupancy integer not null default 2,
+    price_per_night integer not null default 0,
+    extra_guest_fee integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table restrictions (
+    id integer primary key autoincrement,
+    restriction_name varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table guests (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email text not null default '',
+    phone text not null default '',
+    email_index varchar(255) not null default '',
+    phone_index varchar(255) not null default '',
+    notes text not null default '',
+    tags varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index guests_email_normalized_idx on guests (email_index);
+create index guests_phone_normalized_idx on guests (phone_index);
+
+create table reservations (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email text not null,
+    phone text not null,
+    start_date date not null check (start_date = date(start_date)),
+    end_date date not null check (end_date = date(end_date)),
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    processed integer not null default 0,
+    room_locked boolean not null default false,
+    adults integer not null default 1,
+    children integer not null default 0,
+    total_price integer not null default 0,
+    confirmation_code varchar(255) not null default '',
+    notes text not null default '',
+    guest_id integer null references guests (id) on update cascade on delete set null,
+    anonymized_at timestamp null,
+    email_index varchar(255) not null default '',
+    phone_index varchar(255) not null default '',
+    deleted_at timestamp null,
+    deleted_by integer null
+);
+
+create index reservations_email_idx on reservations (email);
+create index reservations_last_name_idx on reservations (last_name);
+create unique index reservations_confirmation_code_idx on reservations (confirmation_code);
+create index reservations_guest_id_idx on reservations (guest_id);
+create index reservations_end_date_idx on reservations (end_date);
+create index reservations_email_index_idx on reservations (email_index);
+create index reservations_phone_index_idx on reservations (phone_index);
+create index reservations_deleted_at_idx on reservations (deleted_at);
+
+create table block_series (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    start_date date not null check (start_date = date(start_date)),
+    end_date date not null check (end_date = date(end_date)),
+    frequency varchar(255) not null,
+    until_date date not null check (until_date = date(until_date)),
+    note varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table room_restriction (
+    id integer primary key autoincrement,
+    start_date date not null check (start_date = date(start_date)),
+    end_date date not null check (end_date = date(end_date)),
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    -- Owner blocks have no reservation
+    reservation_id integer null references reservations (id) on update cascade on delete cascade,
+    restriction_id integer not null references restrictions (id) on update cascade on delete cascade,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    note varchar(255) not null default '',
+    block_series_id integer null references block_series (id) on update cascade on delete cascade
+);
+
+create index room_restriction_start_date_end_date_idx on room_restriction (start_date, end_date);
+create index room_restriction_room_id_idx on room_restriction (room_id);
+create index room_restriction_reservation_id_idx on room_restriction (reservation_id);
+create index room_restriction_block_series_id_idx on room_restriction (block_series_id);
+
+create table stay_rules (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    start_date date not null check (start_date = date(start_date)),
+    end_date date not null check (end_date = date(end_date)),
+    min_nights integer not null default 0,
+    max_nights integer not null default 0,
+    closed_to_arrival integer not null default 0,
+    closed_to_departure integer not null default 0,
+    min_advance_days integer not null default 0,
+    max_advance_days integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index stay_rules_room_id_start_date_end_date_idx on stay_rules (room_id, start_date, end_date);
+
+create table cancellations (
+    id integer primary key autoincrement,
+    reservation_id integer not null,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email text not null default '',
+    phone text not null default '',
+    start_date date not null check (start_date = date(start_date)),
+    end_date date not null check (end_date = date(end_date)),
+    room_id integer not null,
+    booked_at timestamp not null,
+    total_price integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    anonymized_at timestamp null,
+    email_index varchar(255) not null default '',
+    phone_index varchar(255) not null default ''
+);
+
+create index cancellations_created_at_idx on cancellations (created_at);
+create index cancellations_email_index_idx on cancellations (email_index);
+
+create table guest_accounts (
+    id integer primary key autoincrement,
+    guest_id integer not null references guests (id) on update cascade on delete cascade,
+    email varchar(255) not null,
+    password varchar(60) not null,
+    verified boolean not null default false,
+    verify_token varchar(255) null,
+    verify_expires timestamp null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create unique index guest_accounts_email_idx on guest_accounts (email);
+create unique index guest_accounts_verify_token_idx on guest_accounts (verify_token);
+
+create table sent_emails (
+    id integer primary key autoincrement,
+    to_address varchar(255) not null,
+    email_normalized varchar(255) not null,
+    subject varchar(255) not null default '',
+    content text not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index sent_emails_email_normalized_idx on sent_emails (email_normalized);
+create index sent_emails_created_at_idx on sent_emails (created_at);
+
+create table audit_log (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    action varchar(255) not null,
+    entity varchar(255) not null,
+    entity_id integer not null,
+    changes text not null default '',
+    ip varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index audit_log_entity_entity_id_idx on audit_log (entity, entity_id);
+create index audit_log_user_id_idx on audit_log (user_id);
+create index audit_log_created_at_idx on audit_log (created_at);
+
+create trigger audit_log_no_update before update on audit_log
+begin
+    select raise(abort, 'audit_log is append-only');
+end;
+
+create trigger audit_log_no_delete before delete on audit_log
+begin
+    select raise(abort, 'audit_log is append-only');
+end;
+
+insert into rooms (room_name, created_at, updated_at) values
+    ('General''s Quarters', '2022-02-11 00:00:00.000000', '2022-02-11 00:00:00.000000'),
+    ('Major''s Suite', '2022-02-12 00:00:00.000000', '2022-02-12 00:00:00.000000');
+
+insert into restrictions (restriction_name, created_at, updated_at) values
+    ('Reservation', '2022-02-12 00:00:00.000000', '2022-02-12 00:00:00.000000'),
+    ('Owner Block', '2022-02-12 00:00:00.000000', '2022-02-12 00:00:00.000000');
+
+insert into users (first_name, last_name, email, password, access_level, created_at, updated_at) values
+    ('Toan', 'Tran', 'admin@admin.com', '$2a$12$4jMAUKGaBx3x.aEl/zgHcevkdoWPxv9zXJMesvUvt6Rp5GyWu3fbK', 3,
+    '2022-02-20 00:00:00.000000', '2022-02-20 00:00:00.000000');
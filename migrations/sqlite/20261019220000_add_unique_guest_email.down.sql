@@ -0,0 +1 @@
+drop index if exists guests_email_index_key;
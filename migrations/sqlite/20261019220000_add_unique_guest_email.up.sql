@@ -0,0 +1,21 @@
+-- Guests that share an email are the same customer: their reservations go to the oldest one
+update reservations set guest_id = (
+    select min(o.id) from guests g join guests o on (o.email_index = g.email_index) where g.id = reservations.guest_id
+)
+where guest_id in (
+    select g.id from guests g
+    where g.email_index <> '' and exists (select 1 from guests o where o.email_index = g.email_index and o.id < g.id)
+);
+
+update guest_accounts set guest_id = (
+    select min(o.id) from guests g join guests o on (o.email_index = g.email_index) where g.id = guest_accounts.guest_id
+)
+where guest_id in (
+    select g.id from guests g
+    where g.email_index <> '' and exists (select 1 from guests o where o.email_index = g.email_index and o.id < g.id)
+);
+
+delete from guests
+where email_index <> '' and exists (select 1 from guests o where o.email_index = guests.email_index and o.id < guests.id);
+
+create unique index guests_email_index_key on guests (email_index) where email_index <> '';
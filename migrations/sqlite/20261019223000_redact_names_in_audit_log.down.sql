@@ -0,0 +1 @@
+-- The redacted values are gone, nothing to undo
@@ -0,0 +1,20 @@
+-- The log recorded the names, notes and tags of reservations and guests, it now redacts them as it does
+-- the emails and phones. The entries made before get redacted too, for once past the append-only trigger.
+drop trigger audit_log_no_update;
+
+update audit_log set changes = (
+    select json_group_object(c.key, case when c.key in ('first_name', 'last_name', 'notes', 'tags')
+        then json_object(
+            'from', case when c.value ->> '$.from' <> '' then '[redacted]' else c.value -> '$.from' end,
+            'to', case when c.value ->> '$.to' <> '' then '[redacted]' else c.value -> '$.to' end)
+        else json(c.value) end)
+    from json_each(audit_log.changes) c
+)
+where changes <> '' and exists (
+    select 1 from json_each(audit_log.changes) c where c.key in ('first_name', 'last_name', 'notes', 'tags')
+);
+
+create trigger audit_log_no_update before update on audit_log
+begin
+    select raise(abort, 'audit_log is append-only');
+end;
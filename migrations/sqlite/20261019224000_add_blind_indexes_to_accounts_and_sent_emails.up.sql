@@ -0,0 +1,10 @@
+-- Account emails and sent emails are encrypted too, looked up by the blind index of the email
+alter table guest_accounts add column email_index varchar(255) not null default '';
+update guest_accounts set email_index = email;
+
+drop index guest_accounts_email_idx;
+create unique index guest_accounts_email_index_idx on guest_accounts (email_index);
+
+alter table sent_emails rename column email_normalized to email_index;
+drop index sent_emails_email_normalized_idx;
+create index sent_emails_email_index_idx on sent_emails (email_index);
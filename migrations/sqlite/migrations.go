@@ -0,0 +1,10 @@
+// Package sqlite holds the SQL migrations of the SQLite database schema, embedded in the binary. They are
+// named as the Postgres ones and start from the schema those had reached.
+package sqlite
+
+import "embed"
+
+// FS holds the migration files
+//
+//go:embed *.up.sql *.down.sql
+var FS embed.FS
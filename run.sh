@@ -4,4 +4,5 @@
 # "host=localhost port=5432 dbname=bookings user=postgres password=postgres"
 # env GOOS=linux go build -o bookings cmd/web/*.go
 go build -o bookings cmd/web/*.go
-./bookings -dbname=bookings -dbuser=postgres -cache=false -production=true -dbpass=postgres
\ No newline at end of file
+# The database settings and password are read from bookings.yml, see bookings.example.yml
+./bookings -config=bookings.yml -cache=false -production=true
\ No newline at end of file
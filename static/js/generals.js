@@ -2,7 +2,23 @@ function startSweetAlertForRoomBooking(room_id, csrf_token) {
 	document
 		.getElementById("check-availability-button")
 		.addEventListener("click", function () {
-			let html = `
+			// Grey out the nights already booked or blocked for the next months, the server still checks the dates
+			fetch(`/availability-grid?room_id=${room_id}&months=6`)
+				.then((response) => response.json())
+				.then((json) =>
+					json.ok
+						? json.days
+								.filter((day) => day.status === "booked" || day.status === "blocked")
+								.map((day) => day.date)
+						: []
+				)
+				.catch(() => [])
+				.then((datesDisabled) => showRoomDatePicker(room_id, csrf_token, datesDisabled));
+		});
+}
+
+function showRoomDatePicker(room_id, csrf_token, datesDisabled) {
+	let html = `
                     <form id="check-availability-form" action="" method="post" novalidate class="needs-validation"
                         <div class="row">
                             <div class="col">
@@ -20,58 +36,71 @@ function startSweetAlertForRoomBooking(room_id, csrf_token) {
                     <br><br><br><br><br><br><br><br><br><br><br><br>
                     `;
 
-			attention.custom({
-				msg: html,
-				title: "Choose your date",
-				// Sync runs before datePicker has been popup shown up in the screen
-				willOpen: () => {
-					const elem = document.getElementById("reservation-dates-modal");
-					const rangePicker = new DateRangePicker(elem, {
-						format: "yyyy-mm-dd",
-						showOnFocus: true,
-						minDate: new Date(),
-					});
-				},
-				// ASync runs after datePicker popup has been shown up in the screen
-				didOpen: () => {
-					document.getElementById("start").removeAttribute("disabled");
-					document.getElementById("end").removeAttribute("disabled");
-				},
+	attention.custom({
+		msg: html,
+		title: "Choose your date",
+		// Sync runs before datePicker has been popup shown up in the screen
+		willOpen: () => {
+			const elem = document.getElementById("reservation-dates-modal");
+			const rangePicker = new DateRangePicker(elem, {
+				format: "yyyy-mm-dd",
+				showOnFocus: true,
+				minDate: new Date(),
+				datesDisabled: datesDisabled,
+			});
+		},
+		// ASync runs after datePicker popup has been shown up in the screen
+		didOpen: () => {
+			document.getElementById("start").removeAttribute("disabled");
+			document.getElementById("end").removeAttribute("disabled");
+		},
 
-				callback: function (result) {
-					console.log(result);
+		callback: function (result) {
+			console.log(result);
 
-					// Extract input tags (#start, #end) into formdata and append CSRF token before sending post request
-					const form = document.getElementById("check-availability-form");
-					let formData = new FormData(form);
-					formData.append("csrf_token", csrf_token);
-					// 1 is the room_id of general's Quarters
-					formData.append("room_id", room_id);
+			// Extract input tags (#start, #end) into formdata and append CSRF token before sending post request
+			const form = document.getElementById("check-availability-form");
+			let formData = new FormData(form);
+			formData.append("csrf_token", csrf_token);
+			// 1 is the room_id of general's Quarters
+			formData.append("room_id", room_id);
 
-					// Call handler
-					fetch("/search-availability-json", {
-						method: "post",
-						body: formData,
-					})
-						.then((response) => response.json())
-						.then((json) => {
-							if (json.ok) {
-								attention.custom({
-									icon: "success",
-									showConfirmButton: false,
-									msg: `<strong>Room is available</strong>
+			// Call handler
+			fetch("/search-availability-json", {
+				method: "post",
+				body: formData,
+			})
+				.then((response) => response.json())
+				.then((json) => {
+					if (json.ok) {
+						attention.custom({
+							icon: "success",
+							showConfirmButton: false,
+							msg: `<strong>Room is available</strong>
                                         <div> <br> 
                             <a href="/book-room?id=${json.room_id}&s=${json.start_date}&e=${json.end_date}" 
                                         class="btn btn-primary">Book now</a>
                                         </div>`,
-								});
-							} else {
-								attention.error({
-									msg: `<strong>Room isn't availability</strong>`,
-								});
-							}
 						});
-				},
-			});
-		});
-}
\ No newline at end of file
+					} else {
+						// Offer the closest free dates of this room
+						let alternatives = "";
+						(json.alternatives || []).forEach((alt) => {
+							alternatives += `<a href="/book-room?id=${json.room_id}&s=${alt.start_date}&e=${alt.end_date}"
+                                        class="btn btn-sm btn-outline-primary m-1">${alt.start_date} - ${alt.end_date}</a>`;
+						});
+						if (alternatives !== "") {
+							alternatives = `<div><br>Next available dates:<br>${alternatives}</div>`;
+						}
+						attention.custom({
+							icon: "error",
+							showConfirmButton: false,
+							msg: `<strong>Room isn't availability</strong>
+                                        ${json.message ? "<div>" + json.message + "</div>" : ""}
+                                        ${alternatives}`,
+						});
+					}
+				});
+		},
+	});
+}
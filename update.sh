@@ -2,8 +2,8 @@
 
 git pull
 
-soda migrate
 go build -o bookingsLinux cmd/web/*.go
+# The migrations are applied on startup, see -migrate in the supervisor config
 
 sudo supervisorctl stop book
 sudo supervisorctl start book